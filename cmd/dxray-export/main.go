@@ -0,0 +1,152 @@
+// Command dxray-export exports studies of a DX-R database as ISO
+// 9660 image or ZIP archive for media interchange. Studies are
+// selected by their key (VOLUME/STUDY) or by their study instance
+// UID:
+//
+//	dxray-export -db /data/dxr -o patient.iso VOL00001/0001_1 1.2.3.4
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
+	"github.com/tierklinik-dobersberg/dxray/internal/export"
+	"github.com/tierklinik-dobersberg/dxray/internal/search"
+	"github.com/tierklinik-dobersberg/logger"
+)
+
+// errFound stops walking the database once a study has been
+// found.
+var errFound = errors.New("found")
+
+func main() {
+	var (
+		dbPath   = flag.String("db", "", "Path to the DX-R database")
+		output   = flag.String("o", "", "Output file or - for stdout")
+		format   = flag.String("format", "iso", "Export format (iso or zip)")
+		rendered = flag.Bool("rendered", false, "Add JPEG renderings of all instances")
+		viewer   = flag.String("viewer", "", "Directory with a DICOM viewer added to ISO images")
+	)
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] study...\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Studies are selected by key (VOLUME/STUDY) or study instance UID.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	ctx := context.Background()
+
+	if *dbPath == "" || *output == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *format != "iso" && *format != "zip" {
+		logger.Fatalf(ctx, "unsupported format %q", *format)
+	}
+
+	db, err := fsdb.New(*dbPath, nil)
+	if err != nil {
+		logger.Fatalf(ctx, "failed to open database: %s", err)
+	}
+
+	studies := make([]fsdb.Study, 0, flag.NArg())
+	for _, arg := range flag.Args() {
+		std, err := openStudy(db, arg)
+		if err != nil {
+			logger.Fatalf(ctx, "failed to open study %s: %s", arg, err)
+		}
+		studies = append(studies, std)
+	}
+
+	opts := export.Options{
+		Rendered: *rendered,
+	}
+	if *format == "iso" {
+		opts.ViewerDirectory = *viewer
+	}
+
+	files, err := export.Files(studies, opts)
+	if err != nil {
+		logger.Fatalf(ctx, "failed to export studies: %s", err)
+	}
+
+	w := os.Stdout
+	if *output != "-" {
+		w, err = os.Create(*output)
+		if err != nil {
+			logger.Fatalf(ctx, "failed to create output: %s", err)
+		}
+	}
+
+	if err := writeExport(w, *format, files); err != nil {
+		logger.Fatalf(ctx, "failed to write export: %s", err)
+	}
+
+	if err := w.Close(); err != nil {
+		logger.Fatalf(ctx, "failed to write export: %s", err)
+	}
+}
+
+// writeExport writes files to w using format.
+func writeExport(w io.Writer, format string, files []export.File) error {
+	if format == "zip" {
+		return export.WriteZIP(w, files)
+	}
+
+	img, err := export.ISOImage(files)
+	if err != nil {
+		return err
+	}
+
+	_, err = img.WriteTo(w)
+	return err
+}
+
+// openStudy opens and loads the study identified by arg which is
+// either a study key or a study instance UID. Finding a study by
+// its UID requires loading all studies of the database.
+func openStudy(db fsdb.DB, arg string) (fsdb.Study, error) {
+	if strings.Contains(arg, "/") {
+		std, err := search.Get(arg, db)
+		if err != nil {
+			return nil, err
+		}
+		return std, std.Load()
+	}
+
+	var found fsdb.Study
+	err := db.ForEachVolume(func(vol fsdb.Volume) error {
+		return vol.ForEachStudy(func(std fsdb.Study) error {
+			if err := std.Load(); err != nil {
+				// studies without a valid study.xml
+				// are skipped.
+				return nil
+			}
+
+			model, _ := std.Model()
+			if model.Patient.Visit.Study.UID != arg {
+				return nil
+			}
+
+			found = std
+			return errFound
+		})
+	})
+	if err != nil && !errors.Is(err, errFound) {
+		return nil, err
+	}
+
+	if found == nil {
+		return nil, errors.New("not found")
+	}
+
+	return found, nil
+}
@@ -4,39 +4,77 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/ppacher/system-conf/conf"
+	"github.com/tierklinik-dobersberg/dxray/internal/accesslog"
 	"github.com/tierklinik-dobersberg/dxray/internal/api"
 	"github.com/tierklinik-dobersberg/dxray/internal/app"
+	"github.com/tierklinik-dobersberg/dxray/internal/cache"
+	"github.com/tierklinik-dobersberg/dxray/internal/dimse"
 	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
 	"github.com/tierklinik-dobersberg/dxray/internal/index"
+	"github.com/tierklinik-dobersberg/dxray/internal/qr"
+	"github.com/tierklinik-dobersberg/dxray/internal/scan"
 	"github.com/tierklinik-dobersberg/dxray/internal/schema"
+	"github.com/tierklinik-dobersberg/dxray/internal/storage"
 	"github.com/tierklinik-dobersberg/logger"
 	"github.com/tierklinik-dobersberg/service/service"
+	"github.com/tierklinik-dobersberg/service/svcenv"
 )
 
 func main() {
 	var cfg struct {
 		schema.Config `section:"Global"`
+		Index         schema.IndexConfig  `section:"Index"`
+		Cache         schema.CacheConfig  `section:"Cache"`
+		DICOM         schema.DICOMConfig  `section:"DICOM"`
+		Peers         []schema.PeerConfig `section:"Peer"`
+		Export        schema.ExportConfig `section:"Export"`
 	}
 
+	// defaults in case there's no [Index] or [Cache] section
+	// at all.
+	cfg.Index.FullScanInterval = 2 * time.Minute
+	cfg.Cache.MemorySize = 128
+	cfg.Cache.DiskSize = 1024
+	cfg.Cache.Studies = 5000
+	cfg.DICOM.AETitle = "DXRAY"
+	cfg.DICOM.MaxInstanceSize = 512
+
 	ctx := context.Background()
 
 	instance, err := service.Boot(service.Config{
 		ConfigFileName: "dxray.conf",
 		ConfigFileSpec: conf.FileSpec{
 			"global": schema.ConfigSpec,
+			"index":  schema.IndexSpec,
+			"cache":  schema.CacheSpec,
+			"dicom":  schema.DICOMSpec,
+			"peer":   schema.PeerSpec,
+			"export": schema.ExportSpec,
 		},
 		ConfigTarget: &cfg,
 		RouteSetupFunc: func(grp gin.IRouter) error {
 			grp = grp.Group("/api/dxray/v1")
 			{
+				api.AccessLogEndpoint(grp)
+				api.CacheEndpoint(grp)
+				api.ExportEndpoint(grp)
+				api.IndexEndpoint(grp)
 				api.ListStudiesEndpoint(grp)
+				api.MetadataEndpoint(grp)
 				api.OHIFEndpoint(grp)
+				api.PatientsEndpoint(grp)
+				api.QIDOEndpoint(grp)
+				api.RenderedEndpoint(grp)
 				api.SearchStudiesEndpoint(grp)
+				api.STOWEndpoint(grp)
+				api.SuggestEndpoint(grp)
 				api.WadoEndpoint(grp)
+				api.WadoRSEndpoint(grp)
 			}
 			return nil
 		},
@@ -59,19 +97,87 @@ func main() {
 		logger.Fatalf(ctx, "failed to bootstap: %s", err)
 	}
 
-	// Create a new study-indxer that scans for new studies every
-	// two minutes.
-	indexer, err := index.NewStudyIndexer(db, "", time.Minute*2)
+	// Instances received via DICOM or STOW-RS are stored in a
+	// separate folder that is served and indexed together with
+	// the DX-R database. The indexer does not exist yet so the
+	// change callback is bound later.
+	var indexer *index.StudyIndexer
+	storageDir := cfg.DICOM.StorageDirectory
+	if storageDir == "" {
+		storageDir = filepath.Join(svcenv.Env().StateDirectory, "storage")
+	}
+	store, err := storage.New(storage.Options{
+		Directory: storageDir,
+		OnChange: func(volName, studyName string) {
+			if _, err := indexer.IndexStudy(volName, studyName); err != nil {
+				logger.Errorf(ctx, "failed to index stored study %s/%s: %s", volName, studyName, err)
+			}
+		},
+	})
+	if err != nil {
+		logger.Fatalf(ctx, "failed to create storage: %s", err)
+	}
+	db = fsdb.NewUnion(db, store.DB())
+
+	// Keep parsed study.xml files in memory so they are not
+	// parsed again for each request.
+	if cfg.Cache.Studies > 0 {
+		db = fsdb.NewCached(db, cfg.Cache.Studies)
+	}
+
+	// Create the cache for DICOM tags and rendered images.
+	cacheDir := cfg.Cache.Directory
+	if cacheDir == "" {
+		cacheDir = filepath.Join(svcenv.Env().StateDirectory, "cache")
+	}
+	tagCache, err := cache.New(cache.Options{
+		MemorySize: int64(cfg.Cache.MemorySize) * 1024 * 1024,
+		Directory:  cacheDir,
+		DiskSize:   int64(cfg.Cache.DiskSize) * 1024 * 1024,
+	})
+	if err != nil {
+		logger.Fatalf(ctx, "failed to create cache: %s", err)
+	}
+
+	// Create a new study-indxer that periodically scans for new
+	// studies as a fallback for the filesystem watcher.
+	indexer, err = index.NewStudyIndexer(db, index.Options{
+		Path:             cfg.Index.Path,
+		FullScanInterval: cfg.Index.FullScanInterval,
+		Scan: scan.Options{
+			VolumeWorkers: cfg.Index.VolumeWorkers,
+			StudyWorkers:  cfg.Index.StudyWorkers,
+		},
+		OnChange: tagCache.Invalidate,
+	})
 	if err != nil {
 		logger.Fatalf(ctx, "failed to create study indexer: %s", err)
 	}
 
+	// Rotate the access log if one is configured.
+	var accessLog *accesslog.Log
+	if cfg.AccessLogPath != "" {
+		accessLog = &accesslog.Log{
+			Path:    cfg.AccessLogPath,
+			MaxSize: int64(cfg.AccessLogMaxSize) * 1024 * 1024,
+			Keep:    cfg.AccessLogRotateCount,
+		}
+		go accessLog.Run(ctx, time.Minute)
+	}
+
 	// Prepare the application context that is passed to each
 	// api endpoint.
-	appCtx := app.New(db, indexer)
+	appCtx := app.New(db, indexer, accessLog, tagCache, store)
+	appCtx.Export = cfg.Export
+	appCtx.MaxInstanceSize = int64(cfg.DICOM.MaxInstanceSize) * 1024 * 1024
 	instance.Server().WithPreHandler(
 		app.AddToRequest(appCtx),
 	)
+	if cfg.AccessLogUserHeader != "" {
+		instance.Server().WithPreHandler(
+			accesslog.TrustUserHeader(cfg.AccessLogUserHeader),
+		)
+	}
 
 	// Get the number of currently sotred studies.
 	count, err := indexer.Count()
@@ -80,6 +186,39 @@ func main() {
 	}
 	logger.Infof(ctx, "study index contains %d studies", count)
 
+	// Watch the database for new and modified studies so they
+	// become searchable immediately. Periodic full scans are still
+	// performed to catch anything the watcher missed.
+	if !cfg.Index.DisableWatcher {
+		if err := indexer.Watch(ctx); err != nil {
+			logger.Fatalf(ctx, "failed to watch database: %s", err)
+		}
+	}
+
+	// Accept DICOM associations from modalities and
+	// workstations.
+	if cfg.DICOM.ListenAddress != "" {
+		destinations := make(map[string]string, len(cfg.Peers))
+		for _, peer := range cfg.Peers {
+			destinations[peer.AETitle] = peer.Address
+		}
+
+		provider := qr.New(db, indexer, nil)
+		srv := dimse.NewServer(dimse.Options{
+			AETitle:          cfg.DICOM.AETitle,
+			Store:            store.Store,
+			Find:             provider.Find,
+			Retrieve:         provider.Retrieve,
+			Destinations:     destinations,
+			MaxDataSetLength: int64(cfg.DICOM.MaxInstanceSize) * 1024 * 1024,
+		})
+		go func() {
+			if err := srv.ListenAndServe(ctx, cfg.DICOM.ListenAddress); err != nil {
+				logger.Errorf(ctx, "DICOM server failed: %s", err)
+			}
+		}()
+	}
+
 	// Perform a new full scan so we start with an up-to-data
 	// study index.
 	if err := indexer.FullScan(context.Background()); err != nil {
@@ -4,6 +4,7 @@ go 1.13
 
 require (
 	github.com/blevesearch/bleve v1.0.14
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/gin-gonic/gin v1.7.0
 	github.com/grailbio/go-dicom v0.0.0-20190117035129-c30d9eaca591
 	github.com/iancoleman/strcase v0.0.0-20191112232945-16388991a334
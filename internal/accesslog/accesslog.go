@@ -0,0 +1,97 @@
+// Package accesslog records which studies, patients and instances
+// have been accessed by whom. Records are attached to the gin request
+// context and written as JSON lines to the access log configured by
+// AccessLogPath by the HTTP access logger of the service package.
+package accesslog
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tierklinik-dobersberg/service/server"
+)
+
+// Keys used to attach access records to a gin.Context. They are
+// included in the fields of the access log entry written for each
+// request.
+const (
+	keyUser      = "dxray:user"
+	keyRemote    = "dxray:remote"
+	keyStudies   = "dxray:studies"
+	keyPatients  = "dxray:patients"
+	keyInstances = "dxray:instances"
+)
+
+// UnknownUser is recorded for requests without a trusted user
+// header.
+const UnknownUser = "unknown"
+
+type contextKey string
+
+const userHeaderContextKey = contextKey("dxray:user-header")
+
+// RecordStudy records that the request c accessed the study
+// studyUID of patient patientID. If the request accessed only
+// specific instances of the study their UIDs should be passed
+// as well.
+func RecordStudy(c *gin.Context, patientID, studyUID string, instances ...string) {
+	user := User(c)
+	c.Set(keyUser, user)
+	if user == UnknownUser {
+		c.Set(keyRemote, c.Request.RemoteAddr)
+	}
+
+	appendKey(c, keyStudies, studyUID)
+	appendKey(c, keyPatients, patientID)
+
+	for _, instance := range instances {
+		appendKey(c, keyInstances, instance)
+	}
+}
+
+// User returns the name of the authenticated user of the request.
+// dxray does not authenticate users itself so User relies on the
+// header configured using TrustUserHeader. UnknownUser is returned
+// if there's no such header as any other header (or basic-auth
+// credentials) may be set by the client itself.
+func User(c *gin.Context) string {
+	header, _ := c.Request.Context().Value(userHeaderContextKey).(string)
+	if header == "" {
+		return UnknownUser
+	}
+
+	if user := c.GetHeader(header); user != "" {
+		return user
+	}
+
+	return UnknownUser
+}
+
+// TrustUserHeader returns a (service/server).PreHandlerFunc that
+// makes User read the authenticated user from header. It must only
+// be used if dxray is only reachable through an authenticating
+// reverse proxy that sets header on each request.
+func TrustUserHeader(header string) server.PreHandlerFunc {
+	return func(req *http.Request) *http.Request {
+		newCtx := context.WithValue(req.Context(), userHeaderContextKey, header)
+		return req.Clone(newCtx)
+	}
+}
+
+// appendKey appends value to the string slice stored under key
+// unless it's empty or already recorded.
+func appendKey(c *gin.Context, key string, value string) {
+	if value == "" {
+		return
+	}
+
+	values := c.GetStringSlice(key)
+	for _, v := range values {
+		if v == value {
+			return
+		}
+	}
+
+	c.Set(key, append(values, value))
+}
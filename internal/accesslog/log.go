@@ -0,0 +1,205 @@
+package accesslog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/tierklinik-dobersberg/logger"
+)
+
+type (
+	// Log provides rotation and query support for the JSON lines
+	// access log file.
+	Log struct {
+		// Path is the path of the access log file.
+		Path string
+
+		// MaxSize is the size in bytes after which the access
+		// log is rotated. Rotation is disabled if zero.
+		MaxSize int64
+
+		// Keep is the number of rotated files that are kept.
+		// Rotated files are named Path.1 (newest) to Path.Keep
+		// (oldest).
+		Keep int
+	}
+
+	// Entry is a study access parsed from the access log.
+	Entry struct {
+		Time      time.Time `json:"time"`
+		ClientIP  string    `json:"clientIp"`
+		User      string    `json:"user,omitempty"`
+		Remote    string    `json:"remote,omitempty"`
+		Method    string    `json:"method"`
+		Path      string    `json:"path"`
+		Status    int       `json:"status"`
+		Studies   []string  `json:"studies,omitempty"`
+		Patients  []string  `json:"patients,omitempty"`
+		Instances []string  `json:"instances,omitempty"`
+	}
+
+	// line is the format written by the access log file writer
+	// of the service package.
+	line struct {
+		Time   time.Time `json:"time"`
+		Fields struct {
+			Status    int      `json:"http:status"`
+			Method    string   `json:"http:method"`
+			Path      string   `json:"http:path"`
+			RealIP    string   `json:"http:real-ip"`
+			User      string   `json:"dxray:user"`
+			Remote    string   `json:"dxray:remote"`
+			Studies   []string `json:"dxray:studies"`
+			Patients  []string `json:"dxray:patients"`
+			Instances []string `json:"dxray:instances"`
+		} `json:"fields"`
+	}
+)
+
+// Run checks the size of the access log every interval and rotates
+// it if required. Run blocks until ctx is cancelled.
+func (l *Log) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.RotateIfNeeded(); err != nil {
+				logger.From(ctx).Errorf("failed to rotate access log: %s", err)
+			}
+		}
+	}
+}
+
+// RotateIfNeeded rotates the access log if it exceeds MaxSize.
+func (l *Log) RotateIfNeeded() error {
+	if l.MaxSize <= 0 {
+		return nil
+	}
+
+	stat, err := os.Stat(l.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if stat.Size() < l.MaxSize {
+		return nil
+	}
+
+	return l.Rotate()
+}
+
+// Rotate rotates the access log. The oldest rotated file is
+// removed if there are already Keep rotated files. The access log
+// writer re-creates Path with the next entry.
+func (l *Log) Rotate() error {
+	if l.Keep <= 0 {
+		return os.Remove(l.Path)
+	}
+
+	if err := os.Remove(l.rotatedPath(l.Keep)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for i := l.Keep - 1; i > 0; i-- {
+		if err := os.Rename(l.rotatedPath(i), l.rotatedPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Rename(l.Path, l.rotatedPath(1))
+}
+
+// Query returns all study accesses for which filter returns true.
+// Entries are returned in chronological order and include the
+// rotated access log files.
+func (l *Log) Query(filter func(Entry) bool) ([]Entry, error) {
+	var result []Entry
+
+	for i := l.Keep; i >= 0; i-- {
+		path := l.Path
+		if i > 0 {
+			path = l.rotatedPath(i)
+		}
+
+		entries, err := readFile(path, filter)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		result = append(result, entries...)
+	}
+
+	return result, nil
+}
+
+func (l *Log) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", l.Path, i)
+}
+
+func readFile(path string, filter func(Entry) bool) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []Entry
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var l line
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			// skip lines we don't understand
+			continue
+		}
+
+		if len(l.Fields.Studies) == 0 {
+			// not a study access
+			continue
+		}
+
+		e := Entry{
+			Time:      l.Time,
+			ClientIP:  l.Fields.RealIP,
+			User:      l.Fields.User,
+			Remote:    l.Fields.Remote,
+			Method:    l.Fields.Method,
+			Path:      l.Fields.Path,
+			Status:    l.Fields.Status,
+			Studies:   l.Fields.Studies,
+			Patients:  l.Fields.Patients,
+			Instances: l.Fields.Instances,
+		}
+
+		if filter == nil || filter(e) {
+			result = append(result, e)
+		}
+	}
+
+	return result, scanner.Err()
+}
+
+// Contains returns true if values contains v.
+func Contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
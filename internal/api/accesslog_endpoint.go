@@ -0,0 +1,59 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tierklinik-dobersberg/dxray/internal/accesslog"
+	"github.com/tierklinik-dobersberg/dxray/internal/app"
+	"github.com/tierklinik-dobersberg/service/server"
+)
+
+// AccessLogEndpoint allows querying the access log for all accesses
+// of a given patient and/or study.
+//
+// GET /api/dxray/v1/accesslog?patient=12345&study=1.2.3
+func AccessLogEndpoint(grp gin.IRouter) {
+	grp.GET("accesslog", func(ctx *gin.Context) {
+		appCtx := app.From(ctx)
+		if appCtx == nil {
+			return
+		}
+
+		if appCtx.AccessLog == nil {
+			server.AbortRequest(ctx, http.StatusNotFound, errors.New("access log not configured"))
+			return
+		}
+
+		patient := ctx.Query("patient")
+		study := ctx.Query("study")
+
+		if patient == "" && study == "" {
+			server.AbortRequest(ctx, http.StatusBadRequest, errors.New("patient or study required"))
+			return
+		}
+
+		entries, err := appCtx.AccessLog.Query(func(e accesslog.Entry) bool {
+			if patient != "" && !accesslog.Contains(e.Patients, patient) {
+				return false
+			}
+
+			if study != "" && !accesslog.Contains(e.Studies, study) {
+				return false
+			}
+
+			return true
+		})
+		if err != nil {
+			server.AbortRequest(ctx, http.StatusInternalServerError, err)
+			return
+		}
+
+		if entries == nil {
+			entries = []accesslog.Entry{}
+		}
+
+		ctx.JSON(http.StatusOK, entries)
+	})
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tierklinik-dobersberg/dxray/internal/app"
+	"github.com/tierklinik-dobersberg/dxray/internal/cache"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
+	"github.com/tierklinik-dobersberg/dxray/internal/ohif"
+	"github.com/tierklinik-dobersberg/dxray/internal/search"
+	"github.com/tierklinik-dobersberg/service/server"
+)
+
+// CacheEndpoint allows inspecting the hit, miss and eviction
+// statistics of the tag and image cache and purging it.
+//
+// GET    /api/dxray/v1/cache
+// DELETE /api/dxray/v1/cache
+func CacheEndpoint(grp gin.IRouter) {
+	grp.GET("cache", func(ctx *gin.Context) {
+		appCtx := app.From(ctx)
+		if appCtx == nil {
+			return
+		}
+
+		ctx.JSON(http.StatusOK, appCtx.Cache.Stats())
+	})
+
+	grp.DELETE("cache", func(ctx *gin.Context) {
+		appCtx := app.From(ctx)
+		if appCtx == nil {
+			return
+		}
+
+		if err := appCtx.Cache.Purge(); err != nil {
+			server.AbortRequest(ctx, http.StatusInternalServerError, err)
+			return
+		}
+
+		ctx.Status(http.StatusNoContent)
+	})
+}
+
+// cachedJSON returns the value of kind derived from the file at
+// path from the cache of appCtx and decodes it into target. If
+// the value is not cached, create is called and the result is
+// stored.
+func cachedJSON(appCtx *app.App, std fsdb.Study, kind, path string, target interface{}, create func() (interface{}, error)) error {
+	key, err := cache.FileKey(kind, path)
+	if err != nil {
+		return err
+	}
+
+	blob, err := appCtx.Cache.GetOrCreate(key, search.Key(std), func() ([]byte, error) {
+		value, err := create()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(value)
+	})
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(blob, target)
+}
+
+// cachedTagReader returns an ohif.TagReader that caches the tags
+// of the instances of std.
+func cachedTagReader(appCtx *app.App, std fsdb.Study) ohif.TagReader {
+	return func(path string) (map[string]interface{}, error) {
+		var tags map[string]interface{}
+		err := cachedJSON(appCtx, std, "ohif-tags", path, &tags, func() (interface{}, error) {
+			return ohif.ReadTags(path)
+		})
+		return tags, err
+	}
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tierklinik-dobersberg/dxray/internal/accesslog"
+	"github.com/tierklinik-dobersberg/dxray/internal/app"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
+	"github.com/tierklinik-dobersberg/dxray/internal/export"
+	"github.com/tierklinik-dobersberg/logger"
+	"github.com/tierklinik-dobersberg/service/server"
+)
+
+// Export formats.
+const (
+	formatZIP = "zip"
+	formatISO = "iso"
+)
+
+// ExportEndpoint allows to download a copy of one or more studies
+// for media interchange. The export contains all DICOM files of the
+// studies together with a DICOMDIR and is either a ZIP archive
+// (format=zip, the default) or an ISO 9660 image that can be burned
+// to CD or DVD (format=iso). If rendered=true is set, a JPEG
+// rendering of each instance is added as well. The configured
+// viewer is only added to ISO images.
+//
+// GET /api/dxray/v1/studies/:study/export?format=zip
+// GET /api/dxray/v1/export?study=uid&study=uid&format=iso
+func ExportEndpoint(grp gin.IRouter) {
+	grp.GET("studies/:study/export", func(ctx *gin.Context) {
+		exportStudies(ctx, []string{ctx.Param("study")})
+	})
+
+	grp.GET("export", func(ctx *gin.Context) {
+		uids := ctx.QueryArray("study")
+		if len(uids) == 0 {
+			server.AbortRequest(ctx, http.StatusBadRequest, errors.New("no studies selected"))
+			return
+		}
+
+		exportStudies(ctx, uids)
+	})
+}
+
+// exportStudies writes the export of the studies with the given
+// UIDs as response.
+func exportStudies(ctx *gin.Context, uids []string) {
+	log := logger.From(ctx.Request.Context())
+
+	appCtx := app.From(ctx)
+	if appCtx == nil {
+		return
+	}
+
+	format := ctx.DefaultQuery("format", formatZIP)
+	if format != formatZIP && format != formatISO {
+		server.AbortRequest(ctx, http.StatusBadRequest, fmt.Errorf("unsupported format %q", format))
+		return
+	}
+
+	studies := make([]fsdb.Study, 0, len(uids))
+	for _, uid := range uids {
+		std, err := getStudyByUID(ctx, uid)
+		if err != nil {
+			return
+		}
+
+		if err := std.Load(); err != nil {
+			server.AbortRequest(ctx, http.StatusInternalServerError, err)
+			return
+		}
+
+		studies = append(studies, std)
+	}
+
+	opts := export.Options{
+		Rendered: ctx.Query("rendered") == "true",
+	}
+	if format == formatISO {
+		opts.ViewerDirectory = appCtx.Export.ViewerDirectory
+	}
+
+	files, err := export.Files(studies, opts)
+	if err != nil {
+		server.AbortRequest(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	for _, std := range studies {
+		model, _ := std.Model()
+
+		var instances []string
+		for _, ref := range selectInstances(model, "", "") {
+			instances = append(instances, ref.Instance.UID)
+		}
+		accesslog.RecordStudy(ctx, model.Patient.ID, model.Patient.Visit.Study.UID, instances...)
+	}
+
+	fileName := "studies." + format
+	if len(uids) == 1 {
+		fileName = uids[0] + "." + format
+	}
+	ctx.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": fileName,
+	}))
+
+	// once the response has been started errors can only be
+	// logged. The export is left incomplete.
+	switch format {
+	case formatZIP:
+		ctx.Header("Content-Type", "application/zip")
+		ctx.Status(http.StatusOK)
+		err = export.WriteZIP(ctx.Writer, files)
+
+	case formatISO:
+		img, isoErr := export.ISOImage(files)
+		if isoErr != nil {
+			server.AbortRequest(ctx, http.StatusInternalServerError, isoErr)
+			return
+		}
+
+		ctx.Header("Content-Type", "application/x-iso9660-image")
+		ctx.Header("Content-Length", strconv.FormatInt(img.Size(), 10))
+		ctx.Status(http.StatusOK)
+		_, err = img.WriteTo(ctx.Writer)
+	}
+
+	if err != nil {
+		log.WithFields(logger.Fields{
+			"error":  err.Error(),
+			"format": format,
+		}).Errorf("failed to export studies")
+	}
+}
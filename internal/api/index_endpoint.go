@@ -0,0 +1,114 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tierklinik-dobersberg/dxray/internal/app"
+	"github.com/tierklinik-dobersberg/dxray/internal/index"
+	"github.com/tierklinik-dobersberg/dxray/internal/scan"
+	"github.com/tierklinik-dobersberg/service/server"
+)
+
+// IndexEndpoint allows inspecting the status of the study indexer
+// as well as starting and cancelling scans. Only one scan may run
+// at a time. Studies of volumes that are missing from the database
+// are only removed from the index by an explicit sweep.
+//
+// GET    /api/dxray/v1/index
+// POST   /api/dxray/v1/index/scan?volume=VOL00001
+// DELETE /api/dxray/v1/index/scan
+// POST   /api/dxray/v1/index/sweep?volume=VOL00001
+func IndexEndpoint(grp gin.IRouter) {
+	grp.GET("index", func(ctx *gin.Context) {
+		appCtx := app.From(ctx)
+		if appCtx == nil {
+			return
+		}
+
+		count, err := appCtx.Indexer.Count()
+		if err != nil {
+			server.AbortRequest(ctx, http.StatusInternalServerError, err)
+			return
+		}
+
+		current, last := appCtx.Indexer.Status()
+
+		ctx.JSON(http.StatusOK, gin.H{
+			"studies": count,
+			"current": current,
+			"last":    last,
+		})
+	})
+
+	grp.POST("index/scan", func(ctx *gin.Context) {
+		appCtx := app.From(ctx)
+		if appCtx == nil {
+			return
+		}
+
+		volume := ctx.Query("volume")
+		if volume != "" {
+			if _, err := appCtx.FsDB.OpenVolumeByName(volume); err != nil {
+				server.AbortRequest(ctx, http.StatusNotFound, err)
+				return
+			}
+		}
+
+		if err := appCtx.Indexer.StartScan(volume); err != nil {
+			if errors.Is(err, scan.ErrScanRunning) {
+				server.AbortRequest(ctx, http.StatusConflict, err)
+				return
+			}
+
+			server.AbortRequest(ctx, http.StatusInternalServerError, err)
+			return
+		}
+
+		current, _ := appCtx.Indexer.Status()
+		ctx.JSON(http.StatusAccepted, current)
+	})
+
+	grp.DELETE("index/scan", func(ctx *gin.Context) {
+		appCtx := app.From(ctx)
+		if appCtx == nil {
+			return
+		}
+
+		if !appCtx.Indexer.CancelScan() {
+			ctx.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		ctx.Status(http.StatusNoContent)
+	})
+	grp.POST("index/sweep", func(ctx *gin.Context) {
+		appCtx := app.From(ctx)
+		if appCtx == nil {
+			return
+		}
+
+		volume := ctx.Query("volume")
+		if volume == "" {
+			server.AbortRequest(ctx, http.StatusBadRequest, errors.New("missing volume"))
+			return
+		}
+
+		removed, err := appCtx.Indexer.SweepVolume(volume)
+		if err != nil {
+			if errors.Is(err, index.ErrVolumeExists) {
+				server.AbortRequest(ctx, http.StatusConflict, err)
+				return
+			}
+
+			server.AbortRequest(ctx, http.StatusInternalServerError, err)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, gin.H{
+			"volume":  volume,
+			"removed": removed,
+		})
+	})
+}
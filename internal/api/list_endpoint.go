@@ -1,19 +1,39 @@
 package api
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"net/http"
-	"sort"
+	"strconv"
 
+	"github.com/blevesearch/bleve"
 	"github.com/gin-gonic/gin"
 	"github.com/tierklinik-dobersberg/dxray/internal/app"
-	"github.com/tierklinik-dobersberg/dxray/internal/ohif"
+	"github.com/tierklinik-dobersberg/dxray/internal/search"
 	"github.com/tierklinik-dobersberg/service/server"
 )
 
-// ListStudiesEndpoint allows listing all studies with support
-// for pagination (using limit and offset query parameters)
+const (
+	// defaultListLimit is the number of studies returned by
+	// /list if no limit is requested.
+	defaultListLimit = 100
+
+	// maxListLimit is the maximum number of studies returned
+	// by a single /list request.
+	maxListLimit = 1000
+)
+
+// ListStudiesEndpoint allows listing all studies using the search
+// index. Studies are sorted by the sort query parameter (date,
+// patient, owner or indexed) in the order requested by order (asc or
+// desc). The total number of studies is returned in the X-Total-Count
+// header. If there are more studies, an opaque cursor is returned in
+// the X-Next-Cursor header that can be passed as the cursor query
+// parameter to get the next page. For compatibility, pagination using
+// offset is still supported.
 //
-// GET /api/list
+// GET /api/list?sort=date&order=desc&limit=100&cursor=
 func ListStudiesEndpoint(grp gin.IRouter) {
 	grp.GET("list", func(ctx *gin.Context) {
 		appCtx := app.From(ctx)
@@ -21,99 +41,98 @@ func ListStudiesEndpoint(grp gin.IRouter) {
 			return
 		}
 
-		limit, err := getNumberParamDefault(ctx, "limit", 100)
+		sortBy, err := getListSort(ctx)
 		if err != nil {
-			server.AbortRequest(ctx, http.StatusInternalServerError, err)
+			server.AbortRequest(ctx, http.StatusBadRequest, err)
 			return
 		}
 
-		offset, err := getNumberParamDefault(ctx, "offset", 0)
-		if err != nil {
-			server.AbortRequest(ctx, http.StatusInternalServerError, err)
+		limit, err := getNumberParamDefault(ctx, "limit", defaultListLimit)
+		if err != nil || limit < 1 {
+			server.AbortRequest(ctx, http.StatusBadRequest, fmt.Errorf("invalid limit"))
 			return
 		}
+		if limit > maxListLimit {
+			limit = maxListLimit
+		}
 
-		volumes, err := appCtx.FsDB.VolumeNames()
-		if err != nil {
-			server.AbortRequest(ctx, http.StatusInternalServerError, err)
+		offset, err := getNumberParamDefault(ctx, "offset", 0)
+		if err != nil || offset < 0 {
+			server.AbortRequest(ctx, http.StatusBadRequest, fmt.Errorf("invalid offset"))
 			return
 		}
 
-		if len(volumes) == 0 {
-			ctx.JSON(http.StatusOK, []interface{}{})
+		after, err := decodeCursor(ctx.Query("cursor"))
+		if err != nil || (after != nil && len(after) != len(sortBy)) {
+			server.AbortRequest(ctx, http.StatusBadRequest, fmt.Errorf("invalid cursor"))
 			return
 		}
 
-		// reverse sort the volume names so the newest are on top
-		sort.Sort(sort.Reverse(sort.StringSlice(volumes)))
-
-		result := make([]interface{}, limit)
-
-		volIdx := 0
-		vol, err := appCtx.FsDB.OpenVolumeByName(volumes[volIdx])
+		page, err := appCtx.Indexer.QueryPage(bleve.NewMatchAllQuery(), limit, offset, after, sortBy...)
 		if err != nil {
 			server.AbortRequest(ctx, http.StatusInternalServerError, err)
 			return
 		}
 
-		i := 0
-		// iterate volumes
-	L:
-		for {
-			styIdx := 0
-			studies, err := vol.Studies()
+		result := loadStudies(ctx, appCtx, page.Keys)
+
+		ctx.Header("X-Total-Count", strconv.FormatUint(page.Total, 10))
+		if page.Next != nil {
+			cursor, err := encodeCursor(page.Next)
 			if err != nil {
 				server.AbortRequest(ctx, http.StatusInternalServerError, err)
 				return
 			}
+			ctx.Header("X-Next-Cursor", cursor)
+		}
 
-			// sort the in reverse order so newest are on top
-			sort.Sort(sort.Reverse(sort.StringSlice(studies)))
-
-			// iterate studies
-			for {
-				if i-offset >= limit {
-					break L
-				}
-
-				if styIdx >= len(studies) {
-					break
-				}
+		ctx.JSON(http.StatusOK, result)
+	})
+}
 
-				if i-offset >= 0 {
+// getListSort returns the bleve sort order requested by the
+// sort and order query parameters.
+func getListSort(ctx *gin.Context) ([]string, error) {
+	name := ctx.DefaultQuery("sort", "date")
 
-					study, err := vol.OpenStudyByName(studies[styIdx])
-					if err != nil {
-						server.AbortRequest(ctx, http.StatusInternalServerError, err)
-						return
-					}
+	switch order := ctx.DefaultQuery("order", "desc"); order {
+	case "asc":
+	case "desc":
+		name = "-" + name
+	default:
+		return nil, fmt.Errorf("invalid sort order %q", order)
+	}
 
-					m, err := ohif.JSONFromDXR(ctx.Request.Context(), study, createStudyURLFactory(ctx), false)
-					if err != nil {
-						server.AbortRequest(ctx, http.StatusInternalServerError, err)
-						return
-					}
+	return search.SortOrder(name)
+}
 
-					result[i-offset] = m
-				}
+// encodeCursor encodes the sort values of the last study on
+// a page into an opaque cursor.
+func encodeCursor(after []string) (string, error) {
+	blob, err := json.Marshal(after)
+	if err != nil {
+		return "", err
+	}
 
-				styIdx++
-				i++
-			}
+	return base64.RawURLEncoding.EncodeToString(blob), nil
+}
 
-			if volIdx+1 > len(volumes) {
-				break L
-			}
+// decodeCursor decodes a cursor created by encodeCursor. An
+// empty cursor decodes to nil.
+func decodeCursor(cursor string) ([]string, error) {
+	if cursor == "" {
+		return nil, nil
+	}
 
-			volIdx++
+	blob, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
 
-			vol, err = appCtx.FsDB.OpenVolumeByName(volumes[volIdx])
-			if err != nil {
-				server.AbortRequest(ctx, http.StatusInternalServerError, err)
-				return
-			}
-		}
+	var after []string
+	if err := json.Unmarshal(blob, &after); err != nil {
+		return nil, err
+	}
 
-		ctx.JSON(http.StatusOK, result)
-	})
+	return after, nil
 }
@@ -0,0 +1,224 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/tierklinik-dobersberg/dxray/internal/accesslog"
+	"github.com/tierklinik-dobersberg/dxray/internal/app"
+	"github.com/tierklinik-dobersberg/dxray/internal/dicomweb"
+	"github.com/tierklinik-dobersberg/logger"
+	"github.com/tierklinik-dobersberg/service/server"
+)
+
+// MetadataEndpoint implements the WADO-RS metadata, frames and bulk
+// data transactions. Metadata is parsed from the DICOM files (without
+// pixel data) and cached in the application cache. Pixel data is
+// referenced by a BulkDataURI. Frames and bulk data of encapsulated
+// pixel data are returned with the media type of the transfer syntax
+// (e.g. image/jpeg), native pixel data as application/octet-stream.
+//
+// http://dicom.nema.org/medical/dicom/current/output/chtml/part18/sect_10.4.html
+//
+// GET /api/dxray/v1/studies/:study/metadata
+// GET /api/dxray/v1/studies/:study/series/:series/metadata
+// GET /api/dxray/v1/studies/:study/series/:series/instances/:instance/metadata
+// GET /api/dxray/v1/studies/:study/series/:series/instances/:instance/frames/:frames
+// GET /api/dxray/v1/studies/:study/series/:series/instances/:instance/bulkdata/:tag
+func MetadataEndpoint(grp gin.IRouter) {
+	grp.GET("studies/:study/metadata", func(ctx *gin.Context) {
+		retrieveMetadata(ctx, "", "")
+	})
+
+	grp.GET("studies/:study/series/:series/metadata", func(ctx *gin.Context) {
+		retrieveMetadata(ctx, ctx.Param("series"), "")
+	})
+
+	grp.GET("studies/:study/series/:series/instances/:instance/metadata", func(ctx *gin.Context) {
+		retrieveMetadata(ctx, ctx.Param("series"), ctx.Param("instance"))
+	})
+
+	grp.GET("studies/:study/series/:series/instances/:instance/frames/:frames", func(ctx *gin.Context) {
+		var numbers []int
+		for _, s := range strings.Split(ctx.Param("frames"), ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || n < 1 {
+				ctx.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			numbers = append(numbers, n)
+		}
+
+		retrieveFrames(ctx, numbers)
+	})
+
+	grp.GET("studies/:study/series/:series/instances/:instance/bulkdata/:tag", func(ctx *gin.Context) {
+		tag, err := dicomweb.ParseTagKey(ctx.Param("tag"))
+		if err != nil {
+			server.AbortRequest(ctx, http.StatusBadRequest, err)
+			return
+		}
+
+		// Pixel data is the only bulk data we reference.
+		if tag != dicomtag.PixelData {
+			ctx.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		retrieveFrames(ctx, nil)
+	})
+}
+
+// retrieveMetadata returns the metadata of all instances of the
+// requested study that match seriesUID and instanceUID. Empty UIDs
+// match everything.
+func retrieveMetadata(ctx *gin.Context, seriesUID, instanceUID string) {
+	log := logger.From(ctx.Request.Context())
+
+	appCtx := app.From(ctx)
+	if appCtx == nil {
+		return
+	}
+
+	studyUID := ctx.Param("study")
+
+	std, err := getStudyByUID(ctx, studyUID)
+	if err != nil {
+		return
+	}
+
+	if err := std.Load(); err != nil {
+		server.AbortRequest(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	model, _ := std.Model()
+	instances := selectInstances(model, seriesUID, instanceUID)
+	if len(instances) == 0 {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	uids := make([]string, 0, len(instances))
+	for _, ref := range instances {
+		uids = append(uids, ref.Instance.UID)
+	}
+	accesslog.RecordStudy(ctx, model.Patient.ID, studyUID, uids...)
+
+	result := make([]dicomweb.Object, 0, len(instances))
+	for _, ref := range instances {
+		var obj dicomweb.Object
+
+		path, err := std.RealPath(ref.Instance.Data.DICOMPath)
+		if err == nil {
+			err = cachedJSON(appCtx, std, "metadata", path, &obj, func() (interface{}, error) {
+				return dicomweb.ReadMetadata(path)
+			})
+		}
+		if err != nil {
+			log.WithFields(logger.Fields{
+				"error": err.Error(),
+				"path":  path,
+			}).Errorf("failed to read instance metadata")
+
+			// fallback to what we know from study.xml
+			obj = dicomweb.Study(model)
+			for k, v := range dicomweb.Series(model, ref.Series) {
+				obj[k] = v
+			}
+			for k, v := range dicomweb.Instance(model, ref.Series, ref.Instance) {
+				obj[k] = v
+			}
+		}
+
+		url := instanceURL(ctx, studyUID, ref.Series.UID, ref.Instance.UID)
+		if attr, ok := obj.Get(dicomtag.PixelData); ok {
+			attr.BulkDataURI = url + "/bulkdata/" + dicomweb.TagKey(dicomtag.PixelData)
+			obj[dicomweb.TagKey(dicomtag.PixelData)] = attr
+		}
+		obj.SetVR(dicomweb.RetrieveURL, "UR", url)
+
+		result = append(result, obj)
+	}
+
+	writeDICOMJSON(ctx, result)
+}
+
+// retrieveFrames writes the requested frames of an instance as a
+// multipart/related response. Frame numbers start at 1. If numbers
+// is empty all frames are returned.
+func retrieveFrames(ctx *gin.Context, numbers []int) {
+	log := logger.From(ctx.Request.Context())
+
+	studyUID := ctx.Param("study")
+
+	std, err := getStudyByUID(ctx, studyUID)
+	if err != nil {
+		return
+	}
+
+	if err := std.Load(); err != nil {
+		server.AbortRequest(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	model, _ := std.Model()
+	instances := selectInstances(model, ctx.Param("series"), ctx.Param("instance"))
+	if len(instances) != 1 {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	ref := instances[0]
+
+	path, err := std.RealPath(ref.Instance.Data.DICOMPath)
+	if err != nil {
+		server.AbortRequest(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	frames, mediaType, err := dicomweb.ReadFrames(path)
+	if err != nil {
+		server.AbortRequest(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	// frames are returned as stored and never transcoded.
+	if !acceptsMultipart(ctx, mediaType) {
+		ctx.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+
+	accesslog.RecordStudy(ctx, model.Patient.ID, studyUID, ref.Instance.UID)
+
+	if len(numbers) == 0 {
+		for i := range frames {
+			numbers = append(numbers, i+1)
+		}
+	}
+
+	for _, n := range numbers {
+		if n > len(frames) {
+			ctx.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+	}
+
+	mw := dicomweb.NewMultipartWriter(ctx.Writer, mediaType)
+	ctx.Header("Content-Type", mw.ContentType())
+	ctx.Status(http.StatusOK)
+
+	for _, n := range numbers {
+		if err := mw.WritePart(bytes.NewReader(frames[n-1]), ""); err != nil {
+			log.Errorf("failed to write frame: %s", err)
+			return
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		log.Errorf("failed to finish multipart response: %s", err)
+	}
+}
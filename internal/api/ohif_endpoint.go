@@ -6,12 +6,19 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/tierklinik-dobersberg/dxray/internal/accesslog"
+	"github.com/tierklinik-dobersberg/dxray/internal/app"
 	"github.com/tierklinik-dobersberg/dxray/internal/ohif"
 	"github.com/tierklinik-dobersberg/service/server"
 )
 
 func OHIFEndpoint(grp gin.IRouter) {
 	grp.GET("ohif/:study", func(ctx *gin.Context) {
+		appCtx := app.From(ctx)
+		if appCtx == nil {
+			return
+		}
+
 		uid := ctx.Param("study")
 
 		std, err := getStudyByUID(ctx, uid)
@@ -19,12 +26,14 @@ func OHIFEndpoint(grp gin.IRouter) {
 			return
 		}
 
-		model, err := ohif.JSONFromDXR(ctx.Request.Context(), std, createStudyURLFactory(ctx), true)
+		model, err := ohif.JSONFromDXR(ctx.Request.Context(), std, createStudyURLFactory(ctx), cachedTagReader(appCtx, std))
 		if err != nil {
 			server.AbortRequest(ctx, http.StatusInternalServerError, err)
 			return
 		}
 
+		accesslog.RecordStudy(ctx, model.PatientID, model.UID)
+
 		buf := &bytes.Buffer{}
 		enc := json.NewEncoder(buf)
 		enc.SetEscapeHTML(false)
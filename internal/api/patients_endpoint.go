@@ -0,0 +1,235 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tierklinik-dobersberg/dxray/internal/accesslog"
+	"github.com/tierklinik-dobersberg/dxray/internal/app"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/models"
+	"github.com/tierklinik-dobersberg/dxray/internal/search"
+	"github.com/tierklinik-dobersberg/logger"
+	"github.com/tierklinik-dobersberg/service/server"
+)
+
+const (
+	// defaultPatientLimit is the number of patients returned by
+	// /patients if no limit is requested.
+	defaultPatientLimit = 20
+
+	// maxPatientLimit is the maximum number of patients returned
+	// by a single /patients request. Each patient requires all of
+	// its studies to be loaded.
+	maxPatientLimit = 100
+)
+
+type (
+	// PatientJSON describes a patient and the studies taken of
+	// it. Patient details are taken from the most recent study.
+	PatientJSON struct {
+		PatientID        string `json:"patientId"`
+		OwnerName        string `json:"ownerName"`
+		AnimalName       string `json:"animalName"`
+		AnimalRace       string `json:"animalRace"`
+		PatientSex       string `json:"patientSex,omitempty"`
+		PatientBirthDate string `json:"patientBirthDate,omitempty"`
+		StudyCount       int    `json:"studyCount"`
+		FirstStudyDate   string `json:"firstStudyDate,omitempty"`
+		LastStudyDate    string `json:"lastStudyDate,omitempty"`
+
+		// Timeline holds all studies of the patient in
+		// chronological order. It's only set when a single
+		// patient is requested.
+		Timeline []TimelineStudy `json:"timeline,omitempty"`
+	}
+
+	// TimelineStudy is a single study in the timeline of a
+	// patient.
+	TimelineStudy struct {
+		UID         string           `json:"studyInstanceUid"`
+		Date        string           `json:"studyDate,omitempty"`
+		Description string           `json:"studyDescription,omitempty"`
+		Series      []TimelineSeries `json:"seriesList,omitempty"`
+	}
+
+	// TimelineSeries is a single series of a TimelineStudy.
+	TimelineSeries struct {
+		UID           string `json:"seriesInstanceUid"`
+		Number        int    `json:"seriesNumber"`
+		Description   string `json:"seriesDescription,omitempty"`
+		Protocol      string `json:"seriesProtocol,omitempty"`
+		Modality      string `json:"seriesModality,omitempty"`
+		InstanceCount int    `json:"instanceCount"`
+	}
+)
+
+// PatientsEndpoint groups studies by patient ID.
+//
+// GET /api/dxray/v1/patients?prefix=&limit=&offset= lists patients
+// sorted by patient ID and returns the total number of patients in
+// the X-Total-Count header. GET /api/dxray/v1/patients/:id returns a
+// single patient including the timeline of its studies and series and
+// GET /api/dxray/v1/patients/:id/studies returns all studies of the
+// patient in chronological order.
+func PatientsEndpoint(grp gin.IRouter) {
+	grp.GET("patients", func(ctx *gin.Context) {
+		appCtx := app.From(ctx)
+		if appCtx == nil {
+			return
+		}
+
+		limit, err := getNumberParamDefault(ctx, "limit", defaultPatientLimit)
+		if err != nil || limit < 1 {
+			server.AbortRequest(ctx, http.StatusBadRequest, fmt.Errorf("invalid limit"))
+			return
+		}
+		if limit > maxPatientLimit {
+			limit = maxPatientLimit
+		}
+
+		offset, err := getNumberParamDefault(ctx, "offset", 0)
+		if err != nil || offset < 0 {
+			server.AbortRequest(ctx, http.StatusBadRequest, fmt.Errorf("invalid offset"))
+			return
+		}
+
+		ids, total, err := appCtx.Indexer.PatientIDs(ctx.Query("prefix"), limit, offset)
+		if err != nil {
+			server.AbortRequest(ctx, http.StatusInternalServerError, err)
+			return
+		}
+
+		patients := make([]*PatientJSON, 0, len(ids))
+		for _, id := range ids {
+			p, err := loadPatient(ctx, appCtx, id)
+			if err != nil {
+				server.AbortRequest(ctx, http.StatusInternalServerError, err)
+				return
+			}
+			if p == nil {
+				continue
+			}
+
+			p.Timeline = nil
+			patients = append(patients, p)
+		}
+
+		ctx.Header("X-Total-Count", strconv.Itoa(total))
+		ctx.JSON(http.StatusOK, patients)
+	})
+
+	grp.GET("patients/:id", func(ctx *gin.Context) {
+		appCtx := app.From(ctx)
+		if appCtx == nil {
+			return
+		}
+
+		p, err := loadPatient(ctx, appCtx, ctx.Param("id"))
+		if err != nil {
+			server.AbortRequest(ctx, http.StatusInternalServerError, err)
+			return
+		}
+		if p == nil {
+			ctx.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		for _, s := range p.Timeline {
+			accesslog.RecordStudy(ctx, p.PatientID, s.UID)
+		}
+
+		ctx.JSON(http.StatusOK, p)
+	})
+
+	grp.GET("patients/:id/studies", func(ctx *gin.Context) {
+		appCtx := app.From(ctx)
+		if appCtx == nil {
+			return
+		}
+
+		keys, err := appCtx.Indexer.PatientStudies(ctx.Param("id"))
+		if err != nil {
+			server.AbortRequest(ctx, http.StatusInternalServerError, err)
+			return
+		}
+		if len(keys) == 0 {
+			ctx.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, loadStudies(ctx, appCtx, keys))
+	})
+}
+
+// loadPatient loads all studies of the patient identified by id
+// and returns the patient including its timeline. Studies that
+// cannot be opened are logged and skipped. If the patient does not
+// have any studies, nil is returned.
+func loadPatient(ctx *gin.Context, appCtx *app.App, id string) (*PatientJSON, error) {
+	log := logger.From(ctx.Request.Context())
+
+	keys, err := appCtx.Indexer.PatientStudies(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var p *PatientJSON
+	for _, key := range keys {
+		s, err := search.Get(key, appCtx.FsDB)
+		if err == nil {
+			err = s.Load()
+		}
+		if err != nil {
+			log.WithFields(logger.Fields{
+				"error": err.Error(),
+				"key":   key,
+			}).Errorf("failed to open study")
+			continue
+		}
+
+		model, _ := s.Model()
+		if p == nil {
+			p = &PatientJSON{
+				PatientID:      id,
+				FirstStudyDate: model.Patient.Visit.Study.Date,
+			}
+		}
+
+		// studies are sorted by date so the last one holds
+		// the most recent patient details.
+		p.OwnerName = model.Patient.OwnerName()
+		p.AnimalName = model.Patient.AnimalName()
+		p.AnimalRace = model.Patient.AnimalRace()
+		p.PatientSex = model.Patient.Sex
+		p.PatientBirthDate = model.Patient.Birth
+		p.LastStudyDate = model.Patient.Visit.Study.Date
+		p.StudyCount++
+		p.Timeline = append(p.Timeline, timelineStudy(model.Patient.Visit.Study))
+	}
+
+	return p, nil
+}
+
+// timelineStudy returns the timeline representation of s.
+func timelineStudy(s models.Study) TimelineStudy {
+	ts := TimelineStudy{
+		UID:         s.UID,
+		Date:        s.Date,
+		Description: s.Description,
+	}
+
+	for _, series := range s.Series {
+		ts.Series = append(ts.Series, TimelineSeries{
+			UID:           series.UID,
+			Number:        series.Number,
+			Description:   series.Description,
+			Protocol:      series.Protocol,
+			Modality:      series.Modality,
+			InstanceCount: len(series.Instances),
+		})
+	}
+
+	return ts
+}
@@ -0,0 +1,256 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/tierklinik-dobersberg/dxray/internal/accesslog"
+	"github.com/tierklinik-dobersberg/dxray/internal/app"
+	"github.com/tierklinik-dobersberg/dxray/internal/dicomweb"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/models"
+	"github.com/tierklinik-dobersberg/dxray/internal/search"
+	"github.com/tierklinik-dobersberg/logger"
+	"github.com/tierklinik-dobersberg/service/server"
+)
+
+// QIDOEndpoint implements the QIDO-RS search transactions for
+// studies, series and instances.
+//
+// http://dicom.nema.org/medical/dicom/current/output/chtml/part18/sect_10.6.html
+//
+// GET /api/dxray/v1/studies
+// GET /api/dxray/v1/studies/:study/series
+// GET /api/dxray/v1/studies/:study/series/:series/instances
+func QIDOEndpoint(grp gin.IRouter) {
+	grp.GET("studies", func(ctx *gin.Context) {
+		appCtx := app.From(ctx)
+		if appCtx == nil {
+			return
+		}
+
+		q, err := dicomweb.ParseQuery(ctx.Request.URL.Query())
+		if err != nil {
+			server.AbortRequest(ctx, http.StatusBadRequest, err)
+			return
+		}
+
+		// matching keys that are not part of the study level
+		// attributes are ignored as permitted by PS3.18.
+		unindexed := q.Unindexed()
+		if tags := unindexed.Unsupported(dicomweb.Study(models.ImageList{})); len(tags) > 0 {
+			addUnsupportedKeysWarning(ctx, tags)
+		}
+
+		var (
+			result = make([]dicomweb.Object, 0)
+			more   bool
+		)
+
+		if len(unindexed.Match) == 0 {
+			keys, total, err := appCtx.Indexer.Query(q.StudyQuery(), q.Limit, q.Offset, "-date")
+			if err != nil {
+				server.AbortRequest(ctx, http.StatusInternalServerError, err)
+				return
+			}
+
+			for _, key := range keys {
+				if model, ok := loadIndexedStudy(ctx, key); ok {
+					result = append(result, studyResult(ctx, q, model))
+				}
+			}
+			more = uint64(q.Offset+len(keys)) < total
+		} else {
+			// the remaining matching keys are applied to each
+			// study so limit and offset must be applied here
+			// rather than by the index.
+			skip := q.Offset
+			for offset := 0; !more; offset += dicomweb.MaxLimit {
+				keys, total, err := appCtx.Indexer.Query(q.StudyQuery(), dicomweb.MaxLimit, offset, "-date")
+				if err != nil {
+					server.AbortRequest(ctx, http.StatusInternalServerError, err)
+					return
+				}
+
+				for _, key := range keys {
+					model, ok := loadIndexedStudy(ctx, key)
+					if !ok || !unindexed.Matches(dicomweb.Study(model)) {
+						continue
+					}
+					if skip > 0 {
+						skip--
+						continue
+					}
+					if len(result) == q.Limit {
+						more = true
+						break
+					}
+					result = append(result, studyResult(ctx, q, model))
+				}
+
+				if len(keys) == 0 || uint64(offset+len(keys)) >= total {
+					break
+				}
+			}
+		}
+
+		if more {
+			addMoreResultsWarning(ctx)
+		}
+
+		writeDICOMJSON(ctx, result)
+	})
+
+	grp.GET("studies/:study/series", func(ctx *gin.Context) {
+		q, err := dicomweb.ParseQuery(ctx.Request.URL.Query())
+		if err != nil {
+			server.AbortRequest(ctx, http.StatusBadRequest, err)
+			return
+		}
+
+		model, ok := loadStudyModel(ctx, ctx.Param("study"))
+		if !ok {
+			return
+		}
+
+		var result []dicomweb.Object
+		for _, series := range model.Patient.Visit.Study.Series {
+			obj := dicomweb.Series(model, series)
+			obj.SetVR(dicomweb.RetrieveURL, "UR", seriesURL(ctx, ctx.Param("study"), series.UID))
+			if q.Matches(obj) {
+				result = append(result, q.Filter(obj))
+			}
+		}
+
+		writeDICOMJSON(ctx, paginate(ctx, result, q))
+	})
+
+	grp.GET("studies/:study/series/:series/instances", func(ctx *gin.Context) {
+		q, err := dicomweb.ParseQuery(ctx.Request.URL.Query())
+		if err != nil {
+			server.AbortRequest(ctx, http.StatusBadRequest, err)
+			return
+		}
+
+		model, ok := loadStudyModel(ctx, ctx.Param("study"))
+		if !ok {
+			return
+		}
+
+		series, ok := findSeries(model, ctx.Param("series"))
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		var result []dicomweb.Object
+		for _, instance := range series.Instances {
+			obj := dicomweb.Instance(model, series, instance)
+			obj.SetVR(dicomweb.RetrieveURL, "UR", instanceURL(ctx, ctx.Param("study"), series.UID, instance.UID))
+			if q.Matches(obj) {
+				result = append(result, q.Filter(obj))
+			}
+		}
+
+		writeDICOMJSON(ctx, paginate(ctx, result, q))
+	})
+}
+
+// loadIndexedStudy loads the study with the index key. Studies
+// that cannot be opened are logged and skipped.
+func loadIndexedStudy(ctx *gin.Context, key string) (models.ImageList, bool) {
+	appCtx := app.From(ctx)
+
+	s, err := search.Get(key, appCtx.FsDB)
+	if err == nil {
+		err = s.Load()
+	}
+	if err != nil {
+		logger.From(ctx.Request.Context()).WithFields(logger.Fields{
+			"error": err.Error(),
+			"key":   key,
+		}).Errorf("failed to open study")
+		return models.ImageList{}, false
+	}
+
+	model, _ := s.Model()
+	return model, true
+}
+
+// studyResult returns the study level attributes of model as
+// requested by q and records the access.
+func studyResult(ctx *gin.Context, q *dicomweb.Query, model models.ImageList) dicomweb.Object {
+	accesslog.RecordStudy(ctx, model.Patient.ID, model.Patient.Visit.Study.UID)
+
+	obj := dicomweb.Study(model)
+	obj.SetVR(dicomweb.RetrieveURL, "UR", studyURL(ctx, model.Patient.Visit.Study.UID))
+
+	return q.Filter(obj)
+}
+
+// loadStudyModel loads the model of the study identified by uid
+// and records the access. If false is returned the request has
+// already been aborted.
+func loadStudyModel(ctx *gin.Context, uid string) (models.ImageList, bool) {
+	std, err := getStudyByUID(ctx, uid)
+	if err != nil {
+		return models.ImageList{}, false
+	}
+
+	if err := std.Load(); err != nil {
+		server.AbortRequest(ctx, http.StatusInternalServerError, err)
+		return models.ImageList{}, false
+	}
+
+	model, _ := std.Model()
+	accesslog.RecordStudy(ctx, model.Patient.ID, uid)
+
+	return model, true
+}
+
+// findSeries returns the series with uid from model.
+func findSeries(model models.ImageList, uid string) (models.Series, bool) {
+	for _, series := range model.Patient.Visit.Study.Series {
+		if series.UID == uid {
+			return series, true
+		}
+	}
+
+	return models.Series{}, false
+}
+
+// paginate applies limit and offset of q to result.
+func paginate(ctx *gin.Context, result []dicomweb.Object, q *dicomweb.Query) []dicomweb.Object {
+	if q.Offset >= len(result) {
+		return []dicomweb.Object{}
+	}
+	result = result[q.Offset:]
+
+	if len(result) > q.Limit {
+		result = result[:q.Limit]
+		addMoreResultsWarning(ctx)
+	}
+
+	return result
+}
+
+// addMoreResultsWarning adds the warning header required by QIDO-RS
+// if there are more results than returned.
+func addMoreResultsWarning(ctx *gin.Context) {
+	ctx.Writer.Header().Add("Warning", "299 dxray: There are additional results that can be requested")
+}
+
+// addUnsupportedKeysWarning adds a warning header listing the
+// matching keys that have been ignored.
+func addUnsupportedKeysWarning(ctx *gin.Context, tags []dicomtag.Tag) {
+	names := make([]string, len(tags))
+	for i, tag := range tags {
+		names[i] = dicomweb.TagKey(tag)
+		if info, err := dicomtag.Find(tag); err == nil {
+			names[i] = info.Name
+		}
+	}
+
+	ctx.Writer.Header().Add("Warning", "299 dxray: The following matching keys are not supported and have been ignored: "+strings.Join(names, ", "))
+}
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tierklinik-dobersberg/dxray/internal/accesslog"
+	"github.com/tierklinik-dobersberg/dxray/internal/app"
+	"github.com/tierklinik-dobersberg/dxray/internal/cache"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
+	"github.com/tierklinik-dobersberg/dxray/internal/render"
+	"github.com/tierklinik-dobersberg/dxray/internal/search"
+	"github.com/tierklinik-dobersberg/service/server"
+)
+
+// thumbnailSize is the default size of images returned by the
+// thumbnail resources.
+const thumbnailSize = 128
+
+// RenderedEndpoint implements the WADO-RS rendered and thumbnail
+// resources for instances and frames. Images are rendered as JPEG
+// (default) or PNG depending on the Accept header.
+//
+// http://dicom.nema.org/medical/dicom/current/output/chtml/part18/sect_9.5.html
+//
+// Supported query parameters are window=center,width, viewport=vw,vh
+// and quality. In addition, invert=true inverts the image and
+// voilut=true prefers the VOI LUT stored in the instance over its
+// default window.
+//
+// GET /api/dxray/v1/studies/:study/series/:series/instances/:instance/rendered
+// GET /api/dxray/v1/studies/:study/series/:series/instances/:instance/thumbnail
+// GET /api/dxray/v1/studies/:study/series/:series/instances/:instance/frames/:frames/rendered
+// GET /api/dxray/v1/studies/:study/series/:series/instances/:instance/frames/:frames/thumbnail
+func RenderedEndpoint(grp gin.IRouter) {
+	grp.GET("studies/:study/series/:series/instances/:instance/rendered", func(ctx *gin.Context) {
+		renderedResource(ctx, 0, 0)
+	})
+
+	grp.GET("studies/:study/series/:series/instances/:instance/thumbnail", func(ctx *gin.Context) {
+		renderedResource(ctx, 0, thumbnailSize)
+	})
+
+	grp.GET("studies/:study/series/:series/instances/:instance/frames/:frames/rendered", func(ctx *gin.Context) {
+		frame, ok := parseFrameNumber(ctx)
+		if !ok {
+			return
+		}
+		renderedResource(ctx, frame, 0)
+	})
+
+	grp.GET("studies/:study/series/:series/instances/:instance/frames/:frames/thumbnail", func(ctx *gin.Context) {
+		frame, ok := parseFrameNumber(ctx)
+		if !ok {
+			return
+		}
+		renderedResource(ctx, frame, thumbnailSize)
+	})
+}
+
+// renderedResource renders the frame with the given (zero-based)
+// index of the requested instance. If size is set it's used as the
+// default viewport.
+func renderedResource(ctx *gin.Context, frame, size int) {
+	contentType := acceptedImageType(ctx)
+	if contentType == "" {
+		ctx.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+
+	opts := render.Options{
+		Width:  size,
+		Height: size,
+		Invert: ctx.Query("invert") == "true",
+		VOILUT: ctx.Query("voilut") == "true",
+	}
+
+	if viewport := ctx.Query("viewport"); viewport != "" {
+		parts := strings.Split(viewport, ",")
+		if len(parts) < 2 {
+			ctx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		if opts.Width, err = parseSize(parts[0]); err != nil {
+			server.AbortRequest(ctx, http.StatusBadRequest, err)
+			return
+		}
+		if opts.Height, err = parseSize(parts[1]); err != nil {
+			server.AbortRequest(ctx, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if window := ctx.Query("window"); window != "" {
+		parts := strings.Split(window, ",")
+		if len(parts) < 2 {
+			ctx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		w, err := parseWindow(parts[0], parts[1])
+		if err != nil {
+			server.AbortRequest(ctx, http.StatusBadRequest, err)
+			return
+		}
+		opts.Window = w
+	}
+
+	quality, err := parseOptionalInt(ctx.Query("quality"))
+	if err != nil {
+		server.AbortRequest(ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	studyUID := ctx.Param("study")
+	std, err := getStudyByUID(ctx, studyUID)
+	if err != nil {
+		return
+	}
+
+	if err := std.Load(); err != nil {
+		server.AbortRequest(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	model, _ := std.Model()
+	instances := selectInstances(model, ctx.Param("series"), ctx.Param("instance"))
+	if len(instances) != 1 {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	ref := instances[0]
+
+	path, err := std.RealPath(ref.Instance.Data.DICOMPath)
+	if err != nil {
+		server.AbortRequest(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	accesslog.RecordStudy(ctx, model.Patient.ID, studyUID, ref.Instance.UID)
+
+	if err := writeRendered(ctx, std, path, frame, opts, contentType, quality); err != nil {
+		abortRenderError(ctx, err)
+	}
+}
+
+// writeRendered renders a frame of the DICOM file at path and writes
+// it as the response. Rendered images are cached.
+func writeRendered(ctx *gin.Context, std fsdb.Study, path string, frame int, opts render.Options, contentType string, quality int) error {
+	appCtx := app.From(ctx)
+	if appCtx == nil {
+		return errors.New("no app context")
+	}
+
+	window := "default"
+	if opts.Window != nil {
+		window = fmt.Sprintf("%g,%g", opts.Window.Center, opts.Window.Width)
+	}
+
+	key, err := cache.FileKey("rendered", path, frame, opts.Width, opts.Height, window, opts.VOILUT, opts.Invert, contentType, quality)
+	if err != nil {
+		return err
+	}
+
+	blob, err := appCtx.Cache.GetOrCreate(key, search.Key(std), func() ([]byte, error) {
+		f, err := render.ReadFrame(path, frame)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := new(bytes.Buffer)
+		if err := render.Encode(buf, render.Render(f, opts), contentType, quality); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx.Data(http.StatusOK, contentType, blob)
+	return nil
+}
+
+// abortRenderError aborts the request with a status code
+// matching err.
+func abortRenderError(ctx *gin.Context, err error) {
+	if errors.Is(err, render.ErrNoSuchFrame) {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	server.AbortRequest(ctx, http.StatusInternalServerError, err)
+}
+
+// acceptedImageType returns the image type that should be rendered
+// based on the Accept header. An empty string is returned if none
+// of the supported types is acceptable.
+func acceptedImageType(ctx *gin.Context) string {
+	accept := ctx.GetHeader("Accept")
+	if accept == "" {
+		return render.ContentTypeJPEG
+	}
+
+	for _, value := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+
+		switch mediaType {
+		case render.ContentTypeJPEG, render.ContentTypePNG:
+			return mediaType
+		case "*/*", "image/*":
+			return render.ContentTypeJPEG
+		}
+	}
+
+	return ""
+}
+
+// parseFrameNumber parses the :frames parameter. Only a single
+// frame number can be rendered. If false is returned the request
+// has already been aborted.
+func parseFrameNumber(ctx *gin.Context) (int, bool) {
+	n, err := strconv.Atoi(ctx.Param("frames"))
+	if err != nil || n < 1 {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return 0, false
+	}
+
+	return n - 1, true
+}
+
+// parseWindow parses the window center and width.
+func parseWindow(center, width string) (*render.Window, error) {
+	c, err := strconv.ParseFloat(strings.TrimSpace(center), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid window center %q", center)
+	}
+
+	w, err := strconv.ParseFloat(strings.TrimSpace(width), 64)
+	if err != nil || w < 1 {
+		return nil, fmt.Errorf("invalid window width %q", width)
+	}
+
+	return &render.Window{Center: c, Width: w}, nil
+}
+
+// parseOptionalInt parses s as a non-negative integer. An empty
+// string is treated as zero.
+func parseOptionalInt(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+
+	return i, nil
+}
+
+// parseSize parses an optional width or height of a rendered
+// image which must not exceed render.MaxSize.
+func parseSize(s string) (int, error) {
+	i, err := parseOptionalInt(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if i > render.MaxSize {
+		return 0, fmt.Errorf("size %d exceeds the maximum of %d", i, render.MaxSize)
+	}
+
+	return i, nil
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tierklinik-dobersberg/dxray/internal/render"
+)
+
+func TestParseWindow(t *testing.T) {
+	cases := []struct {
+		center string
+		width  string
+		want   *render.Window
+	}{
+		{"40", "400", &render.Window{Center: 40, Width: 400}},
+		{" -600 ", " 1500.5", &render.Window{Center: -600, Width: 1500.5}},
+		{"0", "1", &render.Window{Center: 0, Width: 1}},
+		{"0", "0.5", nil},
+		{"0", "0", nil},
+		{"0", "-10", nil},
+		{"", "400", nil},
+		{"40", "", nil},
+		{"abc", "400", nil},
+	}
+
+	for _, c := range cases {
+		got, err := parseWindow(c.center, c.width)
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("parseWindow(%q, %q): expected an error, got %v", c.center, c.width, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseWindow(%q, %q): %s", c.center, c.width, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseWindow(%q, %q) = %v, want %v", c.center, c.width, got, c.want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		value string
+		want  int
+		err   bool
+	}{
+		{"", 0, false},
+		{" ", 0, false},
+		{"0", 0, false},
+		{"128", 128, false},
+		{" 512 ", 512, false},
+		{"4096", render.MaxSize, false},
+		{"4097", 0, true},
+		{"-1", 0, true},
+		{"1.5", 0, true},
+		{"abc", 0, true},
+	}
+
+	for _, c := range cases {
+		got, err := parseSize(c.value)
+		if (err != nil) != c.err {
+			t.Errorf("parseSize(%q): unexpected error %v", c.value, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parseSize(%q) = %d, want %d", c.value, got, c.want)
+		}
+	}
+}
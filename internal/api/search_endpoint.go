@@ -2,8 +2,11 @@ package api
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/tierklinik-dobersberg/dxray/internal/accesslog"
 	"github.com/tierklinik-dobersberg/dxray/internal/app"
 	"github.com/tierklinik-dobersberg/dxray/internal/ohif"
 	"github.com/tierklinik-dobersberg/dxray/internal/search"
@@ -11,49 +14,147 @@ import (
 	"github.com/tierklinik-dobersberg/service/server"
 )
 
+// SearchResponse is the response of a structured search
+// request.
+type SearchResponse struct {
+	Total   uint64            `json:"total"`
+	Studies []*ohif.StudyJSON `json:"studies"`
+
+	// Highlights holds the highlighted name fragments of each
+	// study keyed by study instance UID.
+	Highlights map[string]map[string][]string `json:"highlights,omitempty"`
+
+	// Facets holds the result of each requested facet keyed
+	// by the name used in the request.
+	Facets map[string]*search.Facet `json:"facets,omitempty"`
+}
+
 // SearchStudiesEndpoint allows searching studies by querying
 // the study-indexer (bleeve index).
 //
-// GET /api/v1/search
+// The GET endpoint accepts a bleve query string in q as well as
+// the size, from and sort (comma separated) query parameters
+// and returns the total number of matches in the X-Total-Count
+// header. Term facets can be requested by passing a comma separated
+// list of fields in facets. In that case a SearchResponse is returned
+// instead of the list of studies. The POST endpoint accepts a JSON
+// encoded search.Request and returns a SearchResponse.
+//
+// GET  /api/v1/search?q=&size=&from=&sort=&facets=
+// POST /api/v1/search
 func SearchStudiesEndpoint(grp gin.IRouter) {
 	grp.GET("search", func(c *gin.Context) {
-		log := logger.From(c.Request.Context())
+		req := search.Request{
+			Query: c.Query("q"),
+		}
 
-		appCtx := app.From(c)
-		if appCtx == nil {
+		var err error
+		if req.Size, err = getNumberParamDefault(c, "size", search.DefaultSize); err != nil {
+			server.AbortRequest(c, http.StatusBadRequest, err)
 			return
 		}
 
-		term := c.Query("q")
-		results, err := appCtx.Indexer.Search(term)
-		if err != nil {
-			server.AbortRequest(c, http.StatusInternalServerError, err)
+		if req.From, err = getNumberParamDefault(c, "from", 0); err != nil {
+			server.AbortRequest(c, http.StatusBadRequest, err)
 			return
 		}
 
-		models := make([]*ohif.StudyJSON, 0, len(results))
-		for _, key := range results {
-			s, err := search.Get(key, appCtx.FsDB)
-			if err != nil {
-				log.WithFields(logger.Fields{
-					"error": err.Error(),
-					"key":   key,
-				}).Errorf("failed to open study")
-				continue
-			}
+		if sortBy := c.Query("sort"); sortBy != "" {
+			req.Sort = strings.Split(sortBy, ",")
+		}
 
-			m, err := ohif.JSONFromDXR(c.Request.Context(), s, createStudyURLFactory(c), false)
-			if err != nil {
-				log.WithFields(logger.Fields{
-					"error": err.Error(),
-					"key":   key,
-				}).Errorf("failed to get JSON representaion")
-				continue
+		if facets := c.Query("facets"); facets != "" {
+			req.Facets = make(map[string]search.FacetRequest)
+			for _, field := range strings.Split(facets, ",") {
+				req.Facets[field] = search.FacetRequest{Field: field}
 			}
+		}
+
+		result := findStudies(c, req)
+		if result == nil {
+			return
+		}
+
+		c.Header("X-Total-Count", strconv.FormatUint(result.Total, 10))
+		if req.Facets != nil {
+			c.JSON(http.StatusOK, result)
+			return
+		}
+		c.JSON(http.StatusOK, result.Studies)
+	})
+
+	grp.POST("search", func(c *gin.Context) {
+		var req search.Request
+		if err := c.ShouldBindJSON(&req); err != nil {
+			server.AbortRequest(c, http.StatusBadRequest, err)
+			return
+		}
 
-			models = append(models, m)
+		result := findStudies(c, req)
+		if result == nil {
+			return
 		}
 
-		c.JSON(http.StatusOK, models)
+		c.JSON(http.StatusOK, result)
 	})
 }
+
+// findStudies executes req and returns the matching studies. If
+// the request fails, c is aborted and nil is returned.
+func findStudies(c *gin.Context, req search.Request) *SearchResponse {
+	appCtx := app.From(c)
+	if appCtx == nil {
+		return nil
+	}
+
+	if err := req.Validate(); err != nil {
+		server.AbortRequest(c, http.StatusBadRequest, err)
+		return nil
+	}
+
+	result, err := appCtx.Indexer.Find(req)
+	if err != nil {
+		server.AbortRequest(c, http.StatusInternalServerError, err)
+		return nil
+	}
+
+	return &SearchResponse{
+		Total:      result.Total,
+		Studies:    loadStudies(c, appCtx, result.Keys),
+		Highlights: result.Highlights,
+		Facets:     result.Facets,
+	}
+}
+
+// loadStudies opens the studies identified by keys and returns
+// their JSON representation. Studies that cannot be opened are
+// logged and skipped.
+func loadStudies(c *gin.Context, appCtx *app.App, keys []string) []*ohif.StudyJSON {
+	log := logger.From(c.Request.Context())
+
+	models := make([]*ohif.StudyJSON, 0, len(keys))
+	for _, key := range keys {
+		s, err := search.Get(key, appCtx.FsDB)
+		if err != nil {
+			log.WithFields(logger.Fields{
+				"error": err.Error(),
+				"key":   key,
+			}).Errorf("failed to open study")
+			continue
+		}
+
+		m, err := ohif.JSONFromDXR(c.Request.Context(), s, createStudyURLFactory(c), nil)
+		if err != nil {
+			log.WithFields(logger.Fields{
+				"error": err.Error(),
+				"key":   key,
+			}).Errorf("failed to get JSON representaion")
+			continue
+		}
+
+		accesslog.RecordStudy(c, m.PatientID, m.UID)
+		models = append(models, m)
+	}
+
+	return models
+}
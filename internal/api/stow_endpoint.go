@@ -0,0 +1,199 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/tierklinik-dobersberg/dxray/internal/accesslog"
+	"github.com/tierklinik-dobersberg/dxray/internal/app"
+	"github.com/tierklinik-dobersberg/dxray/internal/dicomweb"
+	"github.com/tierklinik-dobersberg/dxray/internal/dimse"
+	"github.com/tierklinik-dobersberg/logger"
+	"github.com/tierklinik-dobersberg/service/server"
+)
+
+// STOWEndpoint implements the STOW-RS store transaction. Uploaded
+// instances are stored in the dxray storage and indexed
+// immediately.
+//
+// http://dicom.nema.org/medical/dicom/current/output/chtml/part18/sect_10.5.html
+//
+// POST /api/dxray/v1/studies
+func STOWEndpoint(grp gin.IRouter) {
+	grp.POST("studies", func(ctx *gin.Context) {
+		log := logger.From(ctx.Request.Context())
+
+		appCtx := app.From(ctx)
+		if appCtx == nil {
+			return
+		}
+
+		if appCtx.Storage == nil {
+			server.AbortRequest(ctx, http.StatusServiceUnavailable, errors.New("storage not available"))
+			return
+		}
+
+		maxSize := appCtx.MaxInstanceSize
+		if maxSize <= 0 {
+			maxSize = dimse.DefaultMaxDataSetLength
+		}
+
+		mr, err := dicomweb.NewMultipartReader(ctx.Request.Body, ctx.GetHeader("Content-Type"), dicomweb.ContentTypeDICOM)
+		if err != nil {
+			server.AbortRequest(ctx, http.StatusUnsupportedMediaType, err)
+			return
+		}
+
+		var (
+			referenced []interface{}
+			failed     []interface{}
+			studies    = make(map[string]bool)
+			studyUID   string
+		)
+
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				server.AbortRequest(ctx, http.StatusBadRequest, err)
+				return
+			}
+
+			req, err := readInstancePart(part, maxSize)
+			if err != nil {
+				if errors.Is(err, errInstanceTooLarge) {
+					server.AbortRequest(ctx, http.StatusRequestEntityTooLarge, err)
+					return
+				}
+
+				if req == nil {
+					server.AbortRequest(ctx, http.StatusBadRequest, err)
+					return
+				}
+
+				log.WithFields(logger.Fields{
+					"instance": req.SOPInstanceUID,
+					"error":    err.Error(),
+				}).Errorf("failed to store instance")
+
+				failed = append(failed, failedSOP(req, failureReason(err)))
+				continue
+			}
+
+			inst, err := appCtx.Storage.Add(ctx.Request.Context(), req)
+			if err != nil {
+				log.WithFields(logger.Fields{
+					"instance": req.SOPInstanceUID,
+					"error":    err.Error(),
+				}).Errorf("failed to store instance")
+
+				failed = append(failed, failedSOP(req, failureReason(err)))
+				continue
+			}
+
+			accesslog.RecordStudy(ctx, inst.PatientID, inst.StudyInstanceUID, inst.SOPInstanceUID)
+			studies[inst.StudyInstanceUID] = true
+			studyUID = inst.StudyInstanceUID
+
+			ref := make(dicomweb.Object)
+			ref.Set(dicomtag.ReferencedSOPClassUID, inst.SOPClassUID)
+			ref.Set(dicomtag.ReferencedSOPInstanceUID, inst.SOPInstanceUID)
+			ref.SetVR(dicomweb.RetrieveURL, "UR", instanceURL(ctx, inst.StudyInstanceUID, inst.SeriesInstanceUID, inst.SOPInstanceUID))
+			referenced = append(referenced, ref)
+		}
+
+		if len(referenced)+len(failed) == 0 {
+			server.AbortRequest(ctx, http.StatusBadRequest, errors.New("no instances"))
+			return
+		}
+
+		result := make(dicomweb.Object)
+		if len(studies) == 1 {
+			result.SetVR(dicomweb.RetrieveURL, "UR", studyURL(ctx, studyUID))
+		}
+		if len(failed) > 0 {
+			result.Set(dicomtag.FailedSOPSequence, failed...)
+		}
+		if len(referenced) > 0 {
+			result.Set(dicomtag.ReferencedSOPSequence, referenced...)
+		}
+
+		status := http.StatusOK
+		switch {
+		case len(referenced) == 0:
+			status = http.StatusConflict
+		case len(failed) > 0:
+			status = http.StatusAccepted
+		}
+
+		writeDICOMJSONStatus(ctx, status, result)
+	})
+}
+
+// errInstanceTooLarge is returned by readInstancePart if a part
+// exceeds the maximum instance size.
+var errInstanceTooLarge = errors.New("instance exceeds the maximum size")
+
+// readInstancePart reads the DICOM file of a STOW-RS part that must
+// not exceed maxSize bytes. If the part cannot be read at all a nil
+// request is returned. Otherwise the request holds the UIDs known
+// so far.
+func readInstancePart(part *multipart.Part, maxSize int64) (*dimse.StoreRequest, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(part, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errInstanceTooLarge
+	}
+
+	if contentType := part.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != dicomweb.ContentTypeDICOM {
+			return &dimse.StoreRequest{}, &dimse.StatusError{
+				Status: dimse.StatusCannotUnderstand,
+				Err:    fmt.Errorf("unsupported part type %q", contentType),
+			}
+		}
+	}
+
+	req, err := dimse.ParseFile(data)
+	if err != nil {
+		return &dimse.StoreRequest{}, &dimse.StatusError{Status: dimse.StatusCannotUnderstand, Err: err}
+	}
+
+	if !dimse.IsStorageSOPClass(req.SOPClassUID) {
+		return req, &dimse.StatusError{Status: dimse.StatusSOPClassNotSupported, Err: errors.New("unsupported SOP class")}
+	}
+
+	return req, nil
+}
+
+// failedSOP returns an item of the FailedSOPSequence for req.
+func failedSOP(req *dimse.StoreRequest, reason uint16) dicomweb.Object {
+	obj := make(dicomweb.Object)
+	obj.Set(dicomtag.ReferencedSOPClassUID, req.SOPClassUID)
+	obj.Set(dicomtag.ReferencedSOPInstanceUID, req.SOPInstanceUID)
+	obj.Set(dicomtag.FailureReason, reason)
+
+	return obj
+}
+
+// failureReason returns the failure reason reported for err.
+func failureReason(err error) uint16 {
+	var statusErr *dimse.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Status
+	}
+
+	return dimse.StatusOutOfResources
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tierklinik-dobersberg/dxray/internal/app"
+	"github.com/tierklinik-dobersberg/dxray/internal/search"
+	"github.com/tierklinik-dobersberg/service/server"
+)
+
+const (
+	// defaultSuggestLimit is the number of suggestions returned
+	// if no limit is requested.
+	defaultSuggestLimit = 10
+
+	// maxSuggestLimit is the maximum number of suggestions
+	// returned by a single request.
+	maxSuggestLimit = 100
+)
+
+// SuggestEndpoint returns distinct values of the owner, patient,
+// race or description field that start with prefix together with
+// the number of studies containing them. It's meant for type-ahead
+// suggestions.
+//
+// GET /api/dxray/v1/suggest?field=owner&prefix=hub&limit=10
+func SuggestEndpoint(grp gin.IRouter) {
+	grp.GET("suggest", func(ctx *gin.Context) {
+		appCtx := app.From(ctx)
+		if appCtx == nil {
+			return
+		}
+
+		limit, err := getNumberParamDefault(ctx, "limit", defaultSuggestLimit)
+		if err != nil || limit < 1 {
+			server.AbortRequest(ctx, http.StatusBadRequest, fmt.Errorf("invalid limit"))
+			return
+		}
+		if limit > maxSuggestLimit {
+			limit = maxSuggestLimit
+		}
+
+		field := ctx.DefaultQuery("field", "owner")
+		suggestions, err := appCtx.Indexer.Suggest(field, ctx.Query("prefix"), limit)
+		if errors.Is(err, search.ErrUnknownField) {
+			server.AbortRequest(ctx, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			server.AbortRequest(ctx, http.StatusInternalServerError, err)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, suggestions)
+	})
+}
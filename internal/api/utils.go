@@ -1,6 +1,8 @@
 package api
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -9,6 +11,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/tierklinik-dobersberg/dxray/internal/app"
+	"github.com/tierklinik-dobersberg/dxray/internal/dicomweb"
 	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
 	"github.com/tierklinik-dobersberg/dxray/internal/search"
 	"github.com/tierklinik-dobersberg/service/server"
@@ -64,6 +67,28 @@ func getStudyByUID(ctx *gin.Context, uid string) (fsdb.Study, error) {
 	return std, nil
 }
 
+// writeDICOMJSON writes v as application/dicom+json. HTML
+// escaping is disabled as some viewers fail to parse escaped
+// URLs.
+func writeDICOMJSON(ctx *gin.Context, v interface{}) {
+	writeDICOMJSONStatus(ctx, http.StatusOK, v)
+}
+
+// writeDICOMJSONStatus is like writeDICOMJSON but uses status as
+// the response status code.
+func writeDICOMJSONStatus(ctx *gin.Context, status int, v interface{}) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(v); err != nil {
+		server.AbortRequest(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx.Data(status, dicomweb.ContentTypeDICOMJSON, buf.Bytes())
+}
+
 // getNumberParam returns the value of the query parameter name
 // parsed as a number.
 func getNumberParam(ctx *gin.Context, name string) (int, bool, error) {
@@ -1,13 +1,24 @@
 package api
 
 import (
+	"errors"
 	"net/http"
+	"os"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/tierklinik-dobersberg/dxray/internal/accesslog"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
+	"github.com/tierklinik-dobersberg/dxray/internal/render"
 	"github.com/tierklinik-dobersberg/service/server"
 )
 
+// WadoEndpoint implements WADO-URI. Images requested as image/jpeg
+// or image/png are rendered from the pixel data and support the
+// rows, columns, windowCenter, windowWidth, frameNumber and
+// imageQuality parameters. Without any of them image/jpeg returns
+// the thumbnail created by DX-R.
+//
 // http://dicom.nema.org/medical/dicom/current/output/chtml/part18/chapter_9.html
 func WadoEndpoint(grp gin.IRouter) {
 	grp.GET("wado", func(ctx *gin.Context) {
@@ -17,7 +28,7 @@ func WadoEndpoint(grp gin.IRouter) {
 		objectUID := ctx.Query("objectUID")
 		contentType := ctx.Query("contentType")
 
-		if contentType != "" && (contentType != "application/dicom" && contentType != "image/jpeg") {
+		if contentType != "" && (contentType != "application/dicom" && contentType != render.ContentTypeJPEG && contentType != render.ContentTypePNG) {
 			ctx.AbortWithStatus(http.StatusNotAcceptable)
 			return
 		}
@@ -47,14 +58,17 @@ func WadoEndpoint(grp gin.IRouter) {
 			if series.UID == seriesUID {
 				for _, instance := range series.Instances {
 					if instance.UID == objectUID {
-						// check if we should return application/dicom or the thumbnail image
-						var path string
-						if contentType == "image/jpeg" {
-							path = strings.Replace(instance.Data.DICOMPath, "I_", "S128_", 1)
-							path = strings.Replace(path, ".dcm", ".jpg", 1)
-							path = std.RealPath(path)
-						} else {
-							path = std.RealPath(instance.Data.DICOMPath)
+						accesslog.RecordStudy(ctx, model.Patient.ID, studyUID, objectUID)
+
+						if contentType == render.ContentTypeJPEG || contentType == render.ContentTypePNG {
+							renderWado(ctx, std, instance.Data.DICOMPath, contentType)
+							return
+						}
+
+						path, err := std.RealPath(instance.Data.DICOMPath)
+						if err != nil {
+							server.AbortRequest(ctx, http.StatusInternalServerError, err)
+							return
 						}
 
 						ctx.File(path)
@@ -67,3 +81,89 @@ func WadoEndpoint(grp gin.IRouter) {
 		ctx.AbortWithStatus(http.StatusNotFound)
 	})
 }
+
+// renderWado renders the DICOM file at path, relative to std, using
+// the WADO-URI presentation parameters. JPEG requests without any
+// presentation parameters are served the thumbnail created by DX-R,
+// as is any JPEG request if dxray cannot decode the pixel data.
+func renderWado(ctx *gin.Context, std fsdb.Study, path, contentType string) {
+	var (
+		opts render.Options
+		err  error
+	)
+
+	realPath, err := std.RealPath(path)
+	if err != nil {
+		server.AbortRequest(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the thumbnail is stored next to the DICOM file so its path
+	// is valid as well.
+	thumbnail := strings.Replace(path, "I_", "S128_", 1)
+	thumbnail, _ = std.RealPath(strings.Replace(thumbnail, ".dcm", ".jpg", 1))
+
+	if contentType == render.ContentTypeJPEG && !hasPresentationParams(ctx) {
+		if _, err := os.Stat(thumbnail); err == nil {
+			ctx.File(thumbnail)
+			return
+		}
+	}
+
+	if opts.Height, err = parseSize(ctx.Query("rows")); err != nil {
+		server.AbortRequest(ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	if opts.Width, err = parseSize(ctx.Query("columns")); err != nil {
+		server.AbortRequest(ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	if center, width := ctx.Query("windowCenter"), ctx.Query("windowWidth"); center != "" || width != "" {
+		if opts.Window, err = parseWindow(center, width); err != nil {
+			server.AbortRequest(ctx, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	quality, err := parseOptionalInt(ctx.Query("imageQuality"))
+	if err != nil {
+		server.AbortRequest(ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	frame := 0
+	if n, err := parseOptionalInt(ctx.Query("frameNumber")); err != nil {
+		server.AbortRequest(ctx, http.StatusBadRequest, err)
+		return
+	} else if n > 0 {
+		frame = n - 1
+	}
+
+	err = writeRendered(ctx, std, realPath, frame, opts, contentType, quality)
+	if err == nil {
+		return
+	}
+
+	if errors.Is(err, render.ErrUnsupported) && contentType == render.ContentTypeJPEG {
+		if _, statErr := os.Stat(thumbnail); statErr == nil {
+			ctx.File(thumbnail)
+			return
+		}
+	}
+
+	abortRenderError(ctx, err)
+}
+
+// hasPresentationParams returns true if the WADO-URI request
+// contains any parameter that requires the image to be rendered.
+func hasPresentationParams(ctx *gin.Context) bool {
+	for _, param := range []string{"rows", "columns", "windowCenter", "windowWidth", "frameNumber", "imageQuality"} {
+		if ctx.Query(param) != "" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tierklinik-dobersberg/dxray/internal/accesslog"
+	"github.com/tierklinik-dobersberg/dxray/internal/dicomweb"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/models"
+	"github.com/tierklinik-dobersberg/logger"
+	"github.com/tierklinik-dobersberg/service/server"
+)
+
+// WadoRSEndpoint implements the WADO-RS retrieve transactions for
+// studies, series and instances. Instances are returned as
+// multipart/related response with application/dicom parts.
+//
+// http://dicom.nema.org/medical/dicom/current/output/chtml/part18/sect_10.4.html
+//
+// GET /api/dxray/v1/studies/:study
+// GET /api/dxray/v1/studies/:study/series/:series
+// GET /api/dxray/v1/studies/:study/series/:series/instances/:instance
+func WadoRSEndpoint(grp gin.IRouter) {
+	grp.GET("studies/:study", func(ctx *gin.Context) {
+		retrieveInstances(ctx, "", "")
+	})
+
+	grp.GET("studies/:study/series/:series", func(ctx *gin.Context) {
+		retrieveInstances(ctx, ctx.Param("series"), "")
+	})
+
+	grp.GET("studies/:study/series/:series/instances/:instance", func(ctx *gin.Context) {
+		retrieveInstances(ctx, ctx.Param("series"), ctx.Param("instance"))
+	})
+}
+
+// retrieveInstances streams all instances of the requested study
+// that match seriesUID and instanceUID. Empty UIDs match everything.
+func retrieveInstances(ctx *gin.Context, seriesUID, instanceUID string) {
+	log := logger.From(ctx.Request.Context())
+
+	if !acceptsMultipart(ctx, dicomweb.ContentTypeDICOM) {
+		ctx.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+
+	studyUID := ctx.Param("study")
+
+	std, err := getStudyByUID(ctx, studyUID)
+	if err != nil {
+		return
+	}
+
+	if err := std.Load(); err != nil {
+		server.AbortRequest(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	model, _ := std.Model()
+	instances := selectInstances(model, seriesUID, instanceUID)
+	if len(instances) == 0 {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	uids := make([]string, 0, len(instances))
+	for _, ref := range instances {
+		uids = append(uids, ref.Instance.UID)
+	}
+	accesslog.RecordStudy(ctx, model.Patient.ID, studyUID, uids...)
+
+	mw := dicomweb.NewMultipartWriter(ctx.Writer, dicomweb.ContentTypeDICOM)
+	ctx.Header("Content-Type", mw.ContentType())
+	ctx.Status(http.StatusOK)
+
+	for _, ref := range instances {
+		path, err := std.RealPath(ref.Instance.Data.DICOMPath)
+		if err == nil {
+			err = writeFilePart(mw, path, instanceURL(ctx, studyUID, ref.Series.UID, ref.Instance.UID))
+		}
+		if err != nil {
+			log.WithFields(logger.Fields{
+				"error": err.Error(),
+				"path":  path,
+			}).Errorf("failed to write instance")
+
+			// the client has likely gone away
+			if ctx.Request.Context().Err() != nil {
+				return
+			}
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		log.Errorf("failed to finish multipart response: %s", err)
+	}
+}
+
+// instanceRef references an instance and the series it
+// belongs to.
+type instanceRef struct {
+	Series   models.Series
+	Instance models.Instance
+}
+
+// selectInstances returns all instances of model that match
+// seriesUID and instanceUID. Empty UIDs match everything.
+func selectInstances(model models.ImageList, seriesUID, instanceUID string) []instanceRef {
+	var result []instanceRef
+
+	for _, series := range model.Patient.Visit.Study.Series {
+		if seriesUID != "" && series.UID != seriesUID {
+			continue
+		}
+
+		for _, instance := range series.Instances {
+			if instanceUID != "" && instance.UID != instanceUID {
+				continue
+			}
+
+			result = append(result, instanceRef{
+				Series:   series,
+				Instance: instance,
+			})
+		}
+	}
+
+	return result
+}
+
+func writeFilePart(mw *dicomweb.MultipartWriter, path, location string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return mw.WritePart(f, location)
+}
+
+// acceptsMultipart checks if the Accept header of the request
+// allows a multipart/related response with parts of partType.
+func acceptsMultipart(ctx *gin.Context, partType string) bool {
+	accept := ctx.GetHeader("Accept")
+	if accept == "" {
+		return true
+	}
+
+	for _, value := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+
+		switch mediaType {
+		case "*/*", "multipart/*":
+			return true
+		case "multipart/related":
+			if t := params["type"]; t == "" || t == partType || t == "*/*" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// studyURL returns the WADO-RS URL of the study.
+func studyURL(ctx *gin.Context, study string) string {
+	scheme := "http"
+	if ctx.Request.TLS != nil {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s/api/dxray/v1/studies/%s", scheme, ctx.Request.Host, study)
+}
+
+// seriesURL returns the WADO-RS URL of the series.
+func seriesURL(ctx *gin.Context, study, series string) string {
+	return fmt.Sprintf("%s/series/%s", studyURL(ctx, study), series)
+}
+
+// instanceURL returns the WADO-RS URL of the instance.
+func instanceURL(ctx *gin.Context, study, series, instance string) string {
+	return fmt.Sprintf("%s/instances/%s", seriesURL(ctx, study, series), instance)
+}
@@ -5,8 +5,12 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/tierklinik-dobersberg/dxray/internal/accesslog"
+	"github.com/tierklinik-dobersberg/dxray/internal/cache"
 	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
 	"github.com/tierklinik-dobersberg/dxray/internal/index"
+	"github.com/tierklinik-dobersberg/dxray/internal/schema"
+	"github.com/tierklinik-dobersberg/dxray/internal/storage"
 	"github.com/tierklinik-dobersberg/service/server"
 )
 
@@ -19,13 +23,34 @@ const appContextKey = contextKey("dxray:app")
 type App struct {
 	FsDB    fsdb.DB
 	Indexer *index.StudyIndexer
+
+	// AccessLog may be nil if no access log
+	// is configured.
+	AccessLog *accesslog.Log
+
+	// Cache caches DICOM tags and rendered images.
+	Cache *cache.Cache
+
+	// Storage stores instances uploaded using STOW-RS.
+	Storage *storage.Storage
+
+	// MaxInstanceSize is the maximum size in bytes of
+	// instances uploaded using STOW-RS. Defaults to
+	// dimse.DefaultMaxDataSetLength.
+	MaxInstanceSize int64
+
+	// Export configures study exports.
+	Export schema.ExportConfig
 }
 
 // New returns a new App.
-func New(db fsdb.DB, indexer *index.StudyIndexer) *App {
+func New(db fsdb.DB, indexer *index.StudyIndexer, accessLog *accesslog.Log, c *cache.Cache, store *storage.Storage) *App {
 	return &App{
-		FsDB:    db,
-		Indexer: indexer,
+		FsDB:      db,
+		Indexer:   indexer,
+		AccessLog: accessLog,
+		Cache:     c,
+		Storage:   store,
 	}
 }
 
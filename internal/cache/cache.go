@@ -0,0 +1,166 @@
+// Package cache implements a two-level cache for data derived from
+// files of the DX-R database like parsed DICOM tags and rendered
+// images. Values are kept in an in-memory LRU and, optionally, in
+// a size limited directory on disk.
+package cache
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tierklinik-dobersberg/logger"
+)
+
+type (
+	// Stats holds statistics of a cache.
+	Stats struct {
+		Hits      int64 `json:"hits"`
+		Misses    int64 `json:"misses"`
+		Evictions int64 `json:"evictions"`
+		Entries   int   `json:"entries"`
+		Size      int64 `json:"size"`
+		MaxSize   int64 `json:"maxSize"`
+	}
+
+	// Options configures a Cache.
+	Options struct {
+		// MemorySize is the maximum size in bytes of the
+		// in-memory cache.
+		MemorySize int64
+
+		// Directory is the directory of the disk cache.
+		// The disk cache is disabled if empty.
+		Directory string
+
+		// DiskSize is the maximum size in bytes of the
+		// disk cache.
+		DiskSize int64
+	}
+
+	// Cache is a two-level cache backed by memory and disk.
+	// Entries belong to a group (the study) and are keyed
+	// by the file they have been derived from, see FileKey.
+	Cache struct {
+		memory *Memory
+		disk   *Disk
+	}
+)
+
+// New returns a new cache.
+func New(opts Options) (*Cache, error) {
+	c := &Cache{
+		memory: NewMemory(opts.MemorySize),
+	}
+
+	if opts.Directory != "" && opts.DiskSize > 0 {
+		var err error
+		c.disk, err = NewDisk(opts.Directory, opts.DiskSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// FileKey returns the cache key for data of kind derived from the
+// file at path. The key contains the modification time and size
+// of the file so modified files are never served from the cache.
+// Params should contain everything else the data depends on.
+func FileKey(kind, path string, params ...interface{}) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("%s:%s:%d:%d", kind, path, stat.ModTime().UnixNano(), stat.Size())
+	for _, p := range params {
+		key += ":" + strings.ReplaceAll(fmt.Sprint(p), ":", "\\:")
+	}
+
+	return key, nil
+}
+
+// Get returns the value of key. Values found on disk are
+// added to the in-memory cache.
+func (c *Cache) Get(key, group string) ([]byte, bool) {
+	if value, ok := c.memory.Get(key); ok {
+		return value, true
+	}
+
+	if c.disk == nil {
+		return nil, false
+	}
+
+	value, ok := c.disk.Get(key)
+	if ok {
+		c.memory.Put(key, group, value)
+	}
+
+	return value, ok
+}
+
+// Put stores value for key.
+func (c *Cache) Put(key, group string, value []byte) {
+	c.memory.Put(key, group, value)
+
+	if c.disk != nil {
+		if err := c.disk.Put(key, group, value); err != nil {
+			logger.DefaultLogger().Errorf("failed to write disk cache: %s", err)
+		}
+	}
+}
+
+// GetOrCreate returns the value of key. If it's not cached yet,
+// create is called and the result is stored.
+func (c *Cache) GetOrCreate(key, group string, create func() ([]byte, error)) ([]byte, error) {
+	if value, ok := c.Get(key, group); ok {
+		return value, nil
+	}
+
+	value, err := create()
+	if err != nil {
+		return nil, err
+	}
+
+	c.Put(key, group, value)
+
+	return value, nil
+}
+
+// Invalidate removes all entries of group.
+func (c *Cache) Invalidate(group string) {
+	c.memory.Invalidate(group)
+
+	if c.disk != nil {
+		if err := c.disk.Invalidate(group); err != nil {
+			logger.DefaultLogger().Errorf("failed to invalidate disk cache: %s", err)
+		}
+	}
+}
+
+// Purge removes all entries.
+func (c *Cache) Purge() error {
+	c.memory.Purge()
+
+	if c.disk != nil {
+		return c.disk.Purge()
+	}
+
+	return nil
+}
+
+// Stats returns the statistics of the in-memory and, if
+// enabled, the disk cache.
+func (c *Cache) Stats() map[string]Stats {
+	stats := map[string]Stats{
+		"memory": c.memory.Stats(),
+	}
+
+	if c.disk != nil {
+		stats["disk"] = c.disk.Stats()
+	}
+
+	return stats
+}
@@ -0,0 +1,284 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Disk is a LRU cache that stores values as files below a
+// directory. Entries of the same group are stored in a common
+// sub-directory so they can be removed at once. The cache
+// survives restarts.
+type Disk struct {
+	dir     string
+	maxSize int64
+
+	l       sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   Stats
+}
+
+type diskEntry struct {
+	path string
+	size int64
+}
+
+// NewDisk returns a new disk cache that stores up to maxSize
+// bytes in dir. Files already stored in dir are added to the
+// cache.
+func NewDisk(dir string, maxSize int64) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	d := &Disk{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Get returns the value stored for key.
+func (d *Disk) Get(key string) ([]byte, bool) {
+	id := hash(key)
+
+	d.l.Lock()
+	elem, ok := d.entries[id]
+	if ok {
+		d.lru.MoveToFront(elem)
+	}
+	d.l.Unlock()
+
+	if !ok {
+		d.count(&d.stats.Misses)
+		return nil, false
+	}
+
+	value, err := ioutil.ReadFile(elem.Value.(*diskEntry).path)
+	if err != nil {
+		d.l.Lock()
+		if current, ok := d.entries[id]; ok && current == elem {
+			d.remove(elem)
+		}
+		d.stats.Misses++
+		d.l.Unlock()
+		return nil, false
+	}
+
+	// keep track of the last access across restarts.
+	now := time.Now()
+	_ = os.Chtimes(elem.Value.(*diskEntry).path, now, now)
+
+	d.count(&d.stats.Hits)
+	return value, true
+}
+
+// Put stores value for key in the directory of group.
+func (d *Disk) Put(key, group string, value []byte) error {
+	if int64(len(value)) > d.maxSize {
+		return nil
+	}
+
+	path := d.path(key, group)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	d.l.Lock()
+	defer d.l.Unlock()
+
+	id := hash(key)
+	if elem, ok := d.entries[id]; ok {
+		d.remove(elem)
+	}
+	d.entries[id] = d.lru.PushFront(&diskEntry{
+		path: path,
+		size: int64(len(value)),
+	})
+	d.size += int64(len(value))
+
+	for d.size > d.maxSize {
+		elem := d.lru.Back()
+		os.Remove(elem.Value.(*diskEntry).path)
+		d.remove(elem)
+		d.stats.Evictions++
+	}
+
+	return nil
+}
+
+// Invalidate removes all entries of group.
+func (d *Disk) Invalidate(group string) error {
+	dir := filepath.Join(d.dir, hash(group))
+
+	d.l.Lock()
+	defer d.l.Unlock()
+
+	for _, elem := range d.entries {
+		if filepath.Dir(elem.Value.(*diskEntry).path) == dir {
+			d.remove(elem)
+		}
+	}
+
+	return os.RemoveAll(dir)
+}
+
+// Purge removes all entries.
+func (d *Disk) Purge() error {
+	d.l.Lock()
+	defer d.l.Unlock()
+
+	d.entries = make(map[string]*list.Element)
+	d.lru.Init()
+	d.size = 0
+
+	dirs, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if err := os.RemoveAll(filepath.Join(d.dir, dir.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stats returns statistics about the cache.
+func (d *Disk) Stats() Stats {
+	d.l.Lock()
+	defer d.l.Unlock()
+
+	stats := d.stats
+	stats.Entries = len(d.entries)
+	stats.Size = d.size
+	stats.MaxSize = d.maxSize
+
+	return stats
+}
+
+// load adds all files stored in the cache directory ordered by
+// their last access.
+func (d *Disk) load() error {
+	type file struct {
+		id, path string
+		size     int64
+		modTime  time.Time
+	}
+
+	var files []file
+
+	err := filepath.Walk(d.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		// remove left-overs of interrupted writes.
+		if strings.HasPrefix(info.Name(), ".tmp-") {
+			return os.Remove(path)
+		}
+
+		files = append(files, file{
+			id:      info.Name(),
+			path:    path,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	for _, f := range files {
+		d.entries[f.id] = d.lru.PushFront(&diskEntry{
+			path: f.path,
+			size: f.size,
+		})
+		d.size += f.size
+	}
+
+	for d.size > d.maxSize {
+		elem := d.lru.Back()
+		os.Remove(elem.Value.(*diskEntry).path)
+		d.remove(elem)
+	}
+
+	return nil
+}
+
+// path returns the path of the file for key. Entries are
+// identified by the file name only so Get does not need to
+// know the group.
+func (d *Disk) path(key, group string) string {
+	return filepath.Join(d.dir, hash(group), hash(key))
+}
+
+// remove removes elem. The caller must hold d.l.
+func (d *Disk) remove(elem *list.Element) {
+	entry := elem.Value.(*diskEntry)
+
+	d.lru.Remove(elem)
+	delete(d.entries, filepath.Base(entry.path))
+	d.size -= entry.size
+}
+
+func (d *Disk) count(counter *int64) {
+	d.l.Lock()
+	defer d.l.Unlock()
+
+	*counter++
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
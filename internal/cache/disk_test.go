@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dxray-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := NewDisk(dir, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, o := range []op{
+		{key: "a", group: "1", size: 4},
+		{key: "b", group: "1", size: 4},
+	} {
+		if err := d.Put(o.key, o.group, value(o)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// make sure the access time of a is newer than the one of b
+	// even on file systems with a coarse time resolution.
+	time.Sleep(10 * time.Millisecond)
+	if v, ok := d.Get("a"); !ok || !bytes.Equal(v, value(op{key: "a", size: 4})) {
+		t.Fatalf("got %q, %v for a", v, ok)
+	}
+
+	if err := d.Put("c", "2", value(op{key: "c", size: 4})); err != nil {
+		t.Fatal(err)
+	}
+
+	wantEntries(t, d, map[string]bool{"a": true, "b": false, "c": true})
+
+	// a new cache for the same directory loads the entries in
+	// the order of their last access.
+	time.Sleep(10 * time.Millisecond)
+	d.Get("a")
+
+	d, err = NewDisk(dir, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := d.Stats(); stats.Size != 8 || stats.Entries != 2 {
+		t.Errorf("got size %d with %d entries after reload", stats.Size, stats.Entries)
+	}
+
+	if err := d.Put("d", "2", value(op{key: "d", size: 4})); err != nil {
+		t.Fatal(err)
+	}
+	wantEntries(t, d, map[string]bool{"a": true, "c": false, "d": true})
+
+	// oversize values are not stored.
+	if err := d.Put("e", "2", value(op{key: "e", size: 9})); err != nil {
+		t.Fatal(err)
+	}
+	wantEntries(t, d, map[string]bool{"e": false})
+}
+
+func TestDiskInvalidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dxray-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := NewDisk(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.Put("a1", "a", []byte("1"))
+	d.Put("a2", "a", []byte("2"))
+	d.Put("b1", "b", []byte("3"))
+
+	if err := d.Invalidate("a"); err != nil {
+		t.Fatal(err)
+	}
+	wantEntries(t, d, map[string]bool{"a1": false, "a2": false, "b1": true})
+
+	if stats := d.Stats(); stats.Size != 1 || stats.Entries != 1 {
+		t.Errorf("got size %d with %d entries", stats.Size, stats.Entries)
+	}
+
+	if err := d.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	wantEntries(t, d, map[string]bool{"b1": false})
+}
+
+// wantEntries checks whether the keys of want are stored in d.
+func wantEntries(t *testing.T, d *Disk, want map[string]bool) {
+	t.Helper()
+
+	for key, stored := range want {
+		if _, ok := d.Get(key); ok != stored {
+			t.Errorf("%s: got stored %v, want %v", key, ok, stored)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Memory is an in-memory LRU cache limited by the total size
+// of all stored values.
+type Memory struct {
+	maxSize int64
+
+	l       sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	groups  map[string]map[string]struct{}
+	lru     *list.List
+	stats   Stats
+}
+
+type memoryEntry struct {
+	key   string
+	group string
+	value []byte
+}
+
+// NewMemory returns a new in-memory cache that holds up to
+// maxSize bytes.
+func NewMemory(maxSize int64) *Memory {
+	return &Memory{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		groups:  make(map[string]map[string]struct{}),
+		lru:     list.New(),
+	}
+}
+
+// Get returns the value stored for key.
+func (m *Memory) Get(key string) ([]byte, bool) {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	elem, ok := m.entries[key]
+	if !ok {
+		m.stats.Misses++
+		return nil, false
+	}
+
+	m.stats.Hits++
+	m.lru.MoveToFront(elem)
+
+	return elem.Value.(*memoryEntry).value, true
+}
+
+// Put stores value for key. Group is used to invalidate
+// related entries at once. Values that exceed the size of
+// the cache are not stored.
+func (m *Memory) Put(key, group string, value []byte) {
+	if int64(len(value)) > m.maxSize {
+		return
+	}
+
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	if elem, ok := m.entries[key]; ok {
+		m.remove(elem)
+	}
+
+	m.entries[key] = m.lru.PushFront(&memoryEntry{
+		key:   key,
+		group: group,
+		value: value,
+	})
+	m.size += int64(len(value))
+
+	if m.groups[group] == nil {
+		m.groups[group] = make(map[string]struct{})
+	}
+	m.groups[group][key] = struct{}{}
+
+	for m.size > m.maxSize {
+		m.remove(m.lru.Back())
+		m.stats.Evictions++
+	}
+}
+
+// Invalidate removes all entries of group.
+func (m *Memory) Invalidate(group string) {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	for key := range m.groups[group] {
+		if elem, ok := m.entries[key]; ok {
+			m.remove(elem)
+		}
+	}
+}
+
+// Purge removes all entries.
+func (m *Memory) Purge() {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	m.entries = make(map[string]*list.Element)
+	m.groups = make(map[string]map[string]struct{})
+	m.lru.Init()
+	m.size = 0
+}
+
+// Stats returns statistics about the cache.
+func (m *Memory) Stats() Stats {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	stats := m.stats
+	stats.Entries = len(m.entries)
+	stats.Size = m.size
+	stats.MaxSize = m.maxSize
+
+	return stats
+}
+
+// remove removes elem. The caller must hold m.l.
+func (m *Memory) remove(elem *list.Element) {
+	entry := elem.Value.(*memoryEntry)
+
+	m.lru.Remove(elem)
+	delete(m.entries, entry.key)
+	m.size -= int64(len(entry.value))
+
+	if keys := m.groups[entry.group]; keys != nil {
+		delete(keys, entry.key)
+		if len(keys) == 0 {
+			delete(m.groups, entry.group)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// op is a single operation on a cache in table tests. Values are
+// filled with size bytes of the first letter of key.
+type op struct {
+	get   bool
+	key   string
+	group string
+	size  int
+}
+
+func TestMemoryEviction(t *testing.T) {
+	cases := []struct {
+		name string
+		ops  []op
+		want []string
+	}{
+		{"fits", []op{
+			{key: "a", size: 4},
+			{key: "b", size: 4},
+		}, []string{"a", "b"}},
+		{"least recently put is evicted", []op{
+			{key: "a", size: 4},
+			{key: "b", size: 4},
+			{key: "c", size: 4},
+		}, []string{"b", "c"}},
+		{"get marks as recently used", []op{
+			{key: "a", size: 4},
+			{key: "b", size: 4},
+			{get: true, key: "a"},
+			{key: "c", size: 4},
+		}, []string{"a", "c"}},
+		{"large value evicts several", []op{
+			{key: "a", size: 2},
+			{key: "b", size: 2},
+			{key: "c", size: 2},
+			{key: "d", size: 7},
+		}, []string{"d"}},
+		{"oversize value is not stored", []op{
+			{key: "a", size: 4},
+			{key: "b", size: 9},
+		}, []string{"a"}},
+		{"replacing a value updates the size", []op{
+			{key: "a", size: 4},
+			{key: "b", size: 4},
+			{key: "a", size: 1},
+			{key: "c", size: 3},
+		}, []string{"a", "b", "c"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := NewMemory(8)
+
+			var size int64
+			for _, o := range c.ops {
+				if o.get {
+					m.Get(o.key)
+					continue
+				}
+				m.Put(o.key, o.group, value(o))
+			}
+
+			var got []string
+			for key, elem := range m.entries {
+				got = append(got, key)
+				size += int64(len(elem.Value.(*memoryEntry).value))
+			}
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got entries %v, want %v", got, c.want)
+			}
+			if stats := m.Stats(); stats.Size != size || stats.Entries != len(c.want) {
+				t.Errorf("got size %d with %d entries, want %d with %d", stats.Size, stats.Entries, size, len(c.want))
+			}
+		})
+	}
+}
+
+func TestMemoryInvalidate(t *testing.T) {
+	m := NewMemory(100)
+	m.Put("a1", "a", []byte("1"))
+	m.Put("a2", "a", []byte("2"))
+	m.Put("b1", "b", []byte("3"))
+
+	m.Invalidate("a")
+
+	for key, want := range map[string]bool{"a1": false, "a2": false, "b1": true} {
+		if _, ok := m.Get(key); ok != want {
+			t.Errorf("%s: got %v, want %v", key, ok, want)
+		}
+	}
+
+	stats := m.Stats()
+	if stats.Size != 1 || stats.Entries != 1 {
+		t.Errorf("got size %d with %d entries", stats.Size, stats.Entries)
+	}
+	if stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("got %d hits and %d misses", stats.Hits, stats.Misses)
+	}
+	if len(m.groups) != 1 {
+		t.Errorf("got %d groups", len(m.groups))
+	}
+}
+
+// value returns the value stored by o.
+func value(o op) []byte {
+	return bytes.Repeat([]byte(o.key[:1]), o.size)
+}
@@ -0,0 +1,179 @@
+package dicomweb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// ReadMetadata reads the DICOM file at path and returns all
+// attributes except the file meta information and pixel data
+// in the DICOM JSON model. If the file contains an image, the
+// pixel data attribute is added without value and should be
+// completed with a BulkDataURI by the caller.
+func ReadMetadata(path string) (Object, error) {
+	ds, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{DropPixelData: true})
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := FromElements(ds.Elements)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := obj.Get(dicomtag.Rows); ok {
+		obj.SetVR(dicomtag.PixelData, "OW")
+	}
+
+	return obj, nil
+}
+
+// FromElements converts elems into a DICOM JSON object. File meta
+// information and group length elements are skipped.
+func FromElements(elems []*dicom.Element) (Object, error) {
+	obj := make(Object, len(elems))
+
+	for _, el := range elems {
+		if el.Tag.Group == 0x0002 || el.Tag.Element == 0x0000 {
+			continue
+		}
+
+		if el.Tag == dicomtag.PixelData {
+			continue
+		}
+
+		vr := el.VR
+		if vr == "" {
+			vr = "UN"
+			if info, err := dicomtag.Find(el.Tag); err == nil {
+				vr = info.VR
+			}
+		}
+
+		attr, err := convertElement(el, vr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dicomtag.DebugString(el.Tag), err)
+		}
+		obj[TagKey(el.Tag)] = attr
+	}
+
+	return obj, nil
+}
+
+func convertElement(el *dicom.Element, vr string) (Attribute, error) {
+	attr := Attribute{VR: vr}
+
+	switch vr {
+	case "SQ":
+		for _, v := range el.Value {
+			item, ok := v.(*dicom.Element)
+			if !ok {
+				continue
+			}
+
+			var children []*dicom.Element
+			for _, child := range item.Value {
+				if c, ok := child.(*dicom.Element); ok {
+					children = append(children, c)
+				}
+			}
+
+			child, err := FromElements(children)
+			if err != nil {
+				return attr, err
+			}
+			attr.Value = append(attr.Value, child)
+		}
+
+	case "PN":
+		for _, v := range el.Value {
+			if s, ok := v.(string); ok && s != "" {
+				attr.Value = append(attr.Value, PersonName{Alphabetic: s})
+			}
+		}
+
+	case "IS":
+		for _, v := range el.Value {
+			s, _ := v.(string)
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				attr.Value = append(attr.Value, i)
+			}
+		}
+
+	case "DS":
+		for _, v := range el.Value {
+			s, _ := v.(string)
+			if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+				attr.Value = append(attr.Value, f)
+			}
+		}
+
+	case "AT":
+		for _, v := range el.Value {
+			if tag, ok := v.(dicomtag.Tag); ok {
+				attr.Value = append(attr.Value, TagKey(tag))
+			}
+		}
+
+	case "OB", "OW", "OF", "OD", "OL", "UN":
+		data, err := binaryValue(el.Value)
+		if err != nil {
+			return attr, err
+		}
+		if len(data) > 0 {
+			attr.InlineBinary = base64.StdEncoding.EncodeToString(data)
+		}
+
+	case "FL", "FD":
+		for _, v := range el.Value {
+			switch f := v.(type) {
+			case float32:
+				if !math.IsNaN(float64(f)) && !math.IsInf(float64(f), 0) {
+					attr.Value = append(attr.Value, f)
+				}
+			case float64:
+				if !math.IsNaN(f) && !math.IsInf(f, 0) {
+					attr.Value = append(attr.Value, f)
+				}
+			}
+		}
+
+	default:
+		for _, v := range el.Value {
+			if s, ok := v.(string); ok && s == "" {
+				continue
+			}
+			attr.Value = append(attr.Value, v)
+		}
+	}
+
+	return attr, nil
+}
+
+// binaryValue returns the little-endian byte representation of
+// the values of a binary element.
+func binaryValue(values []interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	for _, v := range values {
+		switch val := v.(type) {
+		case []byte:
+			buf.Write(val)
+		case string:
+			buf.WriteString(val)
+		case float32, float64, uint16, uint32, int16, int32:
+			if err := binary.Write(buf, binary.LittleEndian, val); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,123 @@
+// Package dicomweb implements the DICOM JSON model and helpers for the
+// DICOMweb services (QIDO-RS, WADO-RS) exposed by dxray.
+//
+// http://dicom.nema.org/medical/dicom/current/output/chtml/part18/chapter_F.html
+package dicomweb
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// ContentTypeDICOMJSON is the media type of the DICOM JSON model.
+const ContentTypeDICOMJSON = "application/dicom+json"
+
+// RetrieveURL is the tag of the Retrieve URL attribute which is
+// missing in the data dictionary of go-dicom.
+var RetrieveURL = dicomtag.Tag{Group: 0x0008, Element: 0x1190}
+
+type (
+	// Attribute is a single attribute of the DICOM JSON model.
+	Attribute struct {
+		VR           string        `json:"vr"`
+		Value        []interface{} `json:"Value,omitempty"`
+		BulkDataURI  string        `json:"BulkDataURI,omitempty"`
+		InlineBinary string        `json:"InlineBinary,omitempty"`
+	}
+
+	// Object is a DICOM JSON object. Attributes are keyed by
+	// their tag in the form GGGGEEEE.
+	Object map[string]Attribute
+
+	// PersonName is the JSON representation of a value with
+	// the PN value representation.
+	PersonName struct {
+		Alphabetic string `json:"Alphabetic,omitempty"`
+	}
+)
+
+// TagKey returns the key of tag used in DICOM JSON objects.
+func TagKey(tag dicomtag.Tag) string {
+	return fmt.Sprintf("%04X%04X", tag.Group, tag.Element)
+}
+
+// ParseTagKey parses a tag in the form GGGGEEEE.
+func ParseTagKey(key string) (dicomtag.Tag, error) {
+	if len(key) != 8 {
+		return dicomtag.Tag{}, fmt.Errorf("invalid tag %q", key)
+	}
+
+	group, err := strconv.ParseUint(key[:4], 16, 16)
+	if err != nil {
+		return dicomtag.Tag{}, fmt.Errorf("invalid tag %q", key)
+	}
+
+	element, err := strconv.ParseUint(key[4:], 16, 16)
+	if err != nil {
+		return dicomtag.Tag{}, fmt.Errorf("invalid tag %q", key)
+	}
+
+	return dicomtag.Tag{Group: uint16(group), Element: uint16(element)}, nil
+}
+
+// Set sets the attribute tag to values. The value representation
+// is looked up from the DICOM data dictionary. Empty string values
+// are dropped so an attribute without any value is encoded as
+// zero-length attribute.
+func (o Object) Set(tag dicomtag.Tag, values ...interface{}) {
+	vr := "UN"
+	if info, err := dicomtag.Find(tag); err == nil {
+		vr = info.VR
+	}
+
+	o.SetVR(tag, vr, values...)
+}
+
+// SetVR is like Set but uses vr as the value representation.
+func (o Object) SetVR(tag dicomtag.Tag, vr string, values ...interface{}) {
+	attr := Attribute{
+		VR: vr,
+	}
+
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			if s == "" {
+				continue
+			}
+
+			if vr == "PN" {
+				v = PersonName{Alphabetic: s}
+			}
+		}
+
+		attr.Value = append(attr.Value, v)
+	}
+
+	o[TagKey(tag)] = attr
+}
+
+// Get returns the attribute tag.
+func (o Object) Get(tag dicomtag.Tag) (Attribute, bool) {
+	attr, ok := o[TagKey(tag)]
+	return attr, ok
+}
+
+// Strings returns the string representation of all values
+// of attr.
+func (attr Attribute) Strings() []string {
+	result := make([]string, 0, len(attr.Value))
+	for _, v := range attr.Value {
+		switch val := v.(type) {
+		case string:
+			result = append(result, val)
+		case PersonName:
+			result = append(result, val.Alphabetic)
+		default:
+			result = append(result, fmt.Sprint(val))
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,87 @@
+package dicomweb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+)
+
+// ContentTypeDICOM is the media type of DICOM part 10 files.
+const ContentTypeDICOM = "application/dicom"
+
+// ErrUnsupportedMediaType is returned by NewMultipartReader if the
+// request body is not a multipart/related body of the expected
+// part type.
+var ErrUnsupportedMediaType = errors.New("unsupported media type")
+
+// MultipartWriter writes multipart/related responses as used
+// by WADO-RS.
+type MultipartWriter struct {
+	w        *multipart.Writer
+	partType string
+}
+
+// NewMultipartWriter returns a new multipart writer that writes
+// parts of type partType to w.
+func NewMultipartWriter(w io.Writer, partType string) *MultipartWriter {
+	return &MultipartWriter{
+		w:        multipart.NewWriter(w),
+		partType: partType,
+	}
+}
+
+// ContentType returns the value of the Content-Type header for
+// the multipart response.
+func (mw *MultipartWriter) ContentType() string {
+	return fmt.Sprintf("multipart/related; type=%q; boundary=%s", mw.partType, mw.w.Boundary())
+}
+
+// WritePart writes a new part with the content of r. If location is
+// set it's added as the Content-Location of the part.
+func (mw *MultipartWriter) WritePart(r io.Reader, location string) error {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", mw.partType)
+	if location != "" {
+		header.Set("Content-Location", location)
+	}
+
+	part, err := mw.w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(part, r)
+	return err
+}
+
+// Close writes the closing boundary.
+func (mw *MultipartWriter) Close() error {
+	return mw.w.Close()
+}
+
+// NewMultipartReader returns a reader for the multipart/related
+// body r as used by STOW-RS. contentType is the Content-Type of the
+// body and its type parameter must match partType.
+func NewMultipartReader(r io.Reader, contentType, partType string) (*multipart.Reader, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMediaType, err)
+	}
+
+	if mediaType != "multipart/related" {
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedMediaType, mediaType)
+	}
+
+	if t := params["type"]; t != "" && t != partType {
+		return nil, fmt.Errorf("%w: unsupported part type %q", ErrUnsupportedMediaType, t)
+	}
+
+	if params["boundary"] == "" {
+		return nil, fmt.Errorf("%w: missing boundary", ErrUnsupportedMediaType)
+	}
+
+	return multipart.NewReader(r, params["boundary"]), nil
+}
@@ -0,0 +1,161 @@
+package dicomweb
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// ContentTypeOctetStream is the media type used for bulk data
+// and frames with a native (uncompressed) transfer syntax.
+const ContentTypeOctetStream = "application/octet-stream"
+
+// pixelDataMediaTypes maps the transfer syntaxes of encapsulated
+// pixel data to the media type of the frames.
+//
+// http://dicom.nema.org/medical/dicom/current/output/chtml/part18/sect_8.7.3.html
+var pixelDataMediaTypes = map[string]string{
+	"1.2.840.10008.1.2.4.50":  "image/jpeg",      // JPEG Baseline
+	"1.2.840.10008.1.2.4.51":  "image/jpeg",      // JPEG Extended
+	"1.2.840.10008.1.2.4.57":  "image/jpeg",      // JPEG Lossless
+	"1.2.840.10008.1.2.4.70":  "image/jpeg",      // JPEG Lossless SV1
+	"1.2.840.10008.1.2.4.80":  "image/jls",       // JPEG-LS Lossless
+	"1.2.840.10008.1.2.4.81":  "image/jls",       // JPEG-LS Near-Lossless
+	"1.2.840.10008.1.2.4.90":  "image/jp2",       // JPEG 2000 Lossless
+	"1.2.840.10008.1.2.4.91":  "image/jp2",       // JPEG 2000
+	"1.2.840.10008.1.2.4.92":  "image/jpx",       // JPEG 2000 Part 2 Lossless
+	"1.2.840.10008.1.2.4.93":  "image/jpx",       // JPEG 2000 Part 2
+	"1.2.840.10008.1.2.4.100": "video/mpeg",      // MPEG2 Main Profile
+	"1.2.840.10008.1.2.4.101": "video/mpeg",      // MPEG2 High Profile
+	"1.2.840.10008.1.2.4.102": "video/mp4",       // MPEG-4 AVC/H.264
+	"1.2.840.10008.1.2.4.103": "video/mp4",       // MPEG-4 AVC/H.264 BD
+	"1.2.840.10008.1.2.5":     "image/dicom-rle", // RLE Lossless
+}
+
+// MediaType returns the media type of pixel data encoded with the
+// transfer syntax ts. Native pixel data is returned as
+// ContentTypeOctetStream.
+func MediaType(ts string) string {
+	if mediaType, ok := pixelDataMediaTypes[ts]; ok {
+		return mediaType
+	}
+	return ContentTypeOctetStream
+}
+
+// ReadFrames reads the DICOM file at path and returns the pixel
+// data of each frame together with its media type. See Frames and
+// MediaType for details.
+func ReadFrames(path string) ([][]byte, string, error) {
+	ds, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+
+	frames, err := Frames(ds)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var ts string
+	if el, err := ds.FindElementByTag(dicomtag.TransferSyntaxUID); err == nil {
+		ts, _ = el.GetString()
+	}
+
+	return frames, MediaType(strings.TrimRight(ts, " \x00")), nil
+}
+
+// Frames returns the pixel data of each frame in ds. Native pixel
+// data of multi-frame images is split according to the number of
+// frames. Fragments of encapsulated pixel data are joined per frame
+// using the basic offset table. If there's no offset table each
+// fragment is expected to hold a single frame.
+func Frames(ds *dicom.DataSet) ([][]byte, error) {
+	el, err := ds.FindElementByTag(dicomtag.PixelData)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(el.Value) != 1 {
+		return nil, fmt.Errorf("unexpected pixel data value")
+	}
+
+	info, ok := el.Value[0].(dicom.PixelDataInfo)
+	if !ok {
+		return nil, fmt.Errorf("unexpected pixel data value")
+	}
+
+	if el.UndefinedLength {
+		return joinFragments(info), nil
+	}
+
+	frames := numberOfFrames(ds)
+	if frames <= 1 || len(info.Frames) != 1 {
+		return info.Frames, nil
+	}
+
+	data := info.Frames[0]
+	size := len(data) / frames
+	if size == 0 {
+		return info.Frames, nil
+	}
+
+	result := make([][]byte, 0, frames)
+	for i := 0; i < frames; i++ {
+		result = append(result, data[i*size:(i+1)*size])
+	}
+
+	return result, nil
+}
+
+// joinFragments joins the fragments of encapsulated pixel data
+// to frames using the basic offset table.
+func joinFragments(info dicom.PixelDataInfo) [][]byte {
+	if len(info.Offsets) <= 1 || len(info.Offsets) == len(info.Frames) {
+		if len(info.Offsets) == 1 && len(info.Frames) > 1 {
+			// single frame split into multiple fragments
+			return [][]byte{bytes.Join(info.Frames, nil)}
+		}
+		return info.Frames
+	}
+
+	result := make([][]byte, len(info.Offsets))
+
+	// offsets are relative to the first byte of the first
+	// fragment item including the item header.
+	var (
+		pos   uint32
+		frame int
+	)
+	for _, fragment := range info.Frames {
+		for frame+1 < len(info.Offsets) && pos >= info.Offsets[frame+1] {
+			frame++
+		}
+		result[frame] = append(result[frame], fragment...)
+		pos += uint32(len(fragment)) + 8
+	}
+
+	return result
+}
+
+func numberOfFrames(ds *dicom.DataSet) int {
+	el, err := ds.FindElementByTag(dicomtag.NumberOfFrames)
+	if err != nil {
+		return 1
+	}
+
+	s, err := el.GetString()
+	if err != nil {
+		return 1
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 1
+	}
+
+	return n
+}
@@ -0,0 +1,25 @@
+package dicomweb
+
+import "testing"
+
+func TestMediaType(t *testing.T) {
+	cases := map[string]string{
+		"1.2.840.10008.1.2":       ContentTypeOctetStream,
+		"1.2.840.10008.1.2.1":     ContentTypeOctetStream,
+		"1.2.840.10008.1.2.2":     ContentTypeOctetStream,
+		"1.2.840.10008.1.2.4.50":  "image/jpeg",
+		"1.2.840.10008.1.2.4.70":  "image/jpeg",
+		"1.2.840.10008.1.2.4.80":  "image/jls",
+		"1.2.840.10008.1.2.4.90":  "image/jp2",
+		"1.2.840.10008.1.2.4.91":  "image/jp2",
+		"1.2.840.10008.1.2.4.102": "video/mp4",
+		"1.2.840.10008.1.2.5":     "image/dicom-rle",
+		"":                        ContentTypeOctetStream,
+	}
+
+	for ts, want := range cases {
+		if got := MediaType(ts); got != want {
+			t.Errorf("MediaType(%q) = %q, want %q", ts, got, want)
+		}
+	}
+}
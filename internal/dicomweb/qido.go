@@ -0,0 +1,454 @@
+package dicomweb
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/models"
+	"github.com/tierklinik-dobersberg/dxray/internal/search"
+)
+
+// Query describes the matching keys and options of a QIDO-RS
+// request.
+//
+// http://dicom.nema.org/medical/dicom/current/output/chtml/part18/sect_8.3.4.html
+type Query struct {
+	// Match holds the value of each matching key.
+	Match map[dicomtag.Tag]string
+
+	// Include holds additional attributes that should be
+	// returned.
+	Include map[dicomtag.Tag]bool
+
+	// IncludeAll is set if includefield=all has been
+	// requested.
+	IncludeAll bool
+
+	// Limit is the maximum number of results to return.
+	Limit int
+
+	// Offset is the number of results to skip.
+	Offset int
+}
+
+// Default and maximum values for Query.Limit.
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// optionalTags are only returned if explicitly requested
+// using includefield.
+var optionalTags = map[dicomtag.Tag]bool{
+	dicomtag.ResponsiblePerson:       true,
+	dicomtag.PatientBreedDescription: true,
+	dicomtag.ProtocolName:            true,
+}
+
+// studyKeys are the study level matching keys applied by
+// StudyQuery.
+var studyKeys = map[dicomtag.Tag]bool{
+	dicomtag.PatientName:             true,
+	dicomtag.ResponsiblePerson:       true,
+	dicomtag.PatientBreedDescription: true,
+	dicomtag.PatientID:               true,
+	dicomtag.StudyInstanceUID:        true,
+	dicomtag.ModalitiesInStudy:       true,
+	dicomtag.StudyDescription:        true,
+	dicomtag.StudyDate:               true,
+}
+
+// ParseQuery parses the query parameters of a QIDO-RS request.
+// Matching keys may either be specified by keyword or by tag.
+func ParseQuery(values url.Values) (*Query, error) {
+	q := &Query{
+		Match:   make(map[dicomtag.Tag]string),
+		Include: make(map[dicomtag.Tag]bool),
+		Limit:   DefaultLimit,
+	}
+
+	for key, vals := range values {
+		if len(vals) == 0 {
+			continue
+		}
+
+		switch key {
+		case "limit":
+			limit, err := strconv.Atoi(vals[0])
+			if err != nil || limit < 0 {
+				return nil, fmt.Errorf("invalid limit %q", vals[0])
+			}
+			if limit > MaxLimit {
+				limit = MaxLimit
+			}
+			q.Limit = limit
+
+		case "offset":
+			offset, err := strconv.Atoi(vals[0])
+			if err != nil || offset < 0 {
+				return nil, fmt.Errorf("invalid offset %q", vals[0])
+			}
+			q.Offset = offset
+
+		case "includefield":
+			for _, v := range vals {
+				for _, field := range strings.Split(v, ",") {
+					if field == "all" {
+						q.IncludeAll = true
+						continue
+					}
+
+					tag, err := parseAttribute(field)
+					if err != nil {
+						return nil, err
+					}
+					q.Include[tag] = true
+				}
+			}
+
+		case "fuzzymatching":
+			// not supported, matching is always performed
+			// as described by the standard.
+
+		default:
+			tag, err := parseAttribute(key)
+			if err != nil {
+				return nil, err
+			}
+			q.Match[tag] = vals[0]
+		}
+	}
+
+	return q, nil
+}
+
+// Filter removes all optional attributes from obj that have
+// not been requested by includefield.
+func (q *Query) Filter(obj Object) Object {
+	if q.IncludeAll {
+		return obj
+	}
+
+	for tag := range optionalTags {
+		if !q.Include[tag] {
+			delete(obj, TagKey(tag))
+		}
+	}
+
+	return obj
+}
+
+// Matches returns true if obj matches all matching keys of q.
+// Matching keys that are not part of obj are ignored.
+func (q *Query) Matches(obj Object) bool {
+	for tag, value := range q.Match {
+		if value == "" {
+			continue
+		}
+
+		attr, ok := obj.Get(tag)
+		if !ok {
+			continue
+		}
+
+		if !matchAttribute(attr, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Unindexed returns a query with all matching keys of q that are
+// not applied by StudyQuery. Matching keys without a value are
+// omitted.
+func (q *Query) Unindexed() *Query {
+	result := &Query{Match: make(map[dicomtag.Tag]string)}
+
+	for tag, value := range q.Match {
+		if value != "" && !studyKeys[tag] {
+			result.Match[tag] = value
+		}
+	}
+
+	return result
+}
+
+// Unsupported returns the matching keys of q that are not part
+// of obj and are therefore ignored by Matches.
+func (q *Query) Unsupported(obj Object) []dicomtag.Tag {
+	var tags []dicomtag.Tag
+	for tag, value := range q.Match {
+		if _, ok := obj.Get(tag); value != "" && !ok {
+			tags = append(tags, tag)
+		}
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Group != tags[j].Group {
+			return tags[i].Group < tags[j].Group
+		}
+		return tags[i].Element < tags[j].Element
+	})
+
+	return tags
+}
+
+// StudyQuery returns the bleve query that searches the study
+// index for all study level matching keys of q. Other matching
+// keys are ignored, see Unindexed.
+func (q *Query) StudyQuery() query.Query {
+	var queries []query.Query
+
+	for tag, value := range q.Match {
+		if value == "" {
+			continue
+		}
+
+		switch tag {
+		case dicomtag.PatientName:
+			parts := strings.SplitN(value, "^", 2)
+			if parts[0] != "" {
+				queries = append(queries, textQuery("owner", parts[0]))
+			}
+			if len(parts) == 2 && parts[1] != "" {
+				animal := strings.Fields(parts[1])
+				if len(animal) > 0 {
+					queries = append(queries, textQuery("patient", animal[0]))
+				}
+			}
+
+		case dicomtag.ResponsiblePerson:
+			queries = append(queries, textQuery("owner", value))
+
+		case dicomtag.PatientBreedDescription:
+			queries = append(queries, textQuery("race", value))
+
+		case dicomtag.PatientID:
+			queries = append(queries, listQuery("id", value))
+
+		case dicomtag.StudyInstanceUID:
+			queries = append(queries, listQuery("uid", value))
+
+		case dicomtag.ModalitiesInStudy:
+			queries = append(queries, listQuery("modality", value))
+
+		case dicomtag.StudyDescription:
+			queries = append(queries, textQuery("description", value))
+
+		case dicomtag.StudyDate:
+			queries = append(queries, dateQuery(value))
+		}
+	}
+
+	if len(queries) == 0 {
+		return bleve.NewMatchAllQuery()
+	}
+
+	return bleve.NewConjunctionQuery(queries...)
+}
+
+// Study returns the study level attributes of model.
+func Study(model models.ImageList) Object {
+	s := model.Patient.Visit.Study
+
+	var (
+		modalities []interface{}
+		instances  int
+	)
+	for _, series := range s.Series {
+		instances += len(series.Instances)
+
+		found := false
+		for _, m := range modalities {
+			if m == series.Modality {
+				found = true
+				break
+			}
+		}
+		if !found && series.Modality != "" {
+			modalities = append(modalities, series.Modality)
+		}
+	}
+
+	obj := make(Object)
+	obj.Set(dicomtag.SpecificCharacterSet, "ISO_IR 192")
+	obj.Set(dicomtag.StudyDate, s.Date)
+	obj.Set(dicomtag.StudyTime)
+	obj.Set(dicomtag.AccessionNumber)
+	obj.Set(dicomtag.ModalitiesInStudy, modalities...)
+	obj.Set(dicomtag.ReferringPhysicianName)
+	obj.Set(dicomtag.PatientName, model.Patient.Name)
+	obj.Set(dicomtag.PatientID, model.Patient.ID)
+	obj.Set(dicomtag.PatientBirthDate, model.Patient.Birth)
+	obj.Set(dicomtag.PatientSex, model.Patient.Sex)
+	obj.Set(dicomtag.StudyInstanceUID, s.UID)
+	obj.Set(dicomtag.StudyID)
+	obj.Set(dicomtag.StudyDescription, s.Description)
+	obj.Set(dicomtag.NumberOfStudyRelatedSeries, len(s.Series))
+	obj.Set(dicomtag.NumberOfStudyRelatedInstances, instances)
+	obj.Set(dicomtag.ResponsiblePerson, model.Patient.OwnerName())
+	obj.Set(dicomtag.PatientBreedDescription, model.Patient.AnimalRace())
+
+	return obj
+}
+
+// Series returns the series level attributes of series.
+func Series(model models.ImageList, series models.Series) Object {
+	obj := make(Object)
+	obj.Set(dicomtag.SpecificCharacterSet, "ISO_IR 192")
+	obj.Set(dicomtag.Modality, series.Modality)
+	obj.Set(dicomtag.SeriesDescription, series.Description)
+	obj.Set(dicomtag.ProtocolName, series.Protocol)
+	obj.Set(dicomtag.StudyInstanceUID, model.Patient.Visit.Study.UID)
+	obj.Set(dicomtag.SeriesInstanceUID, series.UID)
+	obj.Set(dicomtag.SeriesNumber, series.Number)
+	obj.Set(dicomtag.NumberOfSeriesRelatedInstances, len(series.Instances))
+
+	return obj
+}
+
+// Instance returns the instance level attributes of instance.
+func Instance(model models.ImageList, series models.Series, instance models.Instance) Object {
+	obj := make(Object)
+	obj.Set(dicomtag.SpecificCharacterSet, "ISO_IR 192")
+	obj.Set(dicomtag.SOPInstanceUID, instance.UID)
+	obj.Set(dicomtag.StudyInstanceUID, model.Patient.Visit.Study.UID)
+	obj.Set(dicomtag.SeriesInstanceUID, series.UID)
+	obj.Set(dicomtag.InstanceNumber, instance.Number)
+
+	return obj
+}
+
+func parseAttribute(name string) (dicomtag.Tag, error) {
+	if tag, err := ParseTagKey(name); err == nil {
+		return tag, nil
+	}
+
+	info, err := dicomtag.FindByName(name)
+	if err != nil {
+		return dicomtag.Tag{}, fmt.Errorf("unknown attribute %q", name)
+	}
+
+	return info.Tag, nil
+}
+
+// textQuery returns a query that matches value against the
+// text field. Value may contain the DICOM wildcards * and ?.
+func textQuery(field, value string) query.Query {
+	return search.FieldQuery(field, value)
+}
+
+// listQuery returns a query that matches any of the backslash
+// separated values.
+func listQuery(field, value string) query.Query {
+	values := strings.Split(value, "\\")
+	if len(values) == 1 {
+		return textQuery(field, value)
+	}
+
+	queries := make([]query.Query, 0, len(values))
+	for _, v := range values {
+		queries = append(queries, textQuery(field, v))
+	}
+
+	return bleve.NewDisjunctionQuery(queries...)
+}
+
+// dateQuery returns a query for DICOM date (range) matching. Date
+// ranges are specified as from-to where either bound may be
+// omitted. Invalid dates don't match any study.
+func dateQuery(value string) query.Query {
+	from, to := value, value
+	if strings.Contains(value, "-") {
+		parts := strings.SplitN(value, "-", 2)
+		from, to = parts[0], parts[1]
+	}
+
+	q, err := search.DateQuery(from, to)
+	if err != nil {
+		return bleve.NewMatchNoneQuery()
+	}
+
+	return q
+}
+
+// matchAttribute implements single value, list of UID, wildcard
+// and range matching of value against attr.
+func matchAttribute(attr Attribute, value string) bool {
+	values := attr.Strings()
+
+	var candidates []string
+	if attr.VR == "UI" {
+		candidates = strings.Split(value, "\\")
+	} else {
+		candidates = []string{value}
+	}
+
+	for _, candidate := range candidates {
+		for _, v := range values {
+			switch {
+			case (attr.VR == "DA" || attr.VR == "TM" || attr.VR == "DT") && strings.Contains(candidate, "-"):
+				parts := strings.SplitN(candidate, "-", 2)
+				if (parts[0] == "" || v >= parts[0]) && (parts[1] == "" || v <= parts[1]) {
+					return true
+				}
+
+			case strings.ContainsAny(candidate, "*?"):
+				if wildcardMatch(strings.ToLower(candidate), strings.ToLower(v)) {
+					return true
+				}
+
+			default:
+				if strings.EqualFold(candidate, v) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// wildcardMatch matches s against pattern where * matches any
+// sequence of characters and ? matches a single character.
+func wildcardMatch(pattern, s string) bool {
+	p := []rune(pattern)
+	r := []rune(s)
+
+	var (
+		pi, si    int
+		star      = -1
+		starMatch int
+	)
+
+	for si < len(r) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == r[si]):
+			pi++
+			si++
+		case pi < len(p) && p[pi] == '*':
+			star = pi
+			starMatch = si
+			pi++
+		case star != -1:
+			pi = star + 1
+			starMatch++
+			si = starMatch
+		default:
+			return false
+		}
+	}
+
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+
+	return pi == len(p)
+}
@@ -0,0 +1,235 @@
+package dicomweb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/models"
+	"github.com/tierklinik-dobersberg/dxray/internal/search"
+)
+
+func TestWildcardMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"huber", "huber", true},
+		{"hub*", "huber", true},
+		{"hub*", "hu", false},
+		{"*ber", "huber", true},
+		{"h*r", "huber", true},
+		{"h*r", "hubert", false},
+		{"h?ber", "huber", true},
+		{"h?ber", "hber", false},
+		{"?", "ü", true},
+		{"m*er", "müller", true},
+		{"*a*b*", "xaxxbx", true},
+		{"*a*b*", "xbxxax", false},
+		{"a**b", "ab", true},
+		{"a*b?", "aXbYbZ", true},
+	}
+
+	for _, c := range cases {
+		if got := wildcardMatch(c.pattern, c.s); got != c.want {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", c.pattern, c.s, got, c.want)
+		}
+	}
+}
+
+func TestMatchAttribute(t *testing.T) {
+	obj := make(Object)
+	obj.Set(dicomtag.PatientName, "Huber^Bello")
+	obj.Set(dicomtag.StudyInstanceUID, "1.2.3.4")
+	obj.Set(dicomtag.ModalitiesInStudy, "CR", "DX")
+	obj.Set(dicomtag.StudyDate, "20210311")
+	obj.Set(dicomtag.PatientSex, "M")
+
+	cases := []struct {
+		tag   dicomtag.Tag
+		value string
+		want  bool
+	}{
+		{dicomtag.PatientName, "Huber^Bello", true},
+		{dicomtag.PatientName, "huber^bello", true},
+		{dicomtag.PatientName, "Huber", false},
+		{dicomtag.PatientName, "Hub*", true},
+		{dicomtag.PatientName, "*bello", true},
+		{dicomtag.PatientName, "Mayer*", false},
+		{dicomtag.StudyInstanceUID, "1.2.3.4", true},
+		{dicomtag.StudyInstanceUID, "1.2.3.5\\1.2.3.4", true},
+		{dicomtag.StudyInstanceUID, "1.2.3.5\\1.2.3.6", false},
+		{dicomtag.ModalitiesInStudy, "DX", true},
+		{dicomtag.ModalitiesInStudy, "MR", false},
+		{dicomtag.StudyDate, "20210311", true},
+		{dicomtag.StudyDate, "20210301-20210331", true},
+		{dicomtag.StudyDate, "20210312-", false},
+		{dicomtag.StudyDate, "-20210311", true},
+		{dicomtag.StudyDate, "20200101-20201231", false},
+		{dicomtag.PatientSex, "M", true},
+		{dicomtag.PatientSex, "F", false},
+	}
+
+	for _, c := range cases {
+		attr, _ := obj.Get(c.tag)
+		if got := matchAttribute(attr, c.value); got != c.want {
+			t.Errorf("matchAttribute(%s, %q) = %v, want %v", dicomtag.DebugString(c.tag), c.value, got, c.want)
+		}
+	}
+}
+
+func TestUnindexedAndUnsupported(t *testing.T) {
+	q, err := ParseQuery(url.Values{
+		"PatientName":       {"Huber*"},
+		"PatientSex":        {"F"},
+		"IssuerOfPatientID": {"X"},
+		"StudyDescription":  {""},
+		"limit":             {"10"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unindexed := q.Unindexed()
+	if !reflect.DeepEqual(unindexed.Match, map[dicomtag.Tag]string{
+		dicomtag.PatientSex:        "F",
+		dicomtag.IssuerOfPatientID: "X",
+	}) {
+		t.Errorf("got unindexed keys %v", unindexed.Match)
+	}
+
+	unsupported := unindexed.Unsupported(Study(testModel()))
+	if !reflect.DeepEqual(unsupported, []dicomtag.Tag{dicomtag.IssuerOfPatientID}) {
+		t.Errorf("got unsupported keys %v", unsupported)
+	}
+
+	// unsupported keys are ignored, PatientSex is M.
+	if unindexed.Matches(Study(testModel())) {
+		t.Errorf("study matches PatientSex F")
+	}
+	unindexed.Match[dicomtag.PatientSex] = "M"
+	if !unindexed.Matches(Study(testModel())) {
+		t.Errorf("study does not match PatientSex M")
+	}
+}
+
+func TestStudyQuery(t *testing.T) {
+	root, err := ioutil.TempDir("", "dxray-qido")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeStudy(t, root, "0001_1", "Huber^Bello Labrador", "100", "1.2.3.1", "20210311", "Thorax", "DX")
+	writeStudy(t, root, "0002_1", "Müller^Rex Dackel", "101", "1.2.3.2", "20210401", "Becken", "CR")
+	writeStudy(t, root, "0003_1", "Huber^Luna", "102", "1.2.3.3", "20200101", "Knie links", "DX")
+
+	db, err := fsdb.New(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := search.New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	for _, name := range []string{"0001_1", "0002_1", "0003_1"} {
+		study, err := search.Get("VOL00001/"+name, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := idx.Add(study); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		query url.Values
+		want  []string
+	}{
+		{url.Values{}, []string{"0001_1", "0002_1", "0003_1"}},
+		{url.Values{"PatientName": {"Huber"}}, []string{"0001_1", "0003_1"}},
+		{url.Values{"PatientName": {"Huber^Luna"}}, []string{"0003_1"}},
+		{url.Values{"PatientName": {"Hub*"}}, []string{"0001_1", "0003_1"}},
+		{url.Values{"PatientName": {"Müller"}}, []string{"0002_1"}},
+		{url.Values{"ResponsiblePerson": {"Huber"}}, []string{"0001_1", "0003_1"}},
+		{url.Values{"PatientBreedDescription": {"Dackel"}}, []string{"0002_1"}},
+		{url.Values{"PatientID": {"100\\102"}}, []string{"0001_1", "0003_1"}},
+		{url.Values{"StudyInstanceUID": {"1.2.3.2"}}, []string{"0002_1"}},
+		{url.Values{"ModalitiesInStudy": {"DX"}}, []string{"0001_1", "0003_1"}},
+		{url.Values{"StudyDescription": {"Knie"}}, []string{"0003_1"}},
+		{url.Values{"StudyDate": {"20210311"}}, []string{"0001_1"}},
+		{url.Values{"StudyDate": {"20210101-"}}, []string{"0001_1", "0002_1"}},
+		{url.Values{"StudyDate": {"-20201231"}}, []string{"0003_1"}},
+		{url.Values{"StudyDate": {"invalid"}}, nil},
+		{url.Values{"PatientName": {"Huber"}, "StudyDate": {"2021"}}, nil},
+		{url.Values{"PatientName": {"Huber"}, "ModalitiesInStudy": {"DX"}, "StudyDate": {"20210101-20211231"}}, []string{"0001_1"}},
+		// keys that are not indexed are ignored by StudyQuery.
+		{url.Values{"PatientSex": {"F"}}, []string{"0001_1", "0002_1", "0003_1"}},
+	}
+
+	for _, c := range cases {
+		q, err := ParseQuery(c.query)
+		if err != nil {
+			t.Fatalf("%v: %s", c.query, err)
+		}
+
+		keys, _, err := idx.Query(q.StudyQuery(), 10, 0)
+		if err != nil {
+			t.Fatalf("%v: %s", c.query, err)
+		}
+
+		var got []string
+		for _, key := range keys {
+			_, name, _ := search.SplitKey(key)
+			got = append(got, name)
+		}
+		sort.Strings(got)
+
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: got %v, want %v", c.query, got, c.want)
+		}
+	}
+}
+
+// writeStudy writes the study.xml of a study with a single
+// instance to the volume VOL00001 below root.
+func writeStudy(t *testing.T, root, name, patientName, patientID, uid, date, description, modality string) {
+	dir := filepath.Join(root, "VOL00001", name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	xml := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Imagelist><Patient><Name>%s</Name><ID>%s</ID><Sex>M</Sex><Visit><Study><UID>%s</UID><Date>%s</Date><Description>%s</Description><Series><UID>%s.1</UID><Modality>%s</Modality><Instance><UID>%s.1.1</UID><Data><DICOM>\DICOMPACS\ORCONSOLEDB\VOL00001\%s\I_000000.dcm</DICOM></Data></Instance></Series></Study></Visit></Patient></Imagelist>`,
+		patientName, patientID, uid, date, description, uid, modality, uid, name)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "study.xml"), []byte(xml), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testModel() models.ImageList {
+	var model models.ImageList
+	model.Patient.Name = "Huber^Bello Labrador"
+	model.Patient.ID = "100"
+	model.Patient.Sex = "M"
+	model.Patient.Visit.Study.UID = "1.2.3.1"
+	model.Patient.Visit.Study.Date = "20210311"
+	model.Patient.Visit.Study.Series = []models.Series{{UID: "1.2.3.1.1", Modality: "DX"}}
+	return model
+}
@@ -0,0 +1,221 @@
+package dimse
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/tierklinik-dobersberg/logger"
+)
+
+// defaultSendLength is the maximum length of P-DATA-TF PDUs sent to
+// peers that do not limit the PDU length.
+const defaultSendLength = 1024 * 1024
+
+type (
+	// association is an established association.
+	association struct {
+		conn           net.Conn
+		log            logger.Logger
+		callingAETitle string
+
+		// maxSend is the maximum length of P-DATA-TF PDUs
+		// accepted by the peer. Zero means unlimited.
+		maxSend uint32
+
+		// maxDataSet is the maximum length of data sets
+		// received from the peer. Zero means unlimited.
+		maxDataSet int64
+
+		// contexts holds all accepted presentation contexts
+		// keyed by their ID.
+		contexts map[byte]*acceptedContext
+
+		// messageID is the ID of the last request sent on the
+		// association.
+		messageID uint16
+
+		// cancelled is set if a C-CANCEL request has been
+		// received while sending C-GET sub-operations.
+		cancelled bool
+	}
+
+	// acceptedContext is a presentation context accepted during
+	// association negotiation.
+	acceptedContext struct {
+		abstractSyntax string
+		transferSyntax string
+	}
+
+	// message is a DIMSE message received on an association.
+	message struct {
+		contextID byte
+		context   *acceptedContext
+		command   *Command
+
+		// data holds the data set of the message, if any.
+		data []byte
+	}
+)
+
+// readMessage reads the next DIMSE message. It returns errReleased
+// if the peer released the association and errAborted if the peer
+// aborted it.
+func (a *association) readMessage() (*message, error) {
+	var (
+		msg      *message
+		cmdData  bytes.Buffer
+		dataSet  bytes.Buffer
+		complete bool
+	)
+
+	for !complete {
+		a.conn.SetDeadline(time.Now().Add(idleTimeout))
+
+		typ, payload, err := readPDU(a.conn, maxPDULength)
+		if err != nil {
+			return nil, err
+		}
+
+		switch typ {
+		case pduDataTF:
+		case pduReleaseRQ:
+			writePDU(a.conn, pduReleaseRP, make([]byte, 4))
+			return nil, errReleased
+		case pduAbort:
+			return nil, errAborted
+		default:
+			return nil, fmt.Errorf("unexpected PDU type 0x%02x", typ)
+		}
+
+		pdvs, err := parsePDVs(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range pdvs {
+			if complete {
+				return nil, fmt.Errorf("unexpected PDV after end of message")
+			}
+
+			pc, ok := a.contexts[p.contextID]
+			if !ok {
+				return nil, fmt.Errorf("PDV for unknown presentation context %d", p.contextID)
+			}
+
+			if msg == nil {
+				msg = &message{
+					contextID: p.contextID,
+					context:   pc,
+				}
+			} else if msg.contextID != p.contextID {
+				return nil, fmt.Errorf("presentation context changed within message")
+			}
+
+			if p.command {
+				if msg.command != nil {
+					return nil, fmt.Errorf("unexpected command fragment")
+				}
+
+				if cmdData.Len()+len(p.data) > maxCommandLength {
+					return nil, fmt.Errorf("command exceeds the maximum length of %d bytes", maxCommandLength)
+				}
+
+				cmdData.Write(p.data)
+				if !p.last {
+					continue
+				}
+
+				msg.command, err = decodeCommand(cmdData.Bytes())
+				if err != nil {
+					return nil, err
+				}
+				complete = !msg.command.HasDataSet
+				continue
+			}
+
+			if msg.command == nil {
+				return nil, fmt.Errorf("data set received before command")
+			}
+
+			if a.maxDataSet > 0 && int64(dataSet.Len()+len(p.data)) > a.maxDataSet {
+				return nil, fmt.Errorf("data set exceeds the maximum length of %d bytes", a.maxDataSet)
+			}
+
+			dataSet.Write(p.data)
+			complete = p.last
+		}
+	}
+
+	if msg.command.HasDataSet {
+		msg.data = dataSet.Bytes()
+	}
+
+	return msg, nil
+}
+
+// writeMessage sends cmd and the optional data set data using the
+// presentation context contextID.
+func (a *association) writeMessage(contextID byte, cmd *Command, data []byte) error {
+	cmd.HasDataSet = data != nil
+
+	cmdData, err := encodeCommand(cmd)
+	if err != nil {
+		return err
+	}
+
+	if err := a.writeFragments(contextID, true, cmdData); err != nil {
+		return err
+	}
+
+	if data != nil {
+		return a.writeFragments(contextID, false, data)
+	}
+
+	return nil
+}
+
+// writeFragments sends data in as many P-DATA-TF PDUs as required
+// by the maximum PDU length of the peer.
+func (a *association) writeFragments(contextID byte, command bool, data []byte) error {
+	maxLength := int(a.maxSend)
+	if maxLength == 0 {
+		maxLength = defaultSendLength
+	}
+
+	// each PDV item requires a 4 byte length and a 2 byte header.
+	fragmentSize := maxLength - 6
+	if fragmentSize <= 0 {
+		return fmt.Errorf("maximum PDU length %d is too small", maxLength)
+	}
+
+	for {
+		n := len(data)
+		if n > fragmentSize {
+			n = fragmentSize
+		}
+
+		a.conn.SetDeadline(time.Now().Add(idleTimeout))
+
+		err := writePDU(a.conn, pduDataTF, encodePDV(pdv{
+			contextID: contextID,
+			command:   command,
+			last:      n == len(data),
+			data:      data[:n],
+		}))
+		if err != nil {
+			return err
+		}
+
+		data = data[n:]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// abort aborts the association.
+func (a *association) abort() {
+	writePDU(a.conn, pduAbort, encodeAbort())
+}
@@ -0,0 +1,187 @@
+package dimse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// dialTimeout is the maximum time to wait for a peer to accept a
+// connection.
+const dialTimeout = 30 * time.Second
+
+// errNoContext is returned by sendStore if no presentation context
+// has been accepted for the SOP class and transfer syntax of the
+// instance.
+var errNoContext = errors.New("no presentation context for instance")
+
+// dial establishes an association with the peer calledAETitle at
+// addr and proposes contexts.
+func dial(ctx context.Context, addr, callingAETitle, calledAETitle string, contexts []presentationContext) (*association, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := requestAssociation(conn, callingAETitle, calledAETitle, contexts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// requestAssociation sends an A-ASSOCIATE-RQ on conn and waits for
+// the peer to accept it.
+func requestAssociation(conn net.Conn, callingAETitle, calledAETitle string, contexts []presentationContext) (*association, error) {
+	conn.SetDeadline(time.Now().Add(idleTimeout))
+
+	rq := &associateRQ{
+		calledAETitle:  calledAETitle,
+		callingAETitle: callingAETitle,
+		contexts:       contexts,
+		maxLength:      maxPDULength,
+	}
+	if err := writePDU(conn, pduAssociateRQ, rq.encode()); err != nil {
+		return nil, err
+	}
+
+	typ, payload, err := readPDU(conn, maxPDULength)
+	if err != nil {
+		return nil, err
+	}
+
+	switch typ {
+	case pduAssociateAC:
+	case pduAssociateRJ:
+		return nil, parseAssociateRJ(payload)
+	case pduAbort:
+		return nil, errAborted
+	default:
+		return nil, fmt.Errorf("unexpected PDU type 0x%02x", typ)
+	}
+
+	ac, err := parseAssociateAC(payload)
+	if err != nil {
+		return nil, err
+	}
+	if ac.maxLength != 0 && ac.maxLength < minPDULength {
+		writePDU(conn, pduAbort, encodeAbort())
+		return nil, fmt.Errorf("maximum PDU length %d of peer is too small", ac.maxLength)
+	}
+
+	proposed := make(map[byte]string, len(contexts))
+	for _, pc := range contexts {
+		proposed[pc.id] = pc.abstractSyntax
+	}
+
+	a := &association{
+		conn:           conn,
+		callingAETitle: callingAETitle,
+		maxSend:        ac.maxLength,
+		contexts:       make(map[byte]*acceptedContext),
+	}
+	for _, pc := range ac.contexts {
+		abstractSyntax, ok := proposed[pc.id]
+		if !ok || pc.result != contextAccepted {
+			continue
+		}
+
+		a.contexts[pc.id] = &acceptedContext{
+			abstractSyntax: abstractSyntax,
+			transferSyntax: pc.transferSyntax,
+		}
+	}
+
+	if len(a.contexts) == 0 {
+		writePDU(conn, pduAbort, encodeAbort())
+		return nil, fmt.Errorf("no presentation context accepted")
+	}
+
+	return a, nil
+}
+
+// release releases the association and waits for the peer to
+// confirm.
+func (a *association) release() error {
+	a.conn.SetDeadline(time.Now().Add(idleTimeout))
+
+	if err := writePDU(a.conn, pduReleaseRQ, make([]byte, 4)); err != nil {
+		return err
+	}
+
+	for {
+		typ, _, err := readPDU(a.conn, maxPDULength)
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case pduReleaseRP:
+			return nil
+		case pduAbort:
+			return errAborted
+		}
+	}
+}
+
+// sendStore sends req to the peer using C-STORE and returns the
+// status reported by the peer. If the instance is sent on behalf
+// of a C-MOVE request the originator must be set. C-CANCEL requests
+// received while waiting for the response mark the association as
+// cancelled.
+func (a *association) sendStore(req *StoreRequest, originator string, originatorMessageID uint16) (uint16, error) {
+	contextID, ok := a.findContext(req.SOPClassUID, req.TransferSyntaxUID)
+	if !ok {
+		return 0, errNoContext
+	}
+
+	a.messageID++
+	messageID := a.messageID
+
+	err := a.writeMessage(contextID, &Command{
+		CommandField:            CStoreRQ,
+		AffectedSOPClassUID:     req.SOPClassUID,
+		MessageID:               messageID,
+		AffectedSOPInstanceUID:  req.SOPInstanceUID,
+		MoveOriginatorAETitle:   originator,
+		MoveOriginatorMessageID: originatorMessageID,
+	}, req.DataSet)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		msg, err := a.readMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		if msg.command.CommandField == CCancelRQ {
+			a.cancelled = true
+			continue
+		}
+
+		if msg.command.CommandField != CStoreRSP || msg.command.MessageIDBeingRespondedTo != messageID {
+			return 0, fmt.Errorf("unexpected response 0x%04x to C-STORE", msg.command.CommandField)
+		}
+
+		return msg.command.Status, nil
+	}
+}
+
+// findContext returns the ID of an accepted presentation context
+// for abstractSyntax and transferSyntax.
+func (a *association) findContext(abstractSyntax, transferSyntax string) (byte, bool) {
+	for id, pc := range a.contexts {
+		if pc.abstractSyntax == abstractSyntax && pc.transferSyntax == transferSyntax {
+			return id, true
+		}
+	}
+
+	return 0, false
+}
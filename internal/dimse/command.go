@@ -0,0 +1,241 @@
+package dimse
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// Command fields of the DIMSE-C messages as defined in PS3.7
+// section E.1.
+const (
+	CStoreRQ  uint16 = 0x0001
+	CStoreRSP uint16 = 0x8001
+	CGetRQ    uint16 = 0x0010
+	CGetRSP   uint16 = 0x8010
+	CFindRQ   uint16 = 0x0020
+	CFindRSP  uint16 = 0x8020
+	CMoveRQ   uint16 = 0x0021
+	CMoveRSP  uint16 = 0x8021
+	CEchoRQ   uint16 = 0x0030
+	CEchoRSP  uint16 = 0x8030
+	CCancelRQ uint16 = 0x0FFF
+)
+
+// Status codes used in DIMSE responses. See PS3.7 annex C.
+const (
+	StatusSuccess                uint16 = 0x0000
+	StatusSOPClassNotSupported   uint16 = 0x0122
+	StatusUnrecognizedOperation  uint16 = 0x0211
+	StatusOutOfResources         uint16 = 0xA700
+	StatusSubOperationsFailed    uint16 = 0xA702
+	StatusMoveDestinationUnknown uint16 = 0xA801
+	StatusDataSetMismatch        uint16 = 0xA900
+	StatusSubOperationsWarning   uint16 = 0xB000
+	StatusCannotUnderstand       uint16 = 0xC000
+	StatusCancel                 uint16 = 0xFE00
+	StatusPending                uint16 = 0xFF00
+)
+
+// noDataSet is the value of CommandDataSetType if the message
+// does not contain a data set.
+const noDataSet uint16 = 0x0101
+
+// Command is the command set of a DIMSE message.
+type Command struct {
+	CommandField              uint16
+	AffectedSOPClassUID       string
+	MessageID                 uint16
+	MessageIDBeingRespondedTo uint16
+	Priority                  uint16
+	Status                    uint16
+	ErrorComment              string
+	AffectedSOPInstanceUID    string
+	MoveOriginatorAETitle     string
+	MoveOriginatorMessageID   uint16
+	MoveDestination           string
+
+	// SubOperations holds the number of sub-operations of
+	// C-GET and C-MOVE responses. It is nil for all other
+	// messages.
+	SubOperations *SubOperations
+
+	// HasDataSet is true if the command is followed by a
+	// data set.
+	HasDataSet bool
+}
+
+// SubOperations counts the C-STORE sub-operations performed for a
+// C-GET or C-MOVE request.
+type SubOperations struct {
+	Remaining uint16
+	Completed uint16
+	Failed    uint16
+	Warning   uint16
+}
+
+// Command sets are always encoded using Implicit VR Little Endian.
+var (
+	commandByteOrder = binary.LittleEndian
+	commandImplicit  = dicomio.ImplicitVR
+)
+
+// encodeCommand encodes cmd as a command set.
+func encodeCommand(cmd *Command) ([]byte, error) {
+	dataSetType := noDataSet
+	if cmd.HasDataSet {
+		dataSetType = 0x0000
+	}
+
+	isRequest := cmd.CommandField&0x8000 == 0
+
+	elems := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.AffectedSOPClassUID, cmd.AffectedSOPClassUID),
+		dicom.MustNewElement(dicomtag.CommandField, cmd.CommandField),
+	}
+	if isRequest {
+		elems = append(elems, dicom.MustNewElement(dicomtag.MessageID, cmd.MessageID))
+	} else {
+		elems = append(elems, dicom.MustNewElement(dicomtag.MessageIDBeingRespondedTo, cmd.MessageIDBeingRespondedTo))
+	}
+	if isRequest && cmd.CommandField != CEchoRQ {
+		elems = append(elems, dicom.MustNewElement(dicomtag.Priority, cmd.Priority))
+	}
+	if cmd.MoveDestination != "" {
+		elems = append(elems, dicom.MustNewElement(dicomtag.MoveDestination, cmd.MoveDestination))
+	}
+	elems = append(elems, dicom.MustNewElement(dicomtag.CommandDataSetType, dataSetType))
+	if !isRequest {
+		elems = append(elems, dicom.MustNewElement(dicomtag.Status, cmd.Status))
+	}
+	if cmd.ErrorComment != "" {
+		elems = append(elems, dicom.MustNewElement(dicomtag.ErrorComment, truncate(cmd.ErrorComment, 64)))
+	}
+	if cmd.AffectedSOPInstanceUID != "" {
+		elems = append(elems, dicom.MustNewElement(dicomtag.AffectedSOPInstanceUID, cmd.AffectedSOPInstanceUID))
+	}
+	if ops := cmd.SubOperations; ops != nil {
+		// the number of remaining sub-operations is only
+		// included in pending and cancel responses.
+		if cmd.Status == StatusPending || cmd.Status == StatusCancel {
+			elems = append(elems, dicom.MustNewElement(dicomtag.NumberOfRemainingSuboperations, ops.Remaining))
+		}
+		elems = append(elems,
+			dicom.MustNewElement(dicomtag.NumberOfCompletedSuboperations, ops.Completed),
+			dicom.MustNewElement(dicomtag.NumberOfFailedSuboperations, ops.Failed),
+			dicom.MustNewElement(dicomtag.NumberOfWarningSuboperations, ops.Warning),
+		)
+	}
+	if cmd.MoveOriginatorAETitle != "" {
+		elems = append(elems,
+			dicom.MustNewElement(dicomtag.MoveOriginatorApplicationEntityTitle, cmd.MoveOriginatorAETitle),
+			dicom.MustNewElement(dicomtag.MoveOriginatorMessageID, cmd.MoveOriginatorMessageID),
+		)
+	}
+
+	body := dicomio.NewBytesEncoder(commandByteOrder, commandImplicit)
+	for _, elem := range elems {
+		dicom.WriteElement(body, elem)
+	}
+	if err := body.Error(); err != nil {
+		return nil, err
+	}
+
+	e := dicomio.NewBytesEncoder(commandByteOrder, commandImplicit)
+	dicom.WriteElement(e, dicom.MustNewElement(dicomtag.CommandGroupLength, uint32(len(body.Bytes()))))
+	e.WriteBytes(body.Bytes())
+	if err := e.Error(); err != nil {
+		return nil, err
+	}
+
+	return e.Bytes(), nil
+}
+
+// decodeCommand decodes the command set stored in data.
+func decodeCommand(data []byte) (*Command, error) {
+	d := dicomio.NewBytesDecoder(data, commandByteOrder, commandImplicit)
+
+	cmd := &Command{}
+	for !d.EOF() {
+		elem := dicom.ReadElement(d, dicom.ReadOptions{})
+		if err := d.Error(); err != nil {
+			return nil, fmt.Errorf("invalid command set: %w", err)
+		}
+
+		switch elem.Tag {
+		case dicomtag.AffectedSOPClassUID:
+			cmd.AffectedSOPClassUID = elementString(elem)
+		case dicomtag.CommandField:
+			cmd.CommandField = elementUInt16(elem)
+		case dicomtag.MessageID:
+			cmd.MessageID = elementUInt16(elem)
+		case dicomtag.MessageIDBeingRespondedTo:
+			cmd.MessageIDBeingRespondedTo = elementUInt16(elem)
+		case dicomtag.Priority:
+			cmd.Priority = elementUInt16(elem)
+		case dicomtag.CommandDataSetType:
+			cmd.HasDataSet = elementUInt16(elem) != noDataSet
+		case dicomtag.Status:
+			cmd.Status = elementUInt16(elem)
+		case dicomtag.ErrorComment:
+			cmd.ErrorComment = elementString(elem)
+		case dicomtag.AffectedSOPInstanceUID:
+			cmd.AffectedSOPInstanceUID = elementString(elem)
+		case dicomtag.MoveOriginatorApplicationEntityTitle:
+			cmd.MoveOriginatorAETitle = elementString(elem)
+		case dicomtag.MoveOriginatorMessageID:
+			cmd.MoveOriginatorMessageID = elementUInt16(elem)
+		case dicomtag.MoveDestination:
+			cmd.MoveDestination = elementString(elem)
+		case dicomtag.NumberOfRemainingSuboperations:
+			cmd.subOperations().Remaining = elementUInt16(elem)
+		case dicomtag.NumberOfCompletedSuboperations:
+			cmd.subOperations().Completed = elementUInt16(elem)
+		case dicomtag.NumberOfFailedSuboperations:
+			cmd.subOperations().Failed = elementUInt16(elem)
+		case dicomtag.NumberOfWarningSuboperations:
+			cmd.subOperations().Warning = elementUInt16(elem)
+		}
+	}
+
+	return cmd, nil
+}
+
+// subOperations returns cmd.SubOperations and allocates it if
+// required.
+func (cmd *Command) subOperations() *SubOperations {
+	if cmd.SubOperations == nil {
+		cmd.SubOperations = &SubOperations{}
+	}
+	return cmd.SubOperations
+}
+
+// elementString returns the first string value of elem or an
+// empty string.
+func elementString(elem *dicom.Element) string {
+	s, err := elem.GetString()
+	if err != nil {
+		return ""
+	}
+	return s
+}
+
+// elementUInt16 returns the first uint16 value of elem or zero.
+func elementUInt16(elem *dicom.Element) uint16 {
+	v, err := elem.GetUInt16()
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// truncate returns s truncated to at most n bytes.
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
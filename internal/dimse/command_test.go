@@ -0,0 +1,126 @@
+package dimse
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/go-dicom/dicomuid"
+)
+
+func TestCommandRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		cmd  *Command
+	}{
+		{"C-ECHO-RQ", &Command{
+			CommandField:        CEchoRQ,
+			AffectedSOPClassUID: dicomuid.VerificationSOPClass,
+			MessageID:           1,
+		}},
+		{"C-ECHO-RSP", &Command{
+			CommandField:              CEchoRSP,
+			AffectedSOPClassUID:       dicomuid.VerificationSOPClass,
+			MessageIDBeingRespondedTo: 1,
+			Status:                    StatusSuccess,
+		}},
+		{"C-STORE-RQ", &Command{
+			CommandField:            CStoreRQ,
+			AffectedSOPClassUID:     "1.2.840.10008.5.1.4.1.1.1",
+			MessageID:               7,
+			Priority:                1,
+			AffectedSOPInstanceUID:  "1.2.3.4.5",
+			MoveOriginatorAETitle:   "VIEWER",
+			MoveOriginatorMessageID: 3,
+			HasDataSet:              true,
+		}},
+		{"C-STORE-RSP failure", &Command{
+			CommandField:              CStoreRSP,
+			AffectedSOPClassUID:       "1.2.840.10008.5.1.4.1.1.1",
+			MessageIDBeingRespondedTo: 7,
+			Status:                    StatusOutOfResources,
+			ErrorComment:              "disk full",
+			AffectedSOPInstanceUID:    "1.2.3.4.5",
+		}},
+		{"C-MOVE-RQ", &Command{
+			CommandField:        CMoveRQ,
+			AffectedSOPClassUID: "1.2.840.10008.5.1.4.1.2.2.2",
+			MessageID:           9,
+			MoveDestination:     "DEST",
+			HasDataSet:          true,
+		}},
+		{"C-MOVE-RSP pending", &Command{
+			CommandField:              CMoveRSP,
+			AffectedSOPClassUID:       "1.2.840.10008.5.1.4.1.2.2.2",
+			MessageIDBeingRespondedTo: 9,
+			Status:                    StatusPending,
+			SubOperations: &SubOperations{
+				Remaining: 4,
+				Completed: 2,
+				Failed:    1,
+				Warning:   0,
+			},
+		}},
+		{"C-MOVE-RSP final", &Command{
+			CommandField:              CMoveRSP,
+			AffectedSOPClassUID:       "1.2.840.10008.5.1.4.1.2.2.2",
+			MessageIDBeingRespondedTo: 9,
+			Status:                    StatusSubOperationsWarning,
+			SubOperations: &SubOperations{
+				Completed: 6,
+				Failed:    1,
+			},
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data, err := encodeCommand(c.cmd)
+			if err != nil {
+				t.Fatalf("failed to encode: %s", err)
+			}
+
+			got, err := decodeCommand(data)
+			if err != nil {
+				t.Fatalf("failed to decode: %s", err)
+			}
+
+			if !reflect.DeepEqual(got, c.cmd) {
+				t.Errorf("got %+v, want %+v", got, c.cmd)
+			}
+		})
+	}
+}
+
+func TestEncodeCommandTruncatesErrorComment(t *testing.T) {
+	cmd := &Command{
+		CommandField: CStoreRSP,
+		Status:       StatusCannotUnderstand,
+		ErrorComment: strings.Repeat("x", 100),
+	}
+
+	data, err := encodeCommand(cmd)
+	if err != nil {
+		t.Fatalf("failed to encode: %s", err)
+	}
+
+	got, err := decodeCommand(data)
+	if err != nil {
+		t.Fatalf("failed to decode: %s", err)
+	}
+
+	if len(got.ErrorComment) != 64 {
+		t.Errorf("error comment has %d bytes", len(got.ErrorComment))
+	}
+}
+
+func TestDecodeCommandInvalid(t *testing.T) {
+	data, err := encodeCommand(&Command{CommandField: CEchoRQ, MessageID: 1})
+	if err != nil {
+		t.Fatalf("failed to encode: %s", err)
+	}
+
+	if _, err := decodeCommand(data[:len(data)-1]); err == nil {
+		t.Errorf("expected an error for a truncated command set")
+	}
+}
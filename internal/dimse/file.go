@@ -0,0 +1,151 @@
+package dimse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// fileHeaderLength is the length of the preamble, the DICM prefix
+// and the group length element of a DICOM file.
+const fileHeaderLength = 128 + 4 + 12
+
+// ReadFile reads the DICOM file at path. The returned request
+// holds the data set of the file without the file meta
+// information so it can be sent using C-STORE.
+func ReadFile(path string) (*StoreRequest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseFile(data)
+}
+
+// ParseFile is like ReadFile but parses the content of a DICOM
+// file.
+func ParseFile(data []byte) (*StoreRequest, error) {
+	req, n, err := readMeta(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	req.DataSet = data[n:]
+	return req, nil
+}
+
+// ReadFileMeta reads only the file meta information of the DICOM
+// file at path. The DataSet of the returned request is nil.
+func ReadFileMeta(path string) (*StoreRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	req, _, err := readMeta(f)
+	return req, err
+}
+
+// readMeta reads the file meta information from r and returns it
+// together with the number of bytes read.
+func readMeta(r io.Reader) (*StoreRequest, int, error) {
+	header := make([]byte, fileHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, fmt.Errorf("not a DICOM file: %w", err)
+	}
+
+	if string(header[128:132]) != "DICM" || string(header[136:138]) != "UL" ||
+		binary.LittleEndian.Uint16(header[132:]) != 0x0002 || binary.LittleEndian.Uint16(header[134:]) != 0x0000 {
+		return nil, 0, fmt.Errorf("not a DICOM file")
+	}
+
+	groupLength := binary.LittleEndian.Uint32(header[140:])
+	if groupLength > maxPDULength {
+		return nil, 0, fmt.Errorf("file meta information too long")
+	}
+
+	meta := make([]byte, groupLength)
+	if _, err := io.ReadFull(r, meta); err != nil {
+		return nil, 0, fmt.Errorf("invalid file meta information: %w", err)
+	}
+
+	req := &StoreRequest{}
+	d := dicomio.NewBytesDecoder(meta, binary.LittleEndian, dicomio.ExplicitVR)
+	for !d.EOF() {
+		elem := dicom.ReadElement(d, dicom.ReadOptions{})
+		if err := d.Error(); err != nil {
+			return nil, 0, fmt.Errorf("invalid file meta information: %w", err)
+		}
+
+		switch elem.Tag {
+		case dicomtag.MediaStorageSOPClassUID:
+			req.SOPClassUID = uidString([]byte(elementString(elem)))
+		case dicomtag.MediaStorageSOPInstanceUID:
+			req.SOPInstanceUID = uidString([]byte(elementString(elem)))
+		case dicomtag.TransferSyntaxUID:
+			req.TransferSyntaxUID = uidString([]byte(elementString(elem)))
+		case dicomtag.SourceApplicationEntityTitle:
+			req.CallingAETitle = uidString([]byte(elementString(elem)))
+		}
+	}
+
+	if req.SOPClassUID == "" || req.SOPInstanceUID == "" || req.TransferSyntaxUID == "" {
+		return nil, 0, fmt.Errorf("incomplete file meta information")
+	}
+
+	return req, fileHeaderLength + int(groupLength), nil
+}
+
+// decodeDataSet decodes the elements of data which is encoded
+// using the transfer syntax ts.
+func decodeDataSet(data []byte, ts string) ([]*dicom.Element, error) {
+	byteOrder, implicit, err := dicomio.ParseTransferSyntaxUID(ts)
+	if err != nil {
+		return nil, err
+	}
+
+	var elems []*dicom.Element
+	d := dicomio.NewBytesDecoder(data, byteOrder, implicit)
+	for !d.EOF() {
+		elem := dicom.ReadElement(d, dicom.ReadOptions{})
+		if err := d.Error(); err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+	}
+
+	return elems, nil
+}
+
+// encodeDataSet encodes elems in ascending tag order using the
+// transfer syntax ts.
+func encodeDataSet(elems []*dicom.Element, ts string) ([]byte, error) {
+	byteOrder, implicit, err := dicomio.ParseTransferSyntaxUID(ts)
+	if err != nil {
+		return nil, err
+	}
+
+	elems = append([]*dicom.Element(nil), elems...)
+	sort.Slice(elems, func(i, j int) bool {
+		return elems[i].Tag.Compare(elems[j].Tag) < 0
+	})
+
+	e := dicomio.NewBytesEncoder(byteOrder, implicit)
+	for _, elem := range elems {
+		dicom.WriteElement(e, elem)
+	}
+	if err := e.Error(); err != nil {
+		return nil, err
+	}
+
+	return e.Bytes(), nil
+}
@@ -0,0 +1,482 @@
+// Package dimse implements the DICOM Upper Layer protocol (PS3.8) and
+// the DIMSE-C services (PS3.7) required to receive images from DICOM
+// modalities and to answer query/retrieve requests of workstations.
+package dimse
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// PDU types as defined in PS3.8 section 9.3.
+const (
+	pduAssociateRQ = 0x01
+	pduAssociateAC = 0x02
+	pduAssociateRJ = 0x03
+	pduDataTF      = 0x04
+	pduReleaseRQ   = 0x05
+	pduReleaseRP   = 0x06
+	pduAbort       = 0x07
+)
+
+// Item types used in A-ASSOCIATE-RQ and A-ASSOCIATE-AC PDUs.
+const (
+	itemApplicationContext     = 0x10
+	itemPresentationContextRQ  = 0x20
+	itemPresentationContextAC  = 0x21
+	itemAbstractSyntax         = 0x30
+	itemTransferSyntax         = 0x40
+	itemUserInformation        = 0x50
+	itemMaximumLength          = 0x51
+	itemImplementationClassUID = 0x52
+	itemRoleSelection          = 0x54
+	itemImplementationVersion  = 0x55
+)
+
+// Results of a presentation context negotiation.
+const (
+	contextAccepted                  = 0
+	contextAbstractSyntaxUnsupported = 3
+	contextTransferSyntaxUnsupported = 4
+)
+
+// Reasons used when rejecting an association.
+const (
+	rejectNoReason                  = 1
+	rejectApplicationContext        = 2
+	rejectCalledAETitleUnrecognized = 7
+)
+
+// applicationContextName is the only application context
+// defined by DICOM.
+const applicationContextName = "1.2.840.10008.3.1.1.1"
+
+// protocolVersion is the version of the Upper Layer protocol.
+const protocolVersion = 0x0001
+
+var (
+	// errReleased is returned when the peer released the
+	// association.
+	errReleased = errors.New("association released")
+
+	// errAborted is returned when the peer aborted the
+	// association.
+	errAborted = errors.New("association aborted")
+)
+
+type (
+	// associateRQ is a parsed A-ASSOCIATE-RQ PDU.
+	associateRQ struct {
+		calledAETitle  string
+		callingAETitle string
+		appContext     string
+		contexts       []presentationContext
+		maxLength      uint32
+		implClassUID   string
+		implVersion    string
+		roles          []roleSelection
+	}
+
+	// associateAC is an A-ASSOCIATE-AC PDU.
+	associateAC struct {
+		calledAETitle  string
+		callingAETitle string
+		contexts       []presentationContextResult
+		maxLength      uint32
+		roles          []roleSelection
+	}
+
+	// roleSelection is an SCP/SCU role selection item. It is
+	// used by C-GET requestors that want to act as storage SCP.
+	roleSelection struct {
+		sopClassUID string
+		scu         bool
+		scp         bool
+	}
+
+	// presentationContext is a presentation context proposed by
+	// the association requestor.
+	presentationContext struct {
+		id               byte
+		abstractSyntax   string
+		transferSyntaxes []string
+	}
+
+	// presentationContextResult is the result of negotiating a
+	// single presentation context.
+	presentationContextResult struct {
+		id             byte
+		result         byte
+		transferSyntax string
+	}
+
+	// pdv is a presentation data value of a P-DATA-TF PDU.
+	pdv struct {
+		contextID byte
+		command   bool
+		last      bool
+		data      []byte
+	}
+)
+
+// readPDU reads the next PDU from r and returns its type and
+// payload. PDUs larger than maxLength are rejected.
+func readPDU(r io.Reader, maxLength uint32) (byte, []byte, error) {
+	var header [6]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[2:])
+	if length > maxLength {
+		return 0, nil, fmt.Errorf("PDU length %d exceeds maximum of %d", length, maxLength)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], payload, nil
+}
+
+// writePDU writes a PDU of type typ to w.
+func writePDU(w io.Writer, typ byte, payload []byte) error {
+	buf := make([]byte, 6, 6+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[2:], uint32(len(payload)))
+	buf = append(buf, payload...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// parseAssociateRQ parses the payload of an A-ASSOCIATE-RQ PDU.
+func parseAssociateRQ(payload []byte) (*associateRQ, error) {
+	if len(payload) < 68 {
+		return nil, fmt.Errorf("A-ASSOCIATE-RQ too short")
+	}
+
+	rq := &associateRQ{
+		calledAETitle:  strings.TrimSpace(string(payload[4:20])),
+		callingAETitle: strings.TrimSpace(string(payload[20:36])),
+	}
+
+	err := forEachItem(payload[68:], func(typ byte, data []byte) error {
+		switch typ {
+		case itemApplicationContext:
+			rq.appContext = uidString(data)
+
+		case itemPresentationContextRQ:
+			if len(data) < 4 {
+				return fmt.Errorf("presentation context item too short")
+			}
+
+			pc := presentationContext{id: data[0]}
+			err := forEachItem(data[4:], func(typ byte, data []byte) error {
+				switch typ {
+				case itemAbstractSyntax:
+					pc.abstractSyntax = uidString(data)
+				case itemTransferSyntax:
+					pc.transferSyntaxes = append(pc.transferSyntaxes, uidString(data))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			rq.contexts = append(rq.contexts, pc)
+
+		case itemUserInformation:
+			return forEachItem(data, func(typ byte, data []byte) error {
+				switch typ {
+				case itemMaximumLength:
+					if len(data) != 4 {
+						return fmt.Errorf("invalid maximum length item")
+					}
+					rq.maxLength = binary.BigEndian.Uint32(data)
+
+				case itemImplementationClassUID:
+					rq.implClassUID = uidString(data)
+
+				case itemImplementationVersion:
+					rq.implVersion = strings.TrimSpace(string(data))
+
+				case itemRoleSelection:
+					role, err := parseRoleSelection(data)
+					if err != nil {
+						return err
+					}
+					rq.roles = append(rq.roles, role)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rq, nil
+}
+
+// encode returns the payload of the A-ASSOCIATE-RQ PDU.
+func (rq *associateRQ) encode() []byte {
+	buf := make([]byte, 68)
+	binary.BigEndian.PutUint16(buf, protocolVersion)
+	copy(buf[4:20], aeTitle(rq.calledAETitle))
+	copy(buf[20:36], aeTitle(rq.callingAETitle))
+
+	buf = appendItem(buf, itemApplicationContext, []byte(applicationContextName))
+
+	for _, pc := range rq.contexts {
+		var data []byte
+		data = append(data, pc.id, 0, 0, 0)
+		data = appendItem(data, itemAbstractSyntax, []byte(pc.abstractSyntax))
+		for _, ts := range pc.transferSyntaxes {
+			data = appendItem(data, itemTransferSyntax, []byte(ts))
+		}
+		buf = appendItem(buf, itemPresentationContextRQ, data)
+	}
+
+	return appendItem(buf, itemUserInformation, encodeUserInformation(rq.maxLength, rq.roles))
+}
+
+// parseAssociateAC parses the payload of an A-ASSOCIATE-AC PDU.
+func parseAssociateAC(payload []byte) (*associateAC, error) {
+	if len(payload) < 68 {
+		return nil, fmt.Errorf("A-ASSOCIATE-AC too short")
+	}
+
+	ac := &associateAC{
+		calledAETitle:  strings.TrimSpace(string(payload[4:20])),
+		callingAETitle: strings.TrimSpace(string(payload[20:36])),
+	}
+
+	err := forEachItem(payload[68:], func(typ byte, data []byte) error {
+		switch typ {
+		case itemPresentationContextAC:
+			if len(data) < 4 {
+				return fmt.Errorf("presentation context item too short")
+			}
+
+			pc := presentationContextResult{id: data[0], result: data[2]}
+			err := forEachItem(data[4:], func(typ byte, data []byte) error {
+				if typ == itemTransferSyntax {
+					pc.transferSyntax = uidString(data)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ac.contexts = append(ac.contexts, pc)
+
+		case itemUserInformation:
+			return forEachItem(data, func(typ byte, data []byte) error {
+				if typ == itemMaximumLength {
+					if len(data) != 4 {
+						return fmt.Errorf("invalid maximum length item")
+					}
+					ac.maxLength = binary.BigEndian.Uint32(data)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ac, nil
+}
+
+// encode returns the payload of the A-ASSOCIATE-AC PDU.
+func (ac *associateAC) encode() []byte {
+	buf := make([]byte, 68)
+	binary.BigEndian.PutUint16(buf, protocolVersion)
+	copy(buf[4:20], aeTitle(ac.calledAETitle))
+	copy(buf[20:36], aeTitle(ac.callingAETitle))
+
+	buf = appendItem(buf, itemApplicationContext, []byte(applicationContextName))
+
+	for _, pc := range ac.contexts {
+		var data []byte
+		data = append(data, pc.id, 0, pc.result, 0)
+		data = appendItem(data, itemTransferSyntax, []byte(pc.transferSyntax))
+		buf = appendItem(buf, itemPresentationContextAC, data)
+	}
+
+	return appendItem(buf, itemUserInformation, encodeUserInformation(ac.maxLength, ac.roles))
+}
+
+// encodeUserInformation returns the sub-items of the user
+// information item sent by dxray.
+func encodeUserInformation(maxLength uint32, roles []roleSelection) []byte {
+	var user []byte
+
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, maxLength)
+	user = appendItem(user, itemMaximumLength, length)
+	user = appendItem(user, itemImplementationClassUID, []byte(ImplementationClassUID))
+
+	for _, role := range roles {
+		data := make([]byte, 2, 4+len(role.sopClassUID))
+		binary.BigEndian.PutUint16(data, uint16(len(role.sopClassUID)))
+		data = append(data, role.sopClassUID...)
+		data = append(data, boolByte(role.scu), boolByte(role.scp))
+		user = appendItem(user, itemRoleSelection, data)
+	}
+
+	return appendItem(user, itemImplementationVersion, []byte(ImplementationVersionName))
+}
+
+// parseRoleSelection parses the payload of a role selection item.
+func parseRoleSelection(data []byte) (roleSelection, error) {
+	if len(data) < 2 {
+		return roleSelection{}, fmt.Errorf("role selection item too short")
+	}
+
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) != 4+length {
+		return roleSelection{}, fmt.Errorf("invalid role selection item")
+	}
+
+	return roleSelection{
+		sopClassUID: uidString(data[2 : 2+length]),
+		scu:         data[2+length] == 1,
+		scp:         data[3+length] == 1,
+	}, nil
+}
+
+// encodeAssociateRJ returns the payload of an A-ASSOCIATE-RJ PDU
+// that permanently rejects the association for reason.
+func encodeAssociateRJ(reason byte) []byte {
+	// result 1 (rejected-permanent), source 1 (service-user)
+	return []byte{0, 1, 1, reason}
+}
+
+// associateRJError is returned if the peer rejected an association.
+type associateRJError struct {
+	result, source, reason byte
+}
+
+// Error implements error.
+func (e *associateRJError) Error() string {
+	return fmt.Sprintf("association rejected (result %d, source %d, reason %d)", e.result, e.source, e.reason)
+}
+
+// parseAssociateRJ returns the error described by the payload of an
+// A-ASSOCIATE-RJ PDU.
+func parseAssociateRJ(payload []byte) error {
+	if len(payload) < 4 {
+		return fmt.Errorf("A-ASSOCIATE-RJ too short")
+	}
+
+	return &associateRJError{
+		result: payload[1],
+		source: payload[2],
+		reason: payload[3],
+	}
+}
+
+// encodeAbort returns the payload of an A-ABORT PDU issued by the
+// service user.
+func encodeAbort() []byte {
+	return []byte{0, 0, 0, 0}
+}
+
+// parsePDVs parses the presentation data values of a P-DATA-TF PDU.
+func parsePDVs(payload []byte) ([]pdv, error) {
+	var pdvs []pdv
+	for len(payload) > 0 {
+		if len(payload) < 6 {
+			return nil, fmt.Errorf("PDV item too short")
+		}
+
+		length := binary.BigEndian.Uint32(payload)
+		if length < 2 || uint64(length) > uint64(len(payload)-4) {
+			return nil, fmt.Errorf("invalid PDV length %d", length)
+		}
+
+		header := payload[5]
+		pdvs = append(pdvs, pdv{
+			contextID: payload[4],
+			command:   header&0x01 != 0,
+			last:      header&0x02 != 0,
+			data:      payload[6 : 4+length],
+		})
+		payload = payload[4+length:]
+	}
+
+	return pdvs, nil
+}
+
+// encodePDV returns a P-DATA-TF payload that holds p.
+func encodePDV(p pdv) []byte {
+	var header byte
+	if p.command {
+		header |= 0x01
+	}
+	if p.last {
+		header |= 0x02
+	}
+
+	buf := make([]byte, 6, 6+len(p.data))
+	binary.BigEndian.PutUint32(buf, uint32(2+len(p.data)))
+	buf[4] = p.contextID
+	buf[5] = header
+
+	return append(buf, p.data...)
+}
+
+// forEachItem calls fn for each item stored in data.
+func forEachItem(data []byte, fn func(typ byte, data []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return fmt.Errorf("item header too short")
+		}
+
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+length {
+			return fmt.Errorf("item 0x%02x exceeds PDU", data[0])
+		}
+
+		if err := fn(data[0], data[4:4+length]); err != nil {
+			return err
+		}
+		data = data[4+length:]
+	}
+
+	return nil
+}
+
+// appendItem appends an item of type typ to buf.
+func appendItem(buf []byte, typ byte, data []byte) []byte {
+	buf = append(buf, typ, 0, byte(len(data)>>8), byte(len(data)))
+	return append(buf, data...)
+}
+
+// aeTitle returns title padded to the 16 bytes used for AE
+// titles in the association PDUs.
+func aeTitle(title string) []byte {
+	return []byte(fmt.Sprintf("%-16.16s", title))
+}
+
+// boolByte returns 1 if b is true and 0 otherwise.
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// uidString returns the UID stored in data without padding.
+func uidString(data []byte) string {
+	return strings.TrimRight(string(data), " \x00")
+}
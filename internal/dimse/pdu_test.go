@@ -0,0 +1,271 @@
+package dimse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/go-dicom/dicomuid"
+)
+
+func TestParseAssociateRQ(t *testing.T) {
+	rq := &associateRQ{
+		calledAETitle:  "DXRAY",
+		callingAETitle: "MODALITY",
+		contexts: []presentationContext{
+			{
+				id:               1,
+				abstractSyntax:   dicomuid.VerificationSOPClass,
+				transferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+			},
+			{
+				id:               3,
+				abstractSyntax:   "1.2.840.10008.5.1.4.1.1.1",
+				transferSyntaxes: []string{dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian},
+			},
+		},
+		maxLength: 16384,
+		roles: []roleSelection{
+			{sopClassUID: "1.2.840.10008.5.1.4.1.1.1", scu: false, scp: true},
+		},
+	}
+	valid := rq.encode()
+
+	// a user information item with a maximum length sub-item
+	// of the wrong size.
+	badMaxLength := appendItem(make([]byte, 68), itemUserInformation,
+		appendItem(nil, itemMaximumLength, []byte{0, 1}))
+
+	cases := []struct {
+		name    string
+		payload []byte
+		wantErr bool
+	}{
+		{"valid", valid, false},
+		{"too short", valid[:67], true},
+		{"truncated item", valid[:len(valid)-1], true},
+		{"short presentation context", appendItem(make([]byte, 68), itemPresentationContextRQ, []byte{1, 0}), true},
+		{"invalid maximum length", badMaxLength, true},
+		{"invalid role selection", appendItem(make([]byte, 68), itemUserInformation,
+			appendItem(nil, itemRoleSelection, []byte{0, 10, '1'})), true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseAssociateRQ(c.payload)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if got.calledAETitle != rq.calledAETitle || got.callingAETitle != rq.callingAETitle {
+				t.Errorf("got AE titles %q and %q", got.calledAETitle, got.callingAETitle)
+			}
+			if got.appContext != applicationContextName {
+				t.Errorf("got application context %q", got.appContext)
+			}
+			if !reflect.DeepEqual(got.contexts, rq.contexts) {
+				t.Errorf("got presentation contexts %+v", got.contexts)
+			}
+			if got.maxLength != rq.maxLength {
+				t.Errorf("got maximum length %d", got.maxLength)
+			}
+			if !reflect.DeepEqual(got.roles, rq.roles) {
+				t.Errorf("got roles %+v", got.roles)
+			}
+			if got.implClassUID != ImplementationClassUID || got.implVersion != ImplementationVersionName {
+				t.Errorf("got implementation %q %q", got.implClassUID, got.implVersion)
+			}
+		})
+	}
+}
+
+func TestParseAssociateAC(t *testing.T) {
+	ac := &associateAC{
+		calledAETitle:  "DXRAY",
+		callingAETitle: "VIEWER",
+		contexts: []presentationContextResult{
+			{id: 1, result: contextAccepted, transferSyntax: dicomuid.ImplicitVRLittleEndian},
+			{id: 3, result: contextAbstractSyntaxUnsupported, transferSyntax: dicomuid.ImplicitVRLittleEndian},
+		},
+		maxLength: maxPDULength,
+	}
+	valid := ac.encode()
+
+	cases := []struct {
+		name    string
+		payload []byte
+		wantErr bool
+	}{
+		{"valid", valid, false},
+		{"too short", valid[:10], true},
+		{"truncated item", valid[:len(valid)-3], true},
+		{"short presentation context", appendItem(make([]byte, 68), itemPresentationContextAC, []byte{1}), true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseAssociateAC(c.payload)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if got.calledAETitle != ac.calledAETitle || got.callingAETitle != ac.callingAETitle {
+				t.Errorf("got AE titles %q and %q", got.calledAETitle, got.callingAETitle)
+			}
+			if !reflect.DeepEqual(got.contexts, ac.contexts) {
+				t.Errorf("got presentation contexts %+v", got.contexts)
+			}
+			if got.maxLength != ac.maxLength {
+				t.Errorf("got maximum length %d", got.maxLength)
+			}
+		})
+	}
+}
+
+func TestParsePDVs(t *testing.T) {
+	first := encodePDV(pdv{contextID: 1, command: true, last: true, data: []byte{1, 2, 3}})
+	second := encodePDV(pdv{contextID: 3, last: false, data: []byte{4}})
+
+	withLength := func(length uint32) []byte {
+		b := append([]byte(nil), first...)
+		binary.BigEndian.PutUint32(b, length)
+		return b
+	}
+
+	cases := []struct {
+		name    string
+		payload []byte
+		want    []pdv
+		wantErr bool
+	}{
+		{"empty", nil, nil, false},
+		{"single", first, []pdv{
+			{contextID: 1, command: true, last: true, data: []byte{1, 2, 3}},
+		}, false},
+		{"multiple", append(append([]byte(nil), first...), second...), []pdv{
+			{contextID: 1, command: true, last: true, data: []byte{1, 2, 3}},
+			{contextID: 3, data: []byte{4}},
+		}, false},
+		{"empty data", encodePDV(pdv{contextID: 5, last: true}), []pdv{
+			{contextID: 5, last: true, data: []byte{}},
+		}, false},
+		{"truncated header", first[:5], nil, true},
+		{"truncated data", first[:len(first)-1], nil, true},
+		{"length too small", withLength(1), nil, true},
+		{"length exceeds payload", withLength(6), nil, true},
+		{"oversize length", withLength(0xFFFFFFFF), nil, true},
+		{"trailing bytes", append(append([]byte(nil), first...), 0, 0), nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parsePDVs(c.payload)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestForEachItem(t *testing.T) {
+	type item struct {
+		typ  byte
+		data []byte
+	}
+
+	two := appendItem(appendItem(nil, 0x10, []byte("abc")), 0x20, nil)
+	errStop := errors.New("stop")
+
+	cases := []struct {
+		name    string
+		data    []byte
+		stopAt  byte
+		want    []item
+		wantErr error
+	}{
+		{"empty", nil, 0, nil, nil},
+		{"two items", two, 0, []item{{0x10, []byte("abc")}, {0x20, []byte{}}}, nil},
+		{"truncated header", two[:3], 0, nil, errAny},
+		{"item exceeds data", two[:5], 0, nil, errAny},
+		{"callback error", two, 0x10, []item{{0x10, []byte("abc")}}, errStop},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got []item
+			err := forEachItem(c.data, func(typ byte, data []byte) error {
+				got = append(got, item{typ, data})
+				if typ == c.stopAt {
+					return errStop
+				}
+				return nil
+			})
+
+			switch {
+			case c.wantErr == nil && err != nil:
+				t.Fatalf("unexpected error: %s", err)
+			case c.wantErr != nil && err == nil:
+				t.Fatalf("expected an error")
+			case c.wantErr != nil && c.wantErr != errAny && !errors.Is(err, c.wantErr):
+				t.Fatalf("got error %v, want %v", err, c.wantErr)
+			}
+
+			if c.wantErr == nil || c.wantErr == errStop {
+				if !reflect.DeepEqual(got, c.want) {
+					t.Errorf("got %+v, want %+v", got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadPDU(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writePDU(&buf, pduDataTF, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	typ, payload, err := readPDU(bytes.NewReader(data), 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if typ != pduDataTF || !bytes.Equal(payload, []byte{1, 2, 3, 4}) {
+		t.Errorf("got PDU 0x%02x %v", typ, payload)
+	}
+
+	if _, _, err := readPDU(bytes.NewReader(data), 3); err == nil {
+		t.Errorf("expected an error for a PDU exceeding the maximum length")
+	}
+
+	if _, _, err := readPDU(bytes.NewReader(data[:8]), 4); err == nil {
+		t.Errorf("expected an error for a truncated PDU")
+	}
+}
+
+// errAny matches any error in table tests.
+var errAny = errors.New("any error")
@@ -0,0 +1,376 @@
+package dimse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/tierklinik-dobersberg/logger"
+)
+
+// maxMoveContexts is the maximum number of presentation contexts
+// proposed to C-MOVE destinations. Each context uses an odd ID so
+// at most 128 are possible.
+const maxMoveContexts = 128
+
+var (
+	// findSOPClasses are the supported query/retrieve
+	// information models for C-FIND.
+	findSOPClasses = map[string]bool{
+		dicomuid.PatientRootQRFind: true,
+		dicomuid.StudyRootQRFind:   true,
+	}
+
+	// retrieveSOPClasses are the supported query/retrieve
+	// information models for C-GET and C-MOVE.
+	retrieveSOPClasses = map[string]bool{
+		dicomuid.PatientRootQRGet:  true,
+		dicomuid.StudyRootQRGet:    true,
+		dicomuid.PatientRootQRMove: true,
+		dicomuid.StudyRootQRMove:   true,
+	}
+)
+
+// handleFind handles a C-FIND request. Each match is sent using a
+// pending response followed by the final response.
+func (s *Server) handleFind(ctx context.Context, a *association, msg *message) error {
+	rsp := queryResponse(msg.command)
+
+	if !findSOPClasses[msg.context.abstractSyntax] {
+		rsp.Status = StatusSOPClassNotSupported
+		return a.writeMessage(msg.contextID, rsp, nil)
+	}
+
+	req, err := s.queryRequest(a, msg)
+	if err != nil {
+		return a.writeMessage(msg.contextID, failed(rsp, StatusCannotUnderstand, err), nil)
+	}
+
+	matches, err := s.opts.Find(ctx, req)
+	if err != nil {
+		a.log.WithFields(logger.Fields{
+			"level": req.Level,
+			"error": err.Error(),
+		}).Errorf("failed to perform C-FIND")
+
+		return a.writeMessage(msg.contextID, failed(rsp, errorStatus(err), err), nil)
+	}
+
+	a.log.WithFields(logger.Fields{
+		"level":   req.Level,
+		"matches": len(matches),
+	}).Infof("received C-FIND")
+
+	for _, match := range matches {
+		data, err := encodeDataSet(match, msg.context.transferSyntax)
+		if err != nil {
+			return err
+		}
+
+		pending := queryResponse(msg.command)
+		pending.Status = StatusPending
+		if err := a.writeMessage(msg.contextID, pending, data); err != nil {
+			return err
+		}
+	}
+
+	return a.writeMessage(msg.contextID, rsp, nil)
+}
+
+// handleRetrieve handles a C-GET or C-MOVE request. Instances are
+// sent using C-STORE sub-operations on the same association for
+// C-GET or on a new association with the move destination for
+// C-MOVE.
+func (s *Server) handleRetrieve(ctx context.Context, a *association, msg *message) error {
+	cmd := msg.command
+	rsp := queryResponse(cmd)
+
+	if !retrieveSOPClasses[msg.context.abstractSyntax] {
+		rsp.Status = StatusSOPClassNotSupported
+		return a.writeMessage(msg.contextID, rsp, nil)
+	}
+
+	req, err := s.queryRequest(a, msg)
+	if err != nil {
+		return a.writeMessage(msg.contextID, failed(rsp, StatusCannotUnderstand, err), nil)
+	}
+
+	var destAddr string
+	if cmd.CommandField == CMoveRQ {
+		var ok bool
+		destAddr, ok = s.opts.Destinations[strings.TrimSpace(cmd.MoveDestination)]
+		if !ok {
+			err := fmt.Errorf("unknown move destination %q", cmd.MoveDestination)
+			return a.writeMessage(msg.contextID, failed(rsp, StatusMoveDestinationUnknown, err), nil)
+		}
+	}
+
+	paths, err := s.opts.Retrieve(ctx, req)
+	if err != nil {
+		a.log.WithFields(logger.Fields{
+			"level": req.Level,
+			"error": err.Error(),
+		}).Errorf("failed to perform retrieve")
+
+		return a.writeMessage(msg.contextID, failed(rsp, errorStatus(err), err), nil)
+	}
+
+	if len(paths) == 0 {
+		rsp.SubOperations = &SubOperations{}
+		return a.writeMessage(msg.contextID, rsp, nil)
+	}
+
+	log := a.log.WithFields(logger.Fields{
+		"level":     req.Level,
+		"instances": len(paths),
+	})
+
+	// dest is the association used for the C-STORE
+	// sub-operations.
+	dest := a
+	if cmd.CommandField == CMoveRQ {
+		log = log.WithFields(logger.Fields{
+			"destination": cmd.MoveDestination,
+		})
+
+		dest, err = s.dialDestination(ctx, strings.TrimSpace(cmd.MoveDestination), destAddr, paths)
+		if err != nil {
+			log.Errorf("failed to connect to move destination: %s", err)
+
+			rsp.SubOperations = &SubOperations{Failed: uint16(len(paths))}
+			return a.writeMessage(msg.contextID, failed(rsp, StatusSubOperationsFailed, err), nil)
+		}
+		defer dest.conn.Close()
+	}
+
+	log.Infof("sending instances")
+
+	var (
+		ops        = &SubOperations{Remaining: uint16(len(paths))}
+		failedUID  []string
+		originator string
+	)
+	if cmd.CommandField == CMoveRQ {
+		originator = a.callingAETitle
+	}
+
+	a.cancelled = false
+	for _, path := range paths {
+		if a.cancelled {
+			break
+		}
+
+		ops.Remaining--
+
+		inst, err := ReadFile(path)
+		if err != nil {
+			log.Errorf("failed to read %s: %s", path, err)
+			ops.Failed++
+			continue
+		}
+
+		status, err := dest.sendStore(inst, originator, cmd.MessageID)
+		switch {
+		case errors.Is(err, errNoContext):
+			ops.Failed++
+			failedUID = append(failedUID, inst.SOPInstanceUID)
+
+		case err != nil:
+			if dest == a {
+				return err
+			}
+
+			// the move destination failed, all remaining
+			// sub-operations fail as well.
+			log.Errorf("failed to send instance: %s", err)
+			ops.Failed += ops.Remaining + 1
+			ops.Remaining = 0
+			failedUID = append(failedUID, inst.SOPInstanceUID)
+
+		case status == StatusSuccess:
+			ops.Completed++
+
+		case status&0xF000 == 0xB000:
+			ops.Warning++
+
+		default:
+			ops.Failed++
+			failedUID = append(failedUID, inst.SOPInstanceUID)
+		}
+
+		if ops.Remaining == 0 {
+			break
+		}
+
+		pending := queryResponse(cmd)
+		pending.Status = StatusPending
+		pending.SubOperations = &SubOperations{
+			Remaining: ops.Remaining,
+			Completed: ops.Completed,
+			Failed:    ops.Failed,
+			Warning:   ops.Warning,
+		}
+		if err := a.writeMessage(msg.contextID, pending, nil); err != nil {
+			return err
+		}
+	}
+
+	if dest != a {
+		if err := dest.release(); err != nil {
+			log.Errorf("failed to release association: %s", err)
+		}
+	}
+
+	rsp.SubOperations = ops
+	switch {
+	case a.cancelled:
+		rsp.Status = StatusCancel
+	case ops.Failed > 0 && ops.Completed+ops.Warning == 0:
+		rsp.Status = StatusSubOperationsFailed
+	case ops.Failed > 0 || ops.Warning > 0:
+		rsp.Status = StatusSubOperationsWarning
+	}
+
+	log.WithFields(logger.Fields{
+		"completed": ops.Completed,
+		"failed":    ops.Failed,
+		"warning":   ops.Warning,
+	}).Infof("instances sent")
+
+	// the identifier of the final response lists all instances
+	// that could not be sent.
+	var data []byte
+	if len(failedUID) > 0 {
+		data, err = encodeDataSet([]*dicom.Element{
+			dicom.MustNewElement(dicomtag.FailedSOPInstanceUIDList, stringValues(failedUID)...),
+		}, msg.context.transferSyntax)
+		if err != nil {
+			return err
+		}
+	}
+
+	return a.writeMessage(msg.contextID, rsp, data)
+}
+
+// dialDestination establishes an association with the C-MOVE
+// destination aeTitle at addr. A presentation context is proposed
+// for each combination of SOP class and transfer syntax of the
+// files at paths.
+func (s *Server) dialDestination(ctx context.Context, aeTitle, addr string, paths []string) (*association, error) {
+	var (
+		contexts []presentationContext
+		seen     = make(map[[2]string]bool)
+	)
+
+	for _, path := range paths {
+		meta, err := ReadFileMeta(path)
+		if err != nil {
+			// the error is reported when the file is
+			// sent.
+			continue
+		}
+
+		key := [2]string{meta.SOPClassUID, meta.TransferSyntaxUID}
+		if seen[key] || len(contexts) == maxMoveContexts {
+			continue
+		}
+		seen[key] = true
+
+		contexts = append(contexts, presentationContext{
+			id:               byte(2*len(contexts) + 1),
+			abstractSyntax:   meta.SOPClassUID,
+			transferSyntaxes: []string{meta.TransferSyntaxUID},
+		})
+	}
+
+	if len(contexts) == 0 {
+		return nil, fmt.Errorf("no instances to send")
+	}
+
+	a, err := dial(ctx, addr, s.opts.AETitle, aeTitle, contexts)
+	if err != nil {
+		return nil, err
+	}
+
+	a.log = s.log.WithFields(logger.Fields{
+		"destination": aeTitle,
+	})
+
+	return a, nil
+}
+
+// queryRequest decodes the identifier of the C-FIND, C-GET or
+// C-MOVE request msg.
+func (s *Server) queryRequest(a *association, msg *message) (*QueryRequest, error) {
+	if msg.data == nil {
+		return nil, fmt.Errorf("missing identifier")
+	}
+
+	elems, err := decodeDataSet(msg.data, msg.context.transferSyntax)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identifier: %w", err)
+	}
+
+	req := &QueryRequest{
+		CallingAETitle: a.callingAETitle,
+		SOPClassUID:    msg.context.abstractSyntax,
+		Identifier:     elems,
+	}
+
+	for _, elem := range elems {
+		if elem.Tag == dicomtag.QueryRetrieveLevel {
+			req.Level = strings.TrimSpace(elementString(elem))
+		}
+	}
+	if req.Level == "" {
+		return nil, fmt.Errorf("missing QueryRetrieveLevel")
+	}
+
+	return req, nil
+}
+
+// queryResponse returns the response to the C-FIND, C-GET or C-MOVE
+// request cmd.
+func queryResponse(cmd *Command) *Command {
+	return &Command{
+		CommandField:              cmd.CommandField | 0x8000,
+		AffectedSOPClassUID:       cmd.AffectedSOPClassUID,
+		MessageIDBeingRespondedTo: cmd.MessageID,
+		Status:                    StatusSuccess,
+	}
+}
+
+// errorStatus returns the status reported for err. See StatusError.
+func errorStatus(err error) uint16 {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Status
+	}
+
+	return StatusOutOfResources
+}
+
+// failed sets the status of rsp and reports err as error comment.
+func failed(rsp *Command, status uint16, err error) *Command {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		err = statusErr.Err
+	}
+
+	rsp.Status = status
+	rsp.ErrorComment = err.Error()
+	return rsp
+}
+
+// stringValues converts values to the value list of an element.
+func stringValues(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, v := range values {
+		result[i] = v
+	}
+	return result
+}
@@ -0,0 +1,487 @@
+package dimse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/tierklinik-dobersberg/logger"
+)
+
+// ImplementationClassUID and ImplementationVersionName identify dxray
+// during association negotiation and in the files it writes.
+const (
+	ImplementationClassUID    = "2.25.143907451392740812359264537102688945217"
+	ImplementationVersionName = "DXRAY"
+)
+
+const (
+	// maxPDULength is the maximum length of P-DATA-TF PDUs
+	// accepted from peers.
+	maxPDULength = 64 * 1024
+
+	// minPDULength is the smallest maximum PDU length accepted
+	// from peers. Shorter PDUs could not even carry a command set.
+	minPDULength = 1024
+
+	// maxCommandLength is the maximum length of a command set
+	// accepted from peers.
+	maxCommandLength = 64 * 1024
+
+	// DefaultMaxDataSetLength is the default maximum length of
+	// data sets accepted from peers.
+	DefaultMaxDataSetLength = 512 * 1024 * 1024
+
+	// idleTimeout is the time an association may be idle before
+	// it is aborted.
+	idleTimeout = 5 * time.Minute
+)
+
+// uncompressedTransferSyntaxes are accepted for all SOP classes that
+// don't transfer images.
+var uncompressedTransferSyntaxes = map[string]bool{
+	dicomuid.ImplicitVRLittleEndian: true,
+	dicomuid.ExplicitVRLittleEndian: true,
+}
+
+// Transfer syntaxes accepted for storage. Datasets are stored as
+// received so compressed transfer syntaxes are accepted as long as
+// their header can be parsed.
+var storageTransferSyntaxes = map[string]bool{
+	dicomuid.ImplicitVRLittleEndian: true,
+	dicomuid.ExplicitVRLittleEndian: true,
+	"1.2.840.10008.1.2.4.50":        true, // JPEG Baseline
+	"1.2.840.10008.1.2.4.51":        true, // JPEG Extended
+	"1.2.840.10008.1.2.4.57":        true, // JPEG Lossless
+	"1.2.840.10008.1.2.4.70":        true, // JPEG Lossless SV1
+	"1.2.840.10008.1.2.4.80":        true, // JPEG-LS Lossless
+	"1.2.840.10008.1.2.4.81":        true, // JPEG-LS Near-Lossless
+	"1.2.840.10008.1.2.4.90":        true, // JPEG 2000 Lossless
+	"1.2.840.10008.1.2.4.91":        true, // JPEG 2000
+	"1.2.840.10008.1.2.5":           true, // RLE Lossless
+}
+
+type (
+	// Options configures a Server.
+	Options struct {
+		// AETitle is the application entity title of the server.
+		// Associations for other AE titles are rejected.
+		AETitle string
+
+		// Store is called for each instance received using
+		// C-STORE. If Store is nil, storage SOP classes are
+		// not accepted. Return a *StatusError to control the
+		// status reported to the peer.
+		Store func(ctx context.Context, req *StoreRequest) error
+
+		// Find is called for each C-FIND request and returns
+		// the identifiers of all matches. If Find is nil, the
+		// query/retrieve find SOP classes are not accepted.
+		Find func(ctx context.Context, req *QueryRequest) ([][]*dicom.Element, error)
+
+		// Retrieve is called for each C-GET and C-MOVE request
+		// and returns the paths of the DICOM files to send. If
+		// Retrieve is nil, the query/retrieve get and move SOP
+		// classes are not accepted.
+		Retrieve func(ctx context.Context, req *QueryRequest) ([]string, error)
+
+		// Destinations maps the AE titles of C-MOVE
+		// destinations to their TCP address (host:port).
+		Destinations map[string]string
+
+		// MaxDataSetLength is the maximum length in bytes of
+		// data sets received from peers. Associations that
+		// exceed it are aborted. Defaults to
+		// DefaultMaxDataSetLength.
+		MaxDataSetLength int64
+
+		// Log is used to log associations and errors. Defaults
+		// to the default logger.
+		Log logger.Logger
+	}
+
+	// StoreRequest is an instance received using C-STORE.
+	StoreRequest struct {
+		// CallingAETitle is the AE title of the peer that sent
+		// the instance.
+		CallingAETitle string
+
+		SOPClassUID       string
+		SOPInstanceUID    string
+		TransferSyntaxUID string
+
+		// DataSet holds the data set encoded using
+		// TransferSyntaxUID and without file meta information.
+		DataSet []byte
+	}
+
+	// QueryRequest is a C-FIND, C-GET or C-MOVE request.
+	QueryRequest struct {
+		// CallingAETitle is the AE title of the peer that sent
+		// the request.
+		CallingAETitle string
+
+		// SOPClassUID is the SOP class of the query/retrieve
+		// information model.
+		SOPClassUID string
+
+		// Level is the value of QueryRetrieveLevel.
+		Level string
+
+		// Identifier holds the keys of the request.
+		Identifier []*dicom.Element
+	}
+
+	// StatusError is an error that is reported to the peer using
+	// Status.
+	StatusError struct {
+		Status uint16
+		Err    error
+	}
+
+	// Server accepts DICOM associations.
+	Server struct {
+		opts Options
+		log  logger.Logger
+
+		wg sync.WaitGroup
+	}
+)
+
+// Error implements error.
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status 0x%04x: %s", e.Status, e.Err)
+}
+
+// Unwrap returns the wrapped error.
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// NewServer returns a new server.
+func NewServer(opts Options) *Server {
+	log := opts.Log
+	if log == nil {
+		log = logger.DefaultLogger()
+	}
+
+	if opts.MaxDataSetLength <= 0 {
+		opts.MaxDataSetLength = DefaultMaxDataSetLength
+	}
+
+	return &Server{
+		opts: opts,
+		log:  log,
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves incoming
+// associations until ctx is cancelled.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ctx, l)
+}
+
+// Serve serves incoming associations on l until ctx is cancelled.
+// Running associations are aborted when ctx is cancelled.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	s.log.Infof("accepting DICOM associations for %s on %s", s.opts.AETitle, l.Addr())
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.wg.Wait()
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(ctx, conn)
+		}()
+	}
+}
+
+// serveConn negotiates an association on conn and handles all
+// requests until the association is released or aborted.
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	log := s.log.WithFields(logger.Fields{
+		"remote": conn.RemoteAddr().String(),
+	})
+
+	a, err := s.negotiate(conn)
+	if err != nil {
+		log.Errorf("failed to negotiate association: %s", err)
+		return
+	}
+	if a == nil {
+		return
+	}
+
+	log = log.WithFields(logger.Fields{
+		"calling": a.callingAETitle,
+	})
+	a.log = log
+	log.Infof("association established")
+
+	for {
+		msg, err := a.readMessage()
+		if errors.Is(err, errReleased) {
+			log.Infof("association released")
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, errAborted) && ctx.Err() == nil {
+				log.Errorf("aborting association: %s", err)
+				a.abort()
+			}
+			return
+		}
+
+		if err := s.handle(ctx, a, msg); err != nil {
+			log.Errorf("aborting association: %s", err)
+			a.abort()
+			return
+		}
+	}
+}
+
+// negotiate reads the A-ASSOCIATE-RQ from conn and either accepts
+// or rejects it. It returns nil if the association has been
+// rejected.
+func (s *Server) negotiate(conn net.Conn) (*association, error) {
+	conn.SetDeadline(time.Now().Add(idleTimeout))
+
+	typ, payload, err := readPDU(conn, maxPDULength)
+	if err != nil {
+		return nil, err
+	}
+	if typ != pduAssociateRQ {
+		writePDU(conn, pduAbort, encodeAbort())
+		return nil, fmt.Errorf("expected A-ASSOCIATE-RQ but got PDU type 0x%02x", typ)
+	}
+
+	rq, err := parseAssociateRQ(payload)
+	if err != nil {
+		writePDU(conn, pduAbort, encodeAbort())
+		return nil, err
+	}
+
+	if reason := s.checkAssociation(rq); reason != 0 {
+		s.log.WithFields(logger.Fields{
+			"remote":  conn.RemoteAddr().String(),
+			"calling": rq.callingAETitle,
+			"called":  rq.calledAETitle,
+			"reason":  reason,
+		}).Infof("rejecting association")
+
+		return nil, writePDU(conn, pduAssociateRJ, encodeAssociateRJ(reason))
+	}
+
+	a := &association{
+		conn:           conn,
+		callingAETitle: rq.callingAETitle,
+		maxSend:        rq.maxLength,
+		maxDataSet:     s.opts.MaxDataSetLength,
+		contexts:       make(map[byte]*acceptedContext),
+	}
+
+	ac := &associateAC{
+		calledAETitle:  rq.calledAETitle,
+		callingAETitle: rq.callingAETitle,
+		maxLength:      maxPDULength,
+	}
+	accepted := make(map[string]bool)
+	for _, pc := range rq.contexts {
+		result := s.negotiateContext(pc)
+		ac.contexts = append(ac.contexts, result)
+
+		if result.result == contextAccepted {
+			a.contexts[pc.id] = &acceptedContext{
+				abstractSyntax: pc.abstractSyntax,
+				transferSyntax: result.transferSyntax,
+			}
+			accepted[pc.abstractSyntax] = true
+		}
+	}
+
+	// C-GET requestors propose to act as SCP for the storage SOP
+	// classes of the instances they retrieve.
+	if s.opts.Retrieve != nil {
+		for _, role := range rq.roles {
+			if accepted[role.sopClassUID] && IsStorageSOPClass(role.sopClassUID) {
+				ac.roles = append(ac.roles, role)
+			}
+		}
+	}
+
+	if err := writePDU(conn, pduAssociateAC, ac.encode()); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// checkAssociation returns the reason for rejecting rq or zero if
+// the association may be accepted.
+func (s *Server) checkAssociation(rq *associateRQ) byte {
+	if rq.appContext != applicationContextName {
+		return rejectApplicationContext
+	}
+
+	if !strings.EqualFold(rq.calledAETitle, s.opts.AETitle) {
+		return rejectCalledAETitleUnrecognized
+	}
+
+	// a maximum length of zero means unlimited.
+	if rq.maxLength != 0 && rq.maxLength < minPDULength {
+		return rejectNoReason
+	}
+
+	return 0
+}
+
+// negotiateContext decides whether the presentation context pc is
+// accepted and selects its transfer syntax. The first transfer
+// syntax proposed by the peer that is supported is used.
+func (s *Server) negotiateContext(pc presentationContext) presentationContextResult {
+	result := presentationContextResult{
+		id:             pc.id,
+		result:         contextAbstractSyntaxUnsupported,
+		transferSyntax: dicomuid.ImplicitVRLittleEndian,
+	}
+
+	var supported map[string]bool
+	switch {
+	case pc.abstractSyntax == dicomuid.VerificationSOPClass:
+		supported = uncompressedTransferSyntaxes
+
+	case s.opts.Find != nil && findSOPClasses[pc.abstractSyntax]:
+		supported = uncompressedTransferSyntaxes
+
+	case s.opts.Retrieve != nil && retrieveSOPClasses[pc.abstractSyntax]:
+		supported = uncompressedTransferSyntaxes
+
+	case (s.opts.Store != nil || s.opts.Retrieve != nil) && IsStorageSOPClass(pc.abstractSyntax):
+		supported = storageTransferSyntaxes
+
+	default:
+		return result
+	}
+
+	result.result = contextTransferSyntaxUnsupported
+	for _, ts := range pc.transferSyntaxes {
+		if supported[ts] {
+			result.result = contextAccepted
+			result.transferSyntax = ts
+			break
+		}
+	}
+
+	return result
+}
+
+// handle handles a single request received on association a.
+// Errors returned abort the association.
+func (s *Server) handle(ctx context.Context, a *association, msg *message) error {
+	cmd := msg.command
+
+	rsp := &Command{
+		CommandField:              cmd.CommandField | 0x8000,
+		AffectedSOPClassUID:       cmd.AffectedSOPClassUID,
+		MessageIDBeingRespondedTo: cmd.MessageID,
+		AffectedSOPInstanceUID:    cmd.AffectedSOPInstanceUID,
+		Status:                    StatusSuccess,
+	}
+
+	switch cmd.CommandField {
+	case CEchoRQ:
+		a.log.Infof("received C-ECHO")
+
+	case CStoreRQ:
+		if s.opts.Store == nil || !IsStorageSOPClass(msg.context.abstractSyntax) {
+			rsp.Status = StatusSOPClassNotSupported
+			break
+		}
+
+		err := s.opts.Store(ctx, &StoreRequest{
+			CallingAETitle:    a.callingAETitle,
+			SOPClassUID:       cmd.AffectedSOPClassUID,
+			SOPInstanceUID:    cmd.AffectedSOPInstanceUID,
+			TransferSyntaxUID: msg.context.transferSyntax,
+			DataSet:           msg.data,
+		})
+		if err != nil {
+			a.log.WithFields(logger.Fields{
+				"instance": cmd.AffectedSOPInstanceUID,
+				"error":    err.Error(),
+			}).Errorf("failed to store instance")
+
+			failed(rsp, errorStatus(err), err)
+		}
+
+	case CFindRQ:
+		return s.handleFind(ctx, a, msg)
+
+	case CGetRQ, CMoveRQ:
+		return s.handleRetrieve(ctx, a, msg)
+
+	case CCancelRQ:
+		// C-FIND, C-GET and C-MOVE requests are completed
+		// before the next message is read so there is
+		// nothing left to cancel.
+		return nil
+
+	default:
+		rsp.Status = StatusUnrecognizedOperation
+	}
+
+	return a.writeMessage(msg.contextID, rsp, nil)
+}
+
+// storageSOPClassPrefix is the common prefix of all composite
+// instance storage SOP classes.
+const storageSOPClassPrefix = "1.2.840.10008.5.1.4.1.1."
+
+// IsStorageSOPClass returns true if uid is a standard storage SOP
+// class.
+func IsStorageSOPClass(uid string) bool {
+	if !strings.HasPrefix(uid, storageSOPClassPrefix) {
+		return false
+	}
+
+	info, err := dicomuid.Lookup(uid)
+	if err != nil {
+		return false
+	}
+
+	return info.Type == dicomuid.TypeSOPClass && strings.Contains(info.Name, "Storage")
+}
@@ -0,0 +1,216 @@
+package dimse
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/grailbio/go-dicom/dicomuid"
+)
+
+// crImageStorage is the SOP class used for test instances.
+const crImageStorage = "1.2.840.10008.5.1.4.1.1.1"
+
+func TestServerEchoAndStore(t *testing.T) {
+	stored := make(chan *StoreRequest, 1)
+
+	addr, stop := startServer(t, Options{
+		AETitle:          "DXRAY",
+		MaxDataSetLength: 256 * 1024,
+		Store: func(ctx context.Context, req *StoreRequest) error {
+			stored <- req
+			return nil
+		},
+	})
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	a, err := requestAssociation(conn, "MODALITY", "DXRAY", []presentationContext{
+		{id: 1, abstractSyntax: dicomuid.VerificationSOPClass, transferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian}},
+		{id: 3, abstractSyntax: crImageStorage, transferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian}},
+	})
+	if err != nil {
+		t.Fatalf("failed to request association: %s", err)
+	}
+
+	// C-ECHO
+	err = a.writeMessage(1, &Command{
+		CommandField:        CEchoRQ,
+		AffectedSOPClassUID: dicomuid.VerificationSOPClass,
+		MessageID:           1,
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to send C-ECHO: %s", err)
+	}
+
+	msg, err := a.readMessage()
+	if err != nil {
+		t.Fatalf("failed to read C-ECHO response: %s", err)
+	}
+	if msg.command.CommandField != CEchoRSP || msg.command.Status != StatusSuccess {
+		t.Fatalf("got C-ECHO response 0x%04x with status 0x%04x", msg.command.CommandField, msg.command.Status)
+	}
+
+	// C-STORE of a data set that spans multiple PDUs.
+	data := bytes.Repeat([]byte{0xAB}, 3*maxPDULength)
+	status, err := a.sendStore(&StoreRequest{
+		SOPClassUID:       crImageStorage,
+		SOPInstanceUID:    "1.2.3.4.5",
+		TransferSyntaxUID: dicomuid.ImplicitVRLittleEndian,
+		DataSet:           data,
+	}, "", 0)
+	if err != nil {
+		t.Fatalf("failed to send C-STORE: %s", err)
+	}
+	if status != StatusSuccess {
+		t.Fatalf("got C-STORE status 0x%04x", status)
+	}
+
+	req := <-stored
+	if req.CallingAETitle != "MODALITY" || req.SOPClassUID != crImageStorage || req.SOPInstanceUID != "1.2.3.4.5" {
+		t.Errorf("got store request %q %q %q", req.CallingAETitle, req.SOPClassUID, req.SOPInstanceUID)
+	}
+	if req.TransferSyntaxUID != dicomuid.ImplicitVRLittleEndian {
+		t.Errorf("got transfer syntax %q", req.TransferSyntaxUID)
+	}
+	if !bytes.Equal(req.DataSet, data) {
+		t.Errorf("got data set of %d bytes, want %d", len(req.DataSet), len(data))
+	}
+
+	if err := a.release(); err != nil {
+		t.Fatalf("failed to release association: %s", err)
+	}
+}
+
+func TestServerAbortsOversizeDataSet(t *testing.T) {
+	addr, stop := startServer(t, Options{
+		AETitle:          "DXRAY",
+		MaxDataSetLength: 1024,
+		Store: func(ctx context.Context, req *StoreRequest) error {
+			t.Errorf("unexpected store request")
+			return nil
+		},
+	})
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	a, err := requestAssociation(conn, "MODALITY", "DXRAY", []presentationContext{
+		{id: 1, abstractSyntax: crImageStorage, transferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian}},
+	})
+	if err != nil {
+		t.Fatalf("failed to request association: %s", err)
+	}
+
+	_, err = a.sendStore(&StoreRequest{
+		SOPClassUID:       crImageStorage,
+		SOPInstanceUID:    "1.2.3.4.5",
+		TransferSyntaxUID: dicomuid.ImplicitVRLittleEndian,
+		DataSet:           make([]byte, 2048),
+	}, "", 0)
+	if err != errAborted {
+		t.Fatalf("got error %v, want %v", err, errAborted)
+	}
+}
+
+func TestServerRejectsUnknownAETitle(t *testing.T) {
+	addr, stop := startServer(t, Options{AETitle: "DXRAY"})
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = requestAssociation(conn, "MODALITY", "OTHER", []presentationContext{
+		{id: 1, abstractSyntax: dicomuid.VerificationSOPClass, transferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian}},
+	})
+
+	rj, ok := err.(*associateRJError)
+	if !ok {
+		t.Fatalf("got error %v, want association rejection", err)
+	}
+	if rj.reason != rejectCalledAETitleUnrecognized {
+		t.Errorf("got reject reason %d", rj.reason)
+	}
+}
+
+func TestServerRejectsTinyMaximumLength(t *testing.T) {
+	addr, stop := startServer(t, Options{AETitle: "DXRAY"})
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	rq := &associateRQ{
+		calledAETitle:  "DXRAY",
+		callingAETitle: "MODALITY",
+		contexts: []presentationContext{
+			{id: 1, abstractSyntax: dicomuid.VerificationSOPClass, transferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian}},
+		},
+		maxLength: 6,
+	}
+	if err := writePDU(conn, pduAssociateRQ, rq.encode()); err != nil {
+		t.Fatal(err)
+	}
+
+	typ, payload, err := readPDU(conn, maxPDULength)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	if typ != pduAssociateRJ {
+		t.Fatalf("got PDU type 0x%02x, want A-ASSOCIATE-RJ", typ)
+	}
+	if rj, ok := parseAssociateRJ(payload).(*associateRJError); !ok || rj.reason != rejectNoReason {
+		t.Errorf("got rejection %v", parseAssociateRJ(payload))
+	}
+}
+
+func TestWriteFragmentsTinyMaximumLength(t *testing.T) {
+	for _, maxSend := range []uint32{1, 5, 6} {
+		client, server := net.Pipe()
+
+		a := &association{conn: client, maxSend: maxSend}
+		if err := a.writeFragments(1, false, []byte{1, 2, 3}); err == nil {
+			t.Errorf("expected an error for a maximum length of %d", maxSend)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+// startServer serves opts on a loopback listener and returns its
+// address and a function that stops the server.
+func startServer(t *testing.T, opts Options) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewServer(opts).Serve(ctx, l)
+	}()
+
+	return l.Addr().String(), func() {
+		cancel()
+		<-done
+	}
+}
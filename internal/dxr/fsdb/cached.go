@@ -0,0 +1,233 @@
+package fsdb
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/models"
+)
+
+type (
+	// modelCache is a LRU cache of parsed study.xml models keyed by
+	// the study path. Entries are only valid as long as modification
+	// time and size of the study.xml file do not change.
+	modelCache struct {
+		size int
+
+		l       sync.Mutex
+		entries map[string]*list.Element
+		lru     *list.List
+	}
+
+	modelEntry struct {
+		path    string
+		modTime time.Time
+		size    int64
+		model   *models.ImageList
+	}
+
+	// cachedDB wraps a DB and memoizes the models of all studies
+	// opened through it.
+	cachedDB struct {
+		DB
+		cache *modelCache
+	}
+
+	// cachedVolume wraps a Volume so all studies opened through
+	// it use the model cache.
+	cachedVolume struct {
+		Volume
+		cache *modelCache
+	}
+
+	// cachedStudy wraps a Study and loads its model from the
+	// model cache, if possible.
+	cachedStudy struct {
+		Study
+		vol   *cachedVolume
+		cache *modelCache
+
+		l     sync.Mutex
+		model *models.ImageList
+	}
+)
+
+// NewCached returns a DB that wraps db and keeps the parsed
+// study.xml models of up to size studies in memory. Models are
+// re-parsed once their study.xml file is modified.
+func NewCached(db DB, size int) DB {
+	return &cachedDB{
+		DB: db,
+		cache: &modelCache{
+			size:    size,
+			entries: make(map[string]*list.Element),
+			lru:     list.New(),
+		},
+	}
+}
+
+// OpenVolumeByName opens the database volume with the given name.
+// It implements the DB interface
+func (d *cachedDB) OpenVolumeByName(name string) (Volume, error) {
+	return d.wrap(d.DB.OpenVolumeByName(name))
+}
+
+// OpenVolumeByIdx opens the database volume with the given index.
+// It implements the DB interface
+func (d *cachedDB) OpenVolumeByIdx(idx int) (Volume, error) {
+	return d.wrap(d.DB.OpenVolumeByIdx(idx))
+}
+
+// ForEachVolume calls fn for each volume in the database.
+// It implements the DB interface
+func (d *cachedDB) ForEachVolume(fn func(Volume) error) error {
+	return d.DB.ForEachVolume(func(vol Volume) error {
+		return fn(&cachedVolume{Volume: vol, cache: d.cache})
+	})
+}
+
+func (d *cachedDB) wrap(vol Volume, err error) (Volume, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachedVolume{Volume: vol, cache: d.cache}, nil
+}
+
+// OpenStudyByName opens the study with the given name
+// It implements the Volume interface
+func (v *cachedVolume) OpenStudyByName(name string) (Study, error) {
+	return v.wrap(v.Volume.OpenStudyByName(name))
+}
+
+// First returns the first study in the volume
+// It implements the Volume interface
+func (v *cachedVolume) First() (Study, error) {
+	return v.wrap(v.Volume.First())
+}
+
+// Last returns the last study in the volume
+// It implements the Volume interface
+func (v *cachedVolume) Last() (Study, error) {
+	return v.wrap(v.Volume.Last())
+}
+
+// ForEachStudy executes fn for each study inside the volume
+// It implements the Volume interface
+func (v *cachedVolume) ForEachStudy(fn func(Study) error) error {
+	return v.Volume.ForEachStudy(func(s Study) error {
+		return fn(&cachedStudy{Study: s, vol: v, cache: v.cache})
+	})
+}
+
+func (v *cachedVolume) wrap(s Study, err error) (Study, error) {
+	if err != nil || s == nil {
+		return nil, err
+	}
+
+	return &cachedStudy{Study: s, vol: v, cache: v.cache}, nil
+}
+
+// Volume returns the ORconsoleDB volume that contains the
+// study. It implements the Study interface.
+func (s *cachedStudy) Volume() Volume {
+	return s.vol
+}
+
+// Load returns the cached model of the study or parses the
+// study.xml file if it has been modified. It implements the
+// Study interface.
+func (s *cachedStudy) Load() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	stat, err := s.Study.Stat()
+	if err != nil {
+		return err
+	}
+
+	if model := s.cache.get(s.Path(), stat); model != nil {
+		s.model = model
+		return nil
+	}
+
+	if err := s.Study.Load(); err != nil {
+		return err
+	}
+
+	model, _ := s.Study.Model()
+	s.model = &model
+	s.cache.add(&modelEntry{
+		path:    s.Path(),
+		modTime: stat.ModTime(),
+		size:    stat.Size(),
+		model:   s.model,
+	})
+
+	return nil
+}
+
+// Model returns the ImageList model and a boolean indicating
+// if it has already been loaded. It implements the Study
+// interface. The model is shared with other studies through the
+// cache so a deep copy is returned.
+func (s *cachedStudy) Model() (models.ImageList, bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.model == nil {
+		return s.Study.Model()
+	}
+
+	return copyModel(*s.model), true
+}
+
+// copyModel returns a deep copy of model.
+func copyModel(model models.ImageList) models.ImageList {
+	study := &model.Patient.Visit.Study
+
+	study.Series = append([]models.Series(nil), study.Series...)
+	for i := range study.Series {
+		study.Series[i].Instances = append([]models.Instance(nil), study.Series[i].Instances...)
+	}
+
+	return model
+}
+
+func (c *modelCache) get(path string, stat os.FileInfo) *models.ImageList {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	elem, ok := c.entries[path]
+	if !ok {
+		return nil
+	}
+
+	entry := elem.Value.(*modelEntry)
+	if !entry.modTime.Equal(stat.ModTime()) || entry.size != stat.Size() {
+		c.lru.Remove(elem)
+		delete(c.entries, path)
+		return nil
+	}
+
+	c.lru.MoveToFront(elem)
+	return entry.model
+}
+
+func (c *modelCache) add(entry *modelEntry) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if elem, ok := c.entries[entry.path]; ok {
+		c.lru.Remove(elem)
+	}
+	c.entries[entry.path] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*modelEntry).path)
+	}
+}
@@ -15,6 +15,9 @@ import (
 type (
 	// DB abstracts access to studies and series stored ina ORconsoleDB folder
 	DB interface {
+		// Path returns the path to the ORconsoleDB folder
+		Path() string
+
 		// VolumeNames returns a list of volume names
 		VolumeNames() ([]string, error)
 
@@ -57,6 +60,12 @@ func New(path string, log logger.Logger) (DB, error) {
 	}, nil
 }
 
+// Path returns the path to the ORconsoleDB folder.
+// It implements the DB interface
+func (d *db) Path() string {
+	return d.rootPath
+}
+
 // VolumeNames returns a list of volume names in the ORconsoleDB
 // directory
 func (d *db) VolumeNames() ([]string, error) {
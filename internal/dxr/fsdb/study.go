@@ -1,7 +1,10 @@
 package fsdb
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -10,6 +13,14 @@ import (
 	"github.com/tierklinik-dobersberg/dxray/internal/dxr/models"
 )
 
+// dbPathPrefix is the prefix of all paths referenced in study.xml.
+// It denotes the root of the ORconsoleDB.
+const dbPathPrefix = "/dicompacs/orconsoledb/"
+
+// ErrInvalidPath is returned by Study.RealPath if a referenced path
+// is not part of the ORconsoleDB.
+var ErrInvalidPath = errors.New("invalid path")
+
 type (
 	// Study abstracts access to study folders stored inside ORconsoleDB
 	// volumes
@@ -37,7 +48,11 @@ type (
 		Model() (models.ImageList, bool)
 
 		// RealPath returns the real path of a file referenced in the study
-		RealPath(p string) string
+		RealPath(p string) (string, error)
+
+		// Stat returns file information about the study.xml file
+		// of the study
+		Stat() (os.FileInfo, error)
 	}
 
 	// study implements the Study interface
@@ -105,7 +120,6 @@ func (s *study) Model() (models.ImageList, bool) {
 
 func (s *study) load() error {
 	path := filepath.Join(s.Path(), "study.xml")
-	fmt.Println(path)
 	model, err := models.FromFile(path)
 	if err != nil {
 		return err
@@ -124,13 +138,27 @@ func (s *study) ensureLoaded() error {
 	return nil
 }
 
-func (s *study) RealPath(p string) string {
-	slashed := filepath.ToSlash(p)
-	lower := strings.ToLower(slashed)
-	prefix := "/dicompacs/orconsoledb/"
-	if !strings.HasPrefix(lower, prefix) {
-		return slashed
+// RealPath returns the real path of a file referenced in the study.
+// DX-R stores Windows paths below \DICOMPACS\ORCONSOLEDB\ so
+// backslashes are always treated as path separators. Paths without
+// that prefix or outside of the database are rejected with
+// ErrInvalidPath.
+func (s *study) RealPath(p string) (string, error) {
+	slashed := strings.ReplaceAll(filepath.ToSlash(p), "\\", "/")
+	if !strings.HasPrefix(strings.ToLower(slashed), dbPathPrefix) {
+		return "", fmt.Errorf("%w %q", ErrInvalidPath, p)
 	}
 
-	return filepath.Join(s.db.rootPath, slashed[len(prefix):])
+	rel := path.Clean(slashed[len(dbPathPrefix):])
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%w %q", ErrInvalidPath, p)
+	}
+
+	return filepath.Join(s.db.rootPath, filepath.FromSlash(rel)), nil
+}
+
+// Stat returns file information about the study.xml file
+// of the study. It implements the Study interface.
+func (s *study) Stat() (os.FileInfo, error) {
+	return os.Stat(filepath.Join(s.Path(), "study.xml"))
 }
@@ -0,0 +1,52 @@
+package fsdb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestRealPath(t *testing.T) {
+	root := filepath.FromSlash("/mnt/orconsoledb")
+	s := &study{db: &db{rootPath: root}}
+
+	cases := []struct {
+		path string
+		want string
+	}{
+		{`\DICOMPACS\ORCONSOLEDB\VOL00001\0001_1\I_000000.dcm`, "VOL00001/0001_1/I_000000.dcm"},
+		{`\dicompacs\OrConsoleDB\VOL00001\0001_1\S128_000000.jpg`, "VOL00001/0001_1/S128_000000.jpg"},
+		{`/DICOMPACS/ORCONSOLEDB/VOL00001/0001_1/I_000000.dcm`, "VOL00001/0001_1/I_000000.dcm"},
+		{`\DICOMPACS\ORCONSOLEDB\VOL00001\.\0001_1\\I_000000.dcm`, "VOL00001/0001_1/I_000000.dcm"},
+		{`\DICOMPACS\ORCONSOLEDB\VOL00001\..\VOL00002\0001_1\I_000000.dcm`, "VOL00002/0001_1/I_000000.dcm"},
+
+		// paths outside of the database are rejected.
+		{`VOL00001\0001_1\I_000000.dcm`, ""},
+		{`C:\DICOMPACS\ORCONSOLEDB\VOL00001\0001_1\I_000000.dcm`, ""},
+		{`\DICOMPACS\VOL00001\0001_1\I_000000.dcm`, ""},
+		{`\DICOMPACS\ORCONSOLEDB`, ""},
+		{`\DICOMPACS\ORCONSOLEDB\`, ""},
+		{`\DICOMPACS\ORCONSOLEDB\..\..\etc\passwd`, ""},
+		{`\DICOMPACS\ORCONSOLEDB\VOL00001\..\..\secret`, ""},
+		{`/etc/passwd`, ""},
+		{``, ""},
+	}
+
+	for _, c := range cases {
+		got, err := s.RealPath(c.path)
+		if c.want == "" {
+			if !errors.Is(err, ErrInvalidPath) {
+				t.Errorf("RealPath(%q) = %q, %v; expected ErrInvalidPath", c.path, got, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("RealPath(%q): unexpected error: %s", c.path, err)
+			continue
+		}
+		if want := filepath.Join(root, filepath.FromSlash(c.want)); got != want {
+			t.Errorf("RealPath(%q) = %q, want %q", c.path, got, want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package fsdb
+
+import (
+	"os"
+)
+
+// unionDB combines multiple databases into one.
+type unionDB struct {
+	dbs []DB
+}
+
+// NewUnion returns a DB that contains the volumes of all dbs. The
+// path of the union is the path of the first database. If multiple
+// databases contain a volume with the same name, the volume of the
+// first one is used.
+func NewUnion(dbs ...DB) DB {
+	return &unionDB{
+		dbs: dbs,
+	}
+}
+
+// Path returns the path of the first database.
+// It implements the DB interface
+func (u *unionDB) Path() string {
+	return u.dbs[0].Path()
+}
+
+// VolumeNames returns the volume names of all databases.
+// It implements the DB interface
+func (u *unionDB) VolumeNames() ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+
+	for _, db := range u.dbs {
+		dbNames, err := db.VolumeNames()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range dbNames {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// OpenVolumeByName opens the volume name of the first database that
+// contains it.
+// It implements the DB interface
+func (u *unionDB) OpenVolumeByName(name string) (Volume, error) {
+	return u.open(func(db DB) (Volume, error) {
+		return db.OpenVolumeByName(name)
+	})
+}
+
+// OpenVolumeByIdx opens the volume idx of the first database that
+// contains it.
+// It implements the DB interface
+func (u *unionDB) OpenVolumeByIdx(idx int) (Volume, error) {
+	return u.open(func(db DB) (Volume, error) {
+		return db.OpenVolumeByIdx(idx)
+	})
+}
+
+// ForEachVolume calls fn for each volume of all databases.
+// It implements the DB interface
+func (u *unionDB) ForEachVolume(fn func(Volume) error) error {
+	names, err := u.VolumeNames()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		vol, err := u.OpenVolumeByName(name)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(vol); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// open calls fn for each database until a volume is found.
+func (u *unionDB) open(fn func(DB) (Volume, error)) (Volume, error) {
+	var lastErr error
+	for _, db := range u.dbs {
+		vol, err := fn(db)
+		if err == nil {
+			return vol, nil
+		}
+
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
@@ -0,0 +1,310 @@
+package export
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/tierklinik-dobersberg/dxray/internal/dimse"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/models"
+)
+
+const (
+	// mediaStorageDirectoryStorage is the SOP class of the
+	// DICOMDIR.
+	mediaStorageDirectoryStorage = "1.2.840.10008.1.3.10"
+
+	// fileSetID identifies the file set of an export.
+	fileSetID = "DXRAY"
+
+	// recordInUse marks a directory record as in use.
+	recordInUse = 0xFFFF
+)
+
+type (
+	// imageRecord describes an instance referenced by the
+	// DICOMDIR.
+	imageRecord struct {
+		fileID            []string
+		number            int
+		sopClassUID       string
+		sopInstanceUID    string
+		transferSyntaxUID string
+	}
+
+	// studyRecords holds a study and the image records of each
+	// of its series.
+	studyRecords struct {
+		model  models.ImageList
+		series [][]imageRecord
+	}
+
+	// directoryRecord is an item of the directory record
+	// sequence. Next and lower are the indexes of the next
+	// record on the same level and of the first record of the
+	// lower level, or -1.
+	directoryRecord struct {
+		typ   string
+		keys  []*dicom.Element
+		next  int
+		lower int
+	}
+)
+
+// encodeDICOMDir returns the DICOMDIR file for studies.
+func encodeDICOMDir(studies []studyRecords) ([]byte, error) {
+	records, last := directoryRecords(studies)
+
+	// the size of a record does not depend on the offsets it
+	// contains so the records are encoded once to calculate
+	// the offset of each record.
+	var (
+		items  = make([][]byte, len(records))
+		seqLen int
+	)
+	for i, r := range records {
+		data, err := r.encode(0, 0)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = data
+		seqLen += len(data)
+	}
+
+	uid := newUID()
+	header, err := encodeDirHeader(uid, 0, 0, uint32(seqLen))
+	if err != nil {
+		return nil, err
+	}
+
+	// offsets are relative to the first byte of the file
+	offsets := make([]uint32, len(records))
+	pos := len(header)
+	for i, data := range items {
+		offsets[i] = uint32(pos)
+		pos += len(data)
+	}
+
+	offsetOf := func(idx int) uint32 {
+		if idx < 0 {
+			return 0
+		}
+		return offsets[idx]
+	}
+
+	header, err = encodeDirHeader(uid, offsets[0], offsets[last], uint32(seqLen))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, 0, pos)
+	result = append(result, header...)
+	for _, r := range records {
+		data, err := r.encode(offsetOf(r.next), offsetOf(r.lower))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, data...)
+	}
+
+	return result, nil
+}
+
+// directoryRecords returns the directory records for studies in
+// the order they are stored together with the index of the last
+// record of the root directory entity. Studies are grouped by
+// patient and the patient records form the root directory entity.
+func directoryRecords(studies []studyRecords) ([]*directoryRecord, int) {
+	var (
+		records  []*directoryRecord
+		patients []string
+		byID     = make(map[string][]studyRecords)
+	)
+
+	for _, s := range studies {
+		id := s.model.Patient.ID
+		if _, ok := byID[id]; !ok {
+			patients = append(patients, id)
+		}
+		byID[id] = append(byID[id], s)
+	}
+
+	// add appends r as the next record after *last or as the
+	// first lower level record of parent.
+	add := func(r *directoryRecord, parent int, last *int) int {
+		idx := len(records)
+		switch {
+		case *last >= 0:
+			records[*last].next = idx
+		case parent >= 0:
+			records[parent].lower = idx
+		}
+		*last = idx
+
+		r.next = -1
+		r.lower = -1
+		records = append(records, r)
+
+		return idx
+	}
+
+	lastPatient := -1
+	for _, id := range patients {
+		patient := byID[id][0].model.Patient
+		patientIdx := add(&directoryRecord{
+			typ: "PATIENT",
+			keys: []*dicom.Element{
+				dicom.MustNewElement(dicomtag.SpecificCharacterSet, "ISO_IR 192"),
+				dicom.MustNewElement(dicomtag.PatientName, patient.Name),
+				dicom.MustNewElement(dicomtag.PatientID, patient.ID),
+				dicom.MustNewElement(dicomtag.PatientBirthDate, patient.Birth),
+				dicom.MustNewElement(dicomtag.PatientSex, patient.Sex),
+			},
+		}, -1, &lastPatient)
+
+		lastStudy := -1
+		for _, s := range byID[id] {
+			study := s.model.Patient.Visit.Study
+			studyIdx := add(&directoryRecord{
+				typ: "STUDY",
+				keys: []*dicom.Element{
+					dicom.MustNewElement(dicomtag.SpecificCharacterSet, "ISO_IR 192"),
+					dicom.MustNewElement(dicomtag.StudyDate, study.Date),
+					dicom.MustNewElement(dicomtag.StudyTime, ""),
+					dicom.MustNewElement(dicomtag.AccessionNumber, ""),
+					dicom.MustNewElement(dicomtag.StudyDescription, study.Description),
+					dicom.MustNewElement(dicomtag.StudyInstanceUID, study.UID),
+					dicom.MustNewElement(dicomtag.StudyID, ""),
+				},
+			}, patientIdx, &lastStudy)
+
+			lastSeries := -1
+			for seriesIdx, series := range study.Series {
+				if len(s.series[seriesIdx]) == 0 {
+					continue
+				}
+
+				seriesRecord := add(&directoryRecord{
+					typ: "SERIES",
+					keys: []*dicom.Element{
+						dicom.MustNewElement(dicomtag.SpecificCharacterSet, "ISO_IR 192"),
+						dicom.MustNewElement(dicomtag.Modality, series.Modality),
+						dicom.MustNewElement(dicomtag.SeriesDescription, series.Description),
+						dicom.MustNewElement(dicomtag.SeriesInstanceUID, series.UID),
+						dicom.MustNewElement(dicomtag.SeriesNumber, strconv.Itoa(series.Number)),
+					},
+				}, studyIdx, &lastSeries)
+
+				lastImage := -1
+				for _, img := range s.series[seriesIdx] {
+					add(&directoryRecord{
+						typ: "IMAGE",
+						keys: []*dicom.Element{
+							dicom.MustNewElement(dicomtag.ReferencedFileID, stringValues(img.fileID)...),
+							dicom.MustNewElement(dicomtag.ReferencedSOPClassUIDInFile, img.sopClassUID),
+							dicom.MustNewElement(dicomtag.ReferencedSOPInstanceUIDInFile, img.sopInstanceUID),
+							dicom.MustNewElement(dicomtag.ReferencedTransferSyntaxUIDInFile, img.transferSyntaxUID),
+							dicom.MustNewElement(dicomtag.InstanceNumber, strconv.Itoa(img.number)),
+						},
+					}, seriesRecord, &lastImage)
+				}
+			}
+		}
+	}
+
+	return records, lastPatient
+}
+
+// encode encodes the record as sequence item using the offsets
+// next and lower.
+func (r *directoryRecord) encode(next, lower uint32) ([]byte, error) {
+	body := dicomio.NewBytesEncoder(binary.LittleEndian, dicomio.ExplicitVR)
+	writeUP(body, dicomtag.OffsetOfTheNextDirectoryRecord, next)
+	dicom.WriteElement(body, dicom.MustNewElement(dicomtag.RecordInUseFlag, uint16(recordInUse)))
+	writeUP(body, dicomtag.OffsetOfReferencedLowerLevelDirectoryEntity, lower)
+	dicom.WriteElement(body, dicom.MustNewElement(dicomtag.DirectoryRecordType, r.typ))
+	for _, elem := range r.keys {
+		dicom.WriteElement(body, elem)
+	}
+	if err := body.Error(); err != nil {
+		return nil, err
+	}
+
+	e := dicomio.NewBytesEncoder(binary.LittleEndian, dicomio.ExplicitVR)
+	e.WriteUInt16(dicomtag.Item.Group)
+	e.WriteUInt16(dicomtag.Item.Element)
+	e.WriteUInt32(uint32(len(body.Bytes())))
+	e.WriteBytes(body.Bytes())
+
+	return e.Bytes(), e.Error()
+}
+
+// encodeDirHeader encodes the file meta information and all
+// elements of the DICOMDIR with the instance UID uid up to the
+// first item of the directory record sequence. first and last are
+// the offsets of the first and last patient record and seqLen the
+// length of all records.
+func encodeDirHeader(uid string, first, last, seqLen uint32) ([]byte, error) {
+	e := dicomio.NewBytesEncoder(binary.LittleEndian, dicomio.ExplicitVR)
+	dicom.WriteFileHeader(e, []*dicom.Element{
+		dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, mediaStorageDirectoryStorage),
+		dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, uid),
+		dicom.MustNewElement(dicomtag.TransferSyntaxUID, dicomuid.ExplicitVRLittleEndian),
+		dicom.MustNewElement(dicomtag.ImplementationClassUID, dimse.ImplementationClassUID),
+		dicom.MustNewElement(dicomtag.ImplementationVersionName, dimse.ImplementationVersionName),
+	})
+
+	dicom.WriteElement(e, dicom.MustNewElement(dicomtag.FileSetID, fileSetID))
+	writeUP(e, dicomtag.OffsetOfTheFirstDirectoryRecordOfTheRootDirectoryEntity, first)
+	writeUP(e, dicomtag.OffsetOfTheLastDirectoryRecordOfTheRootDirectoryEntity, last)
+	dicom.WriteElement(e, dicom.MustNewElement(dicomtag.FileSetConsistencyFlag, uint16(0)))
+
+	e.WriteUInt16(dicomtag.DirectoryRecordSequence.Group)
+	e.WriteUInt16(dicomtag.DirectoryRecordSequence.Element)
+	e.WriteString("SQ")
+	e.WriteZeros(2)
+	e.WriteUInt32(seqLen)
+
+	return e.Bytes(), e.Error()
+}
+
+// writeUP writes an element with the value representation UP
+// which is not supported by go-dicom.
+func writeUP(e *dicomio.Encoder, tag dicomtag.Tag, value uint32) {
+	e.WriteUInt16(tag.Group)
+	e.WriteUInt16(tag.Element)
+	e.WriteString("UP")
+	e.WriteUInt16(4)
+	e.WriteUInt32(value)
+}
+
+// newUID returns a new UUID derived UID.
+func newUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+
+	return "2.25." + new(big.Int).SetBytes(b[:]).String()
+}
+
+// joinFileID returns the slash separated path of a referenced
+// file ID.
+func joinFileID(fileID []string) string {
+	return strings.Join(fileID, "/")
+}
+
+// stringValues converts values to the value list of an element.
+func stringValues(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, v := range values {
+		result[i] = v
+	}
+	return result
+}
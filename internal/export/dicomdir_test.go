@@ -0,0 +1,246 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/models"
+)
+
+func testRecords() []studyRecords {
+	study := func(patientID, uid string, instances ...int) studyRecords {
+		var model models.ImageList
+		model.Patient.Name = "Huber^Bello"
+		model.Patient.ID = patientID
+		model.Patient.Visit.Study.UID = uid
+
+		s := studyRecords{model: model}
+		for seriesIdx, count := range instances {
+			model.Patient.Visit.Study.Series = append(model.Patient.Visit.Study.Series, models.Series{
+				UID:      fmt.Sprintf("%s.%d", uid, seriesIdx+1),
+				Number:   seriesIdx + 1,
+				Modality: "DX",
+			})
+
+			var images []imageRecord
+			for i := 0; i < count; i++ {
+				images = append(images, imageRecord{
+					fileID:            []string{"DICOM", "ST000001", fmt.Sprintf("SE%06d", seriesIdx+1), fmt.Sprintf("IM%06d", i+1)},
+					number:            i + 1,
+					sopClassUID:       "1.2.840.10008.5.1.4.1.1.1.1",
+					sopInstanceUID:    fmt.Sprintf("%s.%d.%d", uid, seriesIdx+1, i+1),
+					transferSyntaxUID: "1.2.840.10008.1.2.1",
+				})
+			}
+			s.series = append(s.series, images)
+		}
+		s.model = model
+
+		return s
+	}
+
+	return []studyRecords{
+		study("100", "1.1", 2, 0, 1),
+		study("200", "2.1", 1),
+		study("100", "1.2", 1),
+	}
+}
+
+func TestDirectoryRecords(t *testing.T) {
+	records, last := directoryRecords(testRecords())
+
+	type record struct {
+		typ   string
+		key   string
+		next  int
+		lower int
+	}
+
+	// patients are the root directory entity, series without
+	// images are omitted.
+	want := []record{
+		{"PATIENT", "100", 10, 1},
+		{"STUDY", "1.1", 7, 2},
+		{"SERIES", "1.1.1", 5, 3},
+		{"IMAGE", "1.1.1.1", 4, -1},
+		{"IMAGE", "1.1.1.2", -1, -1},
+		{"SERIES", "1.1.3", -1, 6},
+		{"IMAGE", "1.1.3.1", -1, -1},
+		{"STUDY", "1.2", -1, 8},
+		{"SERIES", "1.2.1", -1, 9},
+		{"IMAGE", "1.2.1.1", -1, -1},
+		{"PATIENT", "200", -1, 11},
+		{"STUDY", "2.1", -1, 12},
+		{"SERIES", "2.1.1", -1, 13},
+		{"IMAGE", "2.1.1.1", -1, -1},
+	}
+
+	keyTags := map[string]dicomtag.Tag{
+		"PATIENT": dicomtag.PatientID,
+		"STUDY":   dicomtag.StudyInstanceUID,
+		"SERIES":  dicomtag.SeriesInstanceUID,
+		"IMAGE":   dicomtag.ReferencedSOPInstanceUIDInFile,
+	}
+
+	var got []record
+	for _, r := range records {
+		var key string
+		for _, elem := range r.keys {
+			if elem.Tag == keyTags[r.typ] {
+				key, _ = elem.GetString()
+			}
+		}
+		got = append(got, record{r.typ, key, r.next, r.lower})
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got records\n%v\nwant\n%v", got, want)
+	}
+	if last != 10 {
+		t.Errorf("got last root record %d, want 10", last)
+	}
+}
+
+func TestEncodeDICOMDir(t *testing.T) {
+	data, err := encodeDICOMDir(testRecords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds, err := dicom.ReadDataSetInBytes(data, dicom.ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for tag, want := range map[dicomtag.Tag]string{
+		dicomtag.MediaStorageSOPClassUID: mediaStorageDirectoryStorage,
+		dicomtag.FileSetID:               fileSetID,
+	} {
+		elem, err := ds.FindElementByTag(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := elem.GetString(); got != want {
+			t.Errorf("%s: got %q, want %q", dicomtag.DebugString(tag), got, want)
+		}
+	}
+
+	first := upValue(t, data, dicomtag.OffsetOfTheFirstDirectoryRecordOfTheRootDirectoryEntity)
+	last := upValue(t, data, dicomtag.OffsetOfTheLastDirectoryRecordOfTheRootDirectoryEntity)
+
+	// follow the offsets of all records starting with the first
+	// record of the root directory entity.
+	var (
+		tree     []string
+		lastRoot uint32
+	)
+	var walk func(offset uint32, depth int)
+	walk = func(offset uint32, depth int) {
+		for offset != 0 {
+			if depth == 0 {
+				lastRoot = offset
+			}
+
+			typ, next, lower := readRecord(t, data, offset)
+			tree = append(tree, strings.Repeat("  ", depth)+typ)
+
+			walk(lower, depth+1)
+			offset = next
+		}
+	}
+	walk(first, 0)
+
+	want := []string{
+		"PATIENT",
+		"  STUDY",
+		"    SERIES",
+		"      IMAGE",
+		"      IMAGE",
+		"    SERIES",
+		"      IMAGE",
+		"  STUDY",
+		"    SERIES",
+		"      IMAGE",
+		"PATIENT",
+		"  STUDY",
+		"    SERIES",
+		"      IMAGE",
+	}
+	if !reflect.DeepEqual(tree, want) {
+		t.Errorf("got directory tree\n%s\nwant\n%s", strings.Join(tree, "\n"), strings.Join(want, "\n"))
+	}
+
+	if lastRoot != last {
+		t.Errorf("last root record is at %d, header refers to %d", lastRoot, last)
+	}
+}
+
+// upValue returns the value of the UP element tag which must be
+// part of data exactly once.
+func upValue(t *testing.T, data []byte, tag dicomtag.Tag) uint32 {
+	var prefix [6]byte
+	binary.LittleEndian.PutUint16(prefix[0:], tag.Group)
+	binary.LittleEndian.PutUint16(prefix[2:], tag.Element)
+	copy(prefix[4:], "UP")
+
+	idx := bytes.Index(data, prefix[:])
+	if idx < 0 || bytes.Count(data, prefix[:]) != 1 {
+		t.Fatalf("%s not found exactly once", dicomtag.DebugString(tag))
+	}
+
+	return binary.LittleEndian.Uint32(data[idx+8:])
+}
+
+// readRecord reads the record type and the offsets of the next and
+// lower level record of the directory record at offset.
+func readRecord(t *testing.T, data []byte, offset uint32) (string, uint32, uint32) {
+	if int(offset)+8 > len(data) {
+		t.Fatalf("record offset %d out of range", offset)
+	}
+
+	item := data[offset:]
+	if binary.LittleEndian.Uint16(item[0:]) != dicomtag.Item.Group || binary.LittleEndian.Uint16(item[2:]) != dicomtag.Item.Element {
+		t.Fatalf("no item at offset %d", offset)
+	}
+	body := item[8 : 8+binary.LittleEndian.Uint32(item[4:])]
+
+	var (
+		typ         string
+		next, lower uint32
+	)
+
+	// walk the explicit VR little endian elements of the item.
+	for len(body) > 0 {
+		tag := dicomtag.Tag{
+			Group:   binary.LittleEndian.Uint16(body[0:]),
+			Element: binary.LittleEndian.Uint16(body[2:]),
+		}
+
+		var value []byte
+		switch vr := string(body[4:6]); vr {
+		case "OB", "OW", "SQ", "UN", "UT":
+			n := binary.LittleEndian.Uint32(body[8:])
+			value, body = body[12:12+n], body[12+n:]
+		default:
+			n := binary.LittleEndian.Uint16(body[6:])
+			value, body = body[8:8+n], body[8+n:]
+		}
+
+		switch tag {
+		case dicomtag.OffsetOfTheNextDirectoryRecord:
+			next = binary.LittleEndian.Uint32(value)
+		case dicomtag.OffsetOfReferencedLowerLevelDirectoryEntity:
+			lower = binary.LittleEndian.Uint32(value)
+		case dicomtag.DirectoryRecordType:
+			typ = strings.TrimSpace(string(value))
+		}
+	}
+
+	return typ, next, lower
+}
@@ -0,0 +1,292 @@
+// Package export builds copies of studies for media interchange.
+// An export contains all DICOM files of one or more studies
+// together with a DICOMDIR that describes them and, optionally,
+// JPEG renderings that can be viewed without a DICOM viewer and a
+// viewer that is started automatically from CDs. Exports can be
+// written as ZIP archive or ISO 9660 image.
+package export
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tierklinik-dobersberg/dxray/internal/dimse"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
+	"github.com/tierklinik-dobersberg/dxray/internal/iso9660"
+	"github.com/tierklinik-dobersberg/dxray/internal/render"
+)
+
+const (
+	// DICOMDirName is the name of the DICOMDIR file. It's
+	// always placed in the root of an export.
+	DICOMDirName = "DICOMDIR"
+
+	// autorunName is the name of the file that starts the
+	// viewer when a CD is inserted.
+	autorunName = "AUTORUN.INF"
+)
+
+type (
+	// Options configures an export.
+	Options struct {
+		// Rendered adds a JPEG rendering of the first frame
+		// of each instance.
+		Rendered bool
+
+		// ViewerDirectory is a directory holding a DICOM
+		// viewer that is added below VIEWER. An AUTORUN.INF
+		// file in the directory is placed in the root of the
+		// export instead so the viewer is started when the
+		// medium is inserted.
+		ViewerDirectory string
+	}
+
+	// File is a file of an export.
+	File struct {
+		// Name is the slash separated path of the file.
+		// Viewer files keep their original names while all
+		// other path components are valid ISO 9660 level 1
+		// names. ISO 9660 images map other names to level 1
+		// names and record the original ones using Joliet.
+		Name string
+
+		// Size is the size of the file or -1 if it's not
+		// known until the file is read.
+		Size int64
+
+		open func() (io.ReadCloser, error)
+	}
+)
+
+// Open opens the file for reading. Renderings are created when
+// the file is opened.
+func (f File) Open() (io.ReadCloser, error) {
+	return f.open()
+}
+
+// Files returns all files of the export of studies. All studies
+// must already be loaded and are exported only once. The DICOMDIR
+// is always the first file. Instance files are only opened when
+// the returned files are read so the export can be streamed.
+func Files(studies []fsdb.Study, opts Options) ([]File, error) {
+	var (
+		dicomFiles []File
+		jpegFiles  []File
+		records    []studyRecords
+		seen       = make(map[string]bool)
+	)
+
+	for _, std := range studies {
+		model, ok := std.Model()
+		if !ok {
+			return nil, errors.New("study not loaded")
+		}
+
+		if seen[model.Patient.Visit.Study.UID] {
+			continue
+		}
+		seen[model.Patient.Visit.Study.UID] = true
+
+		study := studyRecords{model: model}
+		studyDir := fmt.Sprintf("ST%06d", len(records)+1)
+
+		for seriesIdx, series := range model.Patient.Visit.Study.Series {
+			var images []imageRecord
+			seriesDir := fmt.Sprintf("SE%06d", seriesIdx+1)
+
+			for instanceIdx, instance := range series.Instances {
+				path, err := std.RealPath(instance.Data.DICOMPath)
+				if err != nil {
+					return nil, fmt.Errorf("instance %s: %w", instance.UID, err)
+				}
+				fileName := fmt.Sprintf("IM%06d", instanceIdx+1)
+
+				// the file meta information is required
+				// for the DICOMDIR.
+				meta, err := dimse.ReadFileMeta(path)
+				if err != nil {
+					return nil, fmt.Errorf("instance %s: %w", instance.UID, err)
+				}
+
+				fileID := []string{"DICOM", studyDir, seriesDir, fileName}
+				f, err := sourceFile(joinFileID(fileID), path)
+				if err != nil {
+					return nil, fmt.Errorf("instance %s: %w", instance.UID, err)
+				}
+				dicomFiles = append(dicomFiles, f)
+
+				images = append(images, imageRecord{
+					fileID:            fileID,
+					number:            instance.Number,
+					sopClassUID:       meta.SOPClassUID,
+					sopInstanceUID:    meta.SOPInstanceUID,
+					transferSyntaxUID: meta.TransferSyntaxUID,
+				})
+
+				if opts.Rendered {
+					name := fmt.Sprintf("JPEG/%s/%s/%s.JPG", studyDir, seriesDir, fileName)
+					jpegFiles = append(jpegFiles, renderedFile(name, path))
+				}
+			}
+
+			study.series = append(study.series, images)
+		}
+
+		records = append(records, study)
+	}
+
+	if len(records) == 0 {
+		return nil, errors.New("no studies")
+	}
+
+	dicomDir, err := encodeDICOMDir(records)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DICOMDIR: %w", err)
+	}
+
+	files := make([]File, 0, 1+len(dicomFiles)+len(jpegFiles))
+	files = append(files, dataFile(DICOMDirName, dicomDir))
+	files = append(files, dicomFiles...)
+	files = append(files, jpegFiles...)
+
+	if opts.ViewerDirectory != "" {
+		viewer, err := viewerFiles(opts.ViewerDirectory)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add viewer: %w", err)
+		}
+		files = append(files, viewer...)
+	}
+
+	return files, nil
+}
+
+// ISOImage returns the ISO 9660 image of files. Files with an
+// unknown size, like renderings, are read into memory.
+func ISOImage(files []File) (*iso9660.Image, error) {
+	isoFiles := make([]iso9660.File, 0, len(files))
+
+	for _, f := range files {
+		if f.Size < 0 {
+			var err error
+			if f, err = readFile(f); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.Name, err)
+			}
+		}
+
+		isoFiles = append(isoFiles, iso9660.File{
+			Name: f.Name,
+			Size: f.Size,
+			Open: f.open,
+		})
+	}
+
+	return iso9660.New(fileSetID, isoFiles)
+}
+
+// viewerFiles returns all files of the viewer in dir.
+func viewerFiles(dir string) ([]File, error) {
+	var files []File
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+		if strings.EqualFold(name, autorunName) {
+			name = autorunName
+		} else {
+			name = "VIEWER/" + name
+		}
+
+		f, err := sourceFile(name, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+
+		return nil
+	})
+
+	return files, err
+}
+
+// sourceFile returns a file that is read from path.
+func sourceFile(name, path string) (File, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return File{}, err
+	}
+
+	return File{
+		Name: name,
+		Size: stat.Size(),
+		open: func() (io.ReadCloser, error) {
+			return os.Open(path)
+		},
+	}, nil
+}
+
+// dataFile returns a file with the content data.
+func dataFile(name string, data []byte) File {
+	return File{
+		Name: name,
+		Size: int64(len(data)),
+		open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		},
+	}
+}
+
+// readFile reads the content of f and returns it as data file.
+func readFile(f File) (File, error) {
+	r, err := f.Open()
+	if err != nil {
+		return f, err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return f, err
+	}
+
+	return dataFile(f.Name, data), nil
+}
+
+// renderedFile returns a file holding the JPEG rendering of the
+// first frame of the DICOM file at path.
+func renderedFile(name, path string) File {
+	return File{
+		Name: name,
+		Size: -1,
+		open: func() (io.ReadCloser, error) {
+			frame, err := render.ReadFrame(path, 0)
+			if err != nil {
+				return nil, err
+			}
+
+			buf := new(bytes.Buffer)
+			if err := render.Encode(buf, render.Render(frame, render.Options{}), render.ContentTypeJPEG, render.DefaultQuality); err != nil {
+				return nil, err
+			}
+
+			return ioutil.NopCloser(buf), nil
+		},
+	}
+}
@@ -0,0 +1,43 @@
+package export
+
+import (
+	"archive/zip"
+	"io"
+	"time"
+)
+
+// WriteZIP writes a ZIP archive containing files to w. Files are
+// read one after another so the archive is never kept in memory.
+func WriteZIP(w io.Writer, files []File) error {
+	zw := zip.NewWriter(w)
+	now := time.Now()
+
+	for _, f := range files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     f.Name,
+			Method:   zip.Deflate,
+			Modified: now,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := copyFile(fw, f); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// copyFile copies the content of f to w.
+func copyFile(w io.Writer, f File) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(w, r)
+	return err
+}
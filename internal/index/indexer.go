@@ -2,7 +2,11 @@ package index
 
 import (
 	"context"
+	"errors"
+	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
@@ -21,11 +25,47 @@ type StudyIndexer struct {
 	scanner        *scan.Scanner
 	indexPath      string
 	repeatFullScan time.Duration
+	scanOpts       scan.Options
+	onChange       func(key string)
 	ticker         *time.Ticker
+
+	// statusLock protects current, last and cancelScan.
+	statusLock sync.Mutex
+	current    *ScanStatus
+	last       *ScanStatus
+	cancelScan context.CancelFunc
+}
+
+var (
+	// ErrVolumeExists is returned by SweepVolume if the volume
+	// is still part of the database.
+	ErrVolumeExists = errors.New("volume exists")
+)
+
+// Options configures a StudyIndexer.
+type Options struct {
+	// Path is the path of the search index. Defaults to
+	// index.bleve inside the service state directory.
+	Path string
+
+	// FullScanInterval is the interval at which the whole
+	// database is scanned. Periodic scans are disabled if
+	// zero.
+	FullScanInterval time.Duration
+
+	// Scan configures the parallelism of the scanner. Note
+	// that Scan.Load is always set by the indexer.
+	Scan scan.Options
+
+	// OnChange is called with the key of each study that has
+	// been modified or removed from the database. It's used to
+	// invalidate caches and may be nil.
+	OnChange func(key string)
 }
 
 // NewStudyIndexer creates a new study indexer
-func NewStudyIndexer(db fsdb.DB, path string, repeat time.Duration) (*StudyIndexer, error) {
+func NewStudyIndexer(db fsdb.DB, opts Options) (*StudyIndexer, error) {
+	path := opts.Path
 	if path == "" {
 		path = filepath.Join(svcenv.Env().StateDirectory, "index.bleve")
 	}
@@ -33,7 +73,9 @@ func NewStudyIndexer(db fsdb.DB, path string, repeat time.Duration) (*StudyIndex
 	idx := &StudyIndexer{
 		db:             db,
 		indexPath:      path,
-		repeatFullScan: repeat,
+		repeatFullScan: opts.FullScanInterval,
+		scanOpts:       opts.Scan,
+		onChange:       opts.OnChange,
 	}
 
 	if err := idx.init(); err != nil {
@@ -47,19 +89,28 @@ func NewStudyIndexer(db fsdb.DB, path string, repeat time.Duration) (*StudyIndex
 func (s *StudyIndexer) init() error {
 	var err error
 
-	s.scanner = scan.New(s.db)
 	s.Index, err = search.New(s.indexPath)
 	if err != nil {
 		return err
 	}
 
+	// only parse study.xml files of studies that
+	// actually need to be (re-)indexed.
+	s.scanOpts.Load = func(stdy fsdb.Study) bool {
+		modified, err := s.Index.Modified(stdy)
+		return err == nil && modified
+	}
+	s.scanner = scan.New(s.db, s.scanOpts)
+
 	if s.repeatFullScan != 0 {
 		logger.DefaultLogger().Infof("scanning database every %s", s.repeatFullScan)
 
 		s.ticker = time.NewTicker(s.repeatFullScan)
 		go func() {
 			for range s.ticker.C {
-				s.FullScan(context.Background())
+				if err := s.FullScan(context.Background()); errors.Is(err, scan.ErrScanRunning) {
+					logger.DefaultLogger().Infof("skipping periodic scan: %s", err)
+				}
 			}
 		}()
 	}
@@ -67,42 +118,114 @@ func (s *StudyIndexer) init() error {
 	return nil
 }
 
-// FullScan scans all studies and updates the index
+// FullScan scans all studies and updates the index. It returns
+// scan.ErrScanRunning if another scan is already running.
 func (s *StudyIndexer) FullScan(ctx context.Context) error {
+	ctx, status, err := s.beginScan(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	return s.runScan(ctx, status)
+}
+
+// ScanVolume scans all studies of the volume name and updates the
+// index. It returns scan.ErrScanRunning if another scan is already
+// running.
+func (s *StudyIndexer) ScanVolume(ctx context.Context, name string) error {
+	ctx, status, err := s.beginScan(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	return s.runScan(ctx, status)
+}
+
+// runScan performs the scan described by status. If status is not
+// restricted to a single volume, studies that have not been found
+// are removed from the index.
+func (s *StudyIndexer) runScan(ctx context.Context, status *ScanStatus) error {
+	defer s.endScan()
+
 	log := logger.From(ctx).WithFields(logger.Fields{
 		"module": "indexer",
 	})
 
-	start := time.Now()
+	start := status.Started
 
-	count := 0
-	newStudies := 0
-	existingStudies := 0
-
-	log.Info("starting full database index scan")
-
-	studies, err := s.scanner.Scan(ctx)
+	var (
+		studies <-chan scan.Result
+		err     error
+	)
+	if status.Volume == "" {
+		log.Info("starting full database index scan")
+		studies, err = s.scanner.Scan(ctx)
+	} else {
+		log.Infof("starting index scan of volume %s", status.Volume)
+		studies, err = s.scanner.ScanVolumeName(ctx, status.Volume)
+	}
 	if err != nil {
+		s.updateStatus(func() {
+			status.addError(status.Volume, "", err)
+		})
 		return err
 	}
 
-	for study := range studies {
+	count := 0
+	seen := make(map[string]struct{})
+	for r := range studies {
+		if r.Study == nil {
+			log.WithFields(logger.Fields{
+				"error":  r.Err.Error(),
+				"volume": r.Volume,
+			}).Errorf("failed to scan volume")
+
+			s.updateStatus(func() {
+				status.addError(r.Volume, "", r.Err)
+			})
+			continue
+		}
+
+		study := r.Study
 		count++
-		new, err := s.Index.Add(study)
+		seen[search.Key(study)] = struct{}{}
+
+		err := r.Err
+		var result search.AddResult
+		if err == nil {
+			result, err = s.Index.Add(study)
+		}
+
+		if err == nil && result == search.StudyUpdated {
+			s.notifyChange(search.Key(study))
+		}
+
 		if err != nil {
 			log.WithFields(logger.Fields{
 				"error":  err.Error(),
 				"study":  study.Name(),
 				"volume": study.Volume().Name(),
 			}).Errorf("failed to index study")
-		} else {
-			if new {
-				newStudies++
-			} else {
-				existingStudies++
-			}
 		}
 
+		s.updateStatus(func() {
+			status.Total++
+
+			if err != nil {
+				status.addError(study.Volume().Name(), study.Name(), err)
+				return
+			}
+
+			switch result {
+			case search.StudyNew:
+				status.New++
+			case search.StudyUpdated:
+				status.Updated++
+			default:
+				status.Known++
+			}
+		})
+
 		if count%100 == 0 && time.Now().Sub(start) > 5*time.Second {
 			log.WithFields(logger.Fields{
 				"study":    study.Name(),
@@ -112,6 +235,21 @@ func (s *StudyIndexer) FullScan(ctx context.Context) error {
 		}
 	}
 
+	// Only sweep the index if the scan has not been
+	// interrupted. Otherwise we would remove all studies
+	// that have not been scanned yet.
+	if ctx.Err() == nil && status.Volume == "" {
+		removed, missing, err := s.sweep(ctx, seen)
+		if err != nil {
+			log.Errorf("failed to remove stale studies from index: %s", err)
+		}
+
+		s.updateStatus(func() {
+			status.Removed = removed
+			status.MissingVolumes = missing
+		})
+	}
+
 	round := 500 * time.Millisecond
 	duration := time.Now().Sub(start)
 	if duration < time.Second {
@@ -119,11 +257,198 @@ func (s *StudyIndexer) FullScan(ctx context.Context) error {
 	}
 	duration = duration.Round(round)
 
-	log.WithFields(logger.Fields{
-		"total": count,
-		"new":   newStudies,
-		"known": existingStudies,
-	}).Infof("Scan finished in %s", duration)
+	s.updateStatus(func() {
+		log.WithFields(logger.Fields{
+			"total":   status.Total,
+			"new":     status.New,
+			"known":   status.Known,
+			"updated": status.Updated,
+			"removed": status.Removed,
+			"failed":  status.Failed,
+		}).Infof("Scan finished in %s", duration)
+	})
 
-	return nil
+	return ctx.Err()
+}
+
+// sweep removes all studies from the index that have not been
+// seen during the last full scan and do not exist in the database
+// anymore. Studies of volumes that disappeared completely are never
+// removed as the volume may only be temporarily unavailable (e.g.
+// an unmounted network share). They are kept until the volume
+// returns or SweepVolume is called. The names of those volumes are
+// returned.
+func (s *StudyIndexer) sweep(ctx context.Context, seen map[string]struct{}) (int, []string, error) {
+	log := logger.From(ctx).WithFields(logger.Fields{
+		"module": "indexer",
+	})
+
+	keys, err := s.Index.Keys()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	volumeNames, err := s.db.VolumeNames()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	volumes := make(map[string]bool, len(volumeNames))
+	for _, name := range volumeNames {
+		volumes[name] = true
+	}
+
+	// collect all stale keys grouped by volume.
+	stale := make(map[string][]string)
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+
+		volName, _, err := search.SplitKey(key)
+		if err != nil {
+			log.WithFields(logger.Fields{
+				"key": key,
+			}).Errorf("invalid key stored in index")
+			continue
+		}
+
+		stale[volName] = append(stale[volName], key)
+	}
+
+	var (
+		removed int
+		missing []string
+	)
+	for volName, staleKeys := range stale {
+		if !volumes[volName] {
+			log.WithFields(logger.Fields{
+				"volume":  volName,
+				"studies": len(staleKeys),
+			}).Errorf("volume is missing from database, keeping its studies until it returns or is swept explicitly")
+
+			missing = append(missing, volName)
+			continue
+		}
+
+		for _, key := range staleKeys {
+			// make sure the study does not exist anymore so we don't
+			// remove studies that just failed to be scanned.
+			if _, err := search.Get(key, s.db); !os.IsNotExist(err) {
+				continue
+			}
+
+			if err := s.Index.Delete(key); err != nil {
+				return removed, missing, err
+			}
+			s.notifyChange(key)
+			removed++
+		}
+	}
+
+	sort.Strings(missing)
+
+	return removed, missing, nil
+}
+
+// SweepVolume removes all studies of the volume name from the index.
+// It allows operators to remove volumes that have been deleted on
+// purpose as sweep never does that. It returns ErrVolumeExists if
+// the volume is still part of the database.
+func (s *StudyIndexer) SweepVolume(name string) (int, error) {
+	exists, err := s.volumeExists(name)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, ErrVolumeExists
+	}
+
+	keys, err := s.Index.Keys()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, key := range keys {
+		if volName, _, err := search.SplitKey(key); err != nil || volName != name {
+			continue
+		}
+
+		if err := s.Index.Delete(key); err != nil {
+			return removed, err
+		}
+		s.notifyChange(key)
+		removed++
+	}
+
+	logger.DefaultLogger().WithFields(logger.Fields{
+		"module":  "indexer",
+		"volume":  name,
+		"studies": removed,
+	}).Infof("removed missing volume from index")
+
+	return removed, nil
+}
+
+// volumeExists returns true if the volume name is part of the
+// database.
+func (s *StudyIndexer) volumeExists(name string) (bool, error) {
+	volumeNames, err := s.db.VolumeNames()
+	if err != nil {
+		return false, err
+	}
+
+	for _, volName := range volumeNames {
+		if volName == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// IndexStudy indexes the study studyName stored in volume volName.
+// If the study does not exist anymore it is removed from the index
+// unless the whole volume is missing, see sweep.
+func (s *StudyIndexer) IndexStudy(volName, studyName string) (search.AddResult, error) {
+	key := volName + "/" + studyName
+
+	study, err := search.Get(key, s.db)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return search.StudyKnown, err
+		}
+
+		exists, err := s.volumeExists(volName)
+		if err != nil {
+			return search.StudyKnown, err
+		}
+		if !exists {
+			logger.DefaultLogger().WithFields(logger.Fields{
+				"module": "indexer",
+				"volume": volName,
+				"study":  studyName,
+			}).Errorf("volume is missing from database, keeping study")
+			return search.StudyKnown, nil
+		}
+
+		s.notifyChange(key)
+		return search.StudyKnown, s.Index.Delete(key)
+	}
+
+	result, err := s.Index.Add(study)
+	if err == nil && result == search.StudyUpdated {
+		s.notifyChange(key)
+	}
+
+	return result, err
+}
+
+// notifyChange calls the OnChange callback, if any, for the
+// study identified by key.
+func (s *StudyIndexer) notifyChange(key string) {
+	if s.onChange != nil {
+		s.onChange(key)
+	}
 }
@@ -0,0 +1,117 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
+)
+
+func TestSweepKeepsMissingVolumes(t *testing.T) {
+	root, err := ioutil.TempDir("", "dxray-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeStudy(t, root, "VOL00001", "0001_1", "1.2.3.1")
+	writeStudy(t, root, "VOL00001", "0002_1", "1.2.3.2")
+	writeStudy(t, root, "VOL00002", "0001_1", "1.2.3.3")
+
+	db, err := fsdb.New(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := NewStudyIndexer(db, Options{Path: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	scan := func() *ScanStatus {
+		if err := idx.FullScan(context.Background()); err != nil {
+			t.Fatalf("scan failed: %s", err)
+		}
+		_, last := idx.Status()
+		return last
+	}
+	wantCount := func(want uint64) {
+		if count, _ := idx.Count(); count != want {
+			t.Errorf("index contains %d studies, want %d", count, want)
+		}
+	}
+
+	scan()
+	wantCount(3)
+
+	// a study removed from an existing volume is swept.
+	if err := os.RemoveAll(filepath.Join(root, "VOL00001", "0002_1")); err != nil {
+		t.Fatal(err)
+	}
+	if status := scan(); status.Removed != 1 {
+		t.Errorf("removed %d studies, want 1", status.Removed)
+	}
+	wantCount(2)
+
+	// studies of a missing volume are kept no matter how often
+	// it's scanned.
+	if err := os.Rename(filepath.Join(root, "VOL00002"), filepath.Join(root, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		status := scan()
+		if status.Removed != 0 {
+			t.Errorf("scan %d: removed %d studies", i, status.Removed)
+		}
+		if !reflect.DeepEqual(status.MissingVolumes, []string{"VOL00002"}) {
+			t.Errorf("scan %d: got missing volumes %v", i, status.MissingVolumes)
+		}
+	}
+	wantCount(2)
+
+	// nor by indexing a single study of it.
+	if _, err := idx.IndexStudy("VOL00002", "0001_1"); err != nil {
+		t.Fatal(err)
+	}
+	wantCount(2)
+
+	if _, err := idx.SweepVolume("VOL00001"); err != ErrVolumeExists {
+		t.Errorf("got error %v for an existing volume, want %v", err, ErrVolumeExists)
+	}
+
+	removed, err := idx.SweepVolume("VOL00002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("explicit sweep removed %d studies, want 1", removed)
+	}
+	wantCount(1)
+
+	if status := scan(); len(status.MissingVolumes) != 0 {
+		t.Errorf("got missing volumes %v after explicit sweep", status.MissingVolumes)
+	}
+}
+
+// writeStudy writes the study.xml of a study with a single
+// instance.
+func writeStudy(t *testing.T, root, volume, name, uid string) {
+	dir := filepath.Join(root, volume, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	xml := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Imagelist><Patient><Name>Huber^Bello</Name><ID>100</ID><Visit><Study><UID>%s</UID><Date>20210311</Date><Series><UID>%s.1</UID><Modality>DX</Modality><Instance><UID>%s.1.1</UID><Data><DICOM>\DICOMPACS\ORCONSOLEDB\%s\%s\I_000000.dcm</DICOM></Data></Instance></Series></Study></Visit></Patient></Imagelist>`,
+		uid, uid, uid, volume, name)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "study.xml"), []byte(xml), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,158 @@
+package index
+
+import (
+	"context"
+	"time"
+
+	"github.com/tierklinik-dobersberg/dxray/internal/scan"
+)
+
+// maxStatusErrors is the maximum number of study errors
+// recorded in a ScanStatus.
+const maxStatusErrors = 1000
+
+type (
+	// ScanStatus describes a running or finished scan.
+	ScanStatus struct {
+		// Volume is set if only a single volume is scanned.
+		Volume    string       `json:"volume,omitempty"`
+		Running   bool         `json:"running"`
+		Cancelled bool         `json:"cancelled"`
+		Started   time.Time    `json:"started"`
+		Finished  *time.Time   `json:"finished,omitempty"`
+		Duration  string       `json:"duration"`
+		Total     int          `json:"total"`
+		New       int          `json:"new"`
+		Known     int          `json:"known"`
+		Updated   int          `json:"updated"`
+		Removed   int          `json:"removed"`
+		Failed    int          `json:"failed"`
+		Errors    []StudyError `json:"errors,omitempty"`
+
+		// MissingVolumes holds the names of volumes that are
+		// missing from the database but still have studies in
+		// the index, see StudyIndexer.SweepVolume.
+		MissingVolumes []string `json:"missingVolumes,omitempty"`
+	}
+
+	// StudyError describes a study (or volume) that failed
+	// to be indexed.
+	StudyError struct {
+		Volume string `json:"volume"`
+		Study  string `json:"study,omitempty"`
+		Error  string `json:"error"`
+	}
+)
+
+// Status returns the status of the currently running scan and the
+// last finished scan. Either may be nil.
+func (s *StudyIndexer) Status() (current *ScanStatus, last *ScanStatus) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	if s.current != nil {
+		current = s.current.copy()
+		current.Duration = time.Since(current.Started).Round(time.Second).String()
+	}
+
+	if s.last != nil {
+		last = s.last.copy()
+	}
+
+	return current, last
+}
+
+// StartScan starts a new scan in the background. If volume is
+// empty the whole database is scanned. StartScan returns
+// scan.ErrScanRunning if a scan is already running.
+func (s *StudyIndexer) StartScan(volume string) error {
+	ctx, status, err := s.beginScan(context.Background(), volume)
+	if err != nil {
+		return err
+	}
+
+	go s.runScan(ctx, status)
+
+	return nil
+}
+
+// CancelScan cancels the currently running scan. It returns false
+// if there's no scan running.
+func (s *StudyIndexer) CancelScan() bool {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	if s.current == nil {
+		return false
+	}
+
+	s.current.Cancelled = true
+	s.cancelScan()
+
+	return true
+}
+
+// beginScan marks a new scan as running and returns the context
+// the scan should use.
+func (s *StudyIndexer) beginScan(ctx context.Context, volume string) (context.Context, *ScanStatus, error) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	if s.current != nil {
+		return nil, nil, scan.ErrScanRunning
+	}
+
+	ctx, s.cancelScan = context.WithCancel(ctx)
+	s.current = &ScanStatus{
+		Volume:  volume,
+		Running: true,
+		Started: time.Now(),
+	}
+
+	return ctx, s.current, nil
+}
+
+// endScan marks the current scan as finished.
+func (s *StudyIndexer) endScan() {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	now := time.Now()
+	s.current.Running = false
+	s.current.Finished = &now
+	s.current.Duration = now.Sub(s.current.Started).String()
+
+	s.cancelScan()
+	s.cancelScan = nil
+
+	s.last = s.current
+	s.current = nil
+}
+
+// updateStatus calls fn with the status lock held.
+func (s *StudyIndexer) updateStatus(fn func()) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	fn()
+}
+
+// addError records a failed study in status.
+func (status *ScanStatus) addError(volume, study string, err error) {
+	status.Failed++
+
+	if len(status.Errors) < maxStatusErrors {
+		status.Errors = append(status.Errors, StudyError{
+			Volume: volume,
+			Study:  study,
+			Error:  err.Error(),
+		})
+	}
+}
+
+func (status *ScanStatus) copy() *ScanStatus {
+	c := *status
+	c.Errors = append([]StudyError(nil), status.Errors...)
+	c.MissingVolumes = append([]string(nil), status.MissingVolumes...)
+	return &c
+}
@@ -0,0 +1,336 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/tierklinik-dobersberg/dxray/internal/search"
+	"github.com/tierklinik-dobersberg/logger"
+)
+
+// watchDebounce is the time the watcher waits for further
+// modifications of a study before it is indexed. DX-R writes
+// study.xml and the image files in multiple steps.
+const watchDebounce = 2 * time.Second
+
+// studyWatchVolumes is the number of newest volumes whose study
+// directories are watched. DX-R only writes into the newest volume
+// so watching the studies of all volumes would exhaust the inotify
+// watches on large databases. Modifications of studies in older
+// volumes are detected by the periodic full scan.
+const studyWatchVolumes = 2
+
+// watcher watches the root directory of a DX-R fsdb for new
+// volumes and new or modified studies and feeds them into the
+// study indexer.
+type watcher struct {
+	indexer *StudyIndexer
+	root    string
+	fsw     *fsnotify.Watcher
+	log     logger.Logger
+
+	// studyVolumes holds the volumes whose study directories
+	// are watched, oldest first. It's only accessed by the
+	// goroutine handling events.
+	studyVolumes []string
+
+	// limitOnce reports reaching the watch limit only once.
+	limitOnce sync.Once
+
+	l       sync.Mutex
+	pending map[string]*time.Timer
+}
+
+// Watch starts watching the database for new or modified studies
+// and indexes them as soon as they are detected. Periodic full
+// scans are still required to catch any changes missed by the
+// watcher. Watch returns immediately and stops watching when ctx
+// is cancelled.
+func (s *StudyIndexer) Watch(ctx context.Context) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	w := &watcher{
+		indexer: s,
+		root:    filepath.Clean(s.db.Path()),
+		fsw:     fsw,
+		log: logger.From(ctx).WithFields(logger.Fields{
+			"module": "watcher",
+		}),
+		pending: make(map[string]*time.Timer),
+	}
+
+	if err := w.fsw.Add(w.root); err != nil {
+		fsw.Close()
+		return err
+	}
+
+	names, err := s.db.VolumeNames()
+	if err != nil {
+		fsw.Close()
+		return err
+	}
+
+	// Volumes of other databases combined using fsdb.NewUnion are
+	// not located below root and are not watched.
+	var volumes []string
+	for _, name := range names {
+		if isDir(filepath.Join(w.root, name)) {
+			volumes = append(volumes, name)
+		}
+	}
+
+	// volume names are numbered so the newest volumes are
+	// sorted last.
+	sort.Strings(volumes)
+	for i, name := range volumes {
+		w.watchVolume(name, i >= len(volumes)-studyWatchVolumes, false)
+	}
+
+	go w.run(ctx)
+
+	return nil
+}
+
+func (w *watcher) run(ctx context.Context) {
+	defer w.fsw.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.l.Lock()
+			for key, t := range w.pending {
+				t.Stop()
+				delete(w.pending, key)
+			}
+			w.l.Unlock()
+			return
+
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			w.log.Errorf("filesystem watcher error: %s", err)
+
+		case event, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			w.handleEvent(event)
+		}
+	}
+}
+
+func (w *watcher) handleEvent(event fsnotify.Event) {
+	rel, err := filepath.Rel(w.root, event.Name)
+	if err != nil {
+		return
+	}
+
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	switch len(parts) {
+	case 1:
+		// a new volume has been created inside the database
+		if event.Op&fsnotify.Create != 0 && strings.HasPrefix(parts[0], "VOL") && isDir(event.Name) {
+			w.watchVolume(parts[0], true, true)
+		}
+
+	case 2:
+		// a study has been created or removed inside a volume
+		if event.Op&fsnotify.Create != 0 && isDir(event.Name) {
+			if w.watchesStudies(parts[0]) {
+				w.watchStudy(parts[0], parts[1])
+			}
+			w.schedule(parts[0], parts[1])
+		}
+
+		if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+			w.schedule(parts[0], parts[1])
+		}
+
+	case 3:
+		// the study.xml of a study has been created or modified
+		if parts[2] == "study.xml" && event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) != 0 {
+			w.schedule(parts[0], parts[1])
+		}
+	}
+}
+
+// watchVolume starts watching the volume name. If watchStudies is
+// true the studies stored inside are watched as well and the
+// studies of the oldest volume watched so far are no longer
+// watched. If index is true all studies of the volume are scheduled
+// for indexing.
+func (w *watcher) watchVolume(name string, watchStudies, index bool) {
+	if !w.add(filepath.Join(w.root, name), "failed to watch volume", logger.Fields{"volume": name}) {
+		return
+	}
+
+	if !watchStudies && !index {
+		return
+	}
+
+	studies, err := w.studies(name)
+	if err != nil {
+		return
+	}
+
+	if watchStudies {
+		w.studyVolumes = append(w.studyVolumes, name)
+		if len(w.studyVolumes) > studyWatchVolumes {
+			w.unwatchStudies(w.studyVolumes[0])
+			w.studyVolumes = w.studyVolumes[1:]
+		}
+	}
+
+	for _, study := range studies {
+		if watchStudies {
+			w.watchStudy(name, study)
+		}
+
+		if index {
+			w.schedule(name, study)
+		}
+	}
+}
+
+// watchesStudies returns true if the study directories of the
+// volume name are watched.
+func (w *watcher) watchesStudies(name string) bool {
+	for _, vol := range w.studyVolumes {
+		if vol == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unwatchStudies stops watching the study directories of the
+// volume name.
+func (w *watcher) unwatchStudies(name string) {
+	studies, err := w.studies(name)
+	if err != nil {
+		return
+	}
+
+	for _, study := range studies {
+		// studies may have been removed in the meantime
+		_ = w.fsw.Remove(filepath.Join(w.root, name, study))
+	}
+}
+
+// studies returns the names of all studies of the volume name.
+func (w *watcher) studies(name string) ([]string, error) {
+	vol, err := w.indexer.db.OpenVolumeByName(name)
+	if err != nil {
+		w.log.WithFields(logger.Fields{
+			"volume": name,
+			"error":  err.Error(),
+		}).Errorf("failed to open volume")
+		return nil, err
+	}
+
+	studies, err := vol.Studies()
+	if err != nil {
+		w.log.WithFields(logger.Fields{
+			"volume": name,
+			"error":  err.Error(),
+		}).Errorf("failed to list studies")
+		return nil, err
+	}
+
+	return studies, nil
+}
+
+// watchStudy starts watching the study directory so changes
+// to study.xml are detected.
+func (w *watcher) watchStudy(volName, studyName string) {
+	w.add(filepath.Join(w.root, volName, studyName), "failed to watch study", logger.Fields{
+		"volume": volName,
+		"study":  studyName,
+	})
+}
+
+// add starts watching path and returns true on success. Errors are
+// logged using msg and fields. Reaching the limit of inotify
+// watches is only logged once.
+func (w *watcher) add(path, msg string, fields logger.Fields) bool {
+	err := w.fsw.Add(path)
+	if err == nil {
+		return true
+	}
+
+	if errors.Is(err, syscall.ENOSPC) {
+		w.limitOnce.Do(func() {
+			w.log.Errorf("reached the limit of filesystem watches, further changes are only detected by full scans. Raise fs.inotify.max_user_watches to fix this")
+		})
+		return false
+	}
+
+	fields["error"] = err.Error()
+	w.log.WithFields(fields).Errorf(msg)
+
+	return false
+}
+
+// schedule schedules the study for indexing. Multiple calls for the
+// same study within watchDebounce are merged into one.
+func (w *watcher) schedule(volName, studyName string) {
+	key := volName + "/" + studyName
+
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	if t, ok := w.pending[key]; ok {
+		t.Reset(watchDebounce)
+		return
+	}
+
+	w.pending[key] = time.AfterFunc(watchDebounce, func() {
+		w.l.Lock()
+		delete(w.pending, key)
+		w.l.Unlock()
+
+		w.index(volName, studyName)
+	})
+}
+
+func (w *watcher) index(volName, studyName string) {
+	log := w.log.WithFields(logger.Fields{
+		"volume": volName,
+		"study":  studyName,
+	})
+
+	result, err := w.indexer.IndexStudy(volName, studyName)
+	if err != nil {
+		log.Errorf("failed to index study: %s", err)
+		return
+	}
+
+	switch result {
+	case search.StudyNew:
+		log.Infof("indexed new study")
+	case search.StudyUpdated:
+		log.Infof("re-indexed modified study")
+	}
+}
+
+func isDir(path string) bool {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	return stat.IsDir()
+}
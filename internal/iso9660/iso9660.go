@@ -0,0 +1,739 @@
+// Package iso9660 writes ISO 9660 images as used for CDs and DVDs.
+// The primary volume descriptor uses interchange level 1: file
+// names consist of up to eight upper case letters, digits or
+// underscores with an optional extension of up to three characters
+// and directories may be nested up to eight levels deep. This
+// matches the requirements of DICOM media (PS3.12). Other names
+// are mapped to valid level 1 names while a Joliet supplementary
+// volume descriptor records the original names.
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+)
+
+const (
+	// SectorSize is the size of a logical sector.
+	SectorSize = 2048
+
+	// systemAreaSectors is the number of sectors reserved for
+	// the system area at the start of the image.
+	systemAreaSectors = 16
+
+	// maxDepth is the maximum depth of the directory hierarchy
+	// including the root directory.
+	maxDepth = 8
+
+	// maxFileSize is the maximum size of a file with a single
+	// extent.
+	maxFileSize = 1<<32 - 1
+
+	// maxJolietLength is the maximum number of characters of
+	// a Joliet file or directory name.
+	maxJolietLength = 64
+)
+
+// Directory hierarchies of an image. Both describe the same
+// directories and files but the primary hierarchy uses level 1
+// names while the Joliet hierarchy uses the original names.
+const (
+	primary = iota
+	joliet
+	numHierarchies
+)
+
+type (
+	// File is a file stored in an image.
+	File struct {
+		// Name is the slash separated path of the file.
+		// Names that are not valid for interchange level 1
+		// are mapped to valid ones in the primary hierarchy.
+		// Each directory name and the file name must be a
+		// valid Joliet name of up to 64 characters.
+		Name string
+
+		// Size is the size of the file in bytes.
+		Size int64
+
+		// Open opens the file for reading. It's called
+		// once when the image is written.
+		Open func() (io.ReadCloser, error)
+	}
+
+	// Image is an ISO 9660 image. It only holds the layout of
+	// the image while the file content is read when the image
+	// is written.
+	Image struct {
+		volumeID      string
+		created       time.Time
+		dirs          [numHierarchies][]*directory
+		files         []*file
+		pathTableSize [numHierarchies]int
+		lPathTable    [numHierarchies]uint32
+		mPathTable    [numHierarchies]uint32
+		sectors       uint32
+	}
+
+	// directory is a directory of an image. Directories are
+	// numbered in the order of the path table of each hierarchy
+	// starting with the root directory.
+	directory struct {
+		// entry is the entry of the directory in its parent.
+		// It's nil for the root directory.
+		entry   *entry
+		parent  *directory
+		entries []*entry
+		number  [numHierarchies]int
+		sector  [numHierarchies]uint32
+		size    [numHierarchies]uint32
+	}
+
+	// file is a file of an image.
+	file struct {
+		File
+		sector uint32
+	}
+
+	// entry is a directory or file within a directory. name is
+	// the original name while the level 1 name and extension
+	// are assigned by assignNames.
+	entry struct {
+		name    string
+		isoName string
+		isoExt  string
+		dir     *directory
+		file    *file
+	}
+)
+
+// New returns the image of files. The volume identifier may hold
+// up to 32 upper case letters, digits or underscores.
+func New(volumeID string, files []File) (*Image, error) {
+	if len(volumeID) > 32 || !isDString(volumeID) {
+		return nil, fmt.Errorf("invalid volume identifier %q", volumeID)
+	}
+
+	img := &Image{
+		volumeID: volumeID,
+		created:  time.Now().UTC(),
+	}
+
+	root := &directory{}
+	for _, f := range files {
+		if err := img.add(root, f); err != nil {
+			return nil, err
+		}
+	}
+
+	img.layout(root)
+
+	return img, nil
+}
+
+// Size returns the size of the image in bytes.
+func (img *Image) Size() int64 {
+	return int64(img.sectors) * SectorSize
+}
+
+// add adds f to the directory tree below root.
+func (img *Image) add(root *directory, f File) error {
+	if f.Size < 0 || f.Size > maxFileSize {
+		return fmt.Errorf("%s: invalid file size %d", f.Name, f.Size)
+	}
+
+	parts := strings.Split(f.Name, "/")
+	if len(parts) > maxDepth {
+		return fmt.Errorf("%s: directories nested too deep", f.Name)
+	}
+
+	dir := root
+	for _, name := range parts[:len(parts)-1] {
+		if !isJolietName(name) {
+			return fmt.Errorf("%s: invalid directory name %q", f.Name, name)
+		}
+
+		e := dir.lookup(name)
+		switch {
+		case e == nil:
+			sub := &directory{parent: dir}
+			sub.entry = &entry{name: name, dir: sub}
+			dir.entries = append(dir.entries, sub.entry)
+			dir = sub
+		case e.dir != nil:
+			dir = e.dir
+		default:
+			return fmt.Errorf("%s: %s is a file", f.Name, name)
+		}
+	}
+
+	name := parts[len(parts)-1]
+	if !isJolietName(name) {
+		return fmt.Errorf("%s: invalid file name %q", f.Name, name)
+	}
+
+	if dir.lookup(name) != nil {
+		return fmt.Errorf("%s: duplicate file", f.Name)
+	}
+
+	fl := &file{File: f}
+	dir.entries = append(dir.entries, &entry{name: name, file: fl})
+	img.files = append(img.files, fl)
+
+	return nil
+}
+
+// assignNames assigns the level 1 names of all entries of dir and
+// its subdirectories. Valid level 1 names are kept while all other
+// names are mapped to unique level 1 names.
+func assignNames(dir *directory) {
+	taken := make(map[string]bool, len(dir.entries))
+
+	var mapped []*entry
+	for _, e := range dir.entries {
+		name, ext, ok := splitLevelOneName(e.name, e.dir != nil)
+		if !ok || taken[name+"."+ext] {
+			mapped = append(mapped, e)
+			continue
+		}
+
+		e.isoName, e.isoExt = name, ext
+		taken[name+"."+ext] = true
+	}
+
+	sort.Slice(mapped, func(i, j int) bool {
+		return mapped[i].name < mapped[j].name
+	})
+
+	for _, e := range mapped {
+		name, ext := levelOneName(e.name, e.dir != nil)
+
+		candidate := name
+		for n := 1; taken[candidate+"."+ext]; n++ {
+			suffix := "_" + strconv.Itoa(n)
+			if len(name)+len(suffix) > 8 {
+				candidate = name[:8-len(suffix)] + suffix
+			} else {
+				candidate = name + suffix
+			}
+		}
+
+		e.isoName, e.isoExt = candidate, ext
+		taken[candidate+"."+ext] = true
+	}
+
+	for _, e := range dir.entries {
+		if e.dir != nil {
+			assignNames(e.dir)
+		}
+	}
+}
+
+// layout assigns the level 1 names, numbers all directories of
+// both hierarchies, sizes the path tables and assigns the sectors
+// of all directories and files.
+func (img *Image) layout(root *directory) {
+	assignNames(root)
+
+	// the primary and the supplementary volume descriptor as
+	// well as the terminator follow the system area.
+	sector := uint32(systemAreaSectors + 3)
+
+	for h := range img.dirs {
+		// the path table lists directories by level and,
+		// within a level, by the number of the parent
+		// directory. Walking the tree breadth first with
+		// sorted entries yields this order.
+		img.dirs[h] = []*directory{root}
+		for i := 0; i < len(img.dirs[h]); i++ {
+			dir := img.dirs[h][i]
+			dir.number[h] = i + 1
+
+			for _, e := range dir.sortedEntries(h) {
+				if e.dir != nil {
+					img.dirs[h] = append(img.dirs[h], e.dir)
+				}
+			}
+		}
+
+		for _, dir := range img.dirs[h] {
+			img.pathTableSize[h] += pathTableRecordSize(dir, h)
+		}
+		pathTableSectors := sectorCount(int64(img.pathTableSize[h]))
+
+		img.lPathTable[h] = sector
+		img.mPathTable[h] = sector + pathTableSectors
+		sector += 2 * pathTableSectors
+	}
+
+	for h := range img.dirs {
+		for _, dir := range img.dirs[h] {
+			dir.sector[h] = sector
+			dir.size[h] = dir.contentSize(h)
+			sector += dir.size[h] / SectorSize
+		}
+	}
+
+	for _, f := range img.files {
+		if f.Size == 0 {
+			continue
+		}
+		f.sector = sector
+		sector += sectorCount(f.Size)
+	}
+
+	img.sectors = sector
+}
+
+// WriteTo writes the image to w. The files are opened and read
+// one after another.
+func (img *Image) WriteTo(w io.Writer) (int64, error) {
+	sw := &sectorWriter{w: w}
+
+	sw.write(make([]byte, systemAreaSectors*SectorSize))
+	sw.write(img.volumeDescriptor(primary))
+	sw.write(img.volumeDescriptor(joliet))
+	sw.write(terminator())
+
+	for h := range img.dirs {
+		sw.write(img.encodePathTable(h, binary.LittleEndian))
+		sw.pad()
+		sw.write(img.encodePathTable(h, binary.BigEndian))
+		sw.pad()
+	}
+
+	for h := range img.dirs {
+		for _, dir := range img.dirs[h] {
+			sw.write(img.encodeDirectory(dir, h))
+		}
+	}
+
+	for _, f := range img.files {
+		if f.Size == 0 || sw.err != nil {
+			continue
+		}
+
+		if err := sw.copyFile(f); err != nil {
+			return sw.n, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		sw.pad()
+	}
+
+	return sw.n, sw.err
+}
+
+// volumeDescriptor returns the primary volume descriptor or the
+// Joliet supplementary volume descriptor.
+func (img *Image) volumeDescriptor(h int) []byte {
+	b := make([]byte, SectorSize)
+	root := img.dirs[h][0]
+
+	text := padString
+	b[0] = 1
+	if h == joliet {
+		text = jolietString
+		b[0] = 2
+
+		// UCS-2 level 3
+		copy(b[88:91], "%/E")
+	}
+
+	copy(b[1:6], "CD001")
+	b[6] = 1
+	copy(b[8:40], text("", 32))
+	copy(b[40:72], text(img.volumeID, 32))
+	putBoth32(b[80:], img.sectors)
+	putBoth16(b[120:], 1)
+	putBoth16(b[124:], 1)
+	putBoth16(b[128:], SectorSize)
+	putBoth32(b[132:], uint32(img.pathTableSize[h]))
+	binary.LittleEndian.PutUint32(b[140:], img.lPathTable[h])
+	binary.BigEndian.PutUint32(b[148:], img.mPathTable[h])
+	copy(b[156:190], directoryRecord([]byte{0}, root.sector[h], root.size[h], true, img.created))
+	copy(b[190:318], text("", 128))
+	copy(b[318:446], text("", 128))
+	copy(b[446:574], text("", 128))
+	copy(b[574:702], text("DXRAY", 128))
+	copy(b[702:813], text("", 111))
+	copy(b[813:830], volumeDate(img.created))
+	copy(b[830:847], volumeDate(img.created))
+	copy(b[847:864], volumeDate(time.Time{}))
+	copy(b[864:881], volumeDate(time.Time{}))
+	b[881] = 1
+
+	return b
+}
+
+// encodePathTable encodes the path table of the hierarchy h using
+// byteOrder.
+func (img *Image) encodePathTable(h int, byteOrder binary.ByteOrder) []byte {
+	var b []byte
+	for _, dir := range img.dirs[h] {
+		identifier := dir.identifier(h)
+		parent := 1
+		if dir.parent != nil {
+			parent = dir.parent.number[h]
+		}
+
+		rec := make([]byte, pathTableRecordSize(dir, h))
+		rec[0] = byte(len(identifier))
+		byteOrder.PutUint32(rec[2:], dir.sector[h])
+		byteOrder.PutUint16(rec[6:], uint16(parent))
+		copy(rec[8:], identifier)
+
+		b = append(b, rec...)
+	}
+	return b
+}
+
+// encodeDirectory returns the content of dir in the hierarchy h.
+func (img *Image) encodeDirectory(dir *directory, h int) []byte {
+	// the parent of the root directory is the root
+	// directory itself.
+	parent := dir
+	if dir.parent != nil {
+		parent = dir.parent
+	}
+
+	return packRecords(dir.records(h, img.created, parent))
+}
+
+// records returns the directory records of dir in the hierarchy
+// h including the records for dir itself and its parent.
+func (dir *directory) records(h int, t time.Time, parent *directory) [][]byte {
+	records := [][]byte{
+		directoryRecord([]byte{0}, dir.sector[h], dir.size[h], true, t),
+		directoryRecord([]byte{1}, parent.sector[h], parent.size[h], true, t),
+	}
+
+	for _, e := range dir.sortedEntries(h) {
+		if e.dir != nil {
+			records = append(records, directoryRecord(e.identifier(h), e.dir.sector[h], e.dir.size[h], true, t))
+			continue
+		}
+
+		records = append(records, directoryRecord(e.identifier(h), e.file.sector, uint32(e.file.Size), false, t))
+	}
+
+	return records
+}
+
+// contentSize returns the size of dir in bytes in the hierarchy
+// h. Sectors and sizes are not known yet but don't change the
+// size.
+func (dir *directory) contentSize(h int) uint32 {
+	return uint32(len(packRecords(dir.records(h, time.Time{}, dir))))
+}
+
+// identifier returns the identifier of dir in the hierarchy h.
+func (dir *directory) identifier(h int) []byte {
+	if dir.entry == nil {
+		return []byte{0}
+	}
+	return dir.entry.identifier(h)
+}
+
+// sortedEntries returns the entries of dir in the order of the
+// hierarchy h.
+func (dir *directory) sortedEntries(h int) []*entry {
+	entries := append([]*entry(nil), dir.entries...)
+
+	sort.Slice(entries, func(a, b int) bool {
+		ea, eb := entries[a], entries[b]
+		if h == joliet {
+			return string(ea.identifier(h)) < string(eb.identifier(h))
+		}
+
+		if ea.isoName != eb.isoName {
+			return ea.isoName < eb.isoName
+		}
+		return ea.isoExt < eb.isoExt
+	})
+
+	return entries
+}
+
+// lookup returns the entry of dir with the original name.
+func (dir *directory) lookup(name string) *entry {
+	for _, e := range dir.entries {
+		if e.name == name {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// identifier returns the identifier of e in the hierarchy h.
+func (e *entry) identifier(h int) []byte {
+	if h == joliet {
+		return encodeUCS2(e.name)
+	}
+
+	if e.dir != nil {
+		return []byte(e.isoName)
+	}
+	return []byte(e.isoName + "." + e.isoExt + ";1")
+}
+
+// packRecords returns the directory records padded to full
+// sectors. Records must not span sector boundaries so the rest of
+// a sector is left empty if the next record does not fit.
+func packRecords(records [][]byte) []byte {
+	var b []byte
+	for _, rec := range records {
+		if used := len(b) % SectorSize; used+len(rec) > SectorSize {
+			b = append(b, make([]byte, SectorSize-used)...)
+		}
+		b = append(b, rec...)
+	}
+
+	return append(b, make([]byte, padLength(int64(len(b))))...)
+}
+
+// directoryRecord returns a directory record.
+func directoryRecord(identifier []byte, sector, size uint32, isDir bool, t time.Time) []byte {
+	n := 33 + len(identifier)
+	if n%2 == 1 {
+		n++
+	}
+
+	b := make([]byte, n)
+	b[0] = byte(n)
+	putBoth32(b[2:], sector)
+	putBoth32(b[10:], size)
+	copy(b[18:25], recordingDate(t))
+	if isDir {
+		b[25] = 0x02
+	}
+	putBoth16(b[28:], 1)
+	b[32] = byte(len(identifier))
+	copy(b[33:], identifier)
+
+	return b
+}
+
+// terminator returns the volume descriptor set terminator.
+func terminator() []byte {
+	b := make([]byte, SectorSize)
+	b[0] = 255
+	copy(b[1:6], "CD001")
+	b[6] = 1
+	return b
+}
+
+// splitLevelOneName splits the name of a file into name and
+// extension. It returns false if the name is not valid for
+// interchange level 1. Directory names don't have an extension.
+func splitLevelOneName(s string, isDir bool) (string, string, bool) {
+	name, ext := s, ""
+	if idx := strings.IndexByte(s, '.'); idx >= 0 && !isDir {
+		name, ext = s[:idx], s[idx+1:]
+	}
+
+	if name == "" && ext == "" || len(name) > 8 || len(ext) > 3 || !isDString(name) || !isDString(ext) {
+		return "", "", false
+	}
+
+	return name, ext, true
+}
+
+// levelOneName maps the name of a file or directory to a level 1
+// name and extension. Letters are converted to upper case, all
+// other invalid characters are replaced by underscores and both
+// parts are truncated. The result may not be unique.
+func levelOneName(s string, isDir bool) (string, string) {
+	name, ext := s, ""
+	if idx := strings.LastIndexByte(s, '.'); idx >= 0 && !isDir {
+		name, ext = s[:idx], s[idx+1:]
+	}
+
+	name, ext = toDString(name, 8), toDString(ext, 3)
+	if name == "" {
+		name = "_"
+	}
+
+	return name, ext
+}
+
+// toDString converts s to d-characters and truncates it to n
+// characters.
+func toDString(s string, n int) string {
+	var b strings.Builder
+	for _, c := range s {
+		if b.Len() == n {
+			break
+		}
+
+		c = unicode.ToUpper(c)
+		if !isDString(string(c)) {
+			c = '_'
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// isJolietName returns true if s may be used as a Joliet file or
+// directory name.
+func isJolietName(s string) bool {
+	if s == "" || s == "." || s == ".." || len(utf16.Encode([]rune(s))) > maxJolietLength {
+		return false
+	}
+
+	for _, c := range s {
+		if c < 0x20 || c > 0xFFFF || strings.ContainsRune(`*/:;?\`, c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isDString returns true if s only consists of d-characters.
+func isDString(s string) bool {
+	for _, c := range s {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// pathTableRecordSize returns the size of the path table record
+// of dir in the hierarchy h.
+func pathTableRecordSize(dir *directory, h int) int {
+	n := len(dir.identifier(h))
+	return 8 + n + n%2
+}
+
+// recordingDate returns the date format used by directory
+// records.
+func recordingDate(t time.Time) []byte {
+	if t.IsZero() {
+		return make([]byte, 7)
+	}
+
+	return []byte{
+		byte(t.Year() - 1900),
+		byte(t.Month()),
+		byte(t.Day()),
+		byte(t.Hour()),
+		byte(t.Minute()),
+		byte(t.Second()),
+		0,
+	}
+}
+
+// volumeDate returns the date format used by the volume
+// descriptor. A zero time is encoded as "not specified".
+func volumeDate(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte("0000000000000000"), 0)
+	}
+
+	return append([]byte(fmt.Sprintf("%04d%02d%02d%02d%02d%02d%02d",
+		t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/1e7)), 0)
+}
+
+// padString pads s with spaces to n bytes.
+func padString(s string, n int) []byte {
+	b := []byte(s + strings.Repeat(" ", n))
+	return b[:n]
+}
+
+// jolietString encodes s as UCS-2 and pads it with spaces to n
+// bytes.
+func jolietString(s string, n int) []byte {
+	b := encodeUCS2(s)
+	for len(b) < n {
+		b = append(b, 0, ' ')
+	}
+	return b[:n]
+}
+
+// encodeUCS2 encodes s as big endian UCS-2 as used by Joliet.
+func encodeUCS2(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return b
+}
+
+// putBoth16 writes v in both byte orders.
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+// putBoth32 writes v in both byte orders.
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+// sectorCount returns the number of sectors required for size
+// bytes.
+func sectorCount(size int64) uint32 {
+	return uint32((size + SectorSize - 1) / SectorSize)
+}
+
+// padLength returns the number of bytes required to pad n bytes
+// to a full sector.
+func padLength(n int64) int64 {
+	if n%SectorSize == 0 {
+		return 0
+	}
+	return SectorSize - n%SectorSize
+}
+
+// sectorWriter writes an image to w. It keeps track of the number
+// of bytes written and of the first error.
+type sectorWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+// write writes b unless an error occurred before.
+func (sw *sectorWriter) write(b []byte) {
+	if sw.err != nil {
+		return
+	}
+
+	n, err := sw.w.Write(b)
+	sw.n += int64(n)
+	sw.err = err
+}
+
+// pad pads the data written so far to a full sector.
+func (sw *sectorWriter) pad() {
+	sw.write(make([]byte, padLength(sw.n)))
+}
+
+// copyFile copies the content of f which must match its size.
+func (sw *sectorWriter) copyFile(f *file) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	n, err := io.CopyN(sw.w, r, f.Size)
+	sw.n += n
+	if err == io.EOF {
+		err = fmt.Errorf("file is shorter than %d bytes", f.Size)
+	}
+	sw.err = err
+
+	return err
+}
@@ -0,0 +1,245 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestImage(t *testing.T) {
+	contents := map[string]string{
+		"AUTORUN.INF":                        "[autorun]\r\nopen=VIEWER\\viewer.exe\r\n",
+		"DICOMDIR":                           "dicomdir",
+		"EMPTY":                              "",
+		"DICOM/ST000001/SE000001/IM000001":   strings.Repeat("a", SectorSize+1),
+		"DICOM/ST000001/SE000001/IM000002":   "b",
+		"VIEWER/viewer.exe":                  "exe",
+		"VIEWER/README.TXT":                  "readme",
+		"VIEWER/Read Me.txt":                 "read me",
+		"VIEWER/readme.txt":                  "lower case readme",
+		"VIEWER/a-very-long-file-name.jpeg":  "jpeg",
+		"VIEWER/lib/Ünïcode-Datei.dll":       "dll",
+		"VIEWER/Program Files/data/file.dat": "data",
+	}
+
+	var files []File
+	for name, content := range contents {
+		content := content
+		files = append(files, File{
+			Name: name,
+			Size: int64(len(content)),
+			Open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(content)), nil
+			},
+		})
+	}
+
+	img, err := New("DXRAY_TEST", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := img.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != img.Size() || int64(buf.Len()) != img.Size() {
+		t.Fatalf("wrote %d bytes (%d buffered), expected %d", n, buf.Len(), img.Size())
+	}
+	data := buf.Bytes()
+
+	wantPrimary := map[string]string{
+		"AUTORUN.INF":                      contents["AUTORUN.INF"],
+		"DICOMDIR":                         contents["DICOMDIR"],
+		"EMPTY":                            "",
+		"DICOM/ST000001/SE000001/IM000001": contents["DICOM/ST000001/SE000001/IM000001"],
+		"DICOM/ST000001/SE000001/IM000002": contents["DICOM/ST000001/SE000001/IM000002"],
+		"VIEWER/VIEWER.EXE":                contents["VIEWER/viewer.exe"],
+		"VIEWER/README.TXT":                contents["VIEWER/README.TXT"],
+		"VIEWER/READ_ME.TXT":               contents["VIEWER/Read Me.txt"],
+		"VIEWER/README_1.TXT":              contents["VIEWER/readme.txt"],
+		"VIEWER/A_VERY_L.JPE":              contents["VIEWER/a-very-long-file-name.jpeg"],
+		"VIEWER/LIB/_N_CODE_.DLL":          contents["VIEWER/lib/Ünïcode-Datei.dll"],
+		"VIEWER/PROGRAM_/DATA/FILE.DAT":    contents["VIEWER/Program Files/data/file.dat"],
+	}
+
+	for _, c := range []struct {
+		name   string
+		sector int
+		typ    byte
+		want   map[string]string
+		decode func([]byte) string
+	}{
+		{"primary", systemAreaSectors, 1, wantPrimary, decodePrimary},
+		{"joliet", systemAreaSectors + 1, 2, contents, decodeJoliet},
+	} {
+		vd := data[c.sector*SectorSize:]
+		if vd[0] != c.typ || string(vd[1:6]) != "CD001" {
+			t.Fatalf("%s: invalid volume descriptor", c.name)
+		}
+		if c.typ == 2 && string(vd[88:91]) != "%/E" {
+			t.Errorf("%s: missing UCS-2 escape sequence", c.name)
+		}
+		if got := binary.LittleEndian.Uint32(vd[80:]); got != uint32(len(data)/SectorSize) {
+			t.Errorf("%s: volume space size is %d sectors", c.name, got)
+		}
+
+		root := vd[156:190]
+		got := make(map[string]string)
+		dirs := make(map[string]uint32)
+		readDirectory(t, data, binary.LittleEndian.Uint32(root[2:]), binary.LittleEndian.Uint32(root[10:]), "", c.decode, got, dirs)
+
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got files\n%v\nwant\n%v", c.name, got, c.want)
+		}
+
+		// both path tables must describe the same directories
+		// as the directory records.
+		size := binary.LittleEndian.Uint32(vd[132:])
+		for _, table := range []struct {
+			sector uint32
+			order  binary.ByteOrder
+		}{
+			{binary.LittleEndian.Uint32(vd[140:]), binary.LittleEndian},
+			{binary.BigEndian.Uint32(vd[148:]), binary.BigEndian},
+		} {
+			start := table.sector * SectorSize
+			paths := readPathTable(t, data[start:start+size], table.order, c.decode)
+			if !reflect.DeepEqual(paths, dirs) {
+				t.Errorf("%s: got path table\n%v\nwant\n%v", c.name, paths, dirs)
+			}
+		}
+	}
+
+	terminator := data[(systemAreaSectors+2)*SectorSize:]
+	if terminator[0] != 255 || string(terminator[1:6]) != "CD001" {
+		t.Errorf("missing volume descriptor set terminator")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		volumeID string
+		files    []string
+	}{
+		{"invalid volume identifier", "dxray", nil},
+		{"volume identifier too long", strings.Repeat("A", 33), nil},
+		{"invalid file name", "DXRAY", []string{"A/B:C"}},
+		{"invalid directory name", "DXRAY", []string{"A*/B"}},
+		{"file name too long", "DXRAY", []string{strings.Repeat("a", maxJolietLength+1)}},
+		{"duplicate file", "DXRAY", []string{"A/B", "A/B"}},
+		{"file and directory", "DXRAY", []string{"A/B", "A/B/C"}},
+		{"nested too deep", "DXRAY", []string{"1/2/3/4/5/6/7/8/9"}},
+	}
+
+	for _, c := range cases {
+		var files []File
+		for _, name := range c.files {
+			files = append(files, File{Name: name})
+		}
+
+		if _, err := New(c.volumeID, files); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
+
+// readDirectory adds the files and directories of the directory
+// at sector to files and dirs. Files are read completely while dirs
+// maps each directory path to its sector.
+func readDirectory(t *testing.T, data []byte, sector, size uint32, path string, decode func([]byte) string, files map[string]string, dirs map[string]uint32) {
+	dirs[path] = sector
+
+	content := data[sector*SectorSize : sector*SectorSize+size]
+	for off := 0; off < len(content); {
+		rec := content[off:]
+		if rec[0] == 0 {
+			// records do not span sectors.
+			off += SectorSize - off%SectorSize
+			continue
+		}
+		off += int(rec[0])
+
+		identifier := rec[33 : 33+rec[32]]
+		if len(identifier) == 1 && identifier[0] <= 1 {
+			continue
+		}
+
+		name := decode(identifier)
+		if path != "" {
+			name = path + "/" + name
+		}
+
+		extent := binary.LittleEndian.Uint32(rec[2:])
+		length := binary.LittleEndian.Uint32(rec[10:])
+		if binary.BigEndian.Uint32(rec[6:]) != extent || binary.BigEndian.Uint32(rec[14:]) != length {
+			t.Errorf("%s: byte orders differ", name)
+		}
+
+		if rec[25]&0x02 != 0 {
+			readDirectory(t, data, extent, length, name, decode, files, dirs)
+			continue
+		}
+
+		start := int64(extent) * SectorSize
+		files[name] = string(data[start : start+int64(length)])
+	}
+}
+
+// readPathTable returns the sector of each directory of a path
+// table keyed by the path of the directory.
+func readPathTable(t *testing.T, table []byte, order binary.ByteOrder, decode func([]byte) string) map[string]uint32 {
+	var (
+		paths   []string
+		sectors = make(map[string]uint32)
+	)
+
+	for len(table) > 0 {
+		n := int(table[0])
+		sector := order.Uint32(table[2:])
+		parent := int(order.Uint16(table[6:]))
+		identifier := table[8 : 8+n]
+		table = table[8+n+n%2:]
+
+		path := ""
+		if len(paths) > 0 {
+			if parent < 1 || parent > len(paths) {
+				t.Fatalf("invalid parent directory number %d", parent)
+			}
+
+			path = decode(identifier)
+			if parent > 1 {
+				path = paths[parent-1] + "/" + path
+			}
+		}
+
+		paths = append(paths, path)
+		sectors[path] = sector
+	}
+
+	return sectors
+}
+
+// decodePrimary decodes the identifier of a primary directory
+// record and removes the version number and empty extensions.
+func decodePrimary(b []byte) string {
+	s := strings.TrimSuffix(string(b), ";1")
+	return strings.TrimSuffix(s, ".")
+}
+
+// decodeJoliet decodes the UCS-2 identifier of a Joliet directory
+// record.
+func decodeJoliet(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
@@ -51,6 +51,10 @@ type (
 
 	InstanceTags map[string]interface{}
 
+	// TagReader returns the DICOM tags of the file at path
+	// keyed by their lower-camel-case name. See ReadTags.
+	TagReader func(path string) (map[string]interface{}, error)
+
 	/*
 		InstanceTags struct {
 			Columns                   uint16 `json:"columns"`
@@ -69,8 +73,9 @@ type (
 )
 
 // JSONFromDXR returns the JSON format required by OHIF viewer
-// from the study.xml file stored by DX-R
-func JSONFromDXR(ctx context.Context, study fsdb.Study, instanceURL func(string, string, string) string, withTags bool) (*StudyJSON, error) {
+// from the study.xml file stored by DX-R. If tags is set, it's used
+// to add the DICOM tags of each instance.
+func JSONFromDXR(ctx context.Context, study fsdb.Study, instanceURL func(string, string, string) string, tags TagReader) (*StudyJSON, error) {
 	log := logger.From(ctx)
 
 	if err := study.Load(); err != nil {
@@ -114,14 +119,22 @@ func JSONFromDXR(ctx context.Context, study fsdb.Study, instanceURL func(string,
 				"imagePositionPatient":    "0\\0\\0",
 			}
 
-			if withTags {
-				path := study.RealPath(instance.Data.DICOMPath)
-				if err := setDCMTags(path, im); err != nil {
+			if tags != nil {
+				path, err := study.RealPath(instance.Data.DICOMPath)
+				var values map[string]interface{}
+				if err == nil {
+					values, err = tags(path)
+				}
+				if err != nil {
 					log.WithFields(logger.Fields{
 						"error": err.Error(),
 						"path":  path,
 					}).Errorf("failed to set tags from DCM file")
 				}
+
+				for k, v := range values {
+					im[k] = v
+				}
 			}
 
 			sm.Instances = append(sm.Instances, im)
@@ -133,15 +146,17 @@ func JSONFromDXR(ctx context.Context, study fsdb.Study, instanceURL func(string,
 	return model, nil
 }
 
-func setDCMTags(path string, i map[string]interface{}) error {
+// ReadTags reads the DICOM file at path and returns all tags
+// keyed by their lower-camel-case name. It implements TagReader.
+func ReadTags(path string) (map[string]interface{}, error) {
 	ds, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{DropPixelData: true})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, el := range ds.Elements {
-		fmt.Println(el.String())
+	i := make(map[string]interface{})
 
+	for _, el := range ds.Elements {
 		if len(el.Value) == 0 {
 			continue
 		}
@@ -178,7 +193,7 @@ func setDCMTags(path string, i map[string]interface{}) error {
 		i.ImageType = stringTag(ds, dicomtag.ImageType)
 	*/
 
-	return nil
+	return i, nil
 }
 
 func stringTag(ds *dicom.DataSet, tag dicomtag.Tag) string {
@@ -0,0 +1,406 @@
+// Package qr implements the DICOM query/retrieve service on top of
+// the study index. It answers C-FIND requests using the index and
+// study.xml files and resolves C-GET and C-MOVE requests to the
+// DICOM files that have to be sent.
+package qr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/tierklinik-dobersberg/dxray/internal/dicomweb"
+	"github.com/tierklinik-dobersberg/dxray/internal/dimse"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/models"
+	"github.com/tierklinik-dobersberg/dxray/internal/index"
+	"github.com/tierklinik-dobersberg/dxray/internal/search"
+	"github.com/tierklinik-dobersberg/logger"
+)
+
+// Query/retrieve levels.
+const (
+	LevelPatient = "PATIENT"
+	LevelStudy   = "STUDY"
+	LevelSeries  = "SERIES"
+	LevelImage   = "IMAGE"
+)
+
+const (
+	// studyBatchSize is the number of studies that are
+	// requested from the index at once.
+	studyBatchSize = 1000
+
+	// maxMatches is the maximum number of matches returned for
+	// a C-FIND request.
+	maxMatches = 1000
+)
+
+// nonStringVRs are value representations that cannot hold the
+// string values of the DICOM JSON model. Return keys using them
+// are returned without a value.
+var nonStringVRs = map[string]bool{
+	"AT": true, "FD": true, "FL": true, "OB": true, "OD": true,
+	"OF": true, "OL": true, "OW": true, "SL": true, "SQ": true,
+	"SS": true, "UL": true, "UN": true, "US": true,
+}
+
+// Provider answers query/retrieve requests. Its Find and Retrieve
+// methods can be used as dimse.Options.Find and
+// dimse.Options.Retrieve.
+type Provider struct {
+	db      fsdb.DB
+	indexer *index.StudyIndexer
+	log     logger.Logger
+}
+
+// New returns a new provider that searches indexer and loads
+// studies from db.
+func New(db fsdb.DB, indexer *index.StudyIndexer, log logger.Logger) *Provider {
+	if log == nil {
+		log = logger.DefaultLogger()
+	}
+
+	return &Provider{
+		db:      db,
+		indexer: indexer,
+		log:     log,
+	}
+}
+
+// Find returns the identifiers of all entities that match the
+// C-FIND request req.
+func (p *Provider) Find(ctx context.Context, req *dimse.QueryRequest) ([][]*dicom.Element, error) {
+	if err := checkLevel(req); err != nil {
+		return nil, err
+	}
+
+	q := matchingKeys(req.Identifier)
+
+	// study level keys that are not indexed are matched against
+	// each study. Keys that are not supported at all are ignored
+	// as permitted by PS3.4 C.4.1.1.3.2.
+	unindexed := q.Unindexed()
+
+	var (
+		matches  [][]*dicom.Element
+		patients = make(map[string]bool)
+	)
+	add := func(obj dicomweb.Object) bool {
+		matches = append(matches, identifier(req, obj))
+		return len(matches) < maxMatches
+	}
+
+	err := p.forEachStudy(q, func(study indexedStudy) bool {
+		model := study.ImageList
+		if !unindexed.Matches(dicomweb.Study(model)) {
+			return true
+		}
+
+		switch req.Level {
+		case LevelPatient:
+			// studies are sorted by date so the latest
+			// study of each patient is used.
+			if patients[model.Patient.ID] {
+				return true
+			}
+			patients[model.Patient.ID] = true
+
+			return add(dicomweb.Study(model))
+
+		case LevelStudy:
+			return add(dicomweb.Study(model))
+
+		case LevelSeries:
+			for _, series := range model.Patient.Visit.Study.Series {
+				obj := dicomweb.Series(model, series)
+				if q.Matches(obj) && !add(withStudy(obj, model)) {
+					return false
+				}
+			}
+
+		case LevelImage:
+			for _, series := range model.Patient.Visit.Study.Series {
+				for _, instance := range series.Instances {
+					obj := dicomweb.Instance(model, series, instance)
+					if !q.Matches(obj) {
+						continue
+					}
+
+					if wantsKey(req, dicomtag.SOPClassUID) {
+						addSOPClass(obj, study.study, instance)
+					}
+
+					if !add(withStudy(obj, model)) {
+						return false
+					}
+				}
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return matches, nil
+}
+
+// Retrieve returns the paths of all DICOM files that match the
+// unique keys of the C-GET or C-MOVE request req.
+func (p *Provider) Retrieve(ctx context.Context, req *dimse.QueryRequest) ([]string, error) {
+	if err := checkLevel(req); err != nil {
+		return nil, err
+	}
+
+	keys := uniqueKeys(req.Identifier)
+
+	required := []dicomtag.Tag{dicomtag.StudyInstanceUID}
+	switch req.Level {
+	case LevelPatient:
+		required = []dicomtag.Tag{dicomtag.PatientID}
+	case LevelSeries:
+		required = append(required, dicomtag.SeriesInstanceUID)
+	case LevelImage:
+		required = append(required, dicomtag.SeriesInstanceUID, dicomtag.SOPInstanceUID)
+	}
+	for _, tag := range required {
+		if keys.Match[tag] == "" {
+			return nil, identifierError("missing unique key %s", dicomtag.DebugString(tag))
+		}
+	}
+
+	studyQuery := &dicomweb.Query{Match: map[dicomtag.Tag]string{
+		dicomtag.PatientID:        keys.Match[dicomtag.PatientID],
+		dicomtag.StudyInstanceUID: keys.Match[dicomtag.StudyInstanceUID],
+	}}
+
+	var paths []string
+	err := p.forEachStudy(studyQuery, func(s indexedStudy) bool {
+		model := s.ImageList
+
+		for _, series := range model.Patient.Visit.Study.Series {
+			if !keys.Matches(dicomweb.Series(model, series)) {
+				continue
+			}
+
+			for _, instance := range series.Instances {
+				if !keys.Matches(dicomweb.Instance(model, series, instance)) {
+					continue
+				}
+
+				path, err := s.study.RealPath(instance.Data.DICOMPath)
+				if err != nil {
+					p.log.WithFields(logger.Fields{
+						"study":    model.Patient.Visit.Study.UID,
+						"instance": instance.UID,
+						"error":    err.Error(),
+					}).Errorf("failed to retrieve instance")
+					continue
+				}
+
+				paths = append(paths, path)
+			}
+		}
+
+		p.log.WithFields(logger.Fields{
+			"calling": req.CallingAETitle,
+			"patient": model.Patient.ID,
+			"study":   model.Patient.Visit.Study.UID,
+		}).Infof("study retrieved")
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+}
+
+// indexedStudy is a study found using the index.
+type indexedStudy struct {
+	models.ImageList
+	study fsdb.Study
+}
+
+// forEachStudy calls fn for each study that matches the study
+// level keys of q, latest first, until fn returns false. The
+// index is searched in batches so there is no limit on the
+// number of studies.
+func (p *Provider) forEachStudy(q *dicomweb.Query, fn func(indexedStudy) bool) error {
+	query := q.StudyQuery()
+
+	for offset := 0; ; offset += studyBatchSize {
+		keys, total, err := p.indexer.Query(query, studyBatchSize, offset, "-date")
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			s, err := search.Get(key, p.db)
+			if err == nil {
+				err = s.Load()
+			}
+			if err != nil {
+				p.log.WithFields(logger.Fields{
+					"error": err.Error(),
+					"key":   key,
+				}).Errorf("failed to open study")
+				continue
+			}
+
+			model, _ := s.Model()
+			if !fn(indexedStudy{ImageList: model, study: s}) {
+				return nil
+			}
+		}
+
+		if len(keys) == 0 || uint64(offset+len(keys)) >= total {
+			return nil
+		}
+	}
+}
+
+// addSOPClass adds the SOP class of instance to obj. The SOP class
+// is not part of study.xml so it's read from the file itself.
+func addSOPClass(obj dicomweb.Object, study fsdb.Study, instance models.Instance) {
+	path, err := study.RealPath(instance.Data.DICOMPath)
+	if err != nil {
+		return
+	}
+
+	meta, err := dimse.ReadFileMeta(path)
+	if err != nil {
+		return
+	}
+
+	obj.Set(dicomtag.SOPClassUID, meta.SOPClassUID)
+}
+
+// withStudy adds the study level attributes of model to the series
+// or instance obj so they can be returned as well.
+func withStudy(obj dicomweb.Object, model models.ImageList) dicomweb.Object {
+	for key, attr := range dicomweb.Study(model) {
+		if _, ok := obj[key]; !ok {
+			obj[key] = attr
+		}
+	}
+
+	return obj
+}
+
+// checkLevel returns an error if the query/retrieve level of req is
+// not valid for its information model.
+func checkLevel(req *dimse.QueryRequest) error {
+	switch req.Level {
+	case LevelPatient:
+		switch req.SOPClassUID {
+		case dicomuid.StudyRootQRFind, dicomuid.StudyRootQRGet, dicomuid.StudyRootQRMove:
+			return identifierError("level %s is not supported by the study root information model", req.Level)
+		}
+		return nil
+
+	case LevelStudy, LevelSeries, LevelImage:
+		return nil
+	}
+
+	return identifierError("invalid level %q", req.Level)
+}
+
+// matchingKeys returns a query for all matching keys of identifier.
+func matchingKeys(identifier []*dicom.Element) *dicomweb.Query {
+	q := &dicomweb.Query{Match: make(map[dicomtag.Tag]string)}
+
+	for _, elem := range identifier {
+		if elem.Tag == dicomtag.QueryRetrieveLevel || elem.Tag == dicomtag.SpecificCharacterSet {
+			continue
+		}
+
+		if value := elementValue(elem); value != "" {
+			q.Match[elem.Tag] = value
+		}
+	}
+
+	return q
+}
+
+// uniqueKeys returns a query for the unique keys of identifier.
+func uniqueKeys(identifier []*dicom.Element) *dicomweb.Query {
+	q := &dicomweb.Query{Match: make(map[dicomtag.Tag]string)}
+
+	for _, elem := range identifier {
+		switch elem.Tag {
+		case dicomtag.PatientID, dicomtag.StudyInstanceUID, dicomtag.SeriesInstanceUID, dicomtag.SOPInstanceUID:
+			q.Match[elem.Tag] = elementValue(elem)
+		}
+	}
+
+	return q
+}
+
+// identifier returns the identifier of the C-FIND response for obj.
+// It contains all keys requested by req.
+func identifier(req *dimse.QueryRequest, obj dicomweb.Object) []*dicom.Element {
+	result := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.SpecificCharacterSet, "ISO_IR 192"),
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, req.Level),
+	}
+
+	for _, elem := range req.Identifier {
+		if elem.Tag == dicomtag.QueryRetrieveLevel || elem.Tag == dicomtag.SpecificCharacterSet {
+			continue
+		}
+
+		rsp := &dicom.Element{
+			Tag:             elem.Tag,
+			VR:              elem.VR,
+			UndefinedLength: elem.VR == "SQ",
+		}
+
+		if attr, ok := obj.Get(elem.Tag); ok && !nonStringVRs[elem.VR] {
+			for _, v := range attr.Strings() {
+				rsp.Value = append(rsp.Value, v)
+			}
+		}
+
+		result = append(result, rsp)
+	}
+
+	return result
+}
+
+// wantsKey returns true if req requests the return key tag.
+func wantsKey(req *dimse.QueryRequest, tag dicomtag.Tag) bool {
+	for _, elem := range req.Identifier {
+		if elem.Tag == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// elementValue returns the values of elem separated by a
+// backslash.
+func elementValue(elem *dicom.Element) string {
+	values, err := elem.GetStrings()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.Join(values, `\`))
+}
+
+// identifierError returns an error that is reported using the
+// "identifier does not match SOP class" status.
+func identifierError(format string, args ...interface{}) error {
+	return &dimse.StatusError{
+		Status: dimse.StatusDataSetMismatch,
+		Err:    fmt.Errorf(format, args...),
+	}
+}
@@ -0,0 +1,407 @@
+package render
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/tierklinik-dobersberg/dxray/internal/dicomweb"
+)
+
+// ErrUnsupported is returned if the pixel data of an instance
+// cannot be decoded by dxray.
+var ErrUnsupported = errors.New("unsupported pixel data")
+
+// ErrNoSuchFrame is returned if the requested frame does not
+// exist.
+var ErrNoSuchFrame = errors.New("no such frame")
+
+// Transfer syntaxes that can be decoded.
+const (
+	implicitVRLittleEndian = "1.2.840.10008.1.2"
+	explicitVRLittleEndian = "1.2.840.10008.1.2.1"
+	explicitVRBigEndian    = "1.2.840.10008.1.2.2"
+	jpegBaseline           = "1.2.840.10008.1.2.4.50"
+)
+
+type (
+	// Window describes a linear VOI LUT transformation.
+	Window struct {
+		Center float64
+		Width  float64
+	}
+
+	// LUT is a VOI lookup table as described by the LUT
+	// descriptor of the VOI LUT sequence.
+	LUT struct {
+		FirstMapped int
+		Bits        int
+		Data        []uint16
+	}
+
+	// Frame is a single decoded frame of an instance.
+	Frame struct {
+		Width  int
+		Height int
+
+		// Gray holds the stored pixel values of monochrome
+		// frames in row-major order.
+		Gray []int32
+
+		// RGB is set for color frames instead of Gray.
+		RGB *image.RGBA
+
+		// Monochrome1 is set if the minimum pixel value is
+		// intended to be displayed as white.
+		Monochrome1 bool
+
+		// RescaleSlope and RescaleIntercept convert stored
+		// values to modality values.
+		RescaleSlope     float64
+		RescaleIntercept float64
+
+		// Windows holds the windows that are recommended by
+		// the dataset.
+		Windows []Window
+
+		// VOILUT holds the first VOI LUT of the dataset, if any.
+		VOILUT *LUT
+	}
+)
+
+// ReadFrame reads the DICOM file at path and decodes the frame
+// with the given (zero-based) index.
+func ReadFrame(path string, index int) (*Frame, error) {
+	ds, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeFrame(ds, index)
+}
+
+// DecodeFrame decodes the frame with the given (zero-based) index
+// of ds. Native transfer syntaxes with 8 to 16 bits allocated and
+// JPEG baseline are supported.
+func DecodeFrame(ds *dicom.DataSet, index int) (*Frame, error) {
+	frames, err := dicomweb.Frames(ds)
+	if err != nil {
+		return nil, err
+	}
+
+	if index < 0 || index >= len(frames) {
+		return nil, fmt.Errorf("%w: %d", ErrNoSuchFrame, index+1)
+	}
+	data := frames[index]
+
+	f := &Frame{
+		Width:            getInt(ds, dicomtag.Columns, 0),
+		Height:           getInt(ds, dicomtag.Rows, 0),
+		Monochrome1:      getString(ds, dicomtag.PhotometricInterpretation) == "MONOCHROME1",
+		RescaleSlope:     getFloat(ds, dicomtag.RescaleSlope, 1),
+		RescaleIntercept: getFloat(ds, dicomtag.RescaleIntercept, 0),
+		Windows:          getWindows(ds),
+		VOILUT:           getVOILUT(ds),
+	}
+
+	if f.RescaleSlope == 0 {
+		f.RescaleSlope = 1
+	}
+
+	switch ts := getString(ds, dicomtag.TransferSyntaxUID); ts {
+	case implicitVRLittleEndian, explicitVRLittleEndian:
+		err = f.decodeNative(ds, data, binary.LittleEndian)
+	case explicitVRBigEndian:
+		err = f.decodeNative(ds, data, binary.BigEndian)
+	case jpegBaseline:
+		err = f.decodeJPEG(data)
+	default:
+		err = fmt.Errorf("%w: transfer syntax %s", ErrUnsupported, ts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *Frame) decodeNative(ds *dicom.DataSet, data []byte, order binary.ByteOrder) error {
+	var (
+		samples   = getInt(ds, dicomtag.SamplesPerPixel, 1)
+		allocated = getInt(ds, dicomtag.BitsAllocated, 16)
+		stored    = getInt(ds, dicomtag.BitsStored, allocated)
+		signed    = getInt(ds, dicomtag.PixelRepresentation, 0) == 1
+		planar    = getInt(ds, dicomtag.PlanarConfiguration, 0) == 1
+		pixels    = f.Width * f.Height
+	)
+
+	if pixels == 0 {
+		return fmt.Errorf("%w: missing image dimensions", ErrUnsupported)
+	}
+
+	if samples == 3 {
+		if allocated != 8 {
+			return fmt.Errorf("%w: %d bit color", ErrUnsupported, allocated)
+		}
+		if len(data) < pixels*3 {
+			return fmt.Errorf("pixel data too short")
+		}
+
+		f.RGB = image.NewRGBA(image.Rect(0, 0, f.Width, f.Height))
+		for i := 0; i < pixels; i++ {
+			var r, g, b byte
+			if planar {
+				r, g, b = data[i], data[pixels+i], data[2*pixels+i]
+			} else {
+				r, g, b = data[3*i], data[3*i+1], data[3*i+2]
+			}
+			copy(f.RGB.Pix[4*i:], []byte{r, g, b, 0xff})
+		}
+		return nil
+	}
+
+	if samples != 1 {
+		return fmt.Errorf("%w: %d samples per pixel", ErrUnsupported, samples)
+	}
+
+	if stored < 1 || stored > allocated {
+		stored = allocated
+	}
+	mask := uint32(1)<<uint(stored) - 1
+	signBit := uint32(1) << uint(stored-1)
+
+	f.Gray = make([]int32, pixels)
+
+	switch allocated {
+	case 8:
+		if len(data) < pixels {
+			return fmt.Errorf("pixel data too short")
+		}
+		for i := 0; i < pixels; i++ {
+			f.Gray[i] = storedValue(uint32(data[i]), mask, signBit, signed)
+		}
+
+	case 16:
+		if len(data) < pixels*2 {
+			return fmt.Errorf("pixel data too short")
+		}
+		for i := 0; i < pixels; i++ {
+			f.Gray[i] = storedValue(uint32(order.Uint16(data[2*i:])), mask, signBit, signed)
+		}
+
+	default:
+		return fmt.Errorf("%w: %d bits allocated", ErrUnsupported, allocated)
+	}
+
+	return nil
+}
+
+func (f *Frame) decodeJPEG(data []byte) error {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	f.Width = bounds.Dx()
+	f.Height = bounds.Dy()
+
+	if gray, ok := img.(*image.Gray); ok {
+		f.Gray = make([]int32, f.Width*f.Height)
+		for y := 0; y < f.Height; y++ {
+			for x := 0; x < f.Width; x++ {
+				f.Gray[y*f.Width+x] = int32(gray.Pix[y*gray.Stride+x])
+			}
+		}
+		return nil
+	}
+
+	f.RGB = image.NewRGBA(image.Rect(0, 0, f.Width, f.Height))
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			f.RGB.Set(x, y, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+
+	return nil
+}
+
+// storedValue masks v to the stored bits and applies sign
+// extension for signed pixel representations.
+func storedValue(v, mask, signBit uint32, signed bool) int32 {
+	v &= mask
+	if signed && v&signBit != 0 {
+		return int32(v) - int32(mask) - 1
+	}
+	return int32(v)
+}
+
+func findElement(ds *dicom.DataSet, tag dicomtag.Tag) *dicom.Element {
+	el, err := ds.FindElementByTag(tag)
+	if err != nil {
+		return nil
+	}
+	return el
+}
+
+func getString(ds *dicom.DataSet, tag dicomtag.Tag) string {
+	el := findElement(ds, tag)
+	if el == nil || len(el.Value) == 0 {
+		return ""
+	}
+
+	s, _ := el.Value[0].(string)
+	return strings.TrimSpace(s)
+}
+
+func getInt(ds *dicom.DataSet, tag dicomtag.Tag, def int) int {
+	el := findElement(ds, tag)
+	if el == nil || len(el.Value) == 0 {
+		return def
+	}
+
+	switch v := el.Value[0].(type) {
+	case uint16:
+		return int(v)
+	case uint32:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case string:
+		if i, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			return i
+		}
+	}
+
+	return def
+}
+
+func getFloats(el *dicom.Element) []float64 {
+	if el == nil {
+		return nil
+	}
+
+	var result []float64
+	for _, v := range el.Value {
+		s, _ := v.(string)
+		if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			result = append(result, f)
+		}
+	}
+
+	return result
+}
+
+func getFloat(ds *dicom.DataSet, tag dicomtag.Tag, def float64) float64 {
+	values := getFloats(findElement(ds, tag))
+	if len(values) == 0 {
+		return def
+	}
+	return values[0]
+}
+
+func getWindows(ds *dicom.DataSet) []Window {
+	centers := getFloats(findElement(ds, dicomtag.WindowCenter))
+	widths := getFloats(findElement(ds, dicomtag.WindowWidth))
+
+	var result []Window
+	for i := 0; i < len(centers) && i < len(widths); i++ {
+		if widths[i] >= 1 {
+			result = append(result, Window{Center: centers[i], Width: widths[i]})
+		}
+	}
+
+	return result
+}
+
+func getVOILUT(ds *dicom.DataSet) *LUT {
+	seq := findElement(ds, dicomtag.VOILUTSequence)
+	if seq == nil || len(seq.Value) == 0 {
+		return nil
+	}
+
+	item, ok := seq.Value[0].(*dicom.Element)
+	if !ok {
+		return nil
+	}
+
+	var (
+		descriptor []int
+		data       []uint16
+	)
+	for _, v := range item.Value {
+		el, ok := v.(*dicom.Element)
+		if !ok {
+			continue
+		}
+
+		switch el.Tag {
+		case dicomtag.LUTDescriptor:
+			for _, d := range el.Value {
+				switch n := d.(type) {
+				case uint16:
+					descriptor = append(descriptor, int(n))
+				case int16:
+					descriptor = append(descriptor, int(n))
+				}
+			}
+
+		case dicomtag.LUTData:
+			data = lutData(el)
+		}
+	}
+
+	if len(descriptor) != 3 || len(data) == 0 {
+		return nil
+	}
+
+	// the first mapped value may be signed.
+	first := descriptor[1]
+	if first > 0x7fff {
+		first -= 0x10000
+	}
+
+	bits := descriptor[2]
+	if bits < 8 || bits > 16 {
+		return nil
+	}
+
+	return &LUT{
+		FirstMapped: first,
+		Bits:        bits,
+		Data:        data,
+	}
+}
+
+// lutData returns the entries of the LUT Data element which may be
+// encoded as US, OW or (due to the data dictionary of go-dicom) as
+// a raw string.
+func lutData(el *dicom.Element) []uint16 {
+	var result []uint16
+
+	for _, v := range el.Value {
+		switch d := v.(type) {
+		case uint16:
+			result = append(result, d)
+		case []byte:
+			for i := 0; i+1 < len(d); i += 2 {
+				result = append(result, binary.LittleEndian.Uint16(d[i:]))
+			}
+		case string:
+			for i := 0; i+1 < len(d); i += 2 {
+				result = append(result, binary.LittleEndian.Uint16([]byte(d[i:])))
+			}
+		}
+	}
+
+	return result
+}
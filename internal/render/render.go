@@ -0,0 +1,233 @@
+// Package render renders the pixel data of DICOM instances to
+// images suitable for previews. Monochrome images are converted to
+// 8 bit gray scale by applying the modality rescale and a VOI LUT
+// or window.
+package render
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+)
+
+// Supported output media types.
+const (
+	ContentTypeJPEG = "image/jpeg"
+	ContentTypePNG  = "image/png"
+)
+
+// DefaultQuality is the JPEG quality used if none is requested.
+const DefaultQuality = 90
+
+// MaxSize is the largest width or height that may be requested.
+const MaxSize = 4096
+
+// Options configures how a frame is rendered.
+type Options struct {
+	// Width and Height limit the size of the rendered image.
+	// The aspect ratio is always kept and images are never
+	// scaled up. Zero means no limit.
+	Width  int
+	Height int
+
+	// Window overwrites the window of the dataset.
+	Window *Window
+
+	// VOILUT prefers the VOI LUT of the dataset over the
+	// window recommended by the dataset. Ignored if Window
+	// is set.
+	VOILUT bool
+
+	// Invert inverts the rendered gray scale image.
+	Invert bool
+}
+
+// Render renders f according to opts.
+func Render(f *Frame, opts Options) image.Image {
+	var img image.Image
+
+	if f.RGB != nil {
+		rgb := f.RGB
+		if opts.Invert {
+			rgb = invertRGBA(rgb)
+		}
+		img = rgb
+	} else {
+		img = f.renderGray(opts)
+	}
+
+	width, height := fit(f.Width, f.Height, opts.Width, opts.Height)
+	if width != f.Width || height != f.Height {
+		img = resize(img, width, height)
+	}
+
+	return img
+}
+
+// Encode encodes img as contentType to w. Quality is only used
+// for JPEG and defaults to DefaultQuality.
+func Encode(w io.Writer, img image.Image, contentType string, quality int) error {
+	switch contentType {
+	case ContentTypeJPEG, "":
+		if quality <= 0 || quality > 100 {
+			quality = DefaultQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case ContentTypePNG:
+		return png.Encode(w, img)
+	default:
+		return fmt.Errorf("unsupported content type %q", contentType)
+	}
+}
+
+// renderGray converts the stored values of f to an 8 bit gray
+// image. A lookup table covering all stored values is built first
+// so the (rather expensive) transformation is only performed once
+// per distinct value.
+func (f *Frame) renderGray(opts Options) *image.Gray {
+	min, max := int32(math.MaxInt32), int32(math.MinInt32)
+	for _, v := range f.Gray {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	if min > max {
+		min, max = 0, 0
+	}
+
+	voi := f.voiFunc(opts, min, max)
+	invert := f.Monochrome1 != opts.Invert
+
+	table := make([]uint8, int(max-min)+1)
+	for i := range table {
+		y := voi(float64(min+int32(i))*f.RescaleSlope + f.RescaleIntercept)
+		if invert {
+			y = 255 - y
+		}
+		table[i] = y
+	}
+
+	img := image.NewGray(image.Rect(0, 0, f.Width, f.Height))
+	for i, v := range f.Gray {
+		img.Pix[i] = table[v-min]
+	}
+
+	return img
+}
+
+// voiFunc returns the function that maps modality values to
+// 8 bit gray values.
+func (f *Frame) voiFunc(opts Options, min, max int32) func(float64) uint8 {
+	switch {
+	case opts.Window != nil && opts.Window.Width >= 1:
+		return opts.Window.apply
+	case opts.VOILUT && f.VOILUT != nil:
+		return f.VOILUT.apply
+	case len(f.Windows) > 0:
+		return f.Windows[0].apply
+	case f.VOILUT != nil:
+		return f.VOILUT.apply
+	}
+
+	// use the full range of modality values.
+	lower := float64(min)*f.RescaleSlope + f.RescaleIntercept
+	upper := float64(max)*f.RescaleSlope + f.RescaleIntercept
+	if lower > upper {
+		lower, upper = upper, lower
+	}
+
+	w := Window{
+		Center: (lower+upper)/2 + 0.5,
+		Width:  upper - lower + 1,
+	}
+	return w.apply
+}
+
+// apply implements the linear window function.
+//
+// http://dicom.nema.org/medical/dicom/current/output/chtml/part03/sect_C.11.2.html#sect_C.11.2.1.2.1
+func (w Window) apply(x float64) uint8 {
+	lower := w.Center - 0.5 - (w.Width-1)/2
+	upper := w.Center - 0.5 + (w.Width-1)/2
+
+	switch {
+	case x <= lower:
+		return 0
+	case x > upper:
+		return 255
+	case w.Width <= 1:
+		return 255
+	}
+
+	return uint8(math.Round(((x-(w.Center-0.5))/(w.Width-1) + 0.5) * 255))
+}
+
+// apply maps x through the lookup table and scales the result
+// to 8 bit.
+func (lut *LUT) apply(x float64) uint8 {
+	i := int(math.Round(x)) - lut.FirstMapped
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(lut.Data) {
+		i = len(lut.Data) - 1
+	}
+
+	max := float64(uint32(1)<<uint(lut.Bits) - 1)
+	v := float64(lut.Data[i])
+	if v > max {
+		v = max
+	}
+
+	return uint8(math.Round(v / max * 255))
+}
+
+func invertRGBA(src *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(src.Bounds())
+	for i := 0; i < len(src.Pix); i += 4 {
+		dst.Pix[i] = 255 - src.Pix[i]
+		dst.Pix[i+1] = 255 - src.Pix[i+1]
+		dst.Pix[i+2] = 255 - src.Pix[i+2]
+		dst.Pix[i+3] = src.Pix[i+3]
+	}
+	return dst
+}
+
+// fit returns the size of an image with the given width and
+// height scaled down to fit into maxWidth and maxHeight.
+func fit(width, height, maxWidth, maxHeight int) (int, int) {
+	if width == 0 || height == 0 {
+		return width, height
+	}
+
+	scale := 0.0
+	if maxWidth > 0 {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 {
+		if s := float64(maxHeight) / float64(height); scale == 0 || s < scale {
+			scale = s
+		}
+	}
+
+	if scale == 0 || scale >= 1 {
+		return width, height
+	}
+
+	w := int(math.Round(float64(width) * scale))
+	h := int(math.Round(float64(height) * scale))
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	return w, h
+}
@@ -0,0 +1,100 @@
+package render
+
+import (
+	"image"
+	"testing"
+)
+
+func TestFit(t *testing.T) {
+	cases := []struct {
+		width, height       int
+		maxWidth, maxHeight int
+		wantW, wantH        int
+	}{
+		{1000, 500, 0, 0, 1000, 500},
+		{1000, 500, 2000, 0, 1000, 500},
+		{1000, 500, 500, 0, 500, 250},
+		{1000, 500, 0, 100, 200, 100},
+		{1000, 500, 500, 100, 200, 100},
+		{1000, 500, 100, 500, 100, 50},
+		{500, 1000, 128, 128, 64, 128},
+		{1000, 1, 10, 0, 10, 1},
+		{3, 3, 2, 2, 2, 2},
+		{0, 0, 10, 10, 0, 0},
+	}
+
+	for _, c := range cases {
+		w, h := fit(c.width, c.height, c.maxWidth, c.maxHeight)
+		if w != c.wantW || h != c.wantH {
+			t.Errorf("fit(%d, %d, %d, %d) = %dx%d, want %dx%d",
+				c.width, c.height, c.maxWidth, c.maxHeight, w, h, c.wantW, c.wantH)
+		}
+	}
+}
+
+func TestRenderSize(t *testing.T) {
+	gray := &Frame{
+		Width:        400,
+		Height:       200,
+		Gray:         make([]int32, 400*200),
+		RescaleSlope: 1,
+	}
+	for i := range gray.Gray {
+		gray.Gray[i] = int32(i % 400)
+	}
+
+	rgb := &Frame{
+		Width:  400,
+		Height: 200,
+		RGB:    image.NewRGBA(image.Rect(0, 0, 400, 200)),
+	}
+
+	cases := []struct {
+		frame      *Frame
+		opts       Options
+		wantBounds image.Rectangle
+	}{
+		{gray, Options{}, image.Rect(0, 0, 400, 200)},
+		{gray, Options{Width: 100}, image.Rect(0, 0, 100, 50)},
+		{gray, Options{Height: 50}, image.Rect(0, 0, 100, 50)},
+		{gray, Options{Width: 800, Height: 800}, image.Rect(0, 0, 400, 200)},
+		{rgb, Options{Width: 200, Height: 200}, image.Rect(0, 0, 200, 100)},
+		{rgb, Options{Invert: true}, image.Rect(0, 0, 400, 200)},
+	}
+
+	for _, c := range cases {
+		img := Render(c.frame, c.opts)
+		if img.Bounds() != c.wantBounds {
+			t.Errorf("%+v: got bounds %v, want %v", c.opts, img.Bounds(), c.wantBounds)
+		}
+	}
+}
+
+func TestRenderWindow(t *testing.T) {
+	f := &Frame{
+		Width:        4,
+		Height:       1,
+		Gray:         []int32{0, 100, 200, 300},
+		RescaleSlope: 1,
+	}
+
+	cases := []struct {
+		name string
+		opts Options
+		want []uint8
+	}{
+		{"full range", Options{}, []uint8{0, 85, 170, 255}},
+		{"inverted", Options{Invert: true}, []uint8{255, 170, 85, 0}},
+		{"narrow window", Options{Window: &Window{Center: 150, Width: 100}}, []uint8{0, 0, 255, 255}},
+		{"wide window", Options{Window: &Window{Center: 100.5, Width: 201}}, []uint8{0, 128, 255, 255}},
+	}
+
+	for _, c := range cases {
+		img := Render(f, c.opts).(*image.Gray)
+		for i, want := range c.want {
+			if got := img.Pix[i]; got != want {
+				t.Errorf("%s: pixel %d is %d, want %d", c.name, i, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package render
+
+import (
+	"image"
+)
+
+// resize scales img to width x height. Each target pixel is the
+// average of the source pixels it covers, which gives good results
+// for the downscaling required by previews. Upscaling falls back
+// to nearest neighbour.
+func resize(img image.Image, width, height int) image.Image {
+	switch src := img.(type) {
+	case *image.Gray:
+		dst := image.NewGray(image.Rect(0, 0, width, height))
+		resizePix(src.Pix, src.Stride, src.Rect.Dx(), src.Rect.Dy(), 1, dst.Pix, dst.Stride, width, height)
+		return dst
+
+	case *image.RGBA:
+		dst := image.NewRGBA(image.Rect(0, 0, width, height))
+		resizePix(src.Pix, src.Stride, src.Rect.Dx(), src.Rect.Dy(), 4, dst.Pix, dst.Stride, width, height)
+		return dst
+	}
+
+	return img
+}
+
+func resizePix(src []uint8, srcStride, srcWidth, srcHeight, channels int, dst []uint8, dstStride, width, height int) {
+	sum := make([]int, channels)
+
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := (y + 1) * srcHeight / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := (x + 1) * srcWidth / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			for c := range sum {
+				sum[c] = 0
+			}
+
+			for sy := y0; sy < y1; sy++ {
+				row := src[sy*srcStride:]
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < channels; c++ {
+						sum[c] += int(row[sx*channels+c])
+					}
+				}
+			}
+
+			n := (y1 - y0) * (x1 - x0)
+			for c := 0; c < channels; c++ {
+				dst[y*dstStride+x*channels+c] = uint8((sum[c] + n/2) / n)
+			}
+		}
+	}
+}
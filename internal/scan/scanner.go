@@ -3,8 +3,11 @@ package scan
 import (
 	"context"
 	"errors"
+	"runtime"
+	"sync"
 
 	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/models"
 )
 
 var (
@@ -12,43 +15,96 @@ var (
 	ErrScanRunning = errors.New("scan is already running")
 )
 
-// Scanner scans a DX-R fsdb for all studies stored
-// inside.
-type Scanner struct {
-	db fsdb.DB
+type (
+	// Options configures the parallelism and behavior of
+	// a Scanner.
+	Options struct {
+		// VolumeWorkers is the number of volumes that are
+		// listed in parallel. Defaults to 1.
+		VolumeWorkers int
+
+		// StudyWorkers is the number of studies that are
+		// processed in parallel. Defaults to the number of
+		// CPUs.
+		StudyWorkers int
+
+		// Load decides whether the study.xml file of a study
+		// should be parsed by the scanner. If nil, no study
+		// is loaded. Use LoadAll to load every study.
+		Load func(fsdb.Study) bool
+
+		// Ordered ensures studies are delivered in the order
+		// of volume and study names. If not set, studies are
+		// delivered as soon as they have been processed.
+		Ordered bool
+	}
+
+	// Result is delivered by the scanner for each study
+	// found or each error encountered.
+	Result struct {
+		// Volume is the name of the volume.
+		Volume string
+
+		// Study is the study that has been found. Study may
+		// be nil if Err is set.
+		Study fsdb.Study
+
+		// Model is the parsed study.xml of Study. It is only
+		// set if the study has been loaded.
+		Model *models.ImageList
+
+		// Err is set if the volume or the study could not be
+		// opened or loaded.
+		Err error
+	}
+
+	// Scanner scans a DX-R fsdb for all studies stored
+	// inside.
+	Scanner struct {
+		db   fsdb.DB
+		opts Options
+	}
+)
+
+// LoadAll can be used as Options.Load and loads every study.
+func LoadAll(fsdb.Study) bool {
+	return true
 }
 
 // New returns a new scanner
-func New(db fsdb.DB) *Scanner {
+func New(db fsdb.DB, opts Options) *Scanner {
+	if opts.VolumeWorkers <= 0 {
+		opts.VolumeWorkers = 1
+	}
+
+	if opts.StudyWorkers <= 0 {
+		opts.StudyWorkers = runtime.NumCPU()
+	}
+
 	return &Scanner{
-		db: db,
+		db:   db,
+		opts: opts,
 	}
 }
 
 // Scan scans the whole fsdb and returns each study found.
 // If ctx is cancelled the scan will be stopped.
-func (s *Scanner) Scan(ctx context.Context) (<-chan fsdb.Study, error) {
-	ch := make(chan fsdb.Study)
-
-	go s.scan(ctx, ch)
+func (s *Scanner) Scan(ctx context.Context) (<-chan Result, error) {
+	volumes, err := s.db.VolumeNames()
+	if err != nil {
+		return nil, err
+	}
 
-	return ch, nil
+	return s.run(ctx, volumes), nil
 }
 
 // ScanVolume scans a given volume.
-func (s *Scanner) ScanVolume(ctx context.Context, vol fsdb.Volume) (chan fsdb.Study, error) {
-	ch := make(chan fsdb.Study)
-
-	go func() {
-		defer close(ch)
-		s.scanVolume(ctx, ch, vol)
-	}()
-
-	return ch, nil
+func (s *Scanner) ScanVolume(ctx context.Context, vol fsdb.Volume) (<-chan Result, error) {
+	return s.run(ctx, []string{vol.Name()}), nil
 }
 
 // ScanVolumeName scans the volume with a given name.
-func (s *Scanner) ScanVolumeName(ctx context.Context, name string) (chan fsdb.Study, error) {
+func (s *Scanner) ScanVolumeName(ctx context.Context, name string) (<-chan Result, error) {
 	vol, err := s.db.OpenVolumeByName(name)
 	if err != nil {
 		return nil, err
@@ -58,7 +114,7 @@ func (s *Scanner) ScanVolumeName(ctx context.Context, name string) (chan fsdb.St
 }
 
 // ScanVolumeID scans the volume with ID.
-func (s *Scanner) ScanVolumeID(ctx context.Context, idx int) (chan fsdb.Study, error) {
+func (s *Scanner) ScanVolumeID(ctx context.Context, idx int) (<-chan Result, error) {
 	vol, err := s.db.OpenVolumeByIdx(idx)
 	if err != nil {
 		return nil, err
@@ -67,23 +123,221 @@ func (s *Scanner) ScanVolumeID(ctx context.Context, idx int) (chan fsdb.Study, e
 	return s.ScanVolume(ctx, vol)
 }
 
-func (s *Scanner) scan(ctx context.Context, ch chan fsdb.Study) {
-	defer close(ch)
+// run scans all volumes and returns a channel that receives
+// the results. The channel is closed once all volumes have been
+// scanned or ctx is cancelled.
+//
+// Volumes are listed by opts.VolumeWorkers goroutines which
+// hand each study to one of opts.StudyWorkers goroutines. If
+// opts.Ordered is set, each volume and study gets a result slot
+// that is filled by the workers and consumed in order by a single
+// collector.
+func (s *Scanner) run(ctx context.Context, volumes []string) <-chan Result {
+	out := make(chan Result)
 
-	s.db.ForEachVolume(func(vol fsdb.Volume) error {
-		return s.scanVolume(ctx, ch, vol)
-	})
-}
+	ctx, cancel := context.WithCancel(ctx)
+
+	studies := make(chan func())
+	volumeJobs := make(chan func())
+
+	// pending receives one slot per volume in the order of
+	// volumes. It is only used if opts.Ordered is set and
+	// limits the number of volumes that are scanned ahead.
+	pending := make(chan chan []chan Result, s.opts.VolumeWorkers)
+
+	var studyWg sync.WaitGroup
+	for i := 0; i < s.opts.StudyWorkers; i++ {
+		studyWg.Add(1)
+		go func() {
+			defer studyWg.Done()
+			for job := range studies {
+				job()
+			}
+		}()
+	}
+
+	var volumeWg sync.WaitGroup
+	for i := 0; i < s.opts.VolumeWorkers; i++ {
+		volumeWg.Add(1)
+		go func() {
+			defer volumeWg.Done()
+			for job := range volumeJobs {
+				job()
+			}
+		}()
+	}
+
+	// emit delivers r either directly to out or into the
+	// result slot r belongs to.
+	emit := func(slot chan Result, r Result) {
+		if slot != nil {
+			slot <- r
+			return
+		}
 
-func (s *Scanner) scanVolume(ctx context.Context, ch chan fsdb.Study, vol fsdb.Volume) error {
-	return vol.ForEachStudy(func(stdy fsdb.Study) error {
 		select {
-		case ch <- stdy:
+		case out <- r:
+		case <-ctx.Done():
+		}
+	}
 
+	// submit hands job to one of the study workers.
+	submit := func(job func()) bool {
+		select {
+		case studies <- job:
+			return true
 		case <-ctx.Done():
-			return ctx.Err()
+			return false
 		}
+	}
+
+	scanVolume := func(name string, volSlot chan []chan Result) {
+		var slots []chan Result
+
+		// Ensure the collector always receives the study slots
+		// of this volume.
+		if volSlot != nil {
+			defer func() {
+				volSlot <- slots
+			}()
+		}
+
+		newSlot := func() chan Result {
+			if volSlot == nil {
+				return nil
+			}
+
+			slot := make(chan Result, 1)
+			slots = append(slots, slot)
+			return slot
+		}
+
+		vol, err := s.db.OpenVolumeByName(name)
+		if err != nil {
+			emit(newSlot(), Result{Volume: name, Err: err})
+			return
+		}
+
+		names, err := vol.Studies()
+		if err != nil {
+			emit(newSlot(), Result{Volume: name, Err: err})
+			return
+		}
+
+		for _, studyName := range names {
+			studyName := studyName
+			slot := newSlot()
+
+			ok := submit(func() {
+				emit(slot, s.loadStudy(vol, studyName))
+			})
+
+			if !ok {
+				// drop the slot as it will never be filled
+				if slot != nil {
+					slots = slots[:len(slots)-1]
+				}
+				return
+			}
+		}
+	}
+
+	// dispatch all volumes to the volume workers.
+	go func() {
+		defer func() {
+			close(volumeJobs)
+			if s.opts.Ordered {
+				close(pending)
+			}
+		}()
+
+		for _, name := range volumes {
+			name := name
+
+			var volSlot chan []chan Result
+			if s.opts.Ordered {
+				volSlot = make(chan []chan Result, 1)
+
+				select {
+				case pending <- volSlot:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case volumeJobs <- func() { scanVolume(name, volSlot) }:
+			case <-ctx.Done():
+				if volSlot != nil {
+					volSlot <- nil
+				}
+				return
+			}
+		}
+	}()
+
+	// collect results in order
+	var collectorDone chan struct{}
+	if s.opts.Ordered {
+		collectorDone = make(chan struct{})
+
+		go func() {
+			defer close(collectorDone)
+
+			for volSlot := range pending {
+				for _, slot := range <-volSlot {
+					r := <-slot
+
+					select {
+					case out <- r:
+					case <-ctx.Done():
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer cancel()
+		defer close(out)
+
+		volumeWg.Wait()
+		close(studies)
+		studyWg.Wait()
+
+		if collectorDone != nil {
+			<-collectorDone
+		}
+	}()
+
+	return out
+}
+
+// loadStudy opens the study name inside vol and loads
+// it if requested by opts.Load.
+func (s *Scanner) loadStudy(vol fsdb.Volume, name string) Result {
+	r := Result{
+		Volume: vol.Name(),
+	}
+
+	stdy, err := vol.OpenStudyByName(name)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	r.Study = stdy
+
+	if s.opts.Load == nil || !s.opts.Load(stdy) {
+		return r
+	}
+
+	if err := stdy.Load(); err != nil {
+		r.Err = err
+		return r
+	}
+
+	model, _ := stdy.Model()
+	r.Model = &model
 
-		return nil
-	})
+	return r
 }
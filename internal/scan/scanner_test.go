@@ -0,0 +1,141 @@
+package scan
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
+)
+
+func TestScanOrdered(t *testing.T) {
+	root, err := ioutil.TempDir("", "dxray-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var want []string
+	for v := 1; v <= 3; v++ {
+		volume := fmt.Sprintf("VOL%05d", v)
+		for s := 1; s <= 20; s++ {
+			name := fmt.Sprintf("%04d_1", s)
+			writeStudy(t, root, volume, name, fmt.Sprintf("1.2.3.%d.%d", v, s))
+			want = append(want, volume+"/"+name)
+		}
+	}
+
+	// a study with an invalid study.xml is reported in order
+	// as well.
+	if err := ioutil.WriteFile(filepath.Join(root, "VOL00002", "0005_1", "study.xml"), []byte("<Imagelist"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := fsdb.New(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		opts Options
+	}{
+		{"ordered", Options{VolumeWorkers: 3, StudyWorkers: 8, Load: LoadAll, Ordered: true}},
+		{"ordered single worker", Options{VolumeWorkers: 1, StudyWorkers: 1, Load: LoadAll, Ordered: true}},
+		{"unordered", Options{VolumeWorkers: 3, StudyWorkers: 8, Load: LoadAll}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			results, err := New(db, c.opts).Scan(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for r := range results {
+				if r.Study == nil {
+					t.Fatalf("failed to scan volume %s: %s", r.Volume, r.Err)
+				}
+
+				key := r.Volume + "/" + r.Study.Name()
+				got = append(got, key)
+
+				if key == "VOL00002/0005_1" {
+					if r.Err == nil {
+						t.Errorf("%s: expected an error", key)
+					}
+					continue
+				}
+
+				if r.Err != nil {
+					t.Errorf("%s: unexpected error: %s", key, r.Err)
+				}
+				if r.Model == nil || r.Model.Patient.Visit.Study.UID == "" {
+					t.Errorf("%s: study has not been loaded", key)
+				}
+			}
+
+			if !c.opts.Ordered {
+				sort.Strings(got)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got studies %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestScanCancel(t *testing.T) {
+	root, err := ioutil.TempDir("", "dxray-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for s := 1; s <= 50; s++ {
+		writeStudy(t, root, "VOL00001", fmt.Sprintf("%04d_1", s), fmt.Sprintf("1.2.3.%d", s))
+	}
+
+	db, err := fsdb.New(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results, err := New(db, Options{StudyWorkers: 4, Ordered: true}).Scan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-results
+	cancel()
+
+	// the channel must be closed after cancellation, this
+	// blocks otherwise.
+	for range results {
+	}
+}
+
+// writeStudy writes the study.xml of a study with a single
+// instance.
+func writeStudy(t *testing.T, root, volume, name, uid string) {
+	dir := filepath.Join(root, volume, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	xml := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Imagelist><Patient><Name>Huber^Bello</Name><ID>100</ID><Visit><Study><UID>%s</UID><Date>20210311</Date><Series><UID>%s.1</UID><Modality>DX</Modality><Instance><UID>%s.1.1</UID><Data><DICOM>\DICOMPACS\ORCONSOLEDB\%s\%s\I_000000.dcm</DICOM></Data></Instance></Series></Study></Visit></Patient></Imagelist>`,
+		uid, uid, uid, volume, name)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "study.xml"), []byte(xml), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
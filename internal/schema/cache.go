@@ -0,0 +1,40 @@
+package schema
+
+import "github.com/ppacher/system-conf/conf"
+
+// CacheConfig describes the configuration of the tag, image
+// and study caches parsed by CacheSpec.
+type CacheConfig struct {
+	Directory  string
+	MemorySize int
+	DiskSize   int
+	Studies    int
+}
+
+// CacheSpec describes all valid configuration stanzas
+// of the cache configuration section.
+var CacheSpec = conf.SectionSpec{
+	{
+		Name:        "Directory",
+		Description: "Directory of the disk cache. Defaults to cache in the state directory",
+		Type:        conf.StringType,
+	},
+	{
+		Name:        "MemorySize",
+		Description: "Size in megabytes of the in-memory cache",
+		Type:        conf.IntType,
+		Default:     "128",
+	},
+	{
+		Name:        "DiskSize",
+		Description: "Size in megabytes of the disk cache. Set to 0 to disable the disk cache",
+		Type:        conf.IntType,
+		Default:     "1024",
+	},
+	{
+		Name:        "Studies",
+		Description: "Number of parsed study.xml files kept in memory. Set to 0 to disable",
+		Type:        conf.IntType,
+		Default:     "5000",
+	},
+}
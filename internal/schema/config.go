@@ -5,7 +5,11 @@ import "github.com/ppacher/system-conf/conf"
 // Config describes the configuration structure
 // parsed by ConfigSpec.
 type Config struct {
-	DatabasePath string
+	DatabasePath         string
+	AccessLogPath        string
+	AccessLogMaxSize     int
+	AccessLogRotateCount int
+	AccessLogUserHeader  string
 }
 
 // ConfigSpec describes all valid configuration stanzas
@@ -22,4 +26,21 @@ var ConfigSpec = conf.SectionSpec{
 		Description: "Path to the access log file",
 		Type:        conf.StringType,
 	},
+	{
+		Name:        "AccessLogMaxSize",
+		Description: "Size in megabytes after which the access log is rotated. Set to 0 to disable rotation",
+		Type:        conf.IntType,
+		Default:     "100",
+	},
+	{
+		Name:        "AccessLogRotateCount",
+		Description: "Number of rotated access log files to keep",
+		Type:        conf.IntType,
+		Default:     "10",
+	},
+	{
+		Name:        "AccessLogUserHeader",
+		Description: "Name of the header that holds the authenticated user as set by an authenticating reverse proxy. Only set this if dxray cannot be reached without passing the proxy. The user is logged as unknown otherwise",
+		Type:        conf.StringType,
+	},
 }
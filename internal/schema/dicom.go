@@ -0,0 +1,64 @@
+package schema
+
+import "github.com/ppacher/system-conf/conf"
+
+// DICOMConfig describes the configuration of the DICOM
+// network service parsed by DICOMSpec.
+type DICOMConfig struct {
+	ListenAddress    string
+	AETitle          string
+	StorageDirectory string
+	MaxInstanceSize  int
+}
+
+// DICOMSpec describes all valid configuration stanzas
+// of the DICOM configuration section.
+var DICOMSpec = conf.SectionSpec{
+	{
+		Name:        "ListenAddress",
+		Description: "TCP address for DICOM associations (e.g. :104). Leave empty to disable",
+		Type:        conf.StringType,
+	},
+	{
+		Name:        "AETitle",
+		Description: "Application entity title of dxray",
+		Type:        conf.StringType,
+		Default:     "DXRAY",
+	},
+	{
+		Name:        "StorageDirectory",
+		Description: "Directory for instances received via DICOM or STOW-RS. Defaults to storage in the state directory",
+		Type:        conf.StringType,
+	},
+	{
+		Name:        "MaxInstanceSize",
+		Description: "Maximum size in megabytes of instances received via DICOM or STOW-RS",
+		Type:        conf.IntType,
+		Default:     "512",
+	},
+}
+
+// PeerConfig describes a DICOM application entity that
+// instances can be sent to using C-MOVE. It is parsed by
+// PeerSpec.
+type PeerConfig struct {
+	AETitle string
+	Address string
+}
+
+// PeerSpec describes all valid configuration stanzas
+// of a peer configuration section.
+var PeerSpec = conf.SectionSpec{
+	{
+		Name:        "AETitle",
+		Description: "Application entity title of the peer",
+		Type:        conf.StringType,
+		Required:    true,
+	},
+	{
+		Name:        "Address",
+		Description: "TCP address of the peer (host:port)",
+		Type:        conf.StringType,
+		Required:    true,
+	},
+}
@@ -0,0 +1,19 @@
+package schema
+
+import "github.com/ppacher/system-conf/conf"
+
+// ExportConfig describes the configuration of study exports
+// parsed by ExportSpec.
+type ExportConfig struct {
+	ViewerDirectory string
+}
+
+// ExportSpec describes all valid configuration stanzas
+// of the export configuration section.
+var ExportSpec = conf.SectionSpec{
+	{
+		Name:        "ViewerDirectory",
+		Description: "Directory with a DICOM viewer that is added to ISO images. An AUTORUN.INF in this directory is placed in the root of the image",
+		Type:        conf.StringType,
+	},
+}
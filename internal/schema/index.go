@@ -0,0 +1,50 @@
+package schema
+
+import (
+	"time"
+
+	"github.com/ppacher/system-conf/conf"
+)
+
+// IndexConfig describes the configuration of the study
+// indexer parsed by IndexSpec.
+type IndexConfig struct {
+	Path             string
+	FullScanInterval time.Duration
+	DisableWatcher   bool
+	VolumeWorkers    int
+	StudyWorkers     int
+}
+
+// IndexSpec describes all valid configuration stanzas
+// of the index configuration section.
+var IndexSpec = conf.SectionSpec{
+	{
+		Name:        "Path",
+		Description: "Path to the search index. Defaults to index.bleve in the state directory",
+		Type:        conf.StringType,
+	},
+	{
+		Name:        "FullScanInterval",
+		Description: "Interval at which the whole database is re-scanned",
+		Type:        conf.DurationType,
+		Default:     "2m",
+	},
+	{
+		Name:        "DisableWatcher",
+		Description: "Disable watching the database for new and modified studies",
+		Type:        conf.BoolType,
+		Default:     "no",
+	},
+	{
+		Name:        "VolumeWorkers",
+		Description: "Number of volumes that are scanned in parallel",
+		Type:        conf.IntType,
+		Default:     "1",
+	},
+	{
+		Name:        "StudyWorkers",
+		Description: "Number of studies that are scanned in parallel. Defaults to the number of CPUs",
+		Type:        conf.IntType,
+	},
+}
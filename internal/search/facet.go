@@ -0,0 +1,206 @@
+package search
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/blevesearch/bleve"
+	bsearch "github.com/blevesearch/bleve/search"
+)
+
+// Default and maximum values for FacetRequest.Size.
+const (
+	DefaultFacetSize = 10
+	MaxFacetSize     = 100
+)
+
+// MaxFacets is the maximum number of facets that can be requested
+// with a single search request.
+const MaxFacets = 10
+
+// Formats of the terms indexed for the year and month facets.
+const (
+	yearFormat  = "2006"
+	monthFormat = "2006-01"
+)
+
+type (
+	// FacetRequest requests a breakdown of the matching studies
+	// by the values of a single field.
+	FacetRequest struct {
+		// Field is the name of the field (race, modality, series,
+		// protocol, year, month or date). Term facets count the
+		// distinct values of the field. The date field only
+		// supports date range facets.
+		Field string `json:"field"`
+
+		// Size is the maximum number of terms returned by a term
+		// facet. Defaults to DefaultFacetSize.
+		Size int `json:"size,omitempty"`
+
+		// Ranges turns the facet into a date range facet that
+		// counts the studies within each range. It's only
+		// supported for the date field.
+		Ranges []DateRange `json:"ranges,omitempty"`
+	}
+
+	// DateRange is a named range of study dates used for date range
+	// facets. Dates are formatted as YYYYMMDD or YYYY-MM-DD and are
+	// inclusive. Either bound may be omitted.
+	DateRange struct {
+		Name string `json:"name"`
+		From string `json:"from,omitempty"`
+		To   string `json:"to,omitempty"`
+	}
+
+	// Facet is the result of a FacetRequest.
+	Facet struct {
+		// Field is the name of the field as requested.
+		Field string `json:"field"`
+
+		// Total is the number of values counted. Studies may have
+		// multiple values for fields like modality or series.
+		Total int `json:"total"`
+
+		// Missing is the number of studies without a value.
+		Missing int `json:"missing"`
+
+		// Other is the number of values not returned in Terms
+		// because of the requested size.
+		Other int `json:"other"`
+
+		// Terms holds the counted values of a term facet.
+		Terms []FacetTerm `json:"terms,omitempty"`
+
+		// Ranges holds the counted ranges of a date range
+		// facet in the order they have been requested.
+		Ranges []FacetRange `json:"ranges,omitempty"`
+	}
+
+	// FacetTerm is a single value of a term facet.
+	FacetTerm struct {
+		Term  string `json:"term"`
+		Count int    `json:"count"`
+	}
+
+	// FacetRange is a single range of a date range facet.
+	FacetRange struct {
+		DateRange
+		Count int `json:"count"`
+	}
+)
+
+// facetFields maps the field names accepted by FacetRequest to the
+// index fields holding the facet terms.
+var facetFields = map[string]string{
+	"race":     "race_facet",
+	"modality": "modality_facet",
+	"series":   "series_facet",
+	"protocol": "protocol_facet",
+	"year":     "year_facet",
+	"month":    "month_facet",
+	"date":     "date",
+}
+
+// chronologicalFacets are term facets whose terms are sorted by
+// value instead of count.
+var chronologicalFacets = map[string]bool{
+	"year":  true,
+	"month": true,
+}
+
+// Validate checks the facet request for invalid values.
+func (fr *FacetRequest) Validate() error {
+	if _, ok := facetFields[fr.Field]; !ok {
+		return fmt.Errorf("invalid facet field %q", fr.Field)
+	}
+
+	if fr.Size < 0 || fr.Size > MaxFacetSize {
+		return fmt.Errorf("invalid facet size %d", fr.Size)
+	}
+
+	if fr.Field != "date" {
+		if len(fr.Ranges) > 0 {
+			return fmt.Errorf("facet field %q does not support date ranges", fr.Field)
+		}
+		return nil
+	}
+
+	if len(fr.Ranges) == 0 {
+		return fmt.Errorf("facet field %q requires date ranges", fr.Field)
+	}
+
+	names := make(map[string]bool, len(fr.Ranges))
+	for _, r := range fr.Ranges {
+		if r.Name == "" || names[r.Name] {
+			return fmt.Errorf("invalid or duplicate date range name %q", r.Name)
+		}
+		names[r.Name] = true
+
+		if _, _, err := dateRange(r.From, r.To); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bleveRequest returns the bleve facet request for fr.
+func (fr *FacetRequest) bleveRequest() (*bleve.FacetRequest, error) {
+	size := fr.Size
+	if size == 0 {
+		size = DefaultFacetSize
+	}
+
+	req := bleve.NewFacetRequest(facetFields[fr.Field], size)
+	for _, r := range fr.Ranges {
+		start, end, err := dateRange(r.From, r.To)
+		if err != nil {
+			return nil, err
+		}
+		req.AddDateTimeRange(r.Name, start, end)
+	}
+
+	return req, nil
+}
+
+// facetResult converts the bleve facet result of fr.
+func (fr *FacetRequest) facetResult(res *bsearch.FacetResult) *Facet {
+	facet := &Facet{
+		Field: fr.Field,
+	}
+	if res == nil {
+		return facet
+	}
+
+	facet.Total = res.Total
+	facet.Missing = res.Missing
+	facet.Other = res.Other
+
+	for _, t := range res.Terms {
+		facet.Terms = append(facet.Terms, FacetTerm{
+			Term:  t.Term,
+			Count: t.Count,
+		})
+	}
+	if chronologicalFacets[fr.Field] {
+		sort.Slice(facet.Terms, func(i, j int) bool {
+			return facet.Terms[i].Term < facet.Terms[j].Term
+		})
+	}
+
+	// bleve orders ranges by count, keep the requested order
+	// instead.
+	counts := make(map[string]int, len(res.DateRanges))
+	for _, r := range res.DateRanges {
+		counts[r.Name] = r.Count
+	}
+	for _, r := range fr.Ranges {
+		facet.Ranges = append(facet.Ranges, FacetRange{
+			DateRange: r,
+			Count:     counts[r.Name],
+		})
+	}
+
+	return facet
+}
@@ -0,0 +1,179 @@
+package search
+
+import (
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/analysis/char/asciifolding"
+	"github.com/blevesearch/bleve/analysis/lang/de"
+	"github.com/blevesearch/bleve/analysis/token/lowercase"
+	"github.com/blevesearch/bleve/analysis/tokenizer/single"
+	"github.com/blevesearch/bleve/analysis/tokenizer/unicode"
+	"github.com/blevesearch/bleve/mapping"
+)
+
+// schemaVersion is the version of the index mapping returned by
+// newIndexMapping. Increment it whenever the mapping changes so
+// existing indexes are rebuilt.
+const schemaVersion = 4
+
+// Names of the custom analyzers used by the index mapping.
+const (
+	// nameAnalyzer splits names into words, folds them to ASCII
+	// and applies German normalization so "Müller", "Mueller"
+	// and "muller" match each other.
+	nameAnalyzer = "name"
+
+	// textAnalyzer is like nameAnalyzer but additionally removes
+	// German stop words and reduces words to their stem. It's
+	// used for free-text descriptions.
+	textAnalyzer = "text"
+
+	// sortAnalyzer keeps the whole value as a single, folded and
+	// lower-cased term. It's used for fields that are only used
+	// for sorting and for case-insensitive keywords.
+	sortAnalyzer = "sort"
+
+	// phoneticAnalyzer splits names into words and replaces each
+	// word with its Kölner Phonetik code so names that sound alike
+	// match each other.
+	phoneticAnalyzer = "phonetic"
+)
+
+// newIndexMapping returns the index mapping used for the study
+// index.
+func newIndexMapping() (mapping.IndexMapping, error) {
+	m := bleve.NewIndexMapping()
+
+	analyzers := map[string]map[string]interface{}{
+		nameAnalyzer: {
+			"type":          custom.Name,
+			"char_filters":  []string{asciifolding.Name},
+			"tokenizer":     unicode.Name,
+			"token_filters": []string{lowercase.Name, de.NormalizeName},
+		},
+		textAnalyzer: {
+			"type":          custom.Name,
+			"char_filters":  []string{asciifolding.Name},
+			"tokenizer":     unicode.Name,
+			"token_filters": []string{lowercase.Name, de.StopName, de.NormalizeName, de.LightStemmerName},
+		},
+		phoneticAnalyzer: {
+			"type":          custom.Name,
+			"tokenizer":     unicode.Name,
+			"token_filters": []string{phoneticFilterName},
+		},
+		sortAnalyzer: {
+			"type":          custom.Name,
+			"char_filters":  []string{asciifolding.Name},
+			"tokenizer":     single.Name,
+			"token_filters": []string{lowercase.Name},
+		},
+	}
+	for name, config := range analyzers {
+		if err := m.AddCustomAnalyzer(name, config); err != nil {
+			return nil, err
+		}
+	}
+
+	// query strings without a field are matched against the
+	// composite _all field using the default analyzer.
+	m.DefaultAnalyzer = nameAnalyzer
+
+	doc := bleve.NewDocumentStaticMapping()
+	// owner and patient names are stored so matches can be
+	// highlighted. The phonetic variants are stored as well as
+	// bleve highlights each field using its own stored value.
+	doc.AddFieldMappingsAt("owner", storedField(nameAnalyzer, ""), storedField(phoneticAnalyzer, "owner_phonetic"))
+	doc.AddFieldMappingsAt("patient", storedField(nameAnalyzer, ""), storedField(phoneticAnalyzer, "patient_phonetic"))
+	doc.AddFieldMappingsAt("race", textField(nameAnalyzer))
+	doc.AddFieldMappingsAt("description", textField(textAnalyzer))
+	doc.AddFieldMappingsAt("id", textField(keyword.Name))
+	doc.AddFieldMappingsAt("uid", storedField(keyword.Name, ""))
+	doc.AddFieldMappingsAt("modality", textField(sortAnalyzer))
+	doc.AddFieldMappingsAt("ownerSort", sortField())
+	doc.AddFieldMappingsAt("patientSort", sortField())
+
+	for _, field := range suggestFields {
+		doc.AddFieldMappingsAt(field, termField())
+	}
+
+	for field, indexField := range facetFields {
+		if field != "date" {
+			doc.AddFieldMappingsAt(indexField, termField())
+		}
+	}
+
+	date := bleve.NewDateTimeFieldMapping()
+	date.Store = false
+	doc.AddFieldMappingsAt("date", date)
+
+	indexed := bleve.NewDateTimeFieldMapping()
+	indexed.Store = false
+	indexed.IncludeInAll = false
+	doc.AddFieldMappingsAt("indexed", indexed)
+
+	// the fingerprint must be stored so it can be compared
+	// when a study is added again.
+	fingerprint := bleve.NewTextFieldMapping()
+	fingerprint.Analyzer = keyword.Name
+	fingerprint.Index = false
+	fingerprint.IncludeInAll = false
+	fingerprint.IncludeTermVectors = false
+	doc.AddFieldMappingsAt("fingerprint", fingerprint)
+
+	m.DefaultMapping = doc
+
+	// bleve only resolves the analyzer of fields with a custom
+	// name (like owner_phonetic) for type mappings. Register the
+	// document mapping as a type as well so match queries on those
+	// fields use the correct analyzer.
+	m.AddDocumentMapping("study", doc)
+
+	return m, nil
+}
+
+// textField returns a searchable text field mapping that uses
+// analyzer.
+func textField(analyzer string) *mapping.FieldMapping {
+	f := bleve.NewTextFieldMapping()
+	f.Analyzer = analyzer
+	f.Store = false
+	return f
+}
+
+// storedField is like textField but the field value is stored
+// in the index. If name is set, the field is indexed under name
+// instead of the property name.
+func storedField(analyzer, name string) *mapping.FieldMapping {
+	f := textField(analyzer)
+	f.Store = true
+	f.Name = name
+	if name != "" {
+		f.IncludeInAll = false
+	}
+	return f
+}
+
+// sortField returns the mapping of fields that are only used
+// for sorting.
+func sortField() *mapping.FieldMapping {
+	f := bleve.NewTextFieldMapping()
+	f.Analyzer = sortAnalyzer
+	f.Store = false
+	f.IncludeInAll = false
+	f.IncludeTermVectors = false
+	return f
+}
+
+// termField returns the mapping of fields that hold suggestion or
+// facet terms. Terms are indexed as-is and are only read from the
+// field dictionary or used for facets.
+func termField() *mapping.FieldMapping {
+	f := bleve.NewTextFieldMapping()
+	f.Analyzer = keyword.Name
+	f.Store = false
+	f.IncludeInAll = false
+	f.IncludeTermVectors = false
+	return f
+}
@@ -0,0 +1,53 @@
+package search
+
+import (
+	"github.com/blevesearch/bleve"
+)
+
+// PatientIDs returns up to size distinct patient IDs that start with
+// prefix, skipping the first from IDs. IDs are sorted in ascending
+// order. The total number of matching patient IDs is returned as
+// well.
+func (si *Index) PatientIDs(prefix string, size, from int) ([]string, int, error) {
+	dict, err := si.fieldDict("id", prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer dict.Close()
+
+	var (
+		ids   []string
+		total int
+	)
+	for {
+		entry, err := dict.Next()
+		if err != nil {
+			return nil, 0, err
+		}
+		if entry == nil {
+			break
+		}
+
+		if total >= from && len(ids) < size {
+			ids = append(ids, entry.Term)
+		}
+		total++
+	}
+
+	return ids, total, nil
+}
+
+// PatientStudies returns the keys of all studies of the patient
+// identified by id in chronological order.
+func (si *Index) PatientStudies(id string) ([]string, error) {
+	q := bleve.NewTermQuery(id)
+	q.SetField("id")
+
+	count, err := si.index.DocCount()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, _, err := si.Query(q, int(count), 0, "date", "_id")
+	return keys, err
+}
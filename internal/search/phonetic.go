@@ -0,0 +1,159 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/blevesearch/bleve/analysis"
+	"github.com/blevesearch/bleve/registry"
+)
+
+// phoneticFilterName is the name of the token filter that replaces
+// each token with its Kölner Phonetik code.
+const phoneticFilterName = "cologne_phonetic"
+
+func init() {
+	registry.RegisterTokenFilter(phoneticFilterName, func(map[string]interface{}, *registry.Cache) (analysis.TokenFilter, error) {
+		return phoneticFilter{}, nil
+	})
+}
+
+// phoneticFilter is a bleve token filter that replaces all tokens
+// with their Kölner Phonetik code. Tokens without a code are
+// removed.
+type phoneticFilter struct{}
+
+// Filter implements analysis.TokenFilter.
+func (phoneticFilter) Filter(input analysis.TokenStream) analysis.TokenStream {
+	output := input[:0]
+	for _, token := range input {
+		code := ColognePhonetic(string(token.Term))
+		if code == "" {
+			continue
+		}
+
+		token.Term = []byte(code)
+		output = append(output, token)
+	}
+
+	return output
+}
+
+// ColognePhonetic returns the Kölner Phonetik (cologne phonetics)
+// code of word. Words that sound similar in German, like "Maier",
+// "Meier" and "Mayer", share the same code. Characters other than
+// letters are ignored.
+//
+// https://de.wikipedia.org/wiki/K%C3%B6lner_Phonetik
+func ColognePhonetic(word string) string {
+	var letters []rune
+	for _, r := range strings.ToLower(word) {
+		switch r {
+		case 'ä', 'à', 'á', 'â':
+			r = 'a'
+		case 'ö', 'ò', 'ó', 'ô':
+			r = 'o'
+		case 'ü', 'ù', 'ú', 'û':
+			r = 'u'
+		case 'é', 'è', 'ê':
+			r = 'e'
+		case 'ç':
+			r = 'c'
+		case 'ß':
+			r = 's'
+		}
+
+		if r >= 'a' && r <= 'z' {
+			letters = append(letters, r)
+		} else if unicode.IsLetter(r) {
+			// unknown letters are treated like vowels
+			letters = append(letters, 'e')
+		}
+	}
+
+	var (
+		code []rune
+		last rune
+	)
+	for i, r := range letters {
+		var prev, next rune
+		if i > 0 {
+			prev = letters[i-1]
+		}
+		if i+1 < len(letters) {
+			next = letters[i+1]
+		}
+
+		for _, c := range phoneticCode(r, prev, next, i == 0) {
+			// collapse repeated codes
+			if c == last {
+				continue
+			}
+			last = c
+
+			// vowels are only coded at the beginning
+			if c == '0' && len(code) > 0 {
+				continue
+			}
+			code = append(code, c)
+		}
+	}
+
+	return string(code)
+}
+
+// phoneticCode returns the code of letter r depending on the
+// previous and next letter.
+func phoneticCode(r, prev, next rune, initial bool) string {
+	switch r {
+	case 'a', 'e', 'i', 'j', 'o', 'u', 'y':
+		return "0"
+	case 'h':
+		return ""
+	case 'b':
+		return "1"
+	case 'p':
+		if next == 'h' {
+			return "3"
+		}
+		return "1"
+	case 'd', 't':
+		if next != 0 && strings.ContainsRune("csz", next) {
+			return "8"
+		}
+		return "2"
+	case 'f', 'v', 'w':
+		return "3"
+	case 'g', 'k', 'q':
+		return "4"
+	case 'c':
+		if initial {
+			if next != 0 && strings.ContainsRune("ahkloqrux", next) {
+				return "4"
+			}
+			return "8"
+		}
+		if prev != 0 && strings.ContainsRune("sz", prev) {
+			return "8"
+		}
+		if next != 0 && strings.ContainsRune("ahkoqux", next) {
+			return "4"
+		}
+		return "8"
+	case 'x':
+		if prev != 0 && strings.ContainsRune("ckq", prev) {
+			return "8"
+		}
+		return "48"
+	case 'l':
+		return "5"
+	case 'm', 'n':
+		return "6"
+	case 'r':
+		return "7"
+	case 's', 'z':
+		return "8"
+	}
+
+	return ""
+}
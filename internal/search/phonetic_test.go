@@ -0,0 +1,33 @@
+package search
+
+import "testing"
+
+func TestColognePhonetic(t *testing.T) {
+	cases := []struct {
+		word string
+		want string
+	}{
+		// 60550750206880022 before removing repeated codes
+		// and vowels.
+		{"Müller-Lüdenscheidt", "65752682"},
+		{"Breschnew", "17863"},
+		{"Maier", "67"},
+		{"Meier", "67"},
+		{"Mayer", "67"},
+		{"Wikipedia", "3412"},
+		{"Christoph", "47823"},
+		{"Xaver", "4837"},
+		{"Chemie", "46"},
+		{"Huber", "017"},
+		{"Äpfel", "0135"},
+		{"Straße", "8278"},
+		{"", ""},
+		{"1234", ""},
+	}
+
+	for _, c := range cases {
+		if got := ColognePhonetic(c.word); got != c.want {
+			t.Errorf("ColognePhonetic(%q) = %q, want %q", c.word, got, c.want)
+		}
+	}
+}
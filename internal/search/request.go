@@ -0,0 +1,486 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis"
+	"github.com/blevesearch/bleve/analysis/char/asciifolding"
+	"github.com/blevesearch/bleve/analysis/lang/de"
+	"github.com/blevesearch/bleve/analysis/token/lowercase"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// Default and maximum values for Request.Size.
+const (
+	DefaultSize = 20
+	MaxSize     = 1000
+)
+
+// dateFormat is the format of study dates stored in the index.
+const dateFormat = "20060102"
+
+type (
+	// Request is a structured search request. All criteria are
+	// optional and combined so that matching studies fulfill
+	// each of them.
+	Request struct {
+		// Query is a free text query using the bleve query
+		// string syntax.
+		Query string `json:"query,omitempty"`
+
+		// Owner, Patient, Race, PatientID and Description are
+		// matched against the respective study fields. Values
+		// may contain the wildcards * and ?.
+		Owner       string `json:"owner,omitempty"`
+		Patient     string `json:"patient,omitempty"`
+		Race        string `json:"race,omitempty"`
+		PatientID   string `json:"patientID,omitempty"`
+		Description string `json:"description,omitempty"`
+
+		// Match selects how Owner and Patient are matched. See
+		// MatchExact, MatchFuzzy and MatchPhonetic. Defaults to
+		// MatchExact.
+		Match string `json:"match,omitempty"`
+
+		// Highlight enables highlighting of owner and patient
+		// names that matched the request.
+		Highlight bool `json:"highlight,omitempty"`
+
+		// Modalities matches studies that contain at least
+		// one of the modalities.
+		Modalities []string `json:"modalities,omitempty"`
+
+		// DateFrom and DateTo limit the study date to the
+		// given (inclusive) range. Dates are formatted as
+		// YYYYMMDD or YYYY-MM-DD and either bound may be
+		// omitted.
+		DateFrom string `json:"dateFrom,omitempty"`
+		DateTo   string `json:"dateTo,omitempty"`
+
+		// Size is the maximum number of studies to return.
+		Size int `json:"size,omitempty"`
+
+		// From is the number of studies to skip.
+		From int `json:"from,omitempty"`
+
+		// Sort holds the names of the sort fields (date,
+		// patient, owner, indexed or score). Prefix a name
+		// with - to sort in descending order. Studies are
+		// sorted by relevance if Sort is empty.
+		Sort []string `json:"sort,omitempty"`
+
+		// Facets requests breakdowns of all matching studies
+		// keyed by a name chosen by the caller. The results
+		// are returned under the same name.
+		Facets map[string]FacetRequest `json:"facets,omitempty"`
+	}
+
+	// Result is the result of a search request.
+	Result struct {
+		// Keys holds the keys of all studies returned.
+		Keys []string
+
+		// Total is the total number of matching studies.
+		Total uint64
+
+		// Highlights holds the highlighted owner and patient
+		// name fragments of each study keyed by the study
+		// instance UID. It's only set if highlighting has been
+		// requested.
+		Highlights map[string]map[string][]string
+
+		// Facets holds the result of each requested facet.
+		Facets map[string]*Facet
+	}
+)
+
+// Supported values for Request.Match.
+const (
+	// MatchExact requires names to match exactly after folding
+	// and normalization.
+	MatchExact = "exact"
+
+	// MatchFuzzy allows names to differ by a small edit distance
+	// depending on the length of each word.
+	MatchFuzzy = "fuzzy"
+
+	// MatchPhonetic matches names that sound alike using the
+	// Kölner Phonetik.
+	MatchPhonetic = "phonetic"
+)
+
+// highlightFields are the fields highlighted if requested. Matches
+// of the phonetic fields are reported for the name field they are
+// derived from.
+var highlightFields = map[string]string{
+	"owner":            "owner",
+	"patient":          "patient",
+	"owner_phonetic":   "owner",
+	"patient_phonetic": "patient",
+}
+
+// sortFields maps the sort names accepted by Request.Sort and
+// SortOrder to the index fields used for sorting.
+var sortFields = map[string]string{
+	"date":    "date",
+	"patient": "patientSort",
+	"owner":   "ownerSort",
+	"indexed": "indexed",
+	"score":   "_score",
+}
+
+// SortOrder translates the sort names into the bleve sort order.
+// Prefix a name with - to sort in descending order. The document
+// ID is always added as the last sort field so the order of studies
+// with the same sort values is stable.
+func SortOrder(names ...string) ([]string, error) {
+	order := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		prefix := ""
+		if strings.HasPrefix(name, "-") {
+			prefix = "-"
+			name = name[1:]
+		}
+
+		field, ok := sortFields[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid sort field %q", name)
+		}
+
+		order = append(order, prefix+field)
+	}
+
+	return append(order, "_id"), nil
+}
+
+// Validate checks the request for invalid values.
+func (r *Request) Validate() error {
+	if r.Size < 0 || r.Size > MaxSize {
+		return fmt.Errorf("invalid size %d", r.Size)
+	}
+
+	if r.From < 0 {
+		return fmt.Errorf("invalid from %d", r.From)
+	}
+
+	switch r.Match {
+	case "", MatchExact, MatchFuzzy, MatchPhonetic:
+	default:
+		return fmt.Errorf("invalid match mode %q", r.Match)
+	}
+
+	if _, err := parseDate(r.DateFrom); err != nil {
+		return err
+	}
+
+	if _, err := parseDate(r.DateTo); err != nil {
+		return err
+	}
+
+	if _, err := SortOrder(r.Sort...); err != nil {
+		return err
+	}
+
+	if len(r.Facets) > MaxFacets {
+		return fmt.Errorf("too many facets, at most %d are supported", MaxFacets)
+	}
+
+	for name, facet := range r.Facets {
+		if err := facet.Validate(); err != nil {
+			return fmt.Errorf("facet %q: %w", name, err)
+		}
+	}
+
+	if r.Query != "" {
+		if err := bleve.NewQueryStringQuery(r.Query).Validate(); err != nil {
+			return fmt.Errorf("invalid query: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// BuildQuery returns the bleve query that matches all studies
+// that fulfill the criteria of r.
+func (r *Request) BuildQuery() (query.Query, error) {
+	var queries []query.Query
+
+	if r.Query != "" {
+		queries = append(queries, bleve.NewQueryStringQuery(r.Query))
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{"owner", r.Owner},
+		{"patient", r.Patient},
+	} {
+		if field.value != "" {
+			queries = append(queries, r.nameQuery(field.name, field.value))
+		}
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{"race", r.Race},
+		{"id", r.PatientID},
+		{"description", r.Description},
+	} {
+		if field.value != "" {
+			queries = append(queries, FieldQuery(field.name, field.value))
+		}
+	}
+
+	if len(r.Modalities) > 0 {
+		modalities := make([]query.Query, 0, len(r.Modalities))
+		for _, m := range r.Modalities {
+			modalities = append(modalities, FieldQuery("modality", m))
+		}
+		queries = append(queries, bleve.NewDisjunctionQuery(modalities...))
+	}
+
+	if r.DateFrom != "" || r.DateTo != "" {
+		q, err := DateQuery(r.DateFrom, r.DateTo)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+	}
+
+	if len(queries) == 0 {
+		return bleve.NewMatchAllQuery(), nil
+	}
+
+	return bleve.NewConjunctionQuery(queries...), nil
+}
+
+// Find executes the search request r.
+func (si *Index) Find(r Request) (*Result, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+
+	q, err := r.BuildQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	size := r.Size
+	if size == 0 {
+		size = DefaultSize
+	}
+
+	sortBy := r.Sort
+	if len(sortBy) == 0 {
+		sortBy = []string{"-score"}
+	}
+
+	order, err := SortOrder(sortBy...)
+	if err != nil {
+		return nil, err
+	}
+
+	search := bleve.NewSearchRequestOptions(q, size, r.From, false)
+	search.SortBy(order)
+	if r.Highlight {
+		search.Highlight = bleve.NewHighlight()
+		for field := range highlightFields {
+			search.Highlight.AddField(field)
+		}
+		search.Fields = []string{"uid"}
+	}
+	for name, facet := range r.Facets {
+		req, err := facet.bleveRequest()
+		if err != nil {
+			return nil, err
+		}
+		search.AddFacet(name, req)
+	}
+
+	results, err := si.index.Search(search)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		Keys:  make([]string, 0, len(results.Hits)),
+		Total: results.Total,
+	}
+	if r.Highlight {
+		result.Highlights = make(map[string]map[string][]string)
+	}
+	if len(r.Facets) > 0 {
+		result.Facets = make(map[string]*Facet, len(r.Facets))
+		for name, facet := range r.Facets {
+			result.Facets[name] = facet.facetResult(results.Facets[name])
+		}
+	}
+
+	for _, h := range results.Hits {
+		result.Keys = append(result.Keys, h.ID)
+
+		uid, _ := h.Fields["uid"].(string)
+		if !r.Highlight || uid == "" {
+			continue
+		}
+
+		fragments := make(map[string][]string)
+		for field, values := range h.Fragments {
+			// bleve returns fragments for all requested fields
+			// even if they did not match.
+			if _, matched := h.Locations[field]; !matched {
+				continue
+			}
+
+			name := highlightFields[field]
+			fragments[name] = append(fragments[name], values...)
+		}
+		if len(fragments) > 0 {
+			result.Highlights[uid] = fragments
+		}
+	}
+
+	return result, nil
+}
+
+// nameQuery returns the query for the owner or patient name field
+// using the match mode of r.
+func (r *Request) nameQuery(field, value string) query.Query {
+	switch r.Match {
+	case MatchFuzzy:
+		words := strings.Fields(value)
+		queries := make([]query.Query, 0, len(words))
+		for _, word := range words {
+			q := bleve.NewMatchQuery(word)
+			q.SetField(field)
+			q.SetFuzziness(fuzziness(word))
+			queries = append(queries, q)
+		}
+		return bleve.NewConjunctionQuery(queries...)
+
+	case MatchPhonetic:
+		q := bleve.NewMatchQuery(value)
+		q.SetField(field + "_phonetic")
+		q.SetOperator(query.MatchQueryOperatorAnd)
+		return q
+	}
+
+	return FieldQuery(field, value)
+}
+
+// fuzziness returns the maximum edit distance allowed for word.
+// Short words must match exactly as almost any short name would
+// match otherwise.
+func fuzziness(word string) int {
+	switch n := len([]rune(word)); {
+	case n <= 2:
+		return 0
+	case n <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// keywordFields are indexed as-is and matched exactly.
+var keywordFields = map[string]bool{
+	"id":  true,
+	"uid": true,
+}
+
+// FieldQuery returns a query that matches value against field.
+// Values containing the wildcards * and ? are matched using a
+// wildcard query, all others must match all terms of value.
+func FieldQuery(field, value string) query.Query {
+	if strings.ContainsAny(value, "*?") {
+		if !keywordFields[field] {
+			value = foldPattern(value)
+		}
+
+		q := bleve.NewWildcardQuery(value)
+		q.SetField(field)
+		return q
+	}
+
+	q := bleve.NewMatchQuery(value)
+	q.SetField(field)
+	q.SetOperator(query.MatchQueryOperatorAnd)
+	return q
+}
+
+// foldPattern applies the same folding and normalization to a
+// wildcard pattern that nameAnalyzer applies to indexed terms.
+// Wildcard queries are not analyzed by bleve.
+func foldPattern(pattern string) string {
+	tokens := analysis.TokenStream{
+		{Term: asciifolding.New().Filter([]byte(pattern))},
+	}
+	tokens = lowercase.NewLowerCaseFilter().Filter(tokens)
+	tokens = de.NewGermanNormalizeFilter().Filter(tokens)
+
+	return string(tokens[0].Term)
+}
+
+// DateQuery returns a query that matches all studies with a study
+// date between from and to (inclusive). Dates are formatted as
+// YYYYMMDD or YYYY-MM-DD and either bound may be empty.
+func DateQuery(from, to string) (query.Query, error) {
+	start, end, err := dateRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	if start.IsZero() && end.IsZero() {
+		return nil, fmt.Errorf("date range without bounds")
+	}
+
+	inclusive, exclusive := true, false
+	q := bleve.NewDateRangeInclusiveQuery(start, end, &inclusive, &exclusive)
+	q.SetField("date")
+
+	return q, nil
+}
+
+// dateRange parses the inclusive date range from - to and returns
+// its start and its exclusive end. Either bound may be empty and is
+// returned as the zero time.
+func dateRange(from, to string) (time.Time, time.Time, error) {
+	start, err := parseDate(from)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	end, err := parseDate(to)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	// the end of the range is the start of the next day
+	if !end.IsZero() {
+		end = end.AddDate(0, 0, 1)
+	}
+
+	return start, end, nil
+}
+
+// parseDate parses a date formatted as YYYYMMDD or YYYY-MM-DD.
+// The zero time is returned for empty dates.
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	for _, layout := range []string{dateFormat, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
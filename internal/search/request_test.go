@@ -0,0 +1,134 @@
+package search
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRequestValidate(t *testing.T) {
+	cases := []struct {
+		name  string
+		r     Request
+		valid bool
+	}{
+		{"empty", Request{}, true},
+		{"complete", Request{
+			Query:      "Bello",
+			Owner:      "Hub*",
+			Match:      MatchPhonetic,
+			Modalities: []string{"DX"},
+			DateFrom:   "2021-01-01",
+			DateTo:     "20211231",
+			Size:       MaxSize,
+			From:       20,
+			Sort:       []string{"-date", "owner"},
+			Facets: map[string]FacetRequest{
+				"races": {Field: "race", Size: 5},
+				"dates": {Field: "date", Ranges: []DateRange{{Name: "2021", From: "20210101", To: "20211231"}}},
+			},
+		}, true},
+		{"negative size", Request{Size: -1}, false},
+		{"size too large", Request{Size: MaxSize + 1}, false},
+		{"negative from", Request{From: -1}, false},
+		{"invalid match", Request{Match: "soundex"}, false},
+		{"invalid date from", Request{DateFrom: "01.01.2021"}, false},
+		{"invalid date to", Request{DateTo: "20211301"}, false},
+		{"invalid sort", Request{Sort: []string{"name"}}, false},
+		{"invalid descending sort", Request{Sort: []string{"-name"}}, false},
+		{"invalid facet", Request{Facets: map[string]FacetRequest{"x": {Field: "owner"}}}, false},
+		{"date facet without ranges", Request{Facets: map[string]FacetRequest{"x": {Field: "date"}}}, false},
+		{"invalid query", Request{Query: `"huber`}, false},
+	}
+
+	for _, c := range cases {
+		err := c.r.Validate()
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+
+	tooMany := Request{Facets: make(map[string]FacetRequest)}
+	for i := 0; i <= MaxFacets; i++ {
+		tooMany.Facets[string(rune('a'+i))] = FacetRequest{Field: "race"}
+	}
+	if err := tooMany.Validate(); err == nil {
+		t.Errorf("expected an error for %d facets", len(tooMany.Facets))
+	}
+}
+
+func TestBuildQuery(t *testing.T) {
+	db, root, cleanup := testDB(t)
+	defer cleanup()
+
+	idx, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	writeStudy(t, root, "VOL00001", "0001_1", "Huber^Bello Labrador", "1.2.3.1")
+	writeStudy(t, root, "VOL00001", "0002_1", "Müller^Rex Dackel", "1.2.3.2")
+	writeStudy(t, root, "VOL00001", "0003_1", "Maier^Luna Labrador", "1.2.3.3")
+
+	for _, key := range []string{"VOL00001/0001_1", "VOL00001/0002_1", "VOL00001/0003_1"} {
+		if _, err := idx.Add(openStudy(t, db, key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name string
+		r    Request
+		want []string
+	}{
+		{"match all", Request{}, []string{"0001_1", "0002_1", "0003_1"}},
+		{"query string", Request{Query: "Rex"}, []string{"0002_1"}},
+		{"owner", Request{Owner: "Huber"}, []string{"0001_1"}},
+		{"owner folded", Request{Owner: "Muller"}, []string{"0002_1"}},
+		{"owner wildcard", Request{Owner: "M*er"}, []string{"0002_1", "0003_1"}},
+		{"owner exact typo", Request{Owner: "Hubr"}, nil},
+		{"owner fuzzy", Request{Owner: "Hubr", Match: MatchFuzzy}, []string{"0001_1"}},
+		{"owner phonetic", Request{Owner: "Meyer", Match: MatchPhonetic}, []string{"0003_1"}},
+		{"patient", Request{Patient: "Luna"}, []string{"0003_1"}},
+		{"race", Request{Race: "Labrador"}, []string{"0001_1", "0003_1"}},
+		{"race and owner", Request{Race: "Labrador", Owner: "Maier"}, []string{"0003_1"}},
+		{"patient id", Request{PatientID: "100"}, []string{"0001_1", "0002_1", "0003_1"}},
+		{"patient id mismatch", Request{PatientID: "101"}, nil},
+		{"modality", Request{Modalities: []string{"CR", "DX"}}, []string{"0001_1", "0002_1", "0003_1"}},
+		{"modality mismatch", Request{Modalities: []string{"CR"}}, nil},
+		{"date", Request{DateFrom: "20210311", DateTo: "2021-03-11"}, []string{"0001_1", "0002_1", "0003_1"}},
+		{"date from", Request{DateFrom: "20210312"}, nil},
+		{"date to", Request{DateTo: "20210310"}, nil},
+	}
+
+	for _, c := range cases {
+		q, err := c.r.BuildQuery()
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+
+		keys, _, err := idx.Query(q, 10, 0)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+
+		var got []string
+		for _, key := range keys {
+			_, name, _ := SplitKey(key)
+			got = append(got, name)
+		}
+		sort.Strings(got)
+
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	if _, err := (&Request{DateFrom: "invalid"}).BuildQuery(); err == nil {
+		t.Errorf("expected an error for an invalid date")
+	}
+}
@@ -3,10 +3,16 @@ package search
 import (
 	"errors"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/index"
+	"github.com/blevesearch/bleve/search/query"
 	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
+	"github.com/tierklinik-dobersberg/logger"
 )
 
 type (
@@ -18,21 +24,94 @@ type (
 
 	// StudyDocument holds all keys that should be searchable
 	StudyDocument struct {
-		Owner       string `json:"owner"`
-		Patient     string `json:"patient"`
-		Race        string `json:"race"`
-		PatientID   string `json:"id"`
-		StudyUID    string `json:"uid"`
-		Date        string `json:"date"`
-		Description string `json:"description"`
+		Owner       string    `json:"owner"`
+		Patient     string    `json:"patient"`
+		Race        string    `json:"race"`
+		PatientID   string    `json:"id"`
+		StudyUID    string    `json:"uid"`
+		Date        time.Time `json:"date"`
+		Description string    `json:"description"`
+		Modalities  []string  `json:"modality"`
+		Fingerprint string    `json:"fingerprint"`
+		Indexed     time.Time `json:"indexed"`
+
+		// OwnerSort and PatientSort hold the owner and patient
+		// name as a single term so results can be sorted by them.
+		OwnerSort   string `json:"ownerSort"`
+		PatientSort string `json:"patientSort"`
+
+		// The suggest fields hold the terms used to suggest owner,
+		// patient, race and description values.
+		OwnerSuggest       []string `json:"owner_suggest"`
+		PatientSuggest     []string `json:"patient_suggest"`
+		RaceSuggest        []string `json:"race_suggest"`
+		DescriptionSuggest []string `json:"description_suggest"`
+
+		// The facet fields hold the values used to break down
+		// search results. See FacetRequest.
+		RaceFacet     string   `json:"race_facet"`
+		ModalityFacet []string `json:"modality_facet"`
+		SeriesFacet   []string `json:"series_facet"`
+		ProtocolFacet []string `json:"protocol_facet"`
+		YearFacet     string   `json:"year_facet"`
+		MonthFacet    string   `json:"month_facet"`
+	}
+
+	// Page is a single page of query results.
+	Page struct {
+		// Keys holds the keys of all studies on the page.
+		Keys []string
+
+		// Total is the total number of matching studies.
+		Total uint64
+
+		// Next holds the sort values of the last study on
+		// the page and is used to request the next page. It's
+		// nil if there are no more results.
+		Next []string
 	}
+
+	// AddResult describes the outcome of adding a study to
+	// the search index.
+	AddResult int
 )
 
-// New opens an existing search index or creates a new one
+// Possible values of AddResult.
+const (
+	// StudyKnown is returned if the study is already indexed
+	// and has not been modified since.
+	StudyKnown AddResult = iota
+
+	// StudyNew is returned if the study has not been indexed
+	// before.
+	StudyNew
+
+	// StudyUpdated is returned if the study has already been
+	// indexed but was modified since and has been re-indexed.
+	StudyUpdated
+)
+
+// documentVersion is part of each study fingerprint. Increment it
+// whenever the layout of StudyDocument changes so existing studies
+// get re-indexed during the next scan.
+const documentVersion = 4
+
+// schemaKey is the key of the internal value that holds the
+// schema version of an index.
+var schemaKey = []byte("schema")
+
+// New opens an existing search index or creates a new one. If
+// the existing index has been created with a different schema
+// version it is removed and an empty index is created instead.
+// The index is then rebuilt during the next full scan.
 func New(path string) (*Index, error) {
+	m, err := newIndexMapping()
+	if err != nil {
+		return nil, err
+	}
 
 	if path == ":memory:" {
-		index, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+		index, err := bleve.NewMemOnly(m)
 		if err != nil {
 			return nil, err
 		}
@@ -40,18 +119,42 @@ func New(path string) (*Index, error) {
 	}
 
 	index, err := bleve.Open(path)
-	if err != nil {
-		if errors.Is(err, bleve.ErrorIndexPathDoesNotExist) {
-			index, err = bleve.New(path, bleve.NewIndexMapping())
-		} else {
+	switch {
+	case err == nil:
+		version, err := index.GetInternal(schemaKey)
+		if err != nil {
+			index.Close()
 			return nil, err
 		}
+
+		if string(version) == strconv.Itoa(schemaVersion) {
+			return &Index{index}, nil
+		}
+
+		logger.DefaultLogger().Infof("search index schema changed from %q to %d, rebuilding index", string(version), schemaVersion)
+
+		if err := index.Close(); err != nil {
+			return nil, err
+		}
+
+		if err := os.RemoveAll(path); err != nil {
+			return nil, err
+		}
+
+	case !errors.Is(err, bleve.ErrorIndexPathDoesNotExist):
+		return nil, err
 	}
 
+	index, err = bleve.New(path, m)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := index.SetInternal(schemaKey, []byte(strconv.Itoa(schemaVersion))); err != nil {
+		index.Close()
+		return nil, err
+	}
+
 	return &Index{index}, nil
 }
 
@@ -65,29 +168,136 @@ func Open(path string) (*Index, error) {
 	return &Index{index}, nil
 }
 
+// Close closes the search index.
+func (si *Index) Close() error {
+	return si.index.Close()
+}
+
 // Count returns the number of documents stored in the index
 func (si *Index) Count() (uint64, error) {
 	return si.index.DocCount()
 }
 
-// Add adds a new study to the search index
-func (si *Index) Add(s fsdb.Study) (bool, error) {
-	key := getKey(s)
+// Add adds a new study to the search index. If the study is already
+// indexed its fingerprint is compared with the one stored in the
+// index and the study is re-indexed if it has been modified.
+func (si *Index) Add(s fsdb.Study) (AddResult, error) {
+	key := Key(s)
 
-	d, err := si.index.Document(key)
+	fingerprint, err := Fingerprint(s)
+	if err != nil {
+		return StudyKnown, err
+	}
+
+	stored, found, err := si.fingerprint(key)
+	if err != nil {
+		return StudyKnown, err
+	}
+
+	result := StudyNew
+	if found {
+		if stored == fingerprint {
+			return StudyKnown, nil
+		}
+		result = StudyUpdated
+	}
+
+	model, err := LoadStudy(s)
+	if err != nil {
+		return StudyKnown, err
+	}
+	model.Fingerprint = fingerprint
+	model.Indexed = time.Now().UTC()
+
+	if err := si.index.Index(key, model); err != nil {
+		return StudyKnown, err
+	}
+
+	return result, nil
+}
+
+// Modified returns true if s is not yet indexed or has been
+// modified since it has been indexed.
+func (si *Index) Modified(s fsdb.Study) (bool, error) {
+	fingerprint, err := Fingerprint(s)
+	if err != nil {
+		return false, err
+	}
+
+	stored, found, err := si.fingerprint(Key(s))
 	if err != nil {
 		return false, err
 	}
 
+	return !found || stored != fingerprint, nil
+}
+
+// Fingerprint returns the fingerprint of study s. The fingerprint
+// changes whenever the study.xml file of s is modified.
+func Fingerprint(s fsdb.Study) (string, error) {
+	stat, err := s.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("v%d:%d:%d", documentVersion, stat.Size(), stat.ModTime().UnixNano()), nil
+}
+
+// fingerprint returns the fingerprint stored in the index for
+// key and whether or not key is indexed at all.
+func (si *Index) fingerprint(key string) (string, bool, error) {
+	d, err := si.index.Document(key)
+	if err != nil {
+		return "", false, err
+	}
+
 	if d == nil {
-		model, err := LoadStudy(s)
-		if err != nil {
-			return false, err
+		return "", false, nil
+	}
+
+	for _, f := range d.Fields {
+		if f.Name() == "fingerprint" {
+			return string(f.Value()), true, nil
 		}
-		return true, si.index.Index(key, model)
 	}
 
-	return false, nil
+	return "", true, nil
+}
+
+// fieldDict returns the dictionary of all terms of field that start
+// with prefix. If prefix is empty, all terms are returned.
+func (si *Index) fieldDict(field, prefix string) (index.FieldDict, error) {
+	if prefix == "" {
+		return si.index.FieldDict(field)
+	}
+
+	return si.index.FieldDictPrefix(field, []byte(prefix))
+}
+
+// Delete removes the study identified by key from the index.
+func (si *Index) Delete(key string) error {
+	return si.index.Delete(key)
+}
+
+// Keys returns the keys of all studies stored in the index.
+func (si *Index) Keys() ([]string, error) {
+	count, err := si.index.DocCount()
+	if err != nil {
+		return nil, err
+	}
+
+	search := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), int(count), 0, false)
+	results, err := si.index.Search(search)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(results.Hits))
+	for _, h := range results.Hits {
+		keys = append(keys, h.ID)
+	}
+
+	return keys, nil
 }
 
 // Search search all indexed studies for term
@@ -108,22 +318,92 @@ func (si *Index) Search(term string) ([]string, error) {
 	return ids, nil
 }
 
-// getKey returns the byte representation of a study key
-func getKey(s fsdb.Study) string {
+// Query executes q and returns the keys of all matching studies as well
+// as the total number of matches. Results are sorted by sortBy using
+// the bleve sort syntax (e.g. "-date").
+func (si *Index) Query(q query.Query, size, from int, sortBy ...string) ([]string, uint64, error) {
+	search := bleve.NewSearchRequestOptions(q, size, from, false)
+	if len(sortBy) > 0 {
+		search.SortBy(sortBy)
+	}
+
+	results, err := si.index.Search(search)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ids := make([]string, 0, len(results.Hits))
+	for _, h := range results.Hits {
+		ids = append(ids, h.ID)
+	}
+
+	return ids, results.Total, nil
+}
+
+// QueryPage executes q and returns up to size studies that are sorted
+// after the sort values in after. If after is empty, the first from
+// studies are skipped instead. Use the Next field of the returned page
+// to request the following page. The sort order should end with a
+// unique field (like _id) so the position in the result set is always
+// well defined.
+func (si *Index) QueryPage(q query.Query, size, from int, after []string, sortBy ...string) (*Page, error) {
+	// request one more hit so we know if there's a next page
+	search := bleve.NewSearchRequestOptions(q, size+1, from, false)
+	search.SortBy(sortBy)
+	if len(after) > 0 {
+		search.From = 0
+		search.SetSearchAfter(after)
+	}
+
+	results, err := si.index.Search(search)
+	if err != nil {
+		return nil, err
+	}
+
+	hits := results.Hits
+	page := &Page{
+		Total: results.Total,
+	}
+	if len(hits) > size {
+		hits = hits[:size]
+		if size > 0 {
+			page.Next = hits[size-1].Sort
+		}
+	}
+
+	page.Keys = make([]string, 0, len(hits))
+	for _, h := range hits {
+		page.Keys = append(page.Keys, h.ID)
+	}
+
+	return page, nil
+}
+
+// Key returns the key used to identify s in the search index.
+func Key(s fsdb.Study) string {
 	return fmt.Sprintf("%s/%s", s.Volume().Name(), s.Name())
 }
 
-// LoadStudy loads the study s and returns the study document representation
+// LoadStudy loads the study s and returns the study document representation.
+// If s has already been loaded the existing model is used.
 // This method is mainly exporeted for debugging reasons and my vanish at any
 // time
 func LoadStudy(s fsdb.Study) (*StudyDocument, error) {
-	if err := s.Load(); err != nil {
-		return nil, err
-	}
+	model, loaded := s.Model()
+	if !loaded {
+		if err := s.Load(); err != nil {
+			return nil, err
+		}
 
-	model, _ := s.Model()
+		model, _ = s.Model()
+	}
 
-	var desc []string
+	var (
+		desc       []string
+		modalities []string
+		series     []string
+		protocols  []string
+	)
 
 	if model.Patient.Visit.Study.Description != "" {
 		desc = append(desc, model.Patient.Visit.Study.Description)
@@ -132,33 +412,89 @@ func LoadStudy(s fsdb.Study) (*StudyDocument, error) {
 	for _, s := range model.Patient.Visit.Study.Series {
 		if s.Description != "" {
 			desc = append(desc, s.Description)
+
+			if !contains(series, s.Description) {
+				series = append(series, s.Description)
+			}
 		}
+
+		if s.Protocol != "" && !contains(protocols, s.Protocol) {
+			protocols = append(protocols, s.Protocol)
+		}
+
+		if s.Modality != "" && !contains(modalities, s.Modality) {
+			modalities = append(modalities, s.Modality)
+		}
+	}
+
+	// DX-R stores study dates as YYYYMMDD. Studies with an
+	// invalid date are indexed without one.
+	date, _ := time.Parse(dateFormat, model.Patient.Visit.Study.Date)
+
+	var year, month string
+	if !date.IsZero() {
+		year = date.Format(yearFormat)
+		month = date.Format(monthFormat)
 	}
 
 	return &StudyDocument{
 		Owner:       model.Patient.OwnerName(),
+		OwnerSort:   model.Patient.OwnerName(),
 		Patient:     model.Patient.AnimalName(),
+		PatientSort: model.Patient.AnimalName(),
 		Race:        model.Patient.AnimalRace(),
 		PatientID:   model.Patient.ID,
 		StudyUID:    model.Patient.Visit.Study.UID,
-		Date:        model.Patient.Visit.Study.Date,
+		Date:        date,
 		Description: strings.Join(desc, "\n"),
+		Modalities:  modalities,
+
+		OwnerSuggest:       suggestTerms(model.Patient.OwnerName()),
+		PatientSuggest:     suggestTerms(model.Patient.AnimalName()),
+		RaceSuggest:        suggestTerms(model.Patient.AnimalRace()),
+		DescriptionSuggest: suggestWords(strings.Join(desc, "\n")),
+
+		RaceFacet:     strings.TrimSpace(model.Patient.AnimalRace()),
+		ModalityFacet: modalities,
+		SeriesFacet:   series,
+		ProtocolFacet: protocols,
+		YearFacet:     year,
+		MonthFacet:    month,
 	}, nil
 }
 
-// Get opens the study identified by key from the database
-func Get(key string, db fsdb.DB) (fsdb.Study, error) {
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitKey splits key into the volume and study name.
+func SplitKey(key string) (string, string, error) {
 	parts := strings.Split(key, "/")
 	if len(parts) != 2 {
-		return nil, fmt.Errorf("invalid study key")
+		return "", "", fmt.Errorf("invalid study key")
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// Get opens the study identified by key from the database
+func Get(key string, db fsdb.DB) (fsdb.Study, error) {
+	volName, studyName, err := SplitKey(key)
+	if err != nil {
+		return nil, err
 	}
 
-	vol, err := db.OpenVolumeByName(parts[0])
+	vol, err := db.OpenVolumeByName(volName)
 	if err != nil {
 		return nil, err
 	}
 
-	stdy, err := vol.OpenStudyByName(parts[1])
+	stdy, err := vol.OpenStudyByName(studyName)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,165 @@
+package search
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
+)
+
+func TestFingerprint(t *testing.T) {
+	db, root, cleanup := testDB(t)
+	defer cleanup()
+
+	writeStudy(t, root, "VOL00001", "0001_1", "Huber^Bello Labrador", "1.2.3.1")
+	study := openStudy(t, db, "VOL00001/0001_1")
+
+	first, err := Fingerprint(study)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again, _ := Fingerprint(study); again != first {
+		t.Errorf("fingerprint changed without modification: %q != %q", again, first)
+	}
+
+	// same size but a different modification time.
+	path := filepath.Join(root, "VOL00001", "0001_1", "study.xml")
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	second, _ := Fingerprint(study)
+	if second == first {
+		t.Errorf("fingerprint did not change with the modification time")
+	}
+
+	// different size but the same modification time.
+	writeStudy(t, root, "VOL00001", "0001_1", "Huber^Bello Labrador Retriever", "1.2.3.1")
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if third, _ := Fingerprint(study); third == second {
+		t.Errorf("fingerprint did not change with the size")
+	}
+}
+
+func TestIndexAdd(t *testing.T) {
+	db, root, cleanup := testDB(t)
+	defer cleanup()
+
+	idx, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	writeStudy(t, root, "VOL00001", "0001_1", "Huber^Bello Labrador", "1.2.3.1")
+	path := filepath.Join(root, "VOL00001", "0001_1", "study.xml")
+
+	steps := []struct {
+		name     string
+		modify   func()
+		modified bool
+		want     AddResult
+	}{
+		{"new study", nil, true, StudyNew},
+		{"unmodified", nil, false, StudyKnown},
+		{"modified", func() {
+			writeStudy(t, root, "VOL00001", "0001_1", "Huber^Rex Dackel", "1.2.3.1")
+			modTime := time.Now().Add(time.Hour)
+			if err := os.Chtimes(path, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}, true, StudyUpdated},
+		{"unmodified after update", nil, false, StudyKnown},
+	}
+
+	for _, step := range steps {
+		if step.modify != nil {
+			step.modify()
+		}
+
+		// open the study again so the modified study.xml
+		// is parsed.
+		study := openStudy(t, db, "VOL00001/0001_1")
+
+		modified, err := idx.Modified(study)
+		if err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+		if modified != step.modified {
+			t.Errorf("%s: got modified %v, want %v", step.name, modified, step.modified)
+		}
+
+		result, err := idx.Add(study)
+		if err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+		if result != step.want {
+			t.Errorf("%s: got result %d, want %d", step.name, result, step.want)
+		}
+	}
+
+	count, _ := idx.Count()
+	if count != 1 {
+		t.Errorf("index contains %d studies", count)
+	}
+
+	keys, err := idx.Search("Rex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "VOL00001/0001_1" {
+		t.Errorf("got %v for the updated patient name", keys)
+	}
+}
+
+// testDB returns a database in a new temporary directory, the
+// path of that directory and a function that removes it.
+func testDB(t *testing.T) (fsdb.DB, string, func()) {
+	root, err := ioutil.TempDir("", "dxray-search")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := fsdb.New(root, nil)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+
+	return db, root, func() { os.RemoveAll(root) }
+}
+
+// writeStudy writes the study.xml of a study with a single
+// instance.
+func writeStudy(t *testing.T, root, volume, name, patientName, uid string) {
+	dir := filepath.Join(root, volume, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	xml := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Imagelist><Patient><Name>%s</Name><ID>100</ID><Visit><Study><UID>%s</UID><Date>20210311</Date><Series><UID>%s.1</UID><Modality>DX</Modality><Instance><UID>%s.1.1</UID><Data><DICOM>\DICOMPACS\ORCONSOLEDB\%s\%s\I_000000.dcm</DICOM></Data></Instance></Series></Study></Visit></Patient></Imagelist>`,
+		patientName, uid, uid, uid, volume, name)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "study.xml"), []byte(xml), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// openStudy opens the study with key.
+func openStudy(t *testing.T, db fsdb.DB, key string) fsdb.Study {
+	study, err := Get(key, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return study
+}
@@ -0,0 +1,133 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// suggestSeparator separates the folded value used for prefix
+// matching from the original value in suggestion terms.
+const suggestSeparator = "\x1f"
+
+// minSuggestWordLength is the minimum length of description words
+// that are suggested.
+const minSuggestWordLength = 3
+
+// ErrUnknownField is returned by Suggest if suggestions for the
+// requested field are not supported.
+var ErrUnknownField = errors.New("unknown field")
+
+// Suggestion is a distinct value of a study field that starts with
+// the requested prefix.
+type Suggestion struct {
+	// Value is the value as stored in the DX-R database.
+	Value string `json:"value"`
+
+	// Count is the number of studies that contain Value.
+	Count uint64 `json:"count"`
+}
+
+// suggestFields maps the field names accepted by Suggest to the
+// index fields holding the suggestion terms.
+var suggestFields = map[string]string{
+	"owner":       "owner_suggest",
+	"patient":     "patient_suggest",
+	"race":        "race_suggest",
+	"description": "description_suggest",
+}
+
+// Suggest returns up to limit distinct values of field (owner,
+// patient, race or description) that start with prefix. If prefix is
+// empty, the most common values are returned. Matching
+// ignores case, accents and German umlaut spelling. Suggestions
+// are ordered by the number of studies that contain them.
+func (si *Index) Suggest(field, prefix string, limit int) ([]Suggestion, error) {
+	indexField, ok := suggestFields[field]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownField, field)
+	}
+
+	dict, err := si.fieldDict(indexField, foldPattern(prefix))
+	if err != nil {
+		return nil, err
+	}
+	defer dict.Close()
+
+	counts := make(map[string]uint64)
+	for {
+		entry, err := dict.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+
+		parts := strings.SplitN(entry.Term, suggestSeparator, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		counts[parts[1]] += entry.Count
+	}
+
+	result := make([]Suggestion, 0, len(counts))
+	for value, count := range counts {
+		result = append(result, Suggestion{Value: value, Count: count})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Value < result[j].Value
+	})
+
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+
+	return result, nil
+}
+
+// suggestTerm returns the term indexed for suggesting value. The
+// folded value is used as a prefix so the dictionary can be searched
+// without knowing the exact spelling.
+func suggestTerm(value string) string {
+	return foldPattern(value) + suggestSeparator + value
+}
+
+// suggestTerms returns the suggestion terms of all values. Empty
+// values are skipped.
+func suggestTerms(values ...string) []string {
+	var terms []string
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		terms = append(terms, suggestTerm(v))
+	}
+	return terms
+}
+
+// suggestWords returns the suggestion terms for all words of text
+// that are at least minSuggestWordLength characters long.
+func suggestWords(text string) []string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	seen := make(map[string]bool)
+	var terms []string
+	for _, w := range words {
+		if len([]rune(w)) < minSuggestWordLength || seen[w] {
+			continue
+		}
+		seen[w] = true
+		terms = append(terms, suggestTerm(w))
+	}
+	return terms
+}
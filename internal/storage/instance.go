@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/models"
+)
+
+// instance holds the attributes of a received instance that are
+// stored in study.xml.
+type instance struct {
+	owner      string
+	animal     string
+	race       string
+	patientID  string
+	birthDate  string
+	sex        string
+	studyUID   string
+	studyDate  string
+	studyDesc  string
+	seriesUID  string
+	seriesNum  int
+	seriesDesc string
+	protocol   string
+	modality   string
+
+	sopInstanceUID string
+	instanceNumber int
+}
+
+// parseInstance reads the attributes of the instance from ds.
+func parseInstance(ds *dicom.DataSet) (*instance, error) {
+	get := func(tag dicomtag.Tag) string {
+		elem, err := ds.FindElementByTag(tag)
+		if err != nil {
+			return ""
+		}
+
+		values, err := elem.GetStrings()
+		if err != nil {
+			return ""
+		}
+
+		return strings.TrimSpace(strings.Join(values, `\`))
+	}
+
+	inst := &instance{
+		patientID:      get(dicomtag.PatientID),
+		birthDate:      get(dicomtag.PatientBirthDate),
+		sex:            get(dicomtag.PatientSex),
+		studyUID:       get(dicomtag.StudyInstanceUID),
+		studyDate:      get(dicomtag.StudyDate),
+		studyDesc:      get(dicomtag.StudyDescription),
+		seriesUID:      get(dicomtag.SeriesInstanceUID),
+		seriesNum:      atoi(get(dicomtag.SeriesNumber)),
+		seriesDesc:     get(dicomtag.SeriesDescription),
+		protocol:       get(dicomtag.ProtocolName),
+		modality:       get(dicomtag.Modality),
+		sopInstanceUID: get(dicomtag.SOPInstanceUID),
+		instanceNumber: atoi(get(dicomtag.InstanceNumber)),
+	}
+
+	for name, value := range map[string]string{
+		"StudyInstanceUID":  inst.studyUID,
+		"SeriesInstanceUID": inst.seriesUID,
+		"SOPInstanceUID":    inst.sopInstanceUID,
+	} {
+		if value == "" {
+			return nil, fmt.Errorf("missing %s", name)
+		}
+	}
+
+	// Veterinary DICOM stores the family name of the responsible
+	// person and the animal name as the patient name.
+	nameParts := strings.Split(get(dicomtag.PatientName), "^")
+	if len(nameParts) > 1 {
+		inst.owner = strings.TrimSpace(nameParts[0])
+		inst.animal = strings.TrimSpace(nameParts[1])
+	} else {
+		inst.animal = strings.TrimSpace(nameParts[0])
+		inst.owner = strings.TrimSpace(strings.Split(get(dicomtag.ResponsiblePerson), "^")[0])
+	}
+
+	inst.race = get(dicomtag.PatientBreedDescription)
+	if inst.race == "" {
+		inst.race = get(dicomtag.PatientSpeciesDescription)
+	}
+
+	return inst, nil
+}
+
+// patientName returns the patient name in the format used by DX-R
+// (owner^animal race). See models.Patient.
+func (inst *instance) patientName() string {
+	// DX-R uses the first word after the owner as the animal
+	// name.
+	animal := strings.Join(strings.Fields(inst.animal), "-")
+	return inst.owner + "^" + strings.TrimSpace(animal+" "+inst.race)
+}
+
+// addTo adds inst to model and returns the name of the instance file
+// inside the study folder volName/studyName. If model already
+// contains the instance, its file name is returned.
+func (inst *instance) addTo(model *models.ImageList, volName, studyName string) string {
+	patient := &model.Patient
+	patient.Name = inst.patientName()
+	patient.ID = inst.patientID
+	patient.Birth = inst.birthDate
+	patient.Sex = inst.sex
+
+	study := &patient.Visit.Study
+	study.UID = inst.studyUID
+	study.Date = inst.studyDate
+	if inst.studyDesc != "" {
+		study.Description = inst.studyDesc
+	}
+
+	count := 0
+	var series *models.Series
+	for idx := range study.Series {
+		s := &study.Series[idx]
+		count += len(s.Instances)
+
+		if s.UID == inst.seriesUID {
+			series = s
+		}
+	}
+
+	if series == nil {
+		study.Series = append(study.Series, models.Series{
+			UID:         inst.seriesUID,
+			Number:      inst.seriesNum,
+			Description: inst.seriesDesc,
+			Protocol:    inst.protocol,
+			Modality:    inst.modality,
+		})
+		sort.SliceStable(study.Series, func(i, j int) bool {
+			return study.Series[i].Number < study.Series[j].Number
+		})
+
+		for idx := range study.Series {
+			if study.Series[idx].UID == inst.seriesUID {
+				series = &study.Series[idx]
+			}
+		}
+	}
+
+	for _, i := range series.Instances {
+		if i.UID == inst.sopInstanceUID {
+			return fileName(i.Data.DICOMPath)
+		}
+	}
+
+	name := fmt.Sprintf("I_%06d.dcm", count)
+	series.Instances = append(series.Instances, models.Instance{
+		UID:    inst.sopInstanceUID,
+		Number: inst.instanceNumber,
+		Data: models.InstanceData{
+			DICOMPath: dicomPathPrefix + volName + `\` + studyName + `\` + name,
+		},
+	})
+	sort.SliceStable(series.Instances, func(i, j int) bool {
+		return series.Instances[i].Number < series.Instances[j].Number
+	})
+
+	return name
+}
+
+// fileName returns the last element of the Windows path p.
+func fileName(p string) string {
+	return p[strings.LastIndex(p, `\`)+1:]
+}
+
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/models"
+)
+
+func TestPatientName(t *testing.T) {
+	cases := []struct {
+		inst instance
+		want string
+	}{
+		{instance{owner: "Huber", animal: "Bello", race: "Labrador"}, "Huber^Bello Labrador"},
+		{instance{owner: "Huber", animal: "Bello"}, "Huber^Bello"},
+		{instance{owner: "Huber", animal: "Mister  Bello", race: "Labrador Retriever"}, "Huber^Mister-Bello Labrador Retriever"},
+		{instance{animal: "Bello"}, "^Bello"},
+	}
+
+	for _, c := range cases {
+		if got := c.inst.patientName(); got != c.want {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+}
+
+func TestAddTo(t *testing.T) {
+	base := instance{
+		owner:     "Huber",
+		animal:    "Bello",
+		race:      "Labrador",
+		patientID: "100",
+		sex:       "M",
+		studyUID:  "1.2.3",
+		studyDate: "20210311",
+		studyDesc: "Thorax",
+		modality:  "DX",
+	}
+
+	with := func(seriesUID string, seriesNum int, sopUID string, number int, desc string) *instance {
+		inst := base
+		inst.seriesUID = seriesUID
+		inst.seriesNum = seriesNum
+		inst.sopInstanceUID = sopUID
+		inst.instanceNumber = number
+		inst.studyDesc = desc
+		return &inst
+	}
+
+	steps := []struct {
+		name string
+		inst *instance
+		want string
+	}{
+		{"first instance", with("1.2.3.2", 2, "1.2.3.2.2", 2, "Thorax"), "I_000000.dcm"},
+		{"same series", with("1.2.3.2", 2, "1.2.3.2.1", 1, ""), "I_000001.dcm"},
+		{"new series", with("1.2.3.1", 1, "1.2.3.1.1", 1, ""), "I_000002.dcm"},
+		{"duplicate", with("1.2.3.2", 2, "1.2.3.2.2", 2, ""), "I_000000.dcm"},
+		{"third series", with("1.2.3.3", 3, "1.2.3.3.1", 1, ""), "I_000003.dcm"},
+	}
+
+	var model models.ImageList
+	for _, step := range steps {
+		if got := step.inst.addTo(&model, "VOLS00001", "0001_1"); got != step.want {
+			t.Errorf("%s: got file name %q, want %q", step.name, got, step.want)
+		}
+	}
+
+	if model.Patient.Name != "Huber^Bello Labrador" || model.Patient.ID != "100" || model.Patient.Sex != "M" {
+		t.Errorf("unexpected patient %+v", model.Patient)
+	}
+
+	study := model.Patient.Visit.Study
+	if study.UID != "1.2.3" || study.Date != "20210311" {
+		t.Errorf("unexpected study %s from %s", study.UID, study.Date)
+	}
+	if study.Description != "Thorax" {
+		t.Errorf("study description overwritten with %q", study.Description)
+	}
+
+	type instanceFile struct {
+		UID  string
+		Path string
+	}
+
+	var got [][]instanceFile
+	for _, series := range study.Series {
+		if series.Modality != "DX" {
+			t.Errorf("series %s: got modality %q", series.UID, series.Modality)
+		}
+
+		var files []instanceFile
+		for _, i := range series.Instances {
+			files = append(files, instanceFile{i.UID, i.Data.DICOMPath})
+		}
+		got = append(got, files)
+	}
+
+	// series and instances are sorted by their number.
+	want := [][]instanceFile{
+		{{"1.2.3.1.1", `\DICOMPACS\ORCONSOLEDB\VOLS00001\0001_1\I_000002.dcm`}},
+		{
+			{"1.2.3.2.1", `\DICOMPACS\ORCONSOLEDB\VOLS00001\0001_1\I_000001.dcm`},
+			{"1.2.3.2.2", `\DICOMPACS\ORCONSOLEDB\VOLS00001\0001_1\I_000000.dcm`},
+		},
+		{{"1.2.3.3.1", `\DICOMPACS\ORCONSOLEDB\VOLS00001\0001_1\I_000003.dcm`}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got instances %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,367 @@
+// Package storage stores DICOM instances received by dxray in a
+// dxray-managed folder that uses the same layout as a DX-R
+// ORconsoleDB so stored studies can be served like any other study.
+package storage
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/tierklinik-dobersberg/dxray/internal/dimse"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/fsdb"
+	"github.com/tierklinik-dobersberg/dxray/internal/dxr/models"
+	"github.com/tierklinik-dobersberg/dxray/internal/search"
+	"github.com/tierklinik-dobersberg/logger"
+)
+
+const (
+	// volumePrefix is the name prefix of all volumes created by
+	// the storage. It differs from the volumes created by DX-R
+	// so volume names never clash.
+	volumePrefix = "VOLS"
+
+	// studiesPerVolume is the maximum number of studies stored in
+	// a single volume. DX-R uses the same limit.
+	studiesPerVolume = 1000
+
+	// dicomPathPrefix is the prefix of the image paths stored in
+	// study.xml. It matches the paths written by DX-R so they are
+	// resolved by fsdb.Study.RealPath.
+	dicomPathPrefix = `\DICOMPACS\ORCONSOLEDB\`
+)
+
+type (
+	// Options configures the storage.
+	Options struct {
+		// Directory is the directory that holds all stored
+		// studies. It is created if it does not exist.
+		Directory string
+
+		// OnChange is called with the volume and study name
+		// whenever a study has been created or modified. It
+		// may be nil.
+		OnChange func(volName, studyName string)
+
+		// Log is used to log stored instances. Defaults to the
+		// default logger.
+		Log logger.Logger
+	}
+
+	// Instance identifies a stored instance.
+	Instance struct {
+		PatientID         string
+		StudyInstanceUID  string
+		SeriesInstanceUID string
+		SOPClassUID       string
+		SOPInstanceUID    string
+	}
+
+	// Storage stores received DICOM instances.
+	Storage struct {
+		dir      string
+		db       fsdb.DB
+		onChange func(volName, studyName string)
+		log      logger.Logger
+
+		// l protects studies, volume and volumeCount and
+		// serializes all modifications of study.xml files.
+		l sync.Mutex
+
+		// studies maps study instance UIDs to the key of the
+		// study folder (see search.Key).
+		studies map[string]string
+
+		// volume is the name of the volume that receives new
+		// studies and volumeCount the number of studies it
+		// contains.
+		volume      string
+		volumeCount int
+	}
+)
+
+// New creates a new storage in opts.Directory and loads the
+// studies stored there.
+func New(opts Options) (*Storage, error) {
+	log := opts.Log
+	if log == nil {
+		log = logger.DefaultLogger()
+	}
+
+	if err := os.MkdirAll(opts.Directory, 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := fsdb.New(opts.Directory, log.WithFields(logger.Fields{
+		"fsdb": opts.Directory,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Storage{
+		dir:      opts.Directory,
+		db:       db,
+		onChange: opts.OnChange,
+		log:      log,
+		studies:  make(map[string]string),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// DB returns the fsdb that provides access to the stored studies.
+func (s *Storage) DB() fsdb.DB {
+	return s.db
+}
+
+// load reads the study instance UIDs of all stored studies and
+// determines the volume that receives new studies.
+func (s *Storage) load() error {
+	return s.db.ForEachVolume(func(vol fsdb.Volume) error {
+		if !strings.HasPrefix(vol.Name(), volumePrefix) {
+			return nil
+		}
+
+		count := 0
+		err := vol.ForEachStudy(func(study fsdb.Study) error {
+			count++
+
+			model, err := models.FromFile(filepath.Join(study.Path(), "study.xml"))
+			if err != nil {
+				s.log.WithFields(logger.Fields{
+					"volume": vol.Name(),
+					"study":  study.Name(),
+					"error":  err.Error(),
+				}).Errorf("failed to load stored study")
+				return nil
+			}
+
+			s.studies[model.Patient.Visit.Study.UID] = vol.Name() + "/" + study.Name()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// volumes are returned in lexical order so the last
+		// one receives new studies.
+		s.volume = vol.Name()
+		s.volumeCount = count
+
+		return nil
+	})
+}
+
+// Store stores the instance received in req. It can be used as
+// dimse.Options.Store.
+func (s *Storage) Store(ctx context.Context, req *dimse.StoreRequest) error {
+	_, err := s.Add(ctx, req)
+	return err
+}
+
+// Add is like Store but returns the stored instance.
+func (s *Storage) Add(ctx context.Context, req *dimse.StoreRequest) (*Instance, error) {
+	// write the instance to a temporary file first so it can be
+	// parsed. Files in the root of the storage directory are
+	// ignored by fsdb.
+	tmp, err := ioutil.TempFile(s.dir, ".incoming-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = writeFile(tmp, req)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ds, err := dicom.ReadDataSetFromFile(tmp.Name(), dicom.ReadOptions{
+		DropPixelData: true,
+	})
+	if err != nil {
+		return nil, &dimse.StatusError{Status: dimse.StatusCannotUnderstand, Err: err}
+	}
+
+	inst, err := parseInstance(ds)
+	if err != nil {
+		return nil, &dimse.StatusError{Status: dimse.StatusCannotUnderstand, Err: err}
+	}
+
+	if req.SOPInstanceUID != "" && inst.sopInstanceUID != req.SOPInstanceUID {
+		return nil, &dimse.StatusError{
+			Status: dimse.StatusDataSetMismatch,
+			Err:    fmt.Errorf("SOP instance UID %s does not match data set", req.SOPInstanceUID),
+		}
+	}
+
+	volName, studyName, err := s.add(inst, tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	s.log.WithFields(logger.Fields{
+		"calling":  req.CallingAETitle,
+		"study":    inst.studyUID,
+		"instance": inst.sopInstanceUID,
+		"key":      volName + "/" + studyName,
+	}).Infof("stored instance")
+
+	if s.onChange != nil {
+		s.onChange(volName, studyName)
+	}
+
+	return &Instance{
+		PatientID:         inst.patientID,
+		StudyInstanceUID:  inst.studyUID,
+		SeriesInstanceUID: inst.seriesUID,
+		SOPClassUID:       req.SOPClassUID,
+		SOPInstanceUID:    inst.sopInstanceUID,
+	}, nil
+}
+
+// add moves the instance file at path into the folder of its study
+// and updates the study.xml file.
+func (s *Storage) add(inst *instance, path string) (string, string, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	key, ok := s.studies[inst.studyUID]
+	if !ok {
+		var err error
+		key, err = s.createStudy()
+		if err != nil {
+			return "", "", err
+		}
+		s.studies[inst.studyUID] = key
+	}
+
+	volName, studyName, err := search.SplitKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	studyDir := filepath.Join(s.dir, volName, studyName)
+	xmlPath := filepath.Join(studyDir, "study.xml")
+
+	model := &models.ImageList{}
+	if _, err := os.Stat(xmlPath); err == nil {
+		model, err = models.FromFile(xmlPath)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	fileName := inst.addTo(model, volName, studyName)
+
+	if err := os.Rename(path, filepath.Join(studyDir, fileName)); err != nil {
+		return "", "", err
+	}
+
+	if err := writeStudyXML(studyDir, model); err != nil {
+		return "", "", err
+	}
+
+	return volName, studyName, nil
+}
+
+// createStudy creates a new study folder and returns its key. The
+// caller must hold s.l.
+func (s *Storage) createStudy() (string, error) {
+	if s.volume == "" || s.volumeCount >= studiesPerVolume {
+		next := 1
+		if s.volume != "" {
+			n, err := strconv.Atoi(strings.TrimPrefix(s.volume, volumePrefix))
+			if err != nil {
+				return "", fmt.Errorf("invalid volume name %q", s.volume)
+			}
+			next = n + 1
+		}
+
+		s.volume = fmt.Sprintf("%s%04d", volumePrefix, next)
+		s.volumeCount = 0
+	}
+
+	volDir := filepath.Join(s.dir, s.volume)
+	if err := os.MkdirAll(volDir, 0755); err != nil {
+		return "", err
+	}
+
+	// DX-R names study folders after their index within the
+	// volume. Skip folders that already exist.
+	for {
+		s.volumeCount++
+
+		name := fmt.Sprintf("%04d_1", s.volumeCount)
+		err := os.Mkdir(filepath.Join(volDir, name), 0755)
+		if err == nil {
+			return s.volume + "/" + name, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+	}
+}
+
+// writeFile writes req as a DICOM file including the file meta
+// information.
+func writeFile(f *os.File, req *dimse.StoreRequest) error {
+	meta := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, req.SOPClassUID),
+		dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, req.SOPInstanceUID),
+		dicom.MustNewElement(dicomtag.TransferSyntaxUID, req.TransferSyntaxUID),
+		dicom.MustNewElement(dicomtag.ImplementationClassUID, dimse.ImplementationClassUID),
+		dicom.MustNewElement(dicomtag.ImplementationVersionName, dimse.ImplementationVersionName),
+	}
+	if req.CallingAETitle != "" {
+		meta = append(meta, dicom.MustNewElement(dicomtag.SourceApplicationEntityTitle, req.CallingAETitle))
+	}
+
+	e := dicomio.NewEncoder(f, nil, dicomio.UnknownVR)
+	dicom.WriteFileHeader(e, meta)
+	if err := e.Error(); err != nil {
+		return err
+	}
+
+	_, err := f.Write(req.DataSet)
+	return err
+}
+
+// writeStudyXML atomically replaces the study.xml file in dir.
+func writeStudyXML(dir string, model *models.ImageList) error {
+	blob, err := xml.Marshal(model)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".study-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append([]byte(xml.Header), blob...))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, "study.xml"))
+}